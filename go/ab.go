@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Two-sided 95% Student t critical values for 1..30 degrees of freedom.
+var tCritical95 = [...]float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+func tQuantile95(df float64) float64 {
+	if df < 1 {
+		return math.Inf(1)
+	}
+	if df > float64(len(tCritical95)) {
+		return 1.96
+	}
+	return tCritical95[int(df)-1]
+}
+
+// ABSide summarizes the timings of one configuration.
+type ABSide struct {
+	Command   string    `json:"command"`
+	SamplesMs []float64 `json:"samples_ms"`
+	MeanMs    float64   `json:"mean_ms"`
+	MedianMs  float64   `json:"median_ms"`
+	StddevMs  float64   `json:"stddev_ms"`
+	CILowMs   float64   `json:"ci95_low_ms"`
+	CIHighMs  float64   `json:"ci95_high_ms"`
+}
+
+// ABResult compares B against A. Diff is mean(B) - mean(A) with a Welch
+// confidence interval; the difference is significant when the interval
+// excludes zero.
+type ABResult struct {
+	A           ABSide  `json:"a"`
+	B           ABSide  `json:"b"`
+	DiffMs      float64 `json:"diff_ms"`
+	DiffLowMs   float64 `json:"diff_ci95_low_ms"`
+	DiffHighMs  float64 `json:"diff_ci95_high_ms"`
+	Ratio       float64 `json:"ratio"`
+	Significant bool    `json:"significant"`
+}
+
+func summarizeSide(command string, samples []float64) ABSide {
+	side := ABSide{Command: command, SamplesMs: samples}
+	side.MeanMs, side.StddevMs = meanStddev(samples)
+	side.MedianMs = median(samples)
+	n := float64(len(samples))
+	half := tQuantile95(n-1) * side.StddevMs / math.Sqrt(n)
+	side.CILowMs = side.MeanMs - half
+	side.CIHighMs = side.MeanMs + half
+	return side
+}
+
+func compareAB(a, b ABSide) ABResult {
+	result := ABResult{A: a, B: b, DiffMs: b.MeanMs - a.MeanMs}
+	if a.MeanMs > 0 {
+		result.Ratio = b.MeanMs / a.MeanMs
+	}
+
+	na, nb := float64(len(a.SamplesMs)), float64(len(b.SamplesMs))
+	va, vb := a.StddevMs*a.StddevMs/na, b.StddevMs*b.StddevMs/nb
+	se := math.Sqrt(va + vb)
+	// Welch–Satterthwaite degrees of freedom.
+	df := (va + vb) * (va + vb) / (va*va/(na-1) + vb*vb/(nb-1))
+	if math.IsNaN(df) {
+		df = na + nb - 2
+	}
+	half := tQuantile95(df) * se
+	result.DiffLowMs = result.DiffMs - half
+	result.DiffHighMs = result.DiffMs + half
+	result.Significant = result.DiffLowMs > 0 || result.DiffHighMs < 0
+	return result
+}
+
+func runCommand(args []string) (float64, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	err := cmd.Run()
+	return ms(time.Since(start)), err
+}
+
+func printABUsage(program string, fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s ab [flags] \"<command A>\" \"<command B>\"\n", program)
+	fmt.Fprintf(os.Stderr, "  Runs both commands in randomized interleaved order and compares their wall time\n")
+	fmt.Fprintf(os.Stderr, "  Example: %s ab \"./filter_go blur in.png out.png 5 1\" \"./filter_go blur in.png out.png 5 8\"\n", program)
+	fs.PrintDefaults()
+}
+
+func abCommand(program string, args []string, jsonOutput bool) {
+	var runs, warmup int
+	var seed uint64
+	fs := flag.NewFlagSet("ab", flag.ExitOnError)
+	fs.IntVar(&runs, "runs", 20, "number of measured runs per command")
+	fs.IntVar(&warmup, "warmup", 2, "number of unmeasured warm-up runs per command")
+	fs.Uint64Var(&seed, "seed", uint64(time.Now().UnixNano()), "seed for the run order shuffle")
+	fs.Usage = func() { printABUsage(program, fs) }
+	fs.Parse(args)
+
+	if fs.NArg() != 2 || runs < 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	commands := [2][]string{strings.Fields(fs.Arg(0)), strings.Fields(fs.Arg(1))}
+	if len(commands[0]) == 0 || len(commands[1]) == 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	var out io.Writer = os.Stdout
+	if jsonOutput {
+		out = io.Discard
+	}
+
+	for range warmup {
+		for _, c := range commands {
+			if _, err := runCommand(c); err != nil {
+				fmt.Fprintf(os.Stderr, "Command %q failed: %v\n", strings.Join(c, " "), err)
+				os.Exit(exitCode(err))
+			}
+		}
+	}
+
+	// Each round runs A and B once in a random order, so drift in machine
+	// state (thermal throttling, background load) affects both sides equally.
+	rng := rand.New(rand.NewPCG(seed, 0))
+	var samples [2][]float64
+	for round := range runs {
+		order := [2]int{0, 1}
+		if rng.IntN(2) == 1 {
+			order = [2]int{1, 0}
+		}
+		for _, side := range order {
+			elapsed, err := runCommand(commands[side])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Command %q failed: %v\n", strings.Join(commands[side], " "), err)
+				os.Exit(exitCode(err))
+			}
+			samples[side] = append(samples[side], elapsed)
+		}
+		fmt.Fprintf(out, "\rRound %d/%d", round+1, runs)
+	}
+	fmt.Fprintf(out, "\n")
+
+	result := compareAB(
+		summarizeSide(fs.Arg(0), samples[0]),
+		summarizeSide(fs.Arg(1), samples[1]),
+	)
+
+	for _, side := range []struct {
+		label string
+		s     ABSide
+	}{{"A", result.A}, {"B", result.B}} {
+		fmt.Fprintf(out, "%s: %s\n", side.label, side.s.Command)
+		fmt.Fprintf(out, "   mean %.2fms  median %.2fms  stddev %.2fms  95%% CI [%.2f, %.2f]ms\n",
+			side.s.MeanMs, side.s.MedianMs, side.s.StddevMs, side.s.CILowMs, side.s.CIHighMs)
+	}
+	fmt.Fprintf(out, "B - A: %+.2fms  95%% CI [%+.2f, %+.2f]ms  (B/A = %.3f)\n",
+		result.DiffMs, result.DiffLowMs, result.DiffHighMs, result.Ratio)
+	if result.Significant {
+		fmt.Fprintf(out, "The difference is statistically significant at the 95%% level\n")
+	} else {
+		fmt.Fprintf(out, "No statistically significant difference at the 95%% level\n")
+	}
+
+	if jsonOutput {
+		writeJSON(os.Stdout, result)
+	}
+}
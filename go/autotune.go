@@ -0,0 +1,32 @@
+package main
+
+// Below this many pixels per worker the cost of starting and joining a
+// goroutine (and of cache lines shared between neighbouring bands) outweighs
+// the extra parallelism. A calibrated profile replaces it per operation.
+const minPixelsPerWorker = 64 * 1024
+
+// tileSize is the edge length of the square tiles used by tile-parallel
+// operations such as matte. It is adjusted by autoTune.
+var tileSize = 128
+
+type tuning struct {
+	Workers  int `json:"workers"`
+	TileSize int `json:"tile_size"`
+}
+
+// autoTune picks a worker count and tile size from the image dimensions:
+// enough pixels per worker to amortize goroutine overhead (from the
+// calibrate profile for operation, if there is one), never more workers
+// than CPUs, and tiles small enough that there are a few per worker for
+// load balancing but no smaller than 64 pixels.
+func autoTune(operation string, width, height int) tuning {
+	pixels := width * height
+	workers := min(max(pixels/loadCostModel().pixelsPerWorker(operation), 1), cpuCount())
+
+	// Aim for about four tiles per worker, rounded down to a power of two.
+	size := 512
+	for size > 64 && (width/size)*(height/size) < 4*workers {
+		size /= 2
+	}
+	return tuning{Workers: workers, TileSize: size}
+}
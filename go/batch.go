@@ -0,0 +1,656 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobFile declares a batch: every job reads one image, runs its steps in
+// order and writes the result. Relative paths are taken from the directory
+// of the job file.
+type JobFile struct {
+	Parallel int   `json:"parallel,omitempty"` // jobs running at once (0 = one per CPU, at most the job count)
+	Workers  int   `json:"workers,omitempty"`  // workers per job (0 = CPUs divided among the parallel jobs)
+	Jobs     []Job `json:"jobs"`
+}
+
+type Job struct {
+	Input  string    `json:"input"`
+	Output string    `json:"output"`
+	Steps  []JobStep `json:"steps"`
+}
+
+// JobStep is one filter; radius means what it does on the command line
+// (the hue for hsl, ignored by histeq, grayscale and sepia).
+type JobStep struct {
+	Operation string `json:"operation"`
+	Radius    int    `json:"radius,omitempty"`
+}
+
+type JobResult struct {
+	Input    string  `json:"input"`
+	Output   string  `json:"output"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	LoadMs   float64 `json:"load_ms"` // decoding, overlapped with earlier jobs when prefetched
+	WaitMs   float64 `json:"wait_ms"` // time the job waited for its input
+	FilterMs float64 `json:"filter_ms"`
+	EncodeMs float64 `json:"encode_ms"` // encoding and writing, overlapped with later jobs
+	TotalMs  float64 `json:"total_ms"`
+	Retries  int     `json:"retries,omitempty"` // transient read and write failures retried
+	Error    string  `json:"error,omitempty"`
+	Skipped  bool    `json:"skipped,omitempty"` // not started, the batch being interrupted
+}
+
+func loadJobFile(path string) (*JobFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jobs JobFile
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, err
+	}
+	if len(jobs.Jobs) == 0 {
+		return nil, errors.New("no jobs")
+	}
+	dir := filepath.Dir(path)
+	for i := range jobs.Jobs {
+		job := &jobs.Jobs[i]
+		if job.Input == "" || job.Output == "" {
+			return nil, fmt.Errorf("job %d: input and output are required", i)
+		}
+		if len(job.Steps) == 0 {
+			return nil, fmt.Errorf("job %d: no steps", i)
+		}
+		for _, step := range job.Steps {
+			if _, ok := lookupOperation(step.Operation); !ok {
+				return nil, fmt.Errorf("job %d: unknown operation %q", i, step.Operation)
+			}
+		}
+		if !filepath.IsAbs(job.Input) && !isURL(job.Input) {
+			job.Input = filepath.Join(dir, job.Input)
+		}
+		if !filepath.IsAbs(job.Output) {
+			job.Output = filepath.Join(dir, job.Output)
+		}
+	}
+	return &jobs, nil
+}
+
+// parseSteps reads a step list such as "blur:3,sepia" (operation, then an
+// optional radius).
+func parseSteps(spec string) ([]JobStep, error) {
+	var steps []JobStep
+	for part := range strings.SplitSeq(spec, ",") {
+		name, radiusArg, hasRadius := strings.Cut(strings.TrimSpace(part), ":")
+		if _, ok := lookupOperation(name); !ok {
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+		step := JobStep{Operation: name}
+		if hasRadius {
+			var err error
+			if step.Radius, err = strconv.Atoi(radiusArg); err != nil {
+				return nil, fmt.Errorf("invalid radius for %s: %v", name, err)
+			}
+		} else if info, _ := lookupOperation(name); info.param != "" {
+			step.Radius = info.defaultArg
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// fileState identifies one version of a file in a watched directory.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+var imageExtensions = []string{".png", ".jpg", ".jpeg"}
+
+// scanImages lists the image files directly inside dir.
+func scanImages(dir string) (map[string]fileState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]fileState)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !slices.Contains(imageExtensions, strings.ToLower(filepath.Ext(entry.Name()))) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed since ReadDir
+		}
+		files[entry.Name()] = fileState{info.Size(), info.ModTime()}
+	}
+	return files, nil
+}
+
+// dirJobs makes a job per named file, writing PNGs of the same base name
+// to outDir.
+func dirJobs(names []string, inDir, outDir string, steps []JobStep) []Job {
+	slices.Sort(names)
+	jobs := make([]Job, len(names))
+	for i, name := range names {
+		jobs[i] = Job{
+			Input:  filepath.Join(inDir, name),
+			Output: filepath.Join(outDir, strings.TrimSuffix(name, filepath.Ext(name))+".png"),
+			Steps:  steps,
+		}
+	}
+	return jobs
+}
+
+// watchDir processes images as they appear in inDir, or change, until the
+// process is interrupted. The directory is polled every interval; a file is
+// picked up once two polls in a row see the same size and modification
+// time, so files still being copied in are left alone.
+func watchDir(inDir, outDir string, steps []JobStep, done map[string]fileState, interval time.Duration, run func([]Job)) error {
+	pending := make(map[string]fileState)
+	for {
+		select {
+		case <-time.After(interval):
+		case <-interrupt.Done():
+			return interrupt.Err()
+		}
+		files, err := scanImages(inDir)
+		if err != nil {
+			return err
+		}
+		var ready []string
+		for name, state := range files {
+			if prev, ok := done[name]; ok && prev == state {
+				continue
+			}
+			if prev, ok := pending[name]; ok && prev == state {
+				ready = append(ready, name)
+				delete(pending, name)
+				done[name] = state
+				continue
+			}
+			pending[name] = state
+		}
+		if len(ready) > 0 {
+			run(dirJobs(ready, inDir, outDir, steps))
+		}
+	}
+}
+
+// decoded is a job's input, decoded ahead of the job.
+type decoded struct {
+	img     image.Image
+	err     error
+	elapsed time.Duration
+	retries int
+}
+
+// prefetchImages decodes the inputs of jobs in job order on separate
+// goroutines and returns a channel per job that receives its image. A
+// decode starts only once it can take a token from tokens, which the job
+// returns when it finishes, so the capacity of tokens bounds the images
+// held in memory. image/jpeg and image/png decode serially, so this is
+// where batches of fast filters gain: the next inputs decode while the
+// workers filter the current one.
+func prefetchImages(jobs []Job, tokens chan struct{}) []chan decoded {
+	loads := make([]chan decoded, len(jobs))
+	for i := range loads {
+		loads[i] = make(chan decoded, 1)
+	}
+	indices := make(chan int)
+	for range cap(tokens) {
+		go func() {
+			for i := range indices {
+				start := time.Now()
+				var img image.Image
+				retries, err := ioRetry.do("read", func() (err error) {
+					img, err = loadImage(jobs[i].Input)
+					return err
+				})
+				loads[i] <- decoded{img, err, time.Since(start), retries}
+			}
+		}()
+	}
+	go func() {
+		defer close(indices)
+		for i := range jobs {
+			select {
+			case tokens <- struct{}{}:
+				indices <- i
+			case <-interrupt.Done():
+				for j := i; j < len(jobs); j++ {
+					loads[j] <- decoded{err: interrupt.Err()}
+				}
+				return
+			}
+		}
+	}()
+	return loads
+}
+
+// filterJob runs the steps of job once its input is decoded, filling in
+// the load and filter figures of result.
+func filterJob(job Job, load <-chan decoded, numWorkers int, result *JobResult) (image.Image, error) {
+	start := time.Now()
+	in := <-load
+	result.LoadMs = ms(in.elapsed)
+	result.WaitMs = ms(time.Since(start))
+	result.Retries += in.retries
+	if in.err != nil {
+		return nil, in.err
+	}
+	img := in.img
+	result.Width, result.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	start = time.Now()
+	for _, step := range job.Steps {
+		dst, err := applyOperation(step.Operation, img, step.Radius, numWorkers)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step.Operation, err)
+		}
+		img = dst
+	}
+	result.FilterMs = ms(time.Since(start))
+	return img, nil
+}
+
+// saveJob encodes and writes the output of job, retrying transient
+// failures by ioRetry, and returns the retries.
+func saveJob(job Job, img image.Image, numWorkers int) (int, error) {
+	return ioRetry.do("write", func() error { return writeJob(job, img, numWorkers) })
+}
+
+func writeJob(job Job, img image.Image, numWorkers int) error {
+	if err := os.MkdirAll(filepath.Dir(job.Output), 0o755); err != nil {
+		return err
+	}
+	var meta *imageMetadata
+	if keepMetadata {
+		var err error
+		if meta, err = readMetadata(job.Input); err != nil {
+			return fmt.Errorf("reading metadata: %w", err)
+		}
+	}
+	return saveOutput(job.Output, img, meta, numWorkers)
+}
+
+// runJob filters and saves one image once its input is decoded.
+func runJob(job Job, load <-chan decoded, numWorkers int) JobResult {
+	start := time.Now()
+	result := JobResult{Input: job.Input, Output: job.Output}
+	img, err := filterJob(job, load, numWorkers, &result)
+	if err == nil {
+		encodeStart := time.Now()
+		var retries int
+		retries, err = saveJob(job, img, numWorkers)
+		result.Retries += retries
+		result.EncodeMs = ms(time.Since(encodeStart))
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.TotalMs = ms(time.Since(start))
+	return result
+}
+
+// filtered is a job passed from the filter stage to the encode stage.
+type filtered struct {
+	index  int
+	start  time.Time
+	result JobResult
+	img    image.Image
+	err    error
+}
+
+// runJobs runs jobs as a pipeline of three stages: decoding, with up to
+// prefetch inputs ahead of the running jobs (see prefetchImages), filtering,
+// up to parallel jobs at once each splitting its steps among numWorkers,
+// and encoding on encoders goroutines. A channel holding at most encoders
+// filtered images joins the last two, so while one image encodes the
+// filter workers move on to the next and the one after decodes; a backed
+// up encoder stalls the filters rather than piling images up. Images hold
+// a decode token until they are written, which bounds the images in
+// memory across all stages to parallel+prefetch. The results come back in
+// job order. done sees each result as its job is written or, when
+// ordered, in job order: a job then starts only within parallel+prefetch
+// of the oldest unreported one, and the stats tell how often that held
+// the next job back.
+func runJobs(jobs []Job, parallel, numWorkers, prefetch, encoders int, ordered bool, done func(JobResult)) ([]JobResult, ReorderStats) {
+	results := make([]JobResult, len(jobs))
+	tokens := make(chan struct{}, parallel+prefetch)
+	loads := prefetchImages(jobs, tokens)
+	next := make(chan int)
+	encode := make(chan filtered, encoders)
+	var order *reorderBuffer[JobResult]
+	if ordered {
+		order = newReorderBuffer(parallel+prefetch, func(_ int, r JobResult) { done(r) })
+	}
+	var mu sync.Mutex
+	var filters, writers sync.WaitGroup
+	for range parallel {
+		// Plain goroutines: each job waits on its own filter workers.
+		filters.Add(1)
+		go func() {
+			defer filters.Done()
+			for i := range next {
+				job := filtered{index: i, start: time.Now(), result: JobResult{Input: jobs[i].Input, Output: jobs[i].Output}}
+				job.img, job.err = filterJob(jobs[i], loads[i], numWorkers, &job.result)
+				encode <- job
+			}
+		}()
+	}
+	for range encoders {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for job := range encode {
+				i, err := job.index, job.err
+				if err == nil {
+					start := time.Now()
+					var retries int
+					retries, err = saveJob(jobs[i], job.img, numWorkers)
+					job.result.Retries += retries
+					job.result.EncodeMs = ms(time.Since(start))
+				}
+				job.img = nil
+				<-tokens
+				if err != nil {
+					job.result.Error = err.Error()
+				}
+				job.result.TotalMs = ms(time.Since(job.start))
+				results[i] = job.result
+				if order != nil {
+					order.put(i, results[i])
+					continue
+				}
+				mu.Lock()
+				done(results[i])
+				mu.Unlock()
+			}
+		}()
+	}
+dispatch:
+	for i := range jobs {
+		if order == nil || order.wait(i, interrupt.Done()) {
+			select {
+			case next <- i:
+				continue
+			case <-interrupt.Done():
+			}
+		}
+		// Jobs in flight finish or are cancelled; the rest never start.
+		for j := i; j < len(jobs); j++ {
+			results[j] = JobResult{Input: jobs[j].Input, Output: jobs[j].Output, Error: "not started: interrupted", Skipped: true}
+		}
+		break dispatch
+	}
+	close(next)
+	filters.Wait()
+	close(encode)
+	writers.Wait()
+	takePhases()
+	var stats ReorderStats
+	if order != nil {
+		// After an interrupt, jobs that finished behind one that never
+		// started are still held back; report them so they are recorded.
+		order.flush()
+		stats = order.report()
+	}
+	return results, stats
+}
+
+// BatchStages sums the time batch jobs spent in each pipeline stage; with
+// the stages overlapping, the sum exceeds the elapsed time.
+type BatchStages struct {
+	DecodeMs float64 `json:"decode_ms"`
+	FilterMs float64 `json:"filter_ms"`
+	EncodeMs float64 `json:"encode_ms"`
+}
+
+func batchStages(results []JobResult) BatchStages {
+	var stats BatchStages
+	for _, r := range results {
+		stats.DecodeMs += r.LoadMs
+		stats.FilterMs += r.FilterMs
+		stats.EncodeMs += r.EncodeMs
+	}
+	return stats
+}
+
+// BatchSummary counts the outcomes of a batch. A failed job doesn't stop
+// the others; skipped ones finished in an earlier run or never started.
+type BatchSummary struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+	Retries   int `json:"retries"`
+}
+
+func summarize(results []JobResult, finishedEarlier int) BatchSummary {
+	summary := BatchSummary{Skipped: finishedEarlier}
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			summary.Skipped++
+		case r.Error != "":
+			summary.Failed++
+		default:
+			summary.Succeeded++
+		}
+		summary.Retries += r.Retries
+	}
+	return summary
+}
+
+// batchWorkers resolves the job-level and per-job worker counts.
+func batchWorkers(parallel, numWorkers, jobCount int) (int, int) {
+	if parallel <= 0 {
+		parallel = cpuCount()
+	}
+	parallel = max(min(parallel, jobCount), 1)
+	if numWorkers <= 0 {
+		numWorkers = max(cpuCount()/parallel, 1)
+	}
+	return parallel, numWorkers
+}
+
+func batchCommand(program string, args []string, jsonOutput bool) {
+	var parallel, numWorkers, prefetch, encoders, retries int
+	var stepSpec string
+	var watch, force, ordered bool
+	var interval time.Duration
+	var manifestPath string
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	fs.IntVar(&parallel, "parallel", 0, "jobs to run at once, overriding the job file (0 = file or one per CPU)")
+	fs.IntVar(&numWorkers, "workers", 0, "workers per job, overriding the job file (0 = file or CPUs divided among jobs)")
+	fs.IntVar(&prefetch, "prefetch", 2, "inputs to decode ahead of the running jobs (0 = when a job starts)")
+	fs.IntVar(&encoders, "encoders", 0, "outputs to encode at once while the next jobs filter (0 = as many as -parallel)")
+	fs.IntVar(&retries, "retries", 0, "retry reading an input or writing an output up to this many times on transient failures (I/O errors, timeouts, HTTP 5xx)")
+	fs.DurationVar(&ioRetry.backoff, "backoff", ioRetry.backoff, "wait before the first retry, doubling for each next one")
+	fs.StringVar(&stepSpec, "steps", "blur", "directory mode: operations to apply, as op[:radius],...")
+	fs.BoolVar(&watch, "watch", false, "directory mode: keep running and process images added to input_dir")
+	fs.DurationVar(&interval, "interval", time.Second, "how often --watch polls input_dir")
+	fs.StringVar(&manifestPath, "manifest", "", "record finished jobs in this file and skip them when run again")
+	fs.BoolVar(&force, "force", false, "with -manifest, reprocess every job and start the manifest afresh")
+	fs.BoolVar(&ordered, "ordered", false, "report results in job order rather than as jobs finish")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s batch [flags] <jobs.json>\n", program)
+		fmt.Fprintf(os.Stderr, "       %s batch [flags] <input_dir> <output_dir>\n", program)
+		fmt.Fprintf(os.Stderr, "  Runs the jobs of a job file, for example\n")
+		fmt.Fprintf(os.Stderr, "  {\"parallel\": 2, \"jobs\": [{\"input\": \"in.png\", \"output\": \"out/in.png\",\n")
+		fmt.Fprintf(os.Stderr, "    \"steps\": [{\"operation\": \"blur\", \"radius\": 3}, {\"operation\": \"sepia\"}]}]}\n")
+		fmt.Fprintf(os.Stderr, "  or applies -steps to every PNG and JPEG in input_dir\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 || interval <= 0 || prefetch < 0 || encoders < 0 || retries < 0 || ioRetry.backoff < 0 || (watch && fs.NArg() != 2) {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	ioRetry.attempts = retries + 1
+	var jobs []Job
+	var seen map[string]fileState
+	var steps []JobStep
+	if fs.NArg() == 1 {
+		jobFile, err := loadJobFile(fs.Arg(0))
+		if err != nil {
+			fatal("invalid job file", "path", fs.Arg(0), "err", err)
+		}
+		jobs = jobFile.Jobs
+		if parallel <= 0 {
+			parallel = jobFile.Parallel
+		}
+		if numWorkers <= 0 {
+			numWorkers = jobFile.Workers
+		}
+	} else {
+		var err error
+		if steps, err = parseSteps(stepSpec); err != nil {
+			fatal("invalid -steps", "err", err)
+		}
+		if seen, err = scanImages(fs.Arg(0)); err != nil {
+			fatal("failed to list input directory", "err", err)
+		}
+		jobs = dirJobs(slices.Collect(maps.Keys(seen)), fs.Arg(0), fs.Arg(1), steps)
+	}
+	// With --watch the CPUs go to however many images arrive together, so
+	// size for the full parallelism rather than the first scan.
+	jobCount := len(jobs)
+	if watch {
+		jobCount = cpuCount()
+	}
+	parallel, numWorkers = batchWorkers(parallel, numWorkers, jobCount)
+	if encoders == 0 {
+		encoders = parallel
+	}
+
+	// Without a manifest every job is pending.
+	pending := func(jobs []Job) []Job { return jobs }
+	var progress *manifest
+	if manifestPath != "" {
+		var err error
+		if progress, err = loadManifest(manifestPath, force); err != nil {
+			fatal("failed to read manifest", "err", err)
+		}
+		pending = progress.pending
+	}
+	out := progressOut(jsonOutput)
+	queued := len(jobs)
+	jobs = pending(jobs)
+	if skipped := queued - len(jobs); skipped > 0 {
+		fmt.Fprintf(out, "Skipping %d jobs finished in an earlier run\n", skipped)
+	}
+
+	if dryRun {
+		reportPlan(planJobs(jobs, parallel, numWorkers, prefetch), jsonOutput)
+		return
+	}
+	if progress != nil {
+		if err := progress.open(manifestPath, force); err != nil {
+			fatal("failed to open manifest", "err", err)
+		}
+		defer progress.Close()
+	}
+
+	printResult := func(r JobResult) {
+		if r.Error == "" && progress != nil {
+			if err := progress.record(r.Output); err != nil {
+				logger.Error("failed to update manifest", "err", err)
+			}
+		}
+		if r.Error != "" {
+			logger.Error("job failed", "input", r.Input, "err", r.Error)
+			return
+		}
+		logger.Debug("job done", "input", r.Input, "load_ms", r.LoadMs, "wait_ms", r.WaitMs, "total_ms", r.TotalMs)
+		if r.Retries > 0 {
+			fmt.Fprintf(out, "%s -> %s (%dx%d) in %.0fms after %d retries\n", r.Input, r.Output, r.Width, r.Height, r.TotalMs, r.Retries)
+			return
+		}
+		fmt.Fprintf(out, "%s -> %s (%dx%d) in %.0fms\n", r.Input, r.Output, r.Width, r.Height, r.TotalMs)
+	}
+	trapSignals()
+	startDefaultPool()
+	startDefaultIOPool()
+	start := time.Now()
+	results, reorder := runJobs(jobs, parallel, numWorkers, prefetch, encoders, ordered, printResult)
+	total := time.Since(start)
+
+	if watch && !interrupted() {
+		fmt.Fprintf(out, "Watching %s (%d jobs at once, %d workers each)\n", fs.Arg(0), parallel, numWorkers)
+		err := watchDir(fs.Arg(0), fs.Arg(1), steps, seen, interval, func(jobs []Job) {
+			results, _ := runJobs(pending(jobs), parallel, numWorkers, prefetch, encoders, ordered, printResult)
+			for _, r := range results {
+				if jsonOutput {
+					writeJSON(os.Stdout, r)
+				}
+			}
+		})
+		exitIfInterrupted()
+		fatal("watch stopped", "err", err)
+	}
+
+	summary := summarize(results, queued-len(jobs))
+	if jsonOutput {
+		params := map[string]any{"parallel": parallel, "prefetch": prefetch, "encoders": encoders,
+			"skipped": queued - len(jobs), "stages": batchStages(results), "summary": summary}
+		if ordered {
+			params["reorder"] = reorder
+		}
+		if pool := poolStats(); pool != nil {
+			params["pool"] = pool
+		}
+		if pool := ioPoolStats(); pool != nil {
+			params["io_pool"] = pool
+		}
+		writeJSON(os.Stdout, Report{
+			Operation:  "batch",
+			Input:      fs.Arg(0),
+			Workers:    numWorkers,
+			Parameters: params,
+			TotalMs:    ms(total),
+			Result:     results,
+		})
+	}
+	fmt.Fprintf(out, "Batch: %d jobs, %d succeeded, %d failed, %d skipped, %d retries; %d at once with %d workers each, %dms\n",
+		queued, summary.Succeeded, summary.Failed, summary.Skipped, summary.Retries, parallel, numWorkers, total.Milliseconds())
+	for _, r := range results {
+		if r.Error != "" && !r.Skipped {
+			fmt.Fprintf(out, "  failed: %s: %s\n", r.Input, r.Error)
+		}
+	}
+	stages := batchStages(results)
+	fmt.Fprintf(out, "Stages: %.0fms decoding, %.0fms filtering, %.0fms encoding (%d encoders), overlapped into %dms\n",
+		stages.DecodeMs, stages.FilterMs, stages.EncodeMs, encoders, total.Milliseconds())
+	if pool := poolStats(); pool != nil {
+		fmt.Fprintf(out, "Pool: %d goroutines ran %d workers, %d ran inline, %.0f%% busy\n",
+			pool.Size, pool.Pooled, pool.Inline, 100*pool.Utilization)
+	}
+	if pool := ioPoolStats(); pool != nil {
+		fmt.Fprintf(out, "I/O pool: %d goroutines read %d files (%.1fMB) and wrote %d (%.1fMB), %.0f%% busy, tasks queued %.0fms\n",
+			pool.Size, pool.Reads, float64(pool.BytesRead)/(1<<20), pool.Writes, float64(pool.BytesWritten)/(1<<20),
+			100*pool.Utilization, pool.QueuedMs)
+	}
+	if ordered {
+		fmt.Fprintf(out, "Ordered: at most %d of %d results held back, next job held %d times for %.0fms\n",
+			reorder.MaxPending, reorder.Window, reorder.Stalls, reorder.StallMs)
+	}
+	// The manifest is synced after every job, so it is complete here.
+	exitIfInterrupted()
+	if summary.Failed > 0 {
+		os.Exit(exitFailure)
+	}
+}
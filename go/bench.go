@@ -0,0 +1,458 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type benchConfig struct {
+	runs        int
+	warmup      int     // warm-up runs always executed before measuring
+	maxWarmup   int     // upper bound on warm-up runs while waiting for steady state
+	window      int     // number of recent warm-up runs checked for steady state
+	cvThreshold float64 // coefficient of variation that counts as steady
+}
+
+type BenchResult struct {
+	Operation   string    `json:"operation"`
+	Workers     int       `json:"workers"`
+	Radius      int       `json:"radius"`
+	WarmupRuns  int       `json:"warmup_runs"`
+	SteadyState bool      `json:"steady_state"`
+	SamplesMs   []float64 `json:"samples_ms"`
+	MeanMs      float64   `json:"mean_ms"`
+	MedianMs    float64   `json:"median_ms"`
+	StddevMs    float64   `json:"stddev_ms"`
+	CV          float64   `json:"cv"`
+	Speedup     float64   `json:"speedup,omitempty"`
+	Efficiency  float64   `json:"efficiency,omitempty"`
+	KarpFlatt   float64   `json:"karp_flatt,omitempty"`
+	Schedule    string    `json:"schedule,omitempty"`
+	Backend     string    `json:"backend,omitempty"` // the GPU run's backend, empty on the CPU
+	Phases      []Phase   `json:"phases,omitempty"`
+}
+
+// Phase is the median duration of one named step across the measured runs.
+type Phase struct {
+	Name     string  `json:"name"`
+	MedianMs float64 `json:"median_ms"`
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func meanStddev(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	if len(values) < 2 {
+		return mean, 0
+	}
+	sq := 0.0
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(values)-1))
+}
+
+func coefficientOfVariation(values []float64) float64 {
+	mean, stddev := meanStddev(values)
+	if mean == 0 {
+		return 0
+	}
+	return stddev / mean
+}
+
+func timeRun(job func()) (float64, []phaseTime) {
+	runtime.GC()
+	takePhases()
+	start := time.Now()
+	job()
+	elapsed := time.Since(start)
+	return ms(elapsed), takePhases()
+}
+
+// warmUp runs the job until the last cfg.window timings vary by less than
+// cfg.cvThreshold, so cold caches and CPU frequency ramp-up don't end up in the
+// recorded samples. It reports the number of runs and whether steady state was
+// reached before cfg.maxWarmup.
+func warmUp(job func(), cfg benchConfig) (int, bool) {
+	var timings []float64
+	for len(timings) < cfg.maxWarmup {
+		elapsed, _ := timeRun(job)
+		timings = append(timings, elapsed)
+		if len(timings) < cfg.warmup || len(timings) < cfg.window {
+			continue
+		}
+		if coefficientOfVariation(timings[len(timings)-cfg.window:]) <= cfg.cvThreshold {
+			return len(timings), true
+		}
+	}
+	return len(timings), cfg.maxWarmup == 0
+}
+
+func runBench(job func(), cfg benchConfig) BenchResult {
+	var result BenchResult
+	result.WarmupRuns, result.SteadyState = warmUp(job, cfg)
+	var names []string
+	phaseSamples := make(map[string][]float64)
+	for range cfg.runs {
+		elapsed, list := timeRun(job)
+		result.SamplesMs = append(result.SamplesMs, elapsed)
+		for _, p := range list {
+			if _, ok := phaseSamples[p.name]; !ok {
+				names = append(names, p.name)
+			}
+			phaseSamples[p.name] = append(phaseSamples[p.name], ms(p.duration))
+		}
+	}
+	for _, name := range names {
+		result.Phases = append(result.Phases, Phase{name, median(phaseSamples[name])})
+	}
+	result.MeanMs, result.StddevMs = meanStddev(result.SamplesMs)
+	result.MedianMs = median(result.SamplesMs)
+	result.CV = coefficientOfVariation(result.SamplesMs)
+	return result
+}
+
+// workerSweep returns 1, 2, 4, ... up to and including maxWorkers.
+func workerSweep(maxWorkers int) []int {
+	var counts []int
+	for n := 1; n < maxWorkers; n *= 2 {
+		counts = append(counts, n)
+	}
+	return append(counts, maxWorkers)
+}
+
+func parseWorkerList(list string) ([]int, error) {
+	var counts []int
+	for field := range strings.SplitSeq(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid worker count %q", field)
+		}
+		counts = append(counts, n)
+	}
+	return counts, nil
+}
+
+func writeBenchCSV(path string, results []BenchResult) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"operation", "radius", "workers", "runs", "mean_ms", "median_ms", "stddev_ms", "speedup", "schedule", "backend"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.Operation,
+			strconv.Itoa(r.Radius),
+			strconv.Itoa(r.Workers),
+			strconv.Itoa(len(r.SamplesMs)),
+			strconv.FormatFloat(r.MeanMs, 'f', 3, 64),
+			strconv.FormatFloat(r.MedianMs, 'f', 3, 64),
+			strconv.FormatFloat(r.StddevMs, 'f', 3, 64),
+			strconv.FormatFloat(r.Speedup, 'f', 3, 64),
+			r.Schedule,
+			cmp.Or(r.Backend, "cpu"),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func printBenchUsage(program string, fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s bench [flags] <operation> <input_image> <radius> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "  Without workers, sweeps 1, 2, 4, ... up to NumCPU (or the --workers list)\n")
+	fmt.Fprintf(os.Stderr, "  For monte_carlo, monte_carlo_integrate and monte_carlo_option: input_image is\n")
+	fmt.Fprintf(os.Stderr, "  ignored and radius is the number of samples\n")
+	fmt.Fprintf(os.Stderr, "  For resize and resize_bilinear: radius is the downscale factor\n")
+	fmt.Fprintf(os.Stderr, "  With --gpu: times the GPU backend after the worker counts, with its speedup over 1 worker\n")
+	fmt.Fprintf(os.Stderr, "  For memory: measures copy, transpose and zeroing in GB/s next to the filters\n")
+	fmt.Fprintf(os.Stderr, "  at the given radius, to show which filters are bandwidth-bound\n")
+	fs.PrintDefaults()
+}
+
+func benchCommand(program string, args []string, jsonOutput bool) {
+	var cfg benchConfig
+	var workerList, csvPath string
+	var encode bool
+	var peakGBps float64
+	var scheduleList string
+	var compareGPU bool
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.IntVar(&cfg.runs, "runs", 10, "number of measured runs")
+	fs.IntVar(&cfg.warmup, "warmup", 3, "minimum number of warm-up runs")
+	fs.IntVar(&cfg.maxWarmup, "max-warmup", 20, "maximum number of warm-up runs while waiting for steady state")
+	fs.IntVar(&cfg.window, "window", 3, "number of recent warm-up runs used for steady-state detection")
+	fs.Float64Var(&cfg.cvThreshold, "cv", 0.05, "coefficient of variation below which timings are considered steady")
+	fs.StringVar(&workerList, "workers", "", "comma-separated worker counts to sweep")
+	fs.BoolVar(&encode, "encode", false, "include PNG encoding of the result in each run")
+	fs.StringVar(&csvPath, "csv", "", "write results as CSV to this file ('-' for stdout)")
+	fs.StringVar(&scheduleList, "schedules", "", "comma-separated row schedules to compare ("+strings.Join(schedulerNames, ", ")+")")
+	fs.BoolVar(&compareGPU, "gpu", false, "also time the GPU backend (blur and kuwahara, builds with -tags cuda)")
+	fs.Float64Var(&peakGBps, "peak-gbps", 0, "theoretical memory bandwidth for the memory operation (0 = best measured copy)")
+	fs.Usage = func() { printBenchUsage(program, fs) }
+	fs.Parse(args)
+
+	if fs.NArg() < 3 || fs.NArg() > 4 || cfg.runs <= 0 || cfg.window <= 0 || cfg.maxWarmup < cfg.warmup {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if jsonOutput && csvPath == "-" {
+		fmt.Fprintf(os.Stderr, "--csv - and --json both write to stdout, use one or give --csv a file\n")
+		os.Exit(exitUsage)
+	}
+	operation := fs.Arg(0)
+	inputPath := fs.Arg(1)
+	radius, err := strconv.Atoi(fs.Arg(2))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid radius: %v\n", err)
+		os.Exit(exitInvalidRadius)
+	}
+
+	var schedules []string
+	if scheduleList != "" {
+		for name := range strings.SplitSeq(scheduleList, ",") {
+			name = strings.TrimSpace(name)
+			if _, err := newScheduler(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid --schedules: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			schedules = append(schedules, name)
+		}
+	}
+
+	counts := workerSweep(cpuCount())
+	if workerList != "" {
+		counts, err = parseWorkerList(workerList)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if fs.NArg() == 4 {
+		numWorkers, err := strconv.Atoi(fs.Arg(3))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+		counts = []int{numWorkers}
+	}
+
+	var out io.Writer = os.Stdout
+	if jsonOutput || csvPath == "-" {
+		out = io.Discard
+	}
+
+	if operation == "memory" {
+		srcImg, err := loadImage(inputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		report := memoryBench(out, srcImg, radius, counts, cfg, peakGBps)
+		if jsonOutput {
+			writeJSON(os.Stdout, report)
+		}
+		return
+	}
+
+	if compareGPU && (!gpuOperation(operation) || scheduleList != "") {
+		fmt.Fprintf(os.Stderr, "--gpu applies to blur and kuwahara, without --schedules\n")
+		os.Exit(exitUsage)
+	}
+
+	var makeJob func(numWorkers int) func()
+	var gpuJob func()
+	switch operation {
+	case "monte_carlo":
+		makeJob = func(numWorkers int) func() {
+			return func() { monteCarloOperation(radius, numWorkers, monteCarloOptions{RNG: "lcg"}) }
+		}
+	case "monte_carlo_integrate":
+		fn, dims, _ := compileExpr("exp(-(x1^2+x2^2))")
+		makeJob = func(numWorkers int) func() {
+			return func() { monteCarloIntegrate(fn, dims, radius, numWorkers, "lcg") }
+		}
+	case "monte_carlo_option":
+		opt := optionParams{Spot: 100, Strike: 100, Rate: 0.05, Volatility: 0.2, Maturity: 1}
+		makeJob = func(numWorkers int) func() {
+			return func() { monteCarloOption(opt, radius, numWorkers, "lcg") }
+		}
+	case "resize", "resize_bilinear":
+		srcImg, err := loadImage(inputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		filter := "lanczos3"
+		if operation == "resize_bilinear" {
+			filter = "bilinear"
+		}
+		b := srcImg.Bounds()
+		width, height := max(b.Dx()/max(radius, 1), 1), max(b.Dy()/max(radius, 1), 1)
+		makeJob = func(numWorkers int) func() {
+			return func() { resizeImage(srcImg, width, height, filter, numWorkers, nil) }
+		}
+	default:
+		srcImg, err := loadImage(inputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		// The first call validates the operation name and doubles as a cold run.
+		if _, err := applyOperation(operation, srcImg, radius, 1); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitCode(err))
+		}
+		makeJob = func(numWorkers int) func() {
+			return func() {
+				dstImg, _ := applyOperation(operation, srcImg, radius, numWorkers)
+				if encode {
+					start := time.Now()
+					png.Encode(io.Discard, dstImg)
+					recordPhase("Encode", time.Since(start))
+				}
+			}
+		}
+		if compareGPU {
+			// Also the cold run, which compiles the kernels.
+			if _, err := runGPU(operation, srcImg, radius, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "GPU backend: %v\n", err)
+				os.Exit(exitCode(err))
+			}
+			gpuJob = func() { runGPU(operation, srcImg, radius, nil) }
+		}
+	}
+
+	fmt.Fprintf(out, "Benchmarking %s with radius %d, %d runs per worker count\n", operation, radius, cfg.runs)
+	if len(schedules) == 0 {
+		report := runSweep(out, operation, radius, counts, cfg, makeJob)
+		results := report.Results
+		if gpuJob != nil {
+			report.GPU = benchGPU(out, operation, radius, cfg, gpuJob, report)
+			results = append(results, *report.GPU)
+		}
+		writeBenchOutput(csvPath, jsonOutput, results, report)
+		return
+	}
+
+	// The same sweep under each scheduling policy.
+	var reports []ScalingReport
+	var results []BenchResult
+	for _, name := range schedules {
+		sched, _ := newScheduler(name)
+		SetScheduler(sched)
+		fmt.Fprintf(out, "\nSchedule: %s\n", name)
+		report := runSweep(out, operation, radius, counts, cfg, makeJob)
+		report.Schedule = name
+		for i := range report.Results {
+			report.Results[i].Schedule = name
+		}
+		reports = append(reports, report)
+		results = append(results, report.Results...)
+	}
+	SetScheduler(nil)
+	printScheduleComparison(out, reports)
+	writeBenchOutput(csvPath, jsonOutput, results, reports)
+}
+
+// runSweep benchmarks makeJob at each worker count and prints the timings
+// and scaling analysis.
+func runSweep(out io.Writer, operation string, radius int, counts []int, cfg benchConfig, makeJob func(numWorkers int) func()) ScalingReport {
+	fmt.Fprintf(out, "%8s %8s %12s %12s %12s %8s\n", "workers", "warmup", "mean", "median", "stddev", "speedup")
+
+	// Speedup is relative to the single-worker run, which is measured first
+	// even when the sweep does not include it.
+	var baseline BenchResult
+	if !slices.Contains(counts, 1) {
+		baseline = runBench(makeJob(1), cfg)
+	}
+
+	var results []BenchResult
+	for _, numWorkers := range counts {
+		result := runBench(makeJob(numWorkers), cfg)
+		result.Operation = operation
+		result.Workers = numWorkers
+		result.Radius = radius
+		if numWorkers == 1 {
+			baseline = result
+		}
+		if baseline.MedianMs > 0 && result.MedianMs > 0 {
+			result.Speedup = baseline.MedianMs / result.MedianMs
+		}
+		if !result.SteadyState {
+			fmt.Fprintf(os.Stderr, "Warning: no steady state with %d workers after %d warm-up runs (cv threshold %.3f)\n", numWorkers, result.WarmupRuns, cfg.cvThreshold)
+		}
+		fmt.Fprintf(out, "%8d %8d %10.2fms %10.2fms %10.2fms %7.2fx\n",
+			numWorkers, result.WarmupRuns, result.MeanMs, result.MedianMs, result.StddevMs, result.Speedup)
+		results = append(results, result)
+	}
+
+	report := analyzeScaling(results, baseline)
+	printScaling(out, report)
+	return report
+}
+
+// printScheduleComparison lists each policy's median at the largest worker
+// count relative to the fastest.
+func printScheduleComparison(out io.Writer, reports []ScalingReport) {
+	best := math.Inf(1)
+	for _, r := range reports {
+		best = min(best, r.Results[len(r.Results)-1].MedianMs)
+	}
+	fmt.Fprintf(out, "\nSchedules at %d workers:\n", reports[0].Results[len(reports[0].Results)-1].Workers)
+	fmt.Fprintf(out, "%-10s %12s %10s\n", "schedule", "median", "vs best")
+	for _, r := range reports {
+		median := r.Results[len(r.Results)-1].MedianMs
+		fmt.Fprintf(out, "%-10s %10.2fms %9.2fx\n", r.Schedule, median, median/best)
+	}
+}
+
+func writeBenchOutput(csvPath string, jsonOutput bool, results []BenchResult, report any) {
+	if csvPath != "" {
+		if err := writeBenchCSV(csvPath, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write CSV: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+	if jsonOutput {
+		writeJSON(os.Stdout, report)
+	}
+}
@@ -1,16 +1,87 @@
 package main
 
 import (
+	"fmt"
 	"image"
 	"image/color"
 	"math"
-	"sync"
+	"time"
 )
 
 func generateGaussianKernel(radius int) []float64 {
+	return gaussianKernel(radius, float64(radius)/3.0)
+}
+
+// BlurOptions selects the Gaussian of GaussianBlur. With Sigma <= 0 the
+// sigma is Radius/3, as for the blur operation; with Radius <= 0 the radius
+// is chosen to cover three sigmas.
+type BlurOptions struct {
+	Radius int
+	Sigma  float64
+}
+
+func (o BlurOptions) kernel() []float64 {
+	radius, sigma := o.Radius, o.Sigma
+	if radius <= 0 {
+		radius = sigmaRadius(sigma)
+	}
+	if sigma <= 0 {
+		sigma = float64(radius) / 3.0
+	}
+	return gaussianKernel(radius, sigma)
+}
+
+// sigmaRadius is the kernel radius that covers three sigmas.
+func sigmaRadius(sigma float64) int {
+	return max(int(math.Ceil(3*sigma)), 1)
+}
+
+// blurSigma overrides the radius/3 sigma of the blur operations when
+// positive; it is set from --sigma.
+var blurSigma float64
+
+// blurAlgorithm is --algorithm: how blur applies its kernel. direct and
+// fft convolve with it, the one in passes of 2r+1 taps, the other through
+// FFTs of rows and columns, both at a cost of about the same at any radius;
+// auto takes fft from fftMinRadius. iir runs a
+// recursive approximation of the Gaussian, at a fixed cost too and the
+// cheapest at all but the smallest radii, within a few levels of the
+// kernel; below iirMinSigma, where it is further off, blur runs direct.
+var blurAlgorithm = "auto"
+
+func checkBlurAlgorithm(name string) error {
+	switch name {
+	case "auto", "direct", "fft", "iir":
+		return nil
+	}
+	return fmt.Errorf("unknown blur algorithm %q, use auto, direct, fft or iir", name)
+}
+
+// blurPath is the algorithm blur runs for a kernel radius: direct, fft or
+// iir, resolving auto.
+func blurPath(radius int) string {
+	if blurAlgorithm != "auto" {
+		return blurAlgorithm
+	}
+	if radius >= fftMinRadius {
+		return "fft"
+	}
+	return "direct"
+}
+
+// blurKernel is the kernel the blur operations use for radius.
+func blurKernel(radius int) []float64 {
+	return BlurOptions{Radius: radius, Sigma: blurSigma}.kernel()
+}
+
+// gaussianKernel is a normalized Gaussian of the given sigma sampled over
+// [-radius, radius].
+func gaussianKernel(radius int, sigma float64) []float64 {
+	if radius <= 0 || sigma <= 0 {
+		return []float64{1}
+	}
 	size := 2*radius + 1
 	kernel := make([]float64, size)
-	sigma := float64(radius) / 3.0
 	sum := 0.0
 
 	for i := range size {
@@ -75,55 +146,54 @@ func transposeImage(src *image.RGBA) *image.RGBA {
 	return dst
 }
 
-func applyGaussianBlur(srcImg image.Image, radius int, numWorkers int) *image.RGBA {
-	bounds := srcImg.Bounds()
-	kernel := generateGaussianKernel(radius)
+func applyGaussianBlur(srcImg image.Image, radius int, numWorkers int, phases *phaseLog) *image.RGBA {
+	return gaussianBlur(srcImg, blurKernel(radius), numWorkers, phases)
+}
 
-	// Phase 1: Horizontal blur
-	horizontal := image.NewRGBA(bounds)
+// GaussianBlur blurs srcImg with the Gaussian described by opts using
+// numWorkers goroutines.
+func GaussianBlur(srcImg image.Image, opts BlurOptions, numWorkers int) *image.RGBA {
+	return gaussianBlur(srcImg, opts.kernel(), numWorkers, nil)
+}
 
-	var wg sync.WaitGroup
-	rowsPerWorker := bounds.Max.Y / numWorkers
+func gaussianBlur(srcImg image.Image, kernel []float64, numWorkers int, phases *phaseLog) *image.RGBA {
+	return blurImage(srcImg, kernel, blurPath(len(kernel)/2), numWorkers, phases)
+}
 
-	for i := range numWorkers {
-		startY := i * rowsPerWorker
-		endY := startY + rowsPerWorker
-		if i == numWorkers-1 {
-			endY = bounds.Max.Y
-		}
+// blurImage blurs srcImg by the named path, in bytes.
+func blurImage(srcImg image.Image, kernel []float64, path string, numWorkers int, phases *phaseLog) *image.RGBA {
+	src := imageDataFrom[uint8](srcImg, numWorkers)
+	blurData(src, src, kernel, path, numWorkers, phases)
+	return src.RGBA(numWorkers)
+}
 
-		wg.Add(1)
-		go func(start, end int) {
-			defer wg.Done()
-			blurHorizontal(srcImg, horizontal, kernel, radius, start, end)
-		}(startY, endY)
+// blurData blurs src into dst, which may be src, of any precision and
+// channel count. The direct path convolves in two passes of the kernel's
+// taps, rounding after each; fft and iir run on a float copy. iir falls
+// back to direct for kernels narrower than iirMinSigma. The passes are
+// recorded in phases.
+func blurData[T channelValue](src, dst *ImageData[T], kernel []float64, path string, numWorkers int, phases *phaseLog) {
+	sigma := kernelSigma(kernel)
+	if path == "direct" || path == "iir" && sigma < iirMinSigma {
+		start := time.Now()
+		horizontal := NewImageData[T](src.Width, src.Height, src.Channels)
+		convolveRows(src, horizontal, kernel, numWorkers)
+		phases.record("Horizontal pass", time.Since(start))
+		start = time.Now()
+		convolveColumns(horizontal, dst, kernel, numWorkers)
+		phases.record("Vertical pass", time.Since(start))
+		return
 	}
-	wg.Wait()
-
-	// Transpose for vertical pass
-	transposed := transposeImage(horizontal)
-
-	// Phase 2: Vertical blur (horizontal on transposed)
-	transposedBounds := transposed.Bounds()
-	blurred := image.NewRGBA(transposedBounds)
-
-	rowsPerWorker = transposedBounds.Max.Y / numWorkers
-
-	for i := 0; i < numWorkers; i++ {
-		startY := i * rowsPerWorker
-		endY := startY + rowsPerWorker
-		if i == numWorkers-1 {
-			endY = transposedBounds.Max.Y
-		}
-
-		wg.Add(1)
-		go func(start, end int) {
-			defer wg.Done()
-			blurHorizontal(transposed, blurred, kernel, radius, start, end)
-		}(startY, endY)
+	start := time.Now()
+	values := NewImageData[float32](src.Width, src.Height, src.Channels)
+	convertImageData(src, values, numWorkers)
+	phases.record("Split channels", time.Since(start))
+	if path == "iir" {
+		iirFilter(values, sigma, numWorkers, phases)
+	} else {
+		fftFilter(values, kernel, numWorkers, phases)
 	}
-	wg.Wait()
-
-	// Transpose back
-	return transposeImage(blurred)
+	start = time.Now()
+	convertImageData(values, dst, numWorkers)
+	phases.record("Merge channels", time.Since(start))
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlurPathAuto(t *testing.T) {
+	defer func(algorithm string) { blurAlgorithm = algorithm }(blurAlgorithm)
+	blurAlgorithm = "auto"
+	for radius, want := range map[int]string{1: "direct", fftMinRadius - 1: "direct", fftMinRadius: "fft", 100: "fft"} {
+		if got := blurPath(radius); got != want {
+			t.Errorf("auto at radius %d: %s, want %s", radius, got, want)
+		}
+	}
+	blurAlgorithm = "direct"
+	if got := blurPath(100); got != "direct" {
+		t.Errorf("direct at radius 100: %s", got)
+	}
+}
+
+// TestBlurAlgorithmsMatchDirect holds fft and iir to the direct blur: fft
+// within rounding, iir within a few levels, the bounds selftest uses.
+func TestBlurAlgorithmsMatchDirect(t *testing.T) {
+	// Below sigma 2 iir runs the direct passes, so from radius 1, the
+	// smallest blur takes, to 5 it must match exactly.
+	algorithms := []struct {
+		name    string
+		radii   []int
+		maxDiff int
+		minPSNR float64
+	}{
+		{"fft", []int{1, 2, 6, fftMinRadius, 40}, 1, 50},
+		{"iir", []int{1, 3, 5, 6, fftMinRadius, 40}, 8, 40},
+	}
+	for _, s := range syntheticImages {
+		img := toRGBA(s.generate())
+		for _, bound := range algorithms {
+			algorithm := bound.name
+			for _, radius := range bound.radii {
+				kernel := blurKernel(radius)
+				want := blurImage(img, kernel, "direct", 3, nil)
+				t.Run(fmt.Sprintf("%s_%s_r%d", algorithm, s.name, radius), func(t *testing.T) {
+					got := blurImage(img, kernel, algorithm, 3, nil)
+					diff, _, err := compareImages(got, want)
+					if err != nil {
+						t.Fatal(err)
+					}
+					m, err := computeMetrics(want, got, 3)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if largest := max(diff[0], diff[1], diff[2], diff[3]); largest > bound.maxDiff || m.PSNR < bound.minPSNR {
+						t.Errorf("off the direct blur by up to %d, PSNR %.1fdB", largest, m.PSNR)
+					}
+					if algorithm == "iir" && kernelSigma(kernel) < iirMinSigma && pixelChecksum(got) != pixelChecksum(want) {
+						t.Error("iir below iirMinSigma differs from the direct blur")
+					}
+				})
+			}
+		}
+	}
+	takePhases()
+}
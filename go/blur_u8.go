@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"math"
+	"time"
+)
+
+// kernelShift is the fixed-point precision of the integer blur kernel.
+const kernelShift = 14
+
+// quantizeKernel converts a normalized kernel to integers summing exactly to
+// 1<<kernelShift; the rounding error goes to the centre tap.
+func quantizeKernel(kernel []float64) []int32 {
+	q := make([]int32, len(kernel))
+	var sum int32
+	for i, w := range kernel {
+		q[i] = int32(math.Round(w * (1 << kernelShift)))
+		sum += q[i]
+	}
+	q[len(q)/2] += 1<<kernelShift - sum
+	return q
+}
+
+// satU8 rounds a fixed-point accumulator and saturates it to a byte.
+func satU8(acc int32) uint8 {
+	v := (acc + 1<<(kernelShift-1)) >> kernelShift
+	return uint8(min(max(v, 0), 255))
+}
+
+// applyGaussianBlurU8 is an experimental integer version of
+// applyGaussianBlur: the same kernel in 14-bit fixed point, applied to the
+// raw RGBA bytes with int32 accumulators and saturating stores. The vertical
+// pass accumulates whole rows at a time, which keeps the inner loop a
+// contiguous multiply-add over bytes that compilers can vectorize. Results
+// match the float blur to within one level per channel.
+func applyGaussianBlurU8(srcImg image.Image, radius, numWorkers int, phases *phaseLog) *image.RGBA {
+	src := toRGBA(srcImg)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	kernel := quantizeKernel(blurKernel(radius))
+
+	start := time.Now()
+	horizontal := image.NewRGBA(image.Rect(0, 0, width, height))
+	parallelRows(height, numWorkers, func(from, to int) {
+		for y := from; y < to; y++ {
+			in := src.Pix[y*src.Stride : y*src.Stride+width*4]
+			out := horizontal.Pix[y*horizontal.Stride:]
+			for x := range width {
+				var r, g, b, a int32
+				for k, w := range kernel {
+					p := in[min(max(x+k-radius, 0), width-1)*4:]
+					r += w * int32(p[0])
+					g += w * int32(p[1])
+					b += w * int32(p[2])
+					a += w * int32(p[3])
+				}
+				out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = satU8(r), satU8(g), satU8(b), satU8(a)
+			}
+		}
+	})
+	phases.record("Horizontal pass", time.Since(start))
+
+	start = time.Now()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	parallelRows(height, numWorkers, func(from, to int) {
+		acc := make([]int32, width*4)
+		for y := from; y < to; y++ {
+			clear(acc)
+			for k, w := range kernel {
+				sy := min(max(y+k-radius, 0), height-1)
+				row := horizontal.Pix[sy*horizontal.Stride : sy*horizontal.Stride+width*4]
+				for i, v := range row {
+					acc[i] += w * int32(v)
+				}
+			}
+			out := dst.Pix[y*dst.Stride : y*dst.Stride+width*4]
+			for i := range out {
+				out[i] = satU8(acc[i])
+			}
+		}
+	})
+	phases.record("Vertical pass", time.Since(start))
+	return dst
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// calibrateCommand measures the cost constants of costModel on this
+// machine and stores them as its profile: blur at several radii, fitted
+// per kernel tap, the Kuwahara summed-area table build and filter, each
+// codec, and the costs of starting a worker and handing out a chunk.
+// --dry-run predicts from the profile, --auto-workers sizes the work per
+// worker from the worker start cost, and the adaptive schedule sizes its
+// chunks from the chunk cost.
+func calibrateCommand(program string, args []string, jsonOutput bool) {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	side := fs.Int("size", 1024, "edge of the square samples the filters and codecs run on")
+	radiiList := fs.String("radii", "2,4,8,16", "blur radii the convolution cost is fitted on")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s calibrate [flags]\n", program)
+		fmt.Fprintf(os.Stderr, "  Measures filter, codec and scheduling costs on this machine and stores them in\n")
+		fmt.Fprintf(os.Stderr, "  %s for --dry-run, --auto-workers and --schedule adaptive\n", calibrationPath())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	radii, err := parseWorkerList(*radiiList)
+	if err != nil || fs.NArg() != 0 || *side < 64 || len(radii) < 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	trapSignals()
+	out := progressOut(jsonOutput)
+	m := loadCostModel()
+	*m = costModel{
+		path:    m.path,
+		CPUs:    cpuCount(),
+		Filters: map[string]float64{},
+		Decode:  map[string]float64{},
+		Encode:  map[string]float64{},
+		changed: true,
+	}
+	fmt.Fprintf(out, "Calibrating on %dx%d samples with %d CPUs\n", *side, *side, cpuCount())
+
+	// Convolution: the time per pixel grows with the kernel, 2r+1 taps a
+	// pass; a least-squares line through the radii gives the rest.
+	algorithm := blurAlgorithm
+	blurAlgorithm = "direct"
+	var taps, costs []float64
+	for _, r := range radii {
+		ns, err := measureFilter("blur", r, max(*side, 4*r))
+		if err != nil {
+			fatal("calibration failed", "operation", "blur", "err", err)
+		}
+		exitIfInterrupted()
+		m.Filters[fmt.Sprintf("blur:%d", r)] = ns
+		taps, costs = append(taps, float64(2*r+1)), append(costs, ns)
+		fmt.Fprintf(out, "  blur radius %d: %.1f ns/pixel (%.1f Mpixels/s)\n", r, ns, 1e3/ns)
+	}
+	m.ConvTapNs, m.ConvBaseNs = fitLine(taps, costs)
+	fmt.Fprintf(out, "Convolution: %.2f ns per pixel and tap, %.1f ns per pixel besides\n", m.ConvTapNs, m.ConvBaseNs)
+	blurAlgorithm = "fft"
+	if m.FFTBlurNs, err = measureFilter("blur", fftMinRadius, *side); err != nil {
+		fatal("calibration failed", "operation", "blur", "err", err)
+	}
+	blurAlgorithm = algorithm
+	fmt.Fprintf(out, "FFT convolution: %.1f ns/pixel at any radius, faster from radius %d\n", m.FFTBlurNs, m.fftCrossover())
+	exitIfInterrupted()
+
+	sample := calibrationSample(*side)
+	m.SATNs = fastest(3, func() {
+		integral := NewIntegralImage[float64](*side, *side, false)
+		buildIntegralImages(sample, integral)
+		integral.release()
+	}) / float64(*side**side)
+	fmt.Fprintf(out, "Summed-area tables: %.1f ns/pixel (%.1f Mpixels/s)\n", m.SATNs, 1e3/m.SATNs)
+	ns, err := measureFilter("kuwahara", 5, *side)
+	if err != nil {
+		fatal("calibration failed", "operation", "kuwahara", "err", err)
+	}
+	m.Filters["kuwahara:5"] = ns
+	fmt.Fprintf(out, "Kuwahara: %.1f ns/pixel, %.0f%% building the tables\n", ns, 100*m.SATNs/ns)
+	exitIfInterrupted()
+
+	level := pngCompression
+	for _, name := range []string{"fast", "default", "best"} {
+		pngCompression, _ = parseCompression(name)
+		key := encodeKey("sample.png")
+		m.Encode[key] = measureEncode("sample.png", *side)
+		fmt.Fprintf(out, "Encode png %s: %.1f ns/pixel (%.1f Mpixels/s)\n", name, m.Encode[key], 1e3/m.Encode[key])
+	}
+	pngCompression = level
+	for _, format := range []string{"qoi", "raw"} {
+		m.Encode[format] = measureEncode("sample."+format, *side)
+		fmt.Fprintf(out, "Encode %s: %.1f ns/pixel (%.1f Mpixels/s)\n", format, m.Encode[format], 1e3/m.Encode[format])
+	}
+	for _, format := range []string{"png", "jpeg", "qoi", "raw"} {
+		if ns, ok := measureDecode(format, *side); ok {
+			m.Decode[format] = ns
+			fmt.Fprintf(out, "Decode %s: %.1f ns/pixel (%.1f Mpixels/s)\n", format, ns, 1e3/ns)
+		}
+	}
+	exitIfInterrupted()
+
+	m.SpawnNs = measureSpawn()
+	m.ChunkNs = measureChunk()
+	fmt.Fprintf(out, "Worker start and join: %.0f ns; chunk hand-out: %.0f ns\n", m.SpawnNs, m.ChunkNs)
+	fmt.Fprintf(out, "  --auto-workers gives blur workers at least %d pixels, adaptive chunks aim at %s\n",
+		m.pixelsPerWorker("blur"), m.chunkTarget())
+
+	m.Calibrated = time.Now().UTC().Format(time.RFC3339)
+	if err := m.save(); err != nil {
+		fatal("failed to store the profile", "path", m.path, "err", err)
+	}
+	if jsonOutput {
+		writeJSON(os.Stdout, m)
+	}
+	fmt.Fprintf(out, "Profile written to %s\n", m.path)
+}
+
+// fitLine is the least-squares line y = slope*x + intercept through the
+// points.
+func fitLine(x, y []float64) (slope, intercept float64) {
+	meanX, _ := meanStddev(x)
+	meanY, _ := meanStddev(y)
+	var num, den float64
+	for i := range x {
+		num += (x[i] - meanX) * (y[i] - meanY)
+		den += (x[i] - meanX) * (x[i] - meanX)
+	}
+	if den == 0 {
+		return 0, meanY
+	}
+	slope = num / den
+	return slope, meanY - slope*meanX
+}
+
+// measureSpawn is the time to start and join one filter worker doing
+// nothing, with a worker per CPU started at once as filters do.
+func measureSpawn() float64 {
+	const rounds = 2000
+	workers := cpuCount()
+	return fastest(3, func() {
+		for range rounds {
+			var wg workerGroup
+			for range workers {
+				spawnWorker(&wg, func() {})
+			}
+			wg.Wait()
+		}
+	}) / float64(rounds*workers)
+}
+
+// measureChunk is the time the dynamic schedules take to hand out a chunk,
+// with every worker contending for the counter.
+func measureChunk() float64 {
+	const chunks = 200000
+	return fastest(3, func() {
+		dynamicScheduler{chunk: 1}.Run(chunks, cpuCount(), func(int, int, int) {})
+	}) / chunks
+}
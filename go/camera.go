@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The camera command filters a live source, a V4L2 device read through
+// ffmpeg or raw frames on stdin, as it runs. Unlike 'video' it favours
+// latency over completeness: the capture loop never waits for the
+// filters, since a camera doesn't either. When the workers fall behind and
+// the queue is full it drops a frame by --drop policy, and a frame that
+// finishes after a newer one has been shown is dropped as late rather
+// than shown out of order.
+
+// cameraPolicies are the --drop policies for a full queue.
+var cameraPolicies = []string{"oldest", "newest", "none"}
+
+// CameraReport summarizes 'camera'.
+type CameraReport struct {
+	Operation  string  `json:"operation"`
+	Radius     int     `json:"radius"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	Parallel   int     `json:"parallel"`
+	Workers    int     `json:"workers"`
+	Drop       string  `json:"drop"`
+	Queue      int     `json:"queue"`
+	Captured   int     `json:"captured"`
+	Dropped    int     `json:"dropped"` // queue full
+	Late       int     `json:"late"`    // finished after a newer frame
+	Shown      int     `json:"shown"`
+	CaptureFPS float64 `json:"capture_fps"`
+	OutputFPS  float64 `json:"output_fps"`
+	// Latency from the end of capture to output, of the frames shown.
+	LatencyMeanMs   float64 `json:"latency_mean_ms"`
+	LatencyMedianMs float64 `json:"latency_median_ms"`
+	LatencyP95Ms    float64 `json:"latency_p95_ms"`
+	TotalMs         float64 `json:"total_ms"`
+}
+
+type cameraFrame struct {
+	seq      int
+	pix      []byte
+	captured time.Time
+}
+
+type camera struct {
+	*videoStream
+	policy string
+	queue  chan *cameraFrame
+	free   chan []byte
+
+	mu        sync.Mutex // guards the fields below and the output
+	lastShown int
+	latencies []float64
+	report    *CameraReport
+}
+
+// recycle keeps buf for a later capture if there is room.
+func (c *camera) recycle(buf []byte) {
+	select {
+	case c.free <- buf:
+	default:
+	}
+}
+
+// capture reads frames from r at the pace the source delivers them, or
+// rate a second if it is above 0, until EOF, stop or interrupt, queueing
+// each by the drop policy. It closes the queue when it returns.
+func (c *camera) capture(r io.Reader, rate float64, stop <-chan struct{}) error {
+	defer close(c.queue)
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for seq := 0; ; seq++ {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-stop:
+				return nil
+			case <-interrupt.Done():
+				return nil
+			}
+		}
+		var pix []byte
+		select {
+		case pix = <-c.free:
+		default:
+			pix = make([]byte, c.frameSize())
+		}
+		if _, err := io.ReadFull(r, pix); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("the stream ends within a frame: not %dx%d %d bytes per pixel?", c.width, c.height, c.pixelSize)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		f := &cameraFrame{seq: seq, pix: pix, captured: time.Now()}
+		c.mu.Lock()
+		c.report.Captured++
+		c.mu.Unlock()
+
+		select {
+		case c.queue <- f:
+			continue
+		case <-stop:
+			return nil
+		case <-interrupt.Done():
+			return nil
+		default:
+		}
+		switch c.policy {
+		case "newest":
+			c.dropped(f)
+		case "oldest":
+			// Only this goroutine sends, so once the oldest is taken there
+			// is room.
+			select {
+			case old := <-c.queue:
+				c.dropped(old)
+			default:
+			}
+			c.queue <- f
+		default:
+			select {
+			case c.queue <- f:
+			case <-stop:
+				return nil
+			case <-interrupt.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func (c *camera) dropped(f *cameraFrame) {
+	c.mu.Lock()
+	c.report.Dropped++
+	c.mu.Unlock()
+	c.recycle(f.pix)
+}
+
+// filter runs the operation on queued frames and shows them, until the
+// queue closes.
+func (c *camera) filter(w io.Writer) error {
+	img := image.NewRGBA(image.Rect(0, 0, c.width, c.height))
+	for f := range c.queue {
+		c.unpack(f.pix, img)
+		dst, err := applyOperation(c.operation, img, c.radius, c.numWorkers)
+		if err != nil {
+			return err
+		}
+		c.pack(dst, f.pix)
+		if err := c.show(f, w); err != nil {
+			return err
+		}
+		c.recycle(f.pix)
+	}
+	return nil
+}
+
+// show writes f unless a newer frame has already been shown.
+func (c *camera) show(f *cameraFrame, w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.seq <= c.lastShown {
+		c.report.Late++
+		return nil
+	}
+	if w != nil {
+		if _, err := w.Write(f.pix); err != nil {
+			return err
+		}
+	}
+	c.lastShown = f.seq
+	c.report.Shown++
+	c.latencies = append(c.latencies, ms(time.Since(f.captured)))
+	return nil
+}
+
+// ffmpegSource starts ffmpeg capturing device as raw frames.
+func ffmpegSource(device string, width, height int, pixFmt string, fps float64) (*exec.Cmd, io.Reader, error) {
+	args := []string{"-loglevel", "error", "-f", "v4l2", "-video_size", fmt.Sprintf("%dx%d", width, height)}
+	if fps > 0 {
+		args = append(args, "-framerate", strconv.FormatFloat(fps, 'f', -1, 64))
+	}
+	args = append(args, "-i", device, "-f", "rawvideo", "-pix_fmt", pixFmt, "-")
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	return cmd, stdout, nil
+}
+
+func cameraCommand(program string, args []string, jsonOutput bool) {
+	fs := flag.NewFlagSet("camera", flag.ExitOnError)
+	size := fs.String("size", "640x480", "frame size WxH")
+	pixFmt := fs.String("pix-fmt", "rgb24", "raw pixel format of both streams: rgb24 or rgba")
+	device := fs.String("device", "", "V4L2 device to capture with ffmpeg, e.g. /dev/video0 (default: raw frames on stdin)")
+	fps := fs.Float64("fps", 0, "frame rate asked of the device, or the pace stdin is read at (0 = as delivered)")
+	outPath := fs.String("out", "", "write the shown frames to this file, - for stdout (e.g. into ffplay)")
+	parallel := fs.Int("parallel", 0, "frames filtered at once (0 = one per CPU)")
+	numWorkers := fs.Int("workers", 0, "goroutines per frame (0 = CPUs divided among the frames)")
+	drop := fs.String("drop", "oldest", "when the queue is full drop the oldest queued frame, the newest, or none (wait)")
+	queueSize := fs.Int("queue", 1, "captured frames waiting for a worker, at most")
+	duration := fs.Duration("duration", 0, "stop after this long (0 = at the end of the stream or on interrupt)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s camera [flags] <operation> [radius]\n", program)
+		fmt.Fprintf(os.Stderr, "  Filters a live source in real time, dropping frames when the workers fall behind:\n")
+		fmt.Fprintf(os.Stderr, "    %s camera --device /dev/video0 --out - blur 5 | ffplay -f rawvideo -pixel_format rgb24 -video_size 640x480 -\n", program)
+		fmt.Fprintf(os.Stderr, "  Reports the capture and output frame rates, drops and latency on exit\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	pixelSize := videoPixelSizes[*pixFmt]
+	if fs.NArg() < 1 || fs.NArg() > 2 || pixelSize == 0 || *queueSize <= 0 || *fps < 0 || !slices.Contains(cameraPolicies, *drop) {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	width, height, err := parseSize(*size)
+	if err != nil {
+		fatalCode(exitUsage, "invalid --size", "err", err)
+	}
+	operation := fs.Arg(0)
+	info, ok := lookupOperation(operation)
+	if !ok {
+		fatal("cannot filter frames", "err", fmt.Errorf("%w: %s", ErrUnknownOperation, operation))
+	}
+	radius := info.defaultArg
+	if fs.NArg() == 2 {
+		if radius, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			fatalCode(exitInvalidRadius, "invalid radius", "err", err)
+		}
+	}
+	if radius, err = checkRadius(operation, radius, image.Rect(0, 0, width, height)); err != nil {
+		fatal("invalid radius", "err", err)
+	}
+
+	v := &videoStream{width: width, height: height, pixelSize: pixelSize, operation: operation, radius: radius}
+	v.parallel, v.numWorkers = batchWorkers(*parallel, *numWorkers, math.MaxInt)
+	report := CameraReport{Operation: operation, Radius: radius, Width: width, Height: height,
+		Parallel: v.parallel, Workers: v.numWorkers, Drop: *drop, Queue: *queueSize}
+	c := &camera{
+		videoStream: v,
+		policy:      *drop,
+		queue:       make(chan *cameraFrame, *queueSize),
+		free:        make(chan []byte, v.parallel+*queueSize+1),
+		lastShown:   -1,
+		report:      &report,
+	}
+
+	var r io.Reader = os.Stdin
+	readRate := *fps
+	if *device != "" {
+		cmd, stdout, err := ffmpegSource(*device, width, height, *pixFmt, *fps)
+		if err != nil {
+			fatal("failed to start ffmpeg", "err", err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+		// The device sets the pace.
+		r, readRate = stdout, 0
+	}
+	var w io.Writer
+	out, reportOut := progressOut(jsonOutput), io.Writer(os.Stdout)
+	switch *outPath {
+	case "":
+	case "-":
+		w, reportOut = os.Stdout, os.Stderr
+		if out == os.Stdout {
+			out = os.Stderr
+		}
+	default:
+		file, err := os.Create(*outPath)
+		if err != nil {
+			fatal("failed to create output", "err", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	trapSignals()
+	startDefaultPool()
+
+	fmt.Fprintf(out, "Filtering %dx%d frames with %s, %d at once with %d workers each, --drop %s\n",
+		width, height, operation, v.parallel, v.numWorkers, *drop)
+	stop := make(chan struct{})
+	if *duration > 0 {
+		timer := time.AfterFunc(*duration, func() { close(stop) })
+		defer timer.Stop()
+	}
+	start := time.Now()
+	errs := make(chan error, v.parallel+1)
+	var wg sync.WaitGroup
+	for range v.parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.filter(w); err != nil {
+				errs <- err
+				// Keep draining so capture never blocks on a dead worker.
+				for f := range c.queue {
+					c.dropped(f)
+				}
+			}
+		}()
+	}
+	if err := c.capture(r, readRate, stop); err != nil {
+		errs <- err
+	}
+	wg.Wait()
+	takePhases()
+	close(errs)
+	elapsed := time.Since(start)
+	// An interrupt is how a live source usually ends; the frames it cut
+	// short are no failure.
+	if err := <-errs; err != nil && !interrupted() {
+		fatal("camera failed", "err", err)
+	}
+
+	report.TotalMs = ms(elapsed)
+	if secs := elapsed.Seconds(); secs > 0 {
+		report.CaptureFPS = float64(report.Captured) / secs
+		report.OutputFPS = float64(report.Shown) / secs
+	}
+	if len(c.latencies) > 0 {
+		report.LatencyMeanMs, _ = meanStddev(c.latencies)
+		report.LatencyMedianMs = median(c.latencies)
+		sorted := slices.Sorted(slices.Values(c.latencies))
+		report.LatencyP95Ms = sorted[min(len(sorted)*95/100, len(sorted)-1)]
+	}
+	if jsonOutput {
+		writeJSON(reportOut, report)
+	} else {
+		fmt.Fprintf(out, "Captured %d frames at %.1f fps, showed %d at %.1f fps (%d dropped behind, %d late)\n",
+			report.Captured, report.CaptureFPS, report.Shown, report.OutputFPS, report.Dropped, report.Late)
+		fmt.Fprintf(out, "Latency: mean %.1fms, median %.1fms, p95 %.1fms\n",
+			report.LatencyMeanMs, report.LatencyMedianMs, report.LatencyP95Ms)
+	}
+	exitIfInterrupted()
+}
@@ -0,0 +1,53 @@
+//go:build cshared
+
+package main
+
+// The C API. Build the shared library and its header, libfilter.h, with
+//
+//	go build -tags cshared -buildmode=c-shared -o libfilter.so .
+//
+// (make go-lib builds it into python/ for gofilter.py) and call the
+// filters on RGBA buffers the caller owns, so the harnesses of the other
+// implementations can time the Go filters without the image codecs or a
+// process per run. The library's main is never run: the flags keep their
+// defaults, and GOMAXPROCS follows the cgroup CPU quota as in the CLI.
+
+/*
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	"image"
+	"unsafe"
+)
+
+func init() {
+	setGOMAXPROCS(0)
+}
+
+// ProcessRGBA filters the width x height image in buffer, 8-bit RGBA rows
+// without padding, in place with operation at radius, split among workers
+// (0 for one per CPU). It returns 0, or the exit status the CLI would
+// have: 2 for bad arguments or an unknown operation, 3 for an invalid
+// radius, 1 for other failures, which are logged on stderr.
+//
+//export ProcessRGBA
+func ProcessRGBA(buffer *C.uint8_t, width, height C.int, operation *C.char, radius, workers C.int) C.int {
+	if buffer == nil || operation == nil || width <= 0 || height <= 0 {
+		return exitUsage
+	}
+	pix := unsafe.Slice((*byte)(unsafe.Pointer(buffer)), int(width)*int(height)*4)
+	src := &image.RGBA{Pix: pix, Stride: int(width) * 4, Rect: image.Rect(0, 0, int(width), int(height))}
+	numWorkers := int(workers)
+	if numWorkers <= 0 {
+		numWorkers = cpuCount()
+	}
+	dst, err := applyOperation(C.GoString(operation), src, int(radius), numWorkers)
+	if err != nil {
+		logger.Error("filter failed", "operation", C.GoString(operation), "err", err)
+		return C.int(exitCode(err))
+	}
+	copy(pix, packedPix(dst))
+	return 0
+}
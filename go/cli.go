@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// operationInfo describes a filter for its subcommand: what it does and
+// which flag, if any, sets the integer parameter passed as its radius.
+type operationInfo struct {
+	name        string
+	description string
+	param       string // flag name for the radius, "" if unused
+	paramHelp   string
+	defaultArg  int
+}
+
+var operations = []operationInfo{
+	{"blur", "Gaussian blur", "radius", "kernel radius (0 with --sigma covers 3 sigma)", 5},
+	{"blur_u8", "experimental fixed-point Gaussian blur on raw bytes", "radius", "kernel radius (0 with --sigma covers 3 sigma)", 5},
+	{"kuwahara", "Kuwahara painterly smoothing", "radius", "window radius", 5},
+	{"kuwahara_adaptive", "Kuwahara with the window shrinking on edges", "radius", "window radius in flat areas", 8},
+	{"saliency", "spectral residual saliency map", "radius", fmt.Sprintf("smoothing radius of the map (0 to %d)", saliencySize/2), 3},
+	{"dog", "difference-of-Gaussians line art", "radius", "centre blur radius", 3},
+	{"xdog", "XDoG line art with soft thresholding", "radius", "centre blur radius", 3},
+	{"histeq", "histogram equalization of the luma", "", "", 0},
+	{"grayscale", "Rec. 601 luma", "", "", 0},
+	{"sepia", "sepia toning", "", "", 0},
+	{"hsl", "hue rotation (see 'adjust' for saturation and lightness)", "hue", "hue rotation in degrees", 0},
+}
+
+func lookupOperation(name string) (operationInfo, bool) {
+	for _, op := range operations {
+		if op.name == name {
+			return op, true
+		}
+	}
+	return operationInfo{}, false
+}
+
+// parseOperationArgs reads a filter invocation,
+//
+//	<operation> [--radius n] [--workers n] <input_image> <output_image>
+//
+// or the original positional form
+//
+//	<operation> <input_image> <output_image> <radius> <workers>
+//
+// and returns the operation, paths, radius and worker count. A worker count
+// of 0 or less means one per CPU. monte_carlo only takes the positional form.
+func parseOperationArgs(program string, args []string) (operation, input, output string, radius, numWorkers int) {
+	operation = args[0]
+	if operation == "monte_carlo" {
+		if len(args) != 5 {
+			printUsage(program)
+			os.Exit(exitUsage)
+		}
+		radius, numWorkers = parsePositional(args[3], args[4])
+		return operation, args[1], args[2], radius, numWorkers
+	}
+	info, ok := lookupOperation(operation)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown operation: %s\n", operation)
+		printUsage(program)
+		os.Exit(exitUsage)
+	}
+
+	fs := flag.NewFlagSet(operation, flag.ExitOnError)
+	if info.param != "" {
+		fs.IntVar(&radius, info.param, info.defaultArg, info.paramHelp)
+	}
+	fs.IntVar(&numWorkers, "workers", 0, "number of workers (0 = one per CPU)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [global flags] %s [flags] <input_image> <output_image>\n", program, operation)
+		fmt.Fprintf(os.Stderr, "       %s [global flags] %s <input_image> <output_image> <radius> <workers>\n", program, operation)
+		fmt.Fprintf(os.Stderr, "  %s\n", info.description)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	switch fs.NArg() {
+	case 2:
+		// A radius derived from --sigma replaces the default one.
+		if blurSigma > 0 && info.param == "radius" && !flagSet(fs, info.param) {
+			radius = 0
+		}
+	case 4:
+		if fs.NFlag() > 0 {
+			fmt.Fprintf(os.Stderr, "Pass radius and workers either as flags or as arguments, not both\n")
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		radius, numWorkers = parsePositional(fs.Arg(2), fs.Arg(3))
+	default:
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if numWorkers <= 0 {
+		numWorkers = cpuCount()
+	}
+	return operation, fs.Arg(0), fs.Arg(1), radius, numWorkers
+}
+
+func parsePositional(radiusArg, workersArg string) (radius, numWorkers int) {
+	radius, err := strconv.Atoi(radiusArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid radius: %v\n", err)
+		os.Exit(exitInvalidRadius)
+	}
+	numWorkers, err = strconv.Atoi(workersArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	if numWorkers <= 0 {
+		numWorkers = cpuCount()
+	}
+	return radius, numWorkers
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// kernelPath is the --kernel file the convolve operation applies.
+var kernelPath string
+
+func init() {
+	RegisterFilter(FilterPlugin{
+		Name:        "convolve",
+		Description: "convolution with the NxN kernel of the --kernel file, alpha kept",
+		New: func(int) (Filter, error) {
+			if kernelPath == "" {
+				return nil, errors.New("convolve needs a kernel: pass --kernel")
+			}
+			k, err := loadKernel(kernelPath)
+			if err != nil {
+				return nil, err
+			}
+			logger.Debug("convolution kernel", "size", k.size, "separable", k.column != nil)
+			return k, nil
+		},
+	})
+}
+
+// convolution is a square kernel of odd size, with its factors when it is
+// separable: weights[i*size+j] = column[i]*row[j] within rounding, so two
+// passes of size taps give the result of one of size² taps.
+type convolution struct {
+	size        int
+	weights     []float64
+	column, row []float64
+	bias        float64
+}
+
+// loadKernel reads a kernel file: either rows of numbers separated by
+// spaces or commas, with # comments, or JSON, an array of rows or
+//
+//	{"kernel": [[...], ...], "divisor": 16, "bias": 128}
+//
+// which divides the weights by divisor and adds bias (0..255) to the
+// result, for kernels such as edge detectors that sum to 0.
+func loadKernel(path string) (*convolution, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]float64
+	divisor, bias := 1.0, 0.0
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		if trimmed[0] == '[' {
+			err = json.Unmarshal(trimmed, &rows)
+		} else {
+			file := struct {
+				Kernel  [][]float64 `json:"kernel"`
+				Divisor *float64    `json:"divisor"`
+				Bias    float64     `json:"bias"`
+			}{}
+			err = json.Unmarshal(trimmed, &file)
+			rows, bias = file.Kernel, file.Bias
+			if file.Divisor != nil {
+				divisor = *file.Divisor
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kernel %s: %w", path, err)
+		}
+	} else {
+		lines := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; lines.Scan(); n++ {
+			line, _, _ := strings.Cut(lines.Text(), "#")
+			fields := strings.FieldsFunc(line, func(c rune) bool { return c == ',' || c == ' ' || c == '\t' })
+			if len(fields) == 0 {
+				continue
+			}
+			row := make([]float64, len(fields))
+			for i, field := range fields {
+				if row[i], err = strconv.ParseFloat(field, 64); err != nil {
+					return nil, fmt.Errorf("kernel %s line %d: invalid weight %q", path, n, field)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	if divisor == 0 {
+		return nil, fmt.Errorf("kernel %s: divisor is 0", path)
+	}
+	size := len(rows)
+	if size%2 == 0 {
+		return nil, fmt.Errorf("kernel %s: %d rows, want an odd number", path, size)
+	}
+	k := &convolution{size: size, bias: bias}
+	for i, row := range rows {
+		if len(row) != size {
+			return nil, fmt.Errorf("kernel %s: row %d has %d weights, want %d", path, i+1, len(row), size)
+		}
+		for _, w := range row {
+			k.weights = append(k.weights, w/divisor)
+		}
+	}
+	k.factor()
+	return k, nil
+}
+
+// factor sets column and row if the kernel has rank 1, taken through its
+// largest weight.
+func (k *convolution) factor() {
+	pivot := 0
+	for i, w := range k.weights {
+		if math.Abs(w) > math.Abs(k.weights[pivot]) {
+			pivot = i
+		}
+	}
+	largest := k.weights[pivot]
+	if largest == 0 || k.size == 1 {
+		return
+	}
+	pi, pj := pivot/k.size, pivot%k.size
+	column, row := make([]float64, k.size), make([]float64, k.size)
+	for i := range k.size {
+		column[i] = k.weights[i*k.size+pj]
+		row[i] = k.weights[pi*k.size+i] / largest
+	}
+	for i := range k.size {
+		for j := range k.size {
+			if math.Abs(column[i]*row[j]-k.weights[i*k.size+j]) > 1e-9*math.Abs(largest) {
+				return
+			}
+		}
+	}
+	k.column, k.row = column, row
+}
+
+func (k *convolution) Halo() int { return k.size / 2 }
+
+// Apply convolves the premultiplied colour with edge pixels repeated past
+// the image border, as blur does, and keeps the alpha of the input.
+func (k *convolution) Apply(dst *image.RGBA, tile image.Rectangle, halo *image.RGBA) error {
+	r := k.size / 2
+	hb := halo.Bounds()
+	at := func(x, y int) []uint8 {
+		return halo.Pix[halo.PixOffset(min(max(x, hb.Min.X), hb.Max.X-1), min(max(y, hb.Min.Y), hb.Max.Y-1)):]
+	}
+	store := func(x, y int, sum *[3]float64) {
+		d := dst.Pix[dst.PixOffset(x, y):]
+		a := at(x, y)[3]
+		for c := range 3 {
+			d[c] = uint8(min(max(math.Round(sum[c]+k.bias), 0), float64(a)))
+		}
+		d[3] = a
+	}
+	if k.column == nil {
+		for y := tile.Min.Y; y < tile.Max.Y; y++ {
+			for x := tile.Min.X; x < tile.Max.X; x++ {
+				var sum [3]float64
+				for i := range k.size {
+					for j := range k.size {
+						w, p := k.weights[i*k.size+j], at(x+j-r, y+i-r)
+						sum[0] += w * float64(p[0])
+						sum[1] += w * float64(p[1])
+						sum[2] += w * float64(p[2])
+					}
+				}
+				store(x, y, &sum)
+			}
+		}
+		return nil
+	}
+
+	// Separable: the row pass over every halo row the tile reads, kept in
+	// floats, then the column pass.
+	width := tile.Dx()
+	rows := make([][3]float64, width*hb.Dy())
+	for y := hb.Min.Y; y < hb.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			sum := &rows[(y-hb.Min.Y)*width+x-tile.Min.X]
+			for j, w := range k.row {
+				p := at(x+j-r, y)
+				sum[0] += w * float64(p[0])
+				sum[1] += w * float64(p[1])
+				sum[2] += w * float64(p[2])
+			}
+		}
+	}
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			var sum [3]float64
+			for i, w := range k.column {
+				sy := min(max(y+i-r, hb.Min.Y), hb.Max.Y-1)
+				p := &rows[(sy-hb.Min.Y)*width+x-tile.Min.X]
+				sum[0] += w * p[0]
+				sum[1] += w * p[1]
+				sum[2] += w * p[2]
+			}
+			store(x, y, &sum)
+		}
+	}
+	return nil
+}
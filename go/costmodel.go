@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// costModel predicts how long decoding, filtering and encoding an image
+// take from its pixel count, with constants measured on this machine: the
+// nanoseconds per pixel of each filter and radius on one worker, and of
+// each codec. A missing constant is measured on first use, on a synthetic
+// sample, and kept in the user cache directory, so only the first plan
+// needing it pays for the measurement. The calibrate command measures
+// them all at once, along with the costs of the machinery: starting a
+// worker and handing out a chunk of rows.
+type costModel struct {
+	CPUs       int                `json:"cpus"`
+	Calibrated string             `json:"calibrated,omitempty"`   // when calibrate last ran
+	Filters    map[string]float64 `json:"filter_ns_per_pixel"`    // by operation:radius, on one worker
+	Decode     map[string]float64 `json:"decode_ns_per_pixel"`    // by input format
+	Encode     map[string]float64 `json:"encode_ns_per_pixel"`    // by output format, PNG by level
+	ConvTapNs  float64            `json:"conv_tap_ns,omitempty"`  // blur per pixel and kernel tap, on one worker
+	ConvBaseNs float64            `json:"conv_base_ns,omitempty"` // blur per pixel on top of the taps
+	FFTBlurNs  float64            `json:"fft_blur_ns,omitempty"`  // blur through FFTs per pixel, at any radius
+	SATNs      float64            `json:"sat_ns_per_pixel,omitempty"`
+	SpawnNs    float64            `json:"spawn_ns,omitempty"` // starting and joining a filter worker
+	ChunkNs    float64            `json:"chunk_ns,omitempty"` // handing a worker a chunk of rows
+
+	path    string
+	changed bool
+}
+
+// calibrationSide is the edge of the sample the constants are measured on:
+// large enough that per-call overheads vanish, small enough to take
+// milliseconds.
+const calibrationSide = 256
+
+func calibrationPath() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "filter", "calibration.json")
+}
+
+// loadCostModel reads the stored constants. Those measured with another
+// CPU count are dropped, as the codecs run in parallel.
+func loadCostModel() *costModel {
+	m := &costModel{path: calibrationPath()}
+	if data, err := os.ReadFile(m.path); err == nil {
+		if json.Unmarshal(data, m) != nil || m.CPUs != cpuCount() {
+			*m = costModel{path: m.path}
+		}
+	}
+	m.CPUs = cpuCount()
+	if m.Filters == nil {
+		m.Filters = map[string]float64{}
+	}
+	if m.Decode == nil {
+		m.Decode = map[string]float64{}
+	}
+	if m.Encode == nil {
+		m.Encode = map[string]float64{}
+	}
+	return m
+}
+
+// save stores the constants if any were measured.
+func (m *costModel) save() error {
+	if !m.changed {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	})
+}
+
+// filterNs is the time per pixel of operation at radius on one worker.
+// Blur radii calibrate didn't measure follow from its fit per kernel tap,
+// and those blur takes the FFT path for from its FFT measurement.
+func (m *costModel) filterNs(operation string, radius int) (float64, error) {
+	if operation == "blur" && m.FFTBlurNs > 0 && blurPath(radius) == "fft" {
+		return m.FFTBlurNs, nil
+	}
+	key := fmt.Sprintf("%s:%d", operation, radius)
+	if ns, ok := m.Filters[key]; ok {
+		return ns, nil
+	}
+	if operation == "blur" && m.ConvTapNs > 0 {
+		return m.ConvBaseNs + m.ConvTapNs*float64(2*radius+1), nil
+	}
+	// Radii the sample is too small for are measured on a larger one.
+	side := min(max(calibrationSide, 4*radius), 1024)
+	logger.Info("measuring the filter cost", "operation", operation, "radius", radius, "sample", side)
+	ns, err := measureFilter(operation, radius, side)
+	if err != nil {
+		return 0, err
+	}
+	m.Filters[key] = ns
+	m.changed = true
+	return ns, nil
+}
+
+// fftCrossover is the smallest blur radius at which the FFT path is the
+// faster, fftMinRadius without a profile. calibrate reports it; auto
+// switches at fftMinRadius whatever it is.
+func (m *costModel) fftCrossover() int {
+	if m.FFTBlurNs == 0 || m.ConvTapNs <= 0 {
+		return fftMinRadius
+	}
+	taps := (m.FFTBlurNs - m.ConvBaseNs) / m.ConvTapNs
+	return max(int(math.Ceil((taps-1)/2)), 1)
+}
+
+// cheapestFilterNs is the lowest time per pixel stored for operation at
+// any radius, 0 if none is.
+func (m *costModel) cheapestFilterNs(operation string) float64 {
+	cheapest := 0.0
+	for key, ns := range m.Filters {
+		if op, _, _ := strings.Cut(key, ":"); op == operation && (cheapest == 0 || ns < cheapest) {
+			cheapest = ns
+		}
+	}
+	return cheapest
+}
+
+// pixelsPerWorker is the work a worker of operation needs for starting it
+// to cost under 1% of it: the calibrated counterpart of the
+// minPixelsPerWorker constant, which it falls back to without a profile.
+func (m *costModel) pixelsPerWorker(operation string) int {
+	ns := m.cheapestFilterNs(operation)
+	if m.SpawnNs == 0 || ns == 0 {
+		return minPixelsPerWorker
+	}
+	return max(int(100*m.SpawnNs/ns), 1024)
+}
+
+// chunkTarget is the time adaptive chunks aim at: a thousand times the
+// cost of handing one out, keeping that under 0.1%, but no less than 50µs
+// and no more than the default adaptiveChunkTarget, which applies without
+// a profile.
+func (m *costModel) chunkTarget() time.Duration {
+	if m.ChunkNs == 0 {
+		return adaptiveChunkTarget
+	}
+	return min(max(time.Duration(1000*m.ChunkNs), 50*time.Microsecond), adaptiveChunkTarget)
+}
+
+func measureFilter(operation string, radius, side int) (float64, error) {
+	sample := calibrationSample(side)
+	var err error
+	ns := fastest(3, func() {
+		if _, runErr := applyOperation(operation, sample, radius, 1); runErr != nil {
+			err = runErr
+		}
+	})
+	return ns / float64(side*side), err
+}
+
+// decodeNs is the time per pixel of decoding format, 0 for formats it
+// can't produce a sample of.
+func (m *costModel) decodeNs(format string) float64 {
+	if ns, ok := m.Decode[format]; ok {
+		return ns
+	}
+	ns, ok := measureDecode(format, calibrationSide)
+	if !ok {
+		return 0
+	}
+	m.Decode[format] = ns
+	m.changed = true
+	return ns
+}
+
+func measureDecode(format string, side int) (float64, bool) {
+	sample := calibrationSample(side)
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png", "qoi", "raw":
+		err = encodeImage(&buf, "sample."+format, sample, nil)
+	case "jpeg":
+		err = jpeg.Encode(&buf, sample, nil)
+	default:
+		return 0, false
+	}
+	if err != nil {
+		return 0, false
+	}
+	data := buf.Bytes()
+	ns := fastest(3, func() {
+		if format == "raw" {
+			decodeRawRGBA(bytes.Clone(data))
+			return
+		}
+		image.Decode(bytes.NewReader(data))
+	})
+	return ns / float64(side*side), true
+}
+
+// encodeKey names the encoder saveImage uses for path: its format and, for
+// PNG, the --compression level.
+func encodeKey(path string) string {
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".qoi" || isRawRGBA(path) {
+		return strings.TrimPrefix(ext, ".")
+	}
+	return fmt.Sprintf("png-%d", pngCompression)
+}
+
+// encodeNs is the time per pixel of encoding the format saveImage writes
+// for path.
+func (m *costModel) encodeNs(path string) float64 {
+	key := encodeKey(path)
+	if ns, ok := m.Encode[key]; ok {
+		return ns
+	}
+	m.Encode[key] = measureEncode(path, calibrationSide)
+	m.changed = true
+	return m.Encode[key]
+}
+
+func measureEncode(path string, side int) float64 {
+	sample := calibrationSample(side)
+	return fastest(3, func() { encodeImage(io.Discard, path, sample, nil) }) / float64(side*side)
+}
+
+// calibrationSample is a side x side image compressing like a photograph
+// would: smooth gradients with a little noise.
+func calibrationSample(side int) *image.RGBA {
+	return syntheticImage{"calibration", side, side, func(x, y int, seed *uint32) color.RGBA {
+		noise := int(lcgRandom(seed) * 16)
+		return color.RGBA{uint8(x*239/side + noise), uint8(y*239/side + noise), uint8((x+y)*119/side + noise), 255}
+	}}.generate()
+}
+
+// fastest runs job n times and returns its fastest time in nanoseconds,
+// the one least disturbed by the rest of the machine.
+func fastest(n int, job func()) float64 {
+	best := time.Duration(1<<63 - 1)
+	for range n {
+		start := time.Now()
+		job()
+		best = min(best, time.Since(start))
+	}
+	return float64(best)
+}
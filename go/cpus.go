@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cpuCount is the number of CPUs the default worker counts divide among:
+// GOMAXPROCS, which setGOMAXPROCS lowers to the container's CPU quota.
+// Sizing by runtime.NumCPU instead would start a goroutine per host CPU
+// in a container allowed two, oversubscribing the quota and throttling
+// the whole process.
+func cpuCount() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// setGOMAXPROCS applies --gomaxprocs n, or without it (n <= 0) and without
+// the GOMAXPROCS environment variable, the cgroup CPU quota when it is
+// below the CPU count. It returns the value in effect.
+func setGOMAXPROCS(n int) int {
+	if n > 0 {
+		runtime.GOMAXPROCS(n)
+		return n
+	}
+	if os.Getenv("GOMAXPROCS") != "" {
+		return runtime.GOMAXPROCS(0)
+	}
+	if quota := cgroupCPUQuota(); quota > 0 {
+		if limit := max(int(math.Ceil(quota)), 1); limit < runtime.GOMAXPROCS(0) {
+			logger.Debug("limiting GOMAXPROCS to the CPU quota", "quota", quota, "gomaxprocs", limit)
+			runtime.GOMAXPROCS(limit)
+		}
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// cgroupCPUQuota reads the CPU quota of the process's cgroup in CPUs, from
+// cgroup v2 cpu.max or v1 cpu.cfs_quota_us, or 0 when there is none.
+func cgroupCPUQuota() float64 {
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		// "max 100000" or "200000 100000"
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			return quotaRatio(fields[0], fields[1])
+		}
+		return 0
+	}
+	quota, err1 := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	period, err2 := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return quotaRatio(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func quotaRatio(quota, period string) float64 {
+	q, err1 := strconv.ParseFloat(quota, 64)
+	p, err2 := strconv.ParseFloat(period, 64)
+	if err1 != nil || err2 != nil || q <= 0 || p <= 0 {
+		return 0
+	}
+	return q / p
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// customProgram is the --expr program the custom operation runs.
+var customProgram string
+
+func init() {
+	RegisterFilter(FilterPlugin{
+		Name:        "custom",
+		Description: "per-pixel program given with --expr, such as 'r = clamp(r*1.2); g = gray()'",
+		New: func(int) (Filter, error) {
+			if customProgram == "" {
+				return nil, errors.New("custom needs a program: pass --expr")
+			}
+			return compilePixelProgram(customProgram)
+		},
+	})
+}
+
+// The variables of a pixel program, in the order of their values. Names
+// the program assigns besides these get the following slots.
+var pixelVariables = []string{"r", "g", "b", "a", "x", "y", "w", "h"}
+
+// pixelCalls are the functions pixel programs have besides exprFunctions.
+var pixelCalls = map[string]exprCall{
+	"clamp": func(args []exprFunc) (exprFunc, error) {
+		switch len(args) {
+		case 1:
+			v := args[0]
+			return func(vars []float64) float64 { return clamp01(v(vars)) }, nil
+		case 3:
+			v, lo, hi := args[0], args[1], args[2]
+			return func(vars []float64) float64 { return math.Min(math.Max(v(vars), lo(vars)), hi(vars)) }, nil
+		}
+		return nil, errors.New("takes a value, and optionally the bounds (default 0 and 1)")
+	},
+	"min": func(args []exprFunc) (exprFunc, error) { return pixelFold(args, math.Min) },
+	"max": func(args []exprFunc) (exprFunc, error) { return pixelFold(args, math.Max) },
+	"mix": func(args []exprFunc) (exprFunc, error) {
+		if len(args) != 3 {
+			return nil, errors.New("takes two values and the weight of the second")
+		}
+		from, to, t := args[0], args[1], args[2]
+		return func(vars []float64) float64 {
+			f := from(vars)
+			return f + (to(vars)-f)*t(vars)
+		}, nil
+	},
+	"step": func(args []exprFunc) (exprFunc, error) {
+		if len(args) != 2 {
+			return nil, errors.New("takes an edge and a value")
+		}
+		edge, v := args[0], args[1]
+		return func(vars []float64) float64 {
+			if v(vars) < edge(vars) {
+				return 0
+			}
+			return 1
+		}, nil
+	},
+	"gray": func(args []exprFunc) (exprFunc, error) {
+		if len(args) != 0 {
+			return nil, errors.New("takes no arguments")
+		}
+		return func(vars []float64) float64 { return 0.299*vars[0] + 0.587*vars[1] + 0.114*vars[2] }, nil
+	},
+}
+
+// pixelFold applies fn across one or more arguments.
+func pixelFold(args []exprFunc, fn func(a, b float64) float64) (exprFunc, error) {
+	if len(args) == 0 {
+		return nil, errors.New("takes at least one value")
+	}
+	return func(vars []float64) float64 {
+		v := args[0](vars)
+		for _, arg := range args[1:] {
+			v = fn(v, arg(vars))
+		}
+		return v
+	}, nil
+}
+
+// pixelProgram is a compiled --expr program: assignments separated by ';'
+// or newlines, run in order on every pixel. r, g, b and a start as the
+// pixel's channels in 0..1, not premultiplied, and what they hold at the
+// end is the output, clamped to 0..1; x and y are the pixel's position and
+// w and h the image size. Other names hold intermediate values, and must be
+// assigned before they're read. gray() is the Rec. 601 luma of the current
+// r, g and b.
+type pixelProgram struct {
+	slots int
+	steps []pixelStep
+}
+
+type pixelStep struct {
+	slot  int
+	value exprFunc
+}
+
+func compilePixelProgram(src string) (*pixelProgram, error) {
+	slots := map[string]int{}
+	for i, name := range pixelVariables {
+		slots[name] = i
+	}
+	variable := func(name string) (int, error) {
+		if slot, ok := slots[name]; ok {
+			return slot, nil
+		}
+		return 0, fmt.Errorf("unknown identifier %q", name)
+	}
+	prog := &pixelProgram{}
+	for stmt := range strings.FieldsFuncSeq(src, func(c rune) bool { return c == ';' || c == '\n' }) {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		name, expr, ok := strings.Cut(stmt, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !isIdentifier(name) {
+			return nil, fmt.Errorf("invalid statement %q: want name = expression", strings.TrimSpace(stmt))
+		}
+		_, isFunction := exprFunctions[name]
+		_, isCall := pixelCalls[name]
+		_, isConstant := exprConstants[name]
+		if slot, ok := slots[name]; ok && slot >= 4 && slot < len(pixelVariables) || isFunction || isCall || isConstant {
+			return nil, fmt.Errorf("invalid statement %q: %s can't be assigned", strings.TrimSpace(stmt), name)
+		}
+		p := &exprParser{src: strings.TrimSpace(expr), variable: variable, calls: pixelCalls}
+		value, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		slot, ok := slots[name]
+		if !ok {
+			slot = len(slots)
+			slots[name] = slot
+		}
+		prog.steps = append(prog.steps, pixelStep{slot, value})
+	}
+	if len(prog.steps) == 0 {
+		return nil, fmt.Errorf("invalid program %q: no assignments", src)
+	}
+	prog.slots = len(slots)
+	return prog, nil
+}
+
+func isIdentifier(s string) bool {
+	for i, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// clamp01 clamps v to 0..1, taking NaN to 0.
+func clamp01(v float64) float64 {
+	if !(v > 0) {
+		return 0
+	}
+	return math.Min(v, 1)
+}
+
+func (prog *pixelProgram) Halo() int { return 0 }
+
+func (prog *pixelProgram) Apply(dst *image.RGBA, tile image.Rectangle, halo *image.RGBA) error {
+	vars := make([]float64, prog.slots)
+	vars[6], vars[7] = float64(dst.Rect.Dx()), float64(dst.Rect.Dy())
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		vars[5] = float64(y)
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			s := halo.Pix[halo.PixOffset(x, y):]
+			alpha := float64(s[3])
+			for c := range 3 {
+				vars[c] = 0
+				if alpha > 0 {
+					vars[c] = float64(s[c]) / alpha
+				}
+			}
+			vars[3], vars[4] = alpha/255, float64(x)
+			for _, step := range prog.steps {
+				vars[step.slot] = step.value(vars)
+			}
+			a := clamp01(vars[3])
+			d := dst.Pix[dst.PixOffset(x, y):]
+			for c := range 3 {
+				d[c] = uint8(clamp01(vars[c])*a*255 + 0.5)
+			}
+			d[3] = uint8(a*255 + 0.5)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// DiffStats summarizes a difference heatmap. A pixel's difference is the
+// largest of its four channel differences.
+type DiffStats struct {
+	MaxDiff         int     `json:"max_diff"`
+	MeanDiff        float64 `json:"mean_diff"`
+	DifferingPixels int     `json:"differing_pixels"`
+}
+
+// renderDiffHeatmap draws how much each pixel of b differs from a: black
+// where they agree, otherwise the heat ramp scaled to the largest
+// difference. The ramp follows the square root of the difference so that
+// off-by-one pixels, the usual trace of a partitioning bug, stand out
+// rather than vanish next to large ones. Rows are split among workers.
+func renderDiffHeatmap(a, b *image.RGBA, numWorkers int) (*image.RGBA, DiffStats, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return nil, DiffStats{}, fmt.Errorf("image sizes differ: %v and %v", a.Bounds().Size(), b.Bounds().Size())
+	}
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	diffs := make([]uint8, width*height)
+	var stats DiffStats
+	var total int
+	var mu sync.Mutex
+	parallelRows(height, numWorkers, func(from, to int) {
+		var maxDiff, sum, differing int
+		for y := from; y < to; y++ {
+			rowA := a.Pix[a.PixOffset(a.Bounds().Min.X, a.Bounds().Min.Y+y):]
+			rowB := b.Pix[b.PixOffset(b.Bounds().Min.X, b.Bounds().Min.Y+y):]
+			for x := range width {
+				d := 0
+				for c := range 4 {
+					d = max(d, abs(int(rowA[x*4+c])-int(rowB[x*4+c])))
+				}
+				diffs[y*width+x] = uint8(d)
+				maxDiff = max(maxDiff, d)
+				sum += d
+				if d > 0 {
+					differing++
+				}
+			}
+		}
+		mu.Lock()
+		stats.MaxDiff = max(stats.MaxDiff, maxDiff)
+		total += sum
+		stats.DifferingPixels += differing
+		mu.Unlock()
+	})
+	stats.MeanDiff = float64(total) / float64(width*height)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	parallelRows(height, numWorkers, func(from, to int) {
+		for y := from; y < to; y++ {
+			row := dst.Pix[y*dst.Stride:]
+			for x, d := range diffs[y*width : (y+1)*width] {
+				p := row[x*4 : x*4+4]
+				if d == 0 {
+					p[0], p[1], p[2], p[3] = 0, 0, 0, 255
+					continue
+				}
+				c := heatColor(math.Sqrt(float64(d) / float64(stats.MaxDiff)))
+				p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
+			}
+		}
+	})
+	return dst, stats, nil
+}
+
+func diffCommand(program string, args []string, jsonOutput bool) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff <image_a> <image_b> <heatmap_out> [workers]\n", program)
+		fmt.Fprintf(os.Stderr, "  Writes a heatmap of the per-pixel difference between two images of the same size,\n")
+		fmt.Fprintf(os.Stderr, "  such as the outputs of two runs\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 3 || fs.NArg() > 4 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	numWorkers := cpuCount()
+	if fs.NArg() == 4 {
+		var err error
+		if numWorkers, err = strconv.Atoi(fs.Arg(3)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+	}
+
+	var imgs [2]*image.RGBA
+	for i := range imgs {
+		img, err := loadImage(fs.Arg(i))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		imgs[i] = toRGBA(img)
+	}
+	heatmap, stats, err := renderDiffHeatmap(imgs[0], imgs[1], numWorkers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if err := saveImage(fs.Arg(2), heatmap); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if jsonOutput {
+		writeJSON(os.Stdout, stats)
+		return
+	}
+	printDiffStatsTo(os.Stdout, stats, imgs[0].Bounds().Dx()*imgs[0].Bounds().Dy())
+}
+
+func printDiffStatsTo(w io.Writer, stats DiffStats, pixels int) {
+	fmt.Fprintf(w, "Diff: %d of %d pixels differ (%.3f%%), max difference %d, mean %.4f\n",
+		stats.DifferingPixels, pixels, 100*float64(stats.DifferingPixels)/float64(pixels), stats.MaxDiff, stats.MeanDiff)
+}
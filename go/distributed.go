@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Distributed mode spreads one image over machines: 'worker' serves a
+// shard RPC over TCP with net/rpc, and 'coordinate' cuts the image into
+// bands of rows, sends each to a free worker with a halo of radius rows and
+// stitches the results. Shards that fail or time out go back in the queue
+// for any worker, up to --retries times each; a worker that can't be
+// reached hands its shard back without using one up. Operations that
+// aren't local need the whole image, so they make a single shard.
+
+// ShardArgs is a band of rows to filter: the rows Top to Bottom of Pix,
+// packed RGBA of Width x Height, the others being halo.
+type ShardArgs struct {
+	Operation     string
+	Radius        int
+	Width, Height int
+	Pix           []byte
+	Top, Bottom   int
+}
+
+// ShardReply holds the filtered rows Top to Bottom, packed.
+type ShardReply struct {
+	Pix      []byte
+	FilterMs float64
+}
+
+// ShardService is the RPC service of 'worker'.
+type ShardService struct {
+	numWorkers int
+}
+
+// Filter runs a shard. The coordinator has already clamped the radius
+// against the whole image. A panic in the filter fails the shard rather
+// than the worker process, which net/rpc would otherwise let it take down.
+func (s *ShardService) Filter(args ShardArgs, reply *ShardReply) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("shard filter panicked", "operation", args.Operation, "panic", r)
+			if p, ok := r.(*workerPanic); ok {
+				r = p.value
+			}
+			err = fmt.Errorf("%s panicked: %v", args.Operation, r)
+		}
+	}()
+	if len(args.Pix) != args.Width*args.Height*4 || args.Top < 0 || args.Bottom > args.Height || args.Top >= args.Bottom {
+		return fmt.Errorf("malformed shard: %dx%d with %d bytes, rows %d to %d", args.Width, args.Height, len(args.Pix), args.Top, args.Bottom)
+	}
+	src := &image.RGBA{Pix: args.Pix, Stride: args.Width * 4, Rect: image.Rect(0, 0, args.Width, args.Height)}
+	start := time.Now()
+	dst, err := runFilter(args.Operation, src, args.Radius, s.numWorkers, nil)
+	if err != nil {
+		return err
+	}
+	reply.FilterMs = ms(time.Since(start))
+	reply.Pix = dst.Pix[args.Top*dst.Stride : args.Bottom*dst.Stride]
+	takePhases()
+	logger.Debug("filtered shard", "operation", args.Operation, "rows", args.Bottom-args.Top, "ms", reply.FilterMs)
+	return nil
+}
+
+func workerCommand(program string, args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	listen := fs.String("listen", ":7070", "TCP address to serve shards on")
+	numWorkers := fs.Int("workers", 0, "goroutines per shard (0 = one per CPU)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s worker [flags]\n", program)
+		fmt.Fprintf(os.Stderr, "  Serves shards of images to 'coordinate' over TCP until killed\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *numWorkers <= 0 {
+		*numWorkers = cpuCount()
+	}
+
+	server := rpc.NewServer()
+	if err := server.Register(&ShardService{numWorkers: *numWorkers}); err != nil {
+		fatal("failed to register the shard service", "err", err)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal("failed to listen", "err", err)
+	}
+	logger.Info("serving shards", "addr", listener.Addr().String(), "workers", *numWorkers)
+	server.Accept(listener)
+}
+
+// WorkerStats is one remote worker's share of a distributed run.
+type WorkerStats struct {
+	Addr     string  `json:"addr"`
+	Shards   int     `json:"shards"`
+	Failures int     `json:"failures"`
+	FilterMs float64 `json:"filter_ms"` // as measured by the worker
+}
+
+// DistributedReport summarizes 'coordinate'.
+type DistributedReport struct {
+	Operation string        `json:"operation"`
+	Radius    int           `json:"radius"`
+	Width     int           `json:"width"`
+	Height    int           `json:"height"`
+	Shards    int           `json:"shards"`
+	Retried   int           `json:"retried"`
+	Workers   []WorkerStats `json:"workers"`
+	TotalMs   float64       `json:"total_ms"`
+}
+
+// shard is the rows top to bottom of the image, and how often they failed.
+type shard struct {
+	top, bottom int
+	attempts    int
+}
+
+type shardResult struct {
+	shard  shard
+	worker int
+	reply  ShardReply
+	err    error
+	gone   bool // the worker couldn't be reached and stopped
+}
+
+type coordinator struct {
+	addrs     []string
+	operation string
+	radius    int
+	src       *image.RGBA
+	timeout   time.Duration
+}
+
+func dialWorker(addr string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// shardArgs cuts the band of s with its halo out of the source image.
+func (c *coordinator) shardArgs(s shard) ShardArgs {
+	bounds := c.src.Bounds()
+	halo := image.Rect(0, s.top, bounds.Dx(), s.bottom)
+	if localOperation(c.operation) {
+		halo = image.Rect(0, max(s.top-c.radius, 0), bounds.Dx(), min(s.bottom+c.radius, bounds.Dy()))
+	}
+	return ShardArgs{
+		Operation: c.operation,
+		Radius:    c.radius,
+		Width:     halo.Dx(),
+		Height:    halo.Dy(),
+		Pix:       packedPix(c.src.SubImage(halo).(*image.RGBA)),
+		Top:       s.top - halo.Min.Y,
+		Bottom:    s.bottom - halo.Min.Y,
+	}
+}
+
+// serve feeds shards from queue to the worker at addrs[i] until the queue
+// closes, redialing after a failed call; it stops when the worker can't
+// be reached, handing back the shard it held.
+func (c *coordinator) serve(i int, queue <-chan shard, results chan<- shardResult) {
+	var client *rpc.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+	for s := range queue {
+		if client == nil {
+			var err error
+			if client, err = dialWorker(c.addrs[i], c.timeout); err != nil {
+				results <- shardResult{shard: s, worker: i, err: err, gone: true}
+				return
+			}
+		}
+		var reply ShardReply
+		call := client.Go("ShardService.Filter", c.shardArgs(s), &reply, make(chan *rpc.Call, 1))
+		var err error
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(c.timeout):
+			err = fmt.Errorf("no reply within %v", c.timeout)
+		}
+		if err != nil {
+			// The connection may be broken or busy with the late reply.
+			client.Close()
+			client = nil
+		}
+		results <- shardResult{shard: s, worker: i, reply: reply, err: err}
+	}
+}
+
+// run filters the image on the workers and returns the stitched result.
+func (c *coordinator) run(shardRows, retries, inFlight int, report *DistributedReport) (*image.RGBA, error) {
+	bounds := c.src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if !localOperation(c.operation) {
+		shardRows = height
+	}
+	var shards []shard
+	for top := 0; top < height; top += shardRows {
+		shards = append(shards, shard{top: top, bottom: min(top+shardRows, height)})
+	}
+	report.Shards = len(shards)
+
+	// Buffered for every shard, so requeueing never blocks.
+	queue := make(chan shard, len(shards))
+	for _, s := range shards {
+		queue <- s
+	}
+	defer close(queue)
+	results := make(chan shardResult)
+	alive := 0
+	for i := range c.addrs {
+		for range inFlight {
+			go c.serve(i, queue, results)
+			alive++
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for remaining := len(shards); remaining > 0; {
+		if alive == 0 {
+			return nil, fmt.Errorf("no worker left with %d of %d shards to go", remaining, len(shards))
+		}
+		r := <-results
+		stats := &report.Workers[r.worker]
+		if r.gone {
+			// The shard never reached a worker, so it keeps its attempts.
+			alive--
+			stats.Failures++
+			logger.Warn("worker unreachable", "worker", stats.Addr, "err", r.err)
+			queue <- r.shard
+			continue
+		}
+		if r.err == nil && len(r.reply.Pix) != (r.shard.bottom-r.shard.top)*width*4 {
+			r.err = fmt.Errorf("reply has %d bytes for %d rows", len(r.reply.Pix), r.shard.bottom-r.shard.top)
+		}
+		if r.err != nil {
+			stats.Failures++
+			logger.Warn("shard failed", "worker", stats.Addr, "rows", fmt.Sprintf("%d-%d", r.shard.top, r.shard.bottom), "err", r.err)
+			r.shard.attempts++
+			if r.shard.attempts > retries {
+				return nil, fmt.Errorf("rows %d to %d failed %d times, last: %w", r.shard.top, r.shard.bottom, r.shard.attempts, r.err)
+			}
+			report.Retried++
+			queue <- r.shard
+			continue
+		}
+		copy(dst.Pix[r.shard.top*dst.Stride:], r.reply.Pix)
+		stats.Shards++
+		stats.FilterMs += r.reply.FilterMs
+		remaining--
+	}
+	return dst, nil
+}
+
+func coordinateCommand(program string, args []string, jsonOutput bool) {
+	fs := flag.NewFlagSet("coordinate", flag.ExitOnError)
+	workerList := fs.String("workers", "", "comma-separated host:port of the workers (required)")
+	shardRows := fs.Int("shard-rows", 256, "rows per shard")
+	retries := fs.Int("retries", 3, "times a failed shard is resent before giving up")
+	inFlight := fs.Int("in-flight", 2, "shards sent to each worker at once")
+	timeout := fs.Duration("timeout", time.Minute, "time allowed to connect to a worker and for each shard")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s coordinate --workers host:port,... [flags] <operation> <input_image> <output_image> [radius]\n", program)
+		fmt.Fprintf(os.Stderr, "  Filters the image on remote '%s worker' processes, shard by shard\n", program)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 3 || fs.NArg() > 4 || *workerList == "" || *shardRows <= 0 || *retries < 0 || *inFlight <= 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	operation, inputPath, outputPath := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	info, ok := lookupOperation(operation)
+	if !ok {
+		fatal("cannot distribute", "err", fmt.Errorf("%w: %s", ErrUnknownOperation, operation))
+	}
+	radius := info.defaultArg
+	if fs.NArg() == 4 {
+		var err error
+		if radius, err = strconv.Atoi(fs.Arg(3)); err != nil {
+			fatalCode(exitInvalidRadius, "invalid radius", "err", err)
+		}
+	}
+
+	out := progressOut(jsonOutput)
+	start := time.Now()
+	srcImg, err := loadImage(inputPath)
+	if err != nil {
+		fatal("failed to load image", "err", err)
+	}
+	src := toRGBA(srcImg)
+	if radius, err = checkRadius(operation, radius, src.Bounds()); err != nil {
+		fatal("invalid radius", "err", err)
+	}
+
+	c := &coordinator{operation: operation, radius: radius, src: src, timeout: *timeout}
+	report := DistributedReport{Operation: operation, Radius: radius, Width: src.Bounds().Dx(), Height: src.Bounds().Dy()}
+	for addr := range strings.SplitSeq(*workerList, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.addrs = append(c.addrs, addr)
+			report.Workers = append(report.Workers, WorkerStats{Addr: addr})
+		}
+	}
+	if len(c.addrs) == 0 {
+		fatalCode(exitUsage, "no workers given", "err", errors.New("--workers is empty"))
+	}
+	fmt.Fprintf(out, "Distributing %s of %dx%d over %d workers, %d rows per shard\n",
+		operation, report.Width, report.Height, len(c.addrs), *shardRows)
+
+	dst, err := c.run(*shardRows, *retries, *inFlight, &report)
+	if err != nil {
+		fatal("distributed run failed", "err", err)
+	}
+	if err := saveImage(outputPath, dst); err != nil {
+		fatal("failed to save image", "err", err)
+	}
+	report.TotalMs = ms(time.Since(start))
+
+	if jsonOutput {
+		writeJSON(os.Stdout, report)
+		return
+	}
+	for _, w := range report.Workers {
+		fmt.Fprintf(out, "  %-21s %4d shards %3d failed %10.1fms filtering\n", w.Addr, w.Shards, w.Failures, w.FilterMs)
+	}
+	fmt.Fprintf(out, "%d shards, %d resent, total %.1fms\n", report.Shards, report.Retried, report.TotalMs)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"net"
+	"net/rpc"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type panicFilter struct{}
+
+func (panicFilter) Halo() int { return 0 }
+
+func (panicFilter) Apply(dst *image.RGBA, tile image.Rectangle, halo *image.RGBA) error {
+	panic("boom")
+}
+
+// registerTestFilter registers p for the rest of the test only, so the
+// golden cases, which run every operation, don't see it.
+func registerTestFilter(t *testing.T, p FilterPlugin) {
+	t.Helper()
+	RegisterFilter(p)
+	t.Cleanup(func() {
+		delete(filterPlugins, p.Name)
+		operations = slices.DeleteFunc(operations, func(op operationInfo) bool { return op.name == p.Name })
+	})
+}
+
+// startWorker serves ShardService on a local port and returns its address.
+func startWorker(t *testing.T) string {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.Register(&ShardService{}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Accept(l)
+	return l.Addr().String()
+}
+
+// deadAddr is a local address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestUnreachableWorkerKeepsRetries(t *testing.T) {
+	src := toRGBA(syntheticImages[0].generate())
+	want, err := runCase("blur", src, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &coordinator{
+		operation: "blur",
+		radius:    2,
+		src:       src,
+		timeout:   5 * time.Second,
+		addrs:     []string{deadAddr(t), startWorker(t)},
+	}
+	report := DistributedReport{Workers: []WorkerStats{{Addr: c.addrs[0]}, {Addr: c.addrs[1]}}}
+	got, err := c.run(4, 0, 2, &report)
+	if err != nil {
+		t.Fatalf("run with --retries 0 and one dead worker: %v", err)
+	}
+	if report.Retried != 0 {
+		t.Errorf("Retried = %d, want 0", report.Retried)
+	}
+	if pixelChecksum(got) != pixelChecksum(want) {
+		t.Error("distributed result differs from the local one")
+	}
+}
+
+func TestShardPanicIsAnError(t *testing.T) {
+	registerTestFilter(t, FilterPlugin{
+		Name:        "test_panic",
+		Description: "panics in Apply",
+		New:         func(int) (Filter, error) { return panicFilter{}, nil },
+	})
+	client, err := dialWorker(startWorker(t), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	args := ShardArgs{Operation: "test_panic", Width: 4, Height: 4, Pix: make([]byte, 64), Top: 0, Bottom: 4}
+	var reply ShardReply
+	err = client.Call("ShardService.Filter", args, &reply)
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("got %v, want the panic as an RPC error", err)
+	}
+	// The worker is still serving.
+	args.Operation = "blur"
+	args.Radius = 1
+	if err := client.Call("ShardService.Filter", args, &reply); err != nil {
+		t.Fatalf("call after the panic: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// dryRun is --dry-run: read the sizes of the inputs and print what the run
+// would do and cost instead of doing it.
+var dryRun bool
+
+// PlannedJob is a job with its predicted cost.
+type PlannedJob struct {
+	Input       string  `json:"input"`
+	Output      string  `json:"output"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Format      string  `json:"format,omitempty"`
+	MemoryBytes int64   `json:"memory_bytes"` // the input plus the buffers of its largest step
+	DecodeMs    float64 `json:"decode_ms"`
+	FilterMs    float64 `json:"filter_ms"`
+	EncodeMs    float64 `json:"encode_ms"`
+	TotalMs     float64 `json:"total_ms"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// Plan is the output of --dry-run.
+type Plan struct {
+	Jobs            []PlannedJob `json:"jobs"`
+	Parallel        int          `json:"parallel"`
+	Workers         int          `json:"workers"`
+	WorkMs          float64      `json:"work_ms"` // the job estimates summed
+	WallMs          float64      `json:"wall_ms"` // with parallel jobs at once
+	PeakMemoryBytes int64        `json:"peak_memory_bytes"`
+	Calibration     string       `json:"calibration"` // where the cost constants are kept
+}
+
+// planJobs predicts jobs run parallel at once with numWorkers each and up
+// to prefetch inputs decoded ahead. Filter times are the one-worker
+// constants divided by the workers that can run at once, so they are a
+// lower bound where a filter scales less than linearly; the elapsed time
+// hands each job to the first free slot in order and ignores the overlap
+// of decoding and encoding with filtering, so it is an upper bound there.
+func planJobs(jobs []Job, parallel, numWorkers, prefetch int) Plan {
+	model := loadCostModel()
+	plan := Plan{Parallel: parallel, Workers: numWorkers, Calibration: model.path}
+	speedup := float64(max(min(numWorkers, cpuCount()), 1))
+	slots := make([]float64, max(parallel, 1))
+	var memories []int64
+	var largestInput int64
+	for _, job := range jobs {
+		p := PlannedJob{Input: job.Input, Output: job.Output}
+		err := func() error {
+			width, height, format, err := imageSize(job.Input)
+			if err != nil {
+				return err
+			}
+			p.Width, p.Height, p.Format = width, height, format
+			pixels := float64(width) * float64(height)
+			var buffers int64
+			for _, step := range job.Steps {
+				ns, err := model.filterNs(step.Operation, step.Radius)
+				if err != nil {
+					return fmt.Errorf("%s: %w", step.Operation, err)
+				}
+				p.FilterMs += pixels * ns / 1e6 / speedup
+				buffers = max(buffers, estimateFilterBytes(step.Operation, width, height))
+			}
+			p.DecodeMs = pixels * model.decodeNs(format) / 1e6
+			p.EncodeMs = pixels * model.encodeNs(job.Output) / 1e6
+			p.TotalMs = p.DecodeMs + p.FilterMs + p.EncodeMs
+			input := 4 * int64(width) * int64(height)
+			p.MemoryBytes = input + buffers
+			largestInput = max(largestInput, input)
+			return nil
+		}()
+		if err != nil {
+			p.Error = err.Error()
+		}
+		plan.Jobs = append(plan.Jobs, p)
+		plan.WorkMs += p.TotalMs
+		slot := slices.Index(slots, slices.Min(slots))
+		slots[slot] += p.TotalMs
+		memories = append(memories, p.MemoryBytes)
+	}
+	if err := model.save(); err != nil {
+		logger.Warn("failed to store the cost constants", "path", model.path, "err", err)
+	}
+	plan.WallMs = slices.Max(slots)
+	// At worst the largest jobs run together while the next inputs decode.
+	slices.Sort(memories)
+	slices.Reverse(memories)
+	for _, m := range memories[:min(parallel, len(memories))] {
+		plan.PeakMemoryBytes += m
+	}
+	plan.PeakMemoryBytes += int64(prefetch) * largestInput
+	return plan
+}
+
+// reportPlan prints plan, or writes it as JSON, and exits with 1 if a job
+// can't run.
+func reportPlan(plan Plan, jsonOutput bool) {
+	failed := 0
+	for _, p := range plan.Jobs {
+		if p.Error != "" {
+			failed++
+		}
+	}
+	if jsonOutput {
+		writeJSON(os.Stdout, plan)
+	} else {
+		printPlan(os.Stdout, plan)
+	}
+	if failed > 0 {
+		os.Exit(exitFailure)
+	}
+}
+
+func printPlan(out io.Writer, plan Plan) {
+	fmt.Fprintf(out, "Plan: %d jobs, %d at once with %d workers each\n", len(plan.Jobs), plan.Parallel, plan.Workers)
+	for _, p := range plan.Jobs {
+		if p.Error != "" {
+			fmt.Fprintf(out, "  %s -> %s: %s\n", p.Input, p.Output, p.Error)
+			continue
+		}
+		fmt.Fprintf(out, "  %s -> %s: %dx%d %s, %.1f MiB, ~%.0fms (decode %.0f, filter %.0f, encode %.0f)\n",
+			p.Input, p.Output, p.Width, p.Height, p.Format, mib(p.MemoryBytes), p.TotalMs, p.DecodeMs, p.FilterMs, p.EncodeMs)
+	}
+	fmt.Fprintf(out, "Estimate: ~%.0fms of work, ~%.0fms elapsed, ~%.1f MiB at the peak\n",
+		plan.WorkMs, plan.WallMs, mib(plan.PeakMemoryBytes))
+	fmt.Fprintf(out, "Cost constants from %s\n", plan.Calibration)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// Errors that scripts wrapping the CLI may want to tell apart. Functions
+// wrap them with the details, so test with errors.Is.
+var (
+	ErrUnknownOperation  = errors.New("unknown operation")
+	ErrInvalidRadius     = errors.New("invalid radius")
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrDecode            = errors.New("cannot decode image")
+	ErrVerifyMismatch    = errors.New("output differs from the single-threaded reference")
+	ErrMemoryBudget      = errors.New("over the --max-memory budget")
+)
+
+// Exit statuses. 1 covers everything not listed, such as a failed batch
+// job; 2 is also what the flag package uses for unknown flags, and
+// exitInterrupted follows a signal.
+const (
+	exitFailure           = 1
+	exitUsage             = 2 // bad arguments or unknown operation
+	exitInvalidRadius     = 3
+	exitUnsupportedFormat = 4 // the input isn't PNG, JPEG, QOI or raw RGBA
+	exitDecode            = 5 // the input is corrupt or truncated
+	exitIO                = 6 // a file couldn't be opened, read or written
+	exitVerifyMismatch    = 7
+	exitMemoryBudget      = 8
+)
+
+// exitCode maps err to the exit status documented in the usage.
+func exitCode(err error) int {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.Is(err, ErrUnknownOperation):
+		return exitUsage
+	case errors.Is(err, ErrInvalidRadius):
+		return exitInvalidRadius
+	case errors.Is(err, ErrUnsupportedFormat):
+		return exitUnsupportedFormat
+	case errors.Is(err, ErrDecode):
+		return exitDecode
+	case errors.Is(err, ErrVerifyMismatch):
+		return exitVerifyMismatch
+	case errors.Is(err, ErrMemoryBudget):
+		return exitMemoryBudget
+	case errors.Is(err, fs.ErrExist), errors.As(err, &pathErr), errors.As(err, &linkErr):
+		return exitIO
+	}
+	return exitFailure
+}
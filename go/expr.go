@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprFunc evaluates a compiled expression for one set of variable values.
+type exprFunc func(vars []float64) float64
+
+var exprFunctions = map[string]func(float64) float64{
+	"sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+	"exp": math.Exp, "log": math.Log, "sqrt": math.Sqrt, "abs": math.Abs,
+}
+
+var exprConstants = map[string]float64{"pi": math.Pi, "e": math.E}
+
+// compileExpr parses an arithmetic expression over the variables x1..xN
+// (x, y and z are aliases for x1, x2 and x3). It supports + - * / ^, unary
+// minus, parentheses, the constants pi and e, and the functions in
+// exprFunctions. The result is a closure tree, so evaluation does no parsing.
+// dims is the number of variables the expression refers to.
+func compileExpr(src string) (fn exprFunc, dims int, err error) {
+	p := &exprParser{src: src, variable: exprVariable}
+	if fn, err = p.parse(); err != nil {
+		return nil, 0, err
+	}
+	return fn, p.dims, nil
+}
+
+// exprCall builds a call of a function taking any number of arguments from
+// its compiled arguments, or says why the arguments don't fit.
+type exprCall func(args []exprFunc) (exprFunc, error)
+
+type exprParser struct {
+	src  string
+	pos  int
+	tok  string
+	dims int
+	// variable maps an identifier to its index in the values passed to the
+	// compiled expression; calls adds functions to exprFunctions.
+	variable func(name string) (int, error)
+	calls    map[string]exprCall
+}
+
+// parse compiles the whole of p.src.
+func (p *exprParser) parse() (exprFunc, error) {
+	p.next()
+	fn, err := p.parseSum()
+	if err == nil && p.tok != "" {
+		err = fmt.Errorf("unexpected %q at offset %d", p.tok, p.pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", p.src, err)
+	}
+	return fn, nil
+}
+
+// next advances to the next token: a number, an identifier or a single
+// operator character. tok is empty at the end of the input.
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+	c := rune(p.src[p.pos])
+	switch {
+	case unicode.IsDigit(c) || c == '.':
+		p.skip("0123456789.")
+		// Optional exponent such as 1e-3.
+		if rest := p.src[p.pos:]; len(rest) > 1 && rest[0] == 'e' &&
+			(unicode.IsDigit(rune(rest[1])) || len(rest) > 2 && strings.ContainsRune("+-", rune(rest[1])) && unicode.IsDigit(rune(rest[2]))) {
+			p.pos += 2
+			p.skip("0123456789")
+		}
+	case unicode.IsLetter(c):
+		for p.pos < len(p.src) && (unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+func (p *exprParser) skip(chars string) {
+	for p.pos < len(p.src) && strings.IndexByte(chars, p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *exprParser) parseSum() (exprFunc, error) {
+	left, err := p.parseProduct()
+	for err == nil && (p.tok == "+" || p.tok == "-") {
+		op := p.tok
+		p.next()
+		var right exprFunc
+		if right, err = p.parseProduct(); err != nil {
+			break
+		}
+		l := left
+		if op == "+" {
+			left = func(v []float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v []float64) float64 { return l(v) - right(v) }
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseProduct() (exprFunc, error) {
+	left, err := p.parseUnary()
+	for err == nil && (p.tok == "*" || p.tok == "/") {
+		op := p.tok
+		p.next()
+		var right exprFunc
+		if right, err = p.parseUnary(); err != nil {
+			break
+		}
+		l := left
+		if op == "*" {
+			left = func(v []float64) float64 { return l(v) * right(v) }
+		} else {
+			left = func(v []float64) float64 { return l(v) / right(v) }
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprFunc, error) {
+	if p.tok == "-" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v []float64) float64 { return -operand(v) }, nil
+	}
+	return p.parsePower()
+}
+
+// parsePower handles ^, which is right-associative and binds tighter than
+// unary minus on its left: -x^2 is -(x^2).
+func (p *exprParser) parsePower() (exprFunc, error) {
+	base, err := p.parsePrimary()
+	if err != nil || p.tok != "^" {
+		return base, err
+	}
+	p.next()
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return func(v []float64) float64 { return math.Pow(base(v), exponent(v)) }, nil
+}
+
+func (p *exprParser) parsePrimary() (exprFunc, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case tok == "(":
+		p.next()
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, fmt.Errorf("missing ')' at offset %d", p.pos)
+		}
+		p.next()
+		return inner, nil
+	case unicode.IsDigit(rune(tok[0])) || tok[0] == '.':
+		value, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok)
+		}
+		p.next()
+		return func([]float64) float64 { return value }, nil
+	case unicode.IsLetter(rune(tok[0])):
+		p.next()
+		if call, ok := p.calls[tok]; ok {
+			if p.tok != "(" {
+				return nil, fmt.Errorf("expected '(' after %s", tok)
+			}
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			fn, err := call(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", tok, err)
+			}
+			return fn, nil
+		}
+		if f, ok := exprFunctions[tok]; ok {
+			if p.tok != "(" {
+				return nil, fmt.Errorf("expected '(' after %s", tok)
+			}
+			arg, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return func(v []float64) float64 { return f(arg(v)) }, nil
+		}
+		if c, ok := exprConstants[tok]; ok {
+			return func([]float64) float64 { return c }, nil
+		}
+		index, err := p.variable(tok)
+		if err != nil {
+			return nil, err
+		}
+		p.dims = max(p.dims, index+1)
+		return func(v []float64) float64 { return v[index] }, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok, p.pos-len(tok))
+}
+
+// parseArgs reads a parenthesized, comma-separated argument list, which
+// may be empty.
+func (p *exprParser) parseArgs() ([]exprFunc, error) {
+	p.next()
+	var args []exprFunc
+	for p.tok != ")" {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.tok == "," {
+			p.next()
+		} else if p.tok != ")" {
+			return nil, fmt.Errorf("missing ')' at offset %d", p.pos)
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+// exprVariable maps a variable name to its zero-based index.
+func exprVariable(name string) (int, error) {
+	switch name {
+	case "x":
+		return 0, nil
+	case "y":
+		return 1, nil
+	case "z":
+		return 2, nil
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(name, "x")); err == nil && strings.HasPrefix(name, "x") && n >= 1 {
+		return n - 1, nil
+	}
+	return 0, fmt.Errorf("unknown identifier %q", name)
+}
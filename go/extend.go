@@ -0,0 +1,243 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// margins are the pixels added on each side of the canvas.
+type margins struct {
+	top, right, bottom, left int
+}
+
+func parseMargins(s string) (margins, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return margins{}, fmt.Errorf("expected top,right,bottom,left, got %q", s)
+	}
+	var v [4]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 0 {
+			return margins{}, fmt.Errorf("invalid margin %q", f)
+		}
+		v[i] = n
+	}
+	return margins{v[0], v[1], v[2], v[3]}, nil
+}
+
+// centeredMargins grows a width x height image to at least targetW x
+// targetH, splitting the extra space evenly between opposite sides.
+func centeredMargins(width, height, targetW, targetH int) margins {
+	dx, dy := max(targetW-width, 0), max(targetH-height, 0)
+	return margins{top: dy / 2, bottom: dy - dy/2, left: dx / 2, right: dx - dx/2}
+}
+
+// aspectMargins returns the smallest centered extension that gives the image
+// the aspect ratio "W:H".
+func aspectMargins(width, height int, aspect string) (margins, error) {
+	a, b, ok := strings.Cut(aspect, ":")
+	aw, err1 := strconv.Atoi(a)
+	ah, err2 := strconv.Atoi(b)
+	if !ok || err1 != nil || err2 != nil || aw <= 0 || ah <= 0 {
+		return margins{}, fmt.Errorf("expected W:H, got %q", aspect)
+	}
+	if width*ah >= height*aw {
+		return centeredMargins(width, height, width, (width*ah+aw-1)/aw), nil
+	}
+	return centeredMargins(width, height, (height*aw+ah-1)/ah, height), nil
+}
+
+// reflect maps i into [0, n) by mirroring at the edges (edge pixels repeat).
+func reflect(i, n int) int {
+	period := 2 * n
+	i %= period
+	if i < 0 {
+		i += period
+	}
+	if i >= n {
+		i = period - 1 - i
+	}
+	return i
+}
+
+func clampIndex(i, n int) int {
+	return min(max(i, 0), n-1)
+}
+
+// extendCanvas places src on a larger canvas and fills the margins:
+//   - mirror reflects the image across each edge,
+//   - smear repeats the edge pixels outward,
+//   - inpaint diffuses the edge inward ring by ring, so detail fades into a
+//     smooth continuation of the border colours.
+//
+// Each side is filled by its own goroutine. Inpainting fills the left and
+// right margins first and then the top and bottom (which include the
+// corners), since the corners depend on the side columns.
+func extendCanvas(srcImg image.Image, m margins, mode string) (*image.RGBA, error) {
+	src := toRGBA(srcImg)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	W, H := w+m.left+m.right, h+m.top+m.bottom
+	dst := image.NewRGBA(image.Rect(0, 0, W, H))
+	draw.Draw(dst, image.Rect(m.left, m.top, m.left+w, m.top+h), src, src.Bounds().Min, draw.Src)
+
+	sides := [4]image.Rectangle{
+		image.Rect(0, m.top, m.left, m.top+h),   // left
+		image.Rect(m.left+w, m.top, W, m.top+h), // right
+		image.Rect(0, 0, W, m.top),              // top
+		image.Rect(0, m.top+h, W, H),            // bottom
+	}
+
+	var fill func(side int, r image.Rectangle)
+	switch mode {
+	case "mirror", "smear":
+		mapIndex := reflect
+		if mode == "smear" {
+			mapIndex = clampIndex
+		}
+		fill = func(_ int, r image.Rectangle) {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				sy := mapIndex(y-m.top, h)
+				for x := r.Min.X; x < r.Max.X; x++ {
+					sx := mapIndex(x-m.left, w)
+					copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[sy*src.Stride+sx*4:])
+				}
+			}
+		}
+	case "inpaint":
+		fill = func(side int, r image.Rectangle) { inpaintSide(dst, side, r) }
+	default:
+		return nil, fmt.Errorf("unknown fill mode %q: use 'mirror', 'smear' or 'inpaint'", mode)
+	}
+
+	var wg workerGroup
+	for _, group := range [][]int{{0, 1}, {2, 3}} {
+		for _, side := range group {
+			spawnWorker(&wg, func() {
+				fill(side, sides[side])
+			})
+		}
+		wg.Wait()
+	}
+	return dst, nil
+}
+
+// inpaintSide fills a margin one ring at a time, moving away from the image.
+// Each new pixel averages the three nearest pixels of the previous ring.
+func inpaintSide(dst *image.RGBA, side int, r image.Rectangle) {
+	if r.Empty() {
+		return
+	}
+	bounds := dst.Bounds()
+	average := func(x, y int, neighbours [3]image.Point) {
+		var sum [4]int
+		n := 0
+		for _, p := range neighbours {
+			if !p.In(bounds) {
+				continue
+			}
+			off := dst.PixOffset(p.X, p.Y)
+			for ch := range 4 {
+				sum[ch] += int(dst.Pix[off+ch])
+			}
+			n++
+		}
+		off := dst.PixOffset(x, y)
+		for ch := range 4 {
+			dst.Pix[off+ch] = uint8((sum[ch] + n/2) / n)
+		}
+	}
+
+	switch side {
+	case 0: // left: columns right to left
+		for x := r.Max.X - 1; x >= r.Min.X; x-- {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				average(x, y, [3]image.Point{{x + 1, max(y-1, r.Min.Y)}, {x + 1, y}, {x + 1, min(y+1, r.Max.Y-1)}})
+			}
+		}
+	case 1: // right: columns left to right
+		for x := r.Min.X; x < r.Max.X; x++ {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				average(x, y, [3]image.Point{{x - 1, max(y-1, r.Min.Y)}, {x - 1, y}, {x - 1, min(y+1, r.Max.Y-1)}})
+			}
+		}
+	case 2: // top: rows bottom to top
+		for y := r.Max.Y - 1; y >= r.Min.Y; y-- {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				average(x, y, [3]image.Point{{max(x-1, r.Min.X), y + 1}, {x, y + 1}, {min(x+1, r.Max.X-1), y + 1}})
+			}
+		}
+	case 3: // bottom: rows top to bottom
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				average(x, y, [3]image.Point{{max(x-1, r.Min.X), y - 1}, {x, y - 1}, {min(x+1, r.Max.X-1), y - 1}})
+			}
+		}
+	}
+}
+
+func extendCommand(program string, args []string) {
+	var mode, size, aspect, marginFlag string
+	fs := flag.NewFlagSet("extend", flag.ExitOnError)
+	fs.StringVar(&mode, "mode", "mirror", "margin fill: 'mirror', 'smear' or 'inpaint'")
+	fs.StringVar(&size, "size", "", "target canvas size WxH (image centered)")
+	fs.StringVar(&aspect, "aspect", "", "target aspect ratio W:H (image centered)")
+	fs.StringVar(&marginFlag, "margins", "", "explicit margins 'top,right,bottom,left'")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s extend [flags] <input_image> <output_image>\n", program)
+		fmt.Fprintf(os.Stderr, "  Exactly one of --size, --aspect or --margins is required\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	given := 0
+	for _, v := range []string{size, aspect, marginFlag} {
+		if v != "" {
+			given++
+		}
+	}
+	if fs.NArg() != 2 || given != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	srcImg, err := loadImage(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	width, height := srcImg.Bounds().Dx(), srcImg.Bounds().Dy()
+
+	var m margins
+	switch {
+	case size != "":
+		var tw, th int
+		if tw, th, err = parseSize(size); err == nil {
+			m = centeredMargins(width, height, tw, th)
+		}
+	case aspect != "":
+		m, err = aspectMargins(width, height, aspect)
+	default:
+		m, err = parseMargins(marginFlag)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	dstImg, err := extendCanvas(srcImg, m, mode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if err := saveImage(fs.Arg(1), dstImg); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	fmt.Printf("Extended %dx%d to %dx%d (%s)\n", width, height, dstImg.Bounds().Dx(), dstImg.Bounds().Dy(), mode)
+}
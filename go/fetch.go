@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Inputs may be http(s) URLs. They are downloaded into a cache directory
+// and decoded from there like any file; a cached copy is revalidated with
+// its ETag or Last-Modified date, so an unchanged image costs a 304 and no
+// transfer. Batches download through their prefetch, so the next inputs
+// arrive while earlier ones are filtered, at most parallel+prefetch at a
+// time.
+
+// httpCacheDir is where downloads are kept, set from --http-cache; empty
+// means filter/http under the user cache directory.
+var httpCacheDir string
+
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// cacheEntry is the sidecar of a cached download.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// fetchLocks serializes downloads of the same URL, so concurrent jobs
+// reading one input download it once.
+var fetchLocks sync.Map
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+func cacheDir() (string, error) {
+	dir := httpCacheDir
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			base = os.TempDir()
+		}
+		dir = filepath.Join(base, "filter", "http")
+	}
+	return dir, os.MkdirAll(dir, 0o755)
+}
+
+// localInput returns the path of a file holding input: input itself, or
+// for a URL its cached download, fetched or revalidated first. Failures
+// are *fs.PathError, like those of a missing file.
+func localInput(input string) (string, error) {
+	if !isURL(input) {
+		return input, nil
+	}
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", &fs.PathError{Op: "GET", Path: input, Err: err}
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(input))
+	// The extension of the URL path picks the decoder, as for files.
+	body := filepath.Join(dir, hex.EncodeToString(sum[:16])+strings.ToLower(path.Ext(u.Path)))
+	meta := body + ".json"
+
+	lock, _ := fetchLocks.LoadOrStore(input, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	var cached cacheEntry
+	if data, err := os.ReadFile(meta); err == nil && json.Unmarshal(data, &cached) == nil && cached.URL == input {
+		if _, err := os.Stat(body); err != nil {
+			cached = cacheEntry{}
+		}
+	} else {
+		cached = cacheEntry{}
+	}
+
+	if err := download(input, body, meta, cached); err != nil {
+		return "", &fs.PathError{Op: "GET", Path: input, Err: err}
+	}
+	return body, nil
+}
+
+// download fetches url into body, unless the server confirms that the
+// cached copy is current.
+func download(url, body, meta string, cached cacheEntry) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached.URL != "" {
+		logger.Debug("cached download is current", "url", url)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{resp.StatusCode, resp.Status}
+	}
+
+	// Through a temporary file, so concurrent readers of an older copy and
+	// interrupted downloads never see a partial one.
+	tmp, err := os.CreateTemp(filepath.Dir(body), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), body); err != nil {
+		return err
+	}
+	logger.Debug("downloaded", "url", url, "bytes", n, "ms", ms(time.Since(start)))
+
+	entry := cacheEntry{URL: url, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if entry.ETag == "" && entry.LastModified == "" {
+		// Nothing to revalidate with: fetch again next time.
+		os.Remove(meta)
+		return nil
+	}
+	data, _ := json.Marshal(entry)
+	if err := os.WriteFile(meta, data, 0o644); err != nil {
+		return fmt.Errorf("caching: %w", err)
+	}
+	return nil
+}
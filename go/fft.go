@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"math/cmplx"
+)
+
+// fft performs an in-place iterative radix-2 FFT. len(data) must be a power
+// of two. The inverse transform is scaled by 1/n.
+func fft(data []complex128, inverse bool) {
+	n := len(data)
+	if n <= 1 {
+		return
+	}
+	shift := 64 - bits.Len(uint(n-1))
+	for i := range n {
+		j := int(bits.Reverse64(uint64(i)) >> shift)
+		if j > i {
+			data[i], data[j] = data[j], data[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1.0
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		half := size / 2
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := range half {
+				a := data[start+k]
+				b := data[start+k+half] * w
+				data[start+k] = a + b
+				data[start+k+half] = a - b
+				w *= step
+			}
+		}
+	}
+
+	if inverse {
+		scale := complex(1/float64(n), 0)
+		for i := range data {
+			data[i] *= scale
+		}
+	}
+}
+
+func nextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// fft2D transforms a row-major width x height grid (both powers of two). Rows
+// are transformed in parallel, then columns via a transpose so each worker
+// walks contiguous memory.
+func fft2D(data []complex128, width, height int, inverse bool, numWorkers int) {
+	parallelRows := func(buf []complex128, w, h int) {
+		var wg workerGroup
+		for _, r := range splitRows(h, numWorkers) {
+			spawnWorker(&wg, func() {
+				for y := r.start; y < r.end; y++ {
+					fft(buf[y*w:(y+1)*w], inverse)
+				}
+			})
+		}
+		wg.Wait()
+	}
+
+	parallelRows(data, width, height)
+	transposed := make([]complex128, len(data))
+	for y := range height {
+		for x := range width {
+			transposed[x*height+y] = data[y*width+x]
+		}
+	}
+	parallelRows(transposed, height, width)
+	for y := range height {
+		for x := range width {
+			data[y*width+x] = transposed[x*height+y]
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import "time"
+
+// fftMinRadius is the radius from which auto takes the FFT path. The
+// direct passes cost 2r+1 taps a pixel and the FFT ones about the same at
+// any radius. calibrate measures both; they typically cross at radius 4
+// to 6, and the threshold sits well above that so the common small radii
+// keep the direct path's rounding. It is fixed rather than taken from the
+// profile, since the two paths round differently and the output shouldn't
+// depend on which machine calibrated.
+const fftMinRadius = 16
+
+// fftLine convolves lines of one length with a symmetric kernel through
+// FFTs: the line, extended by the kernel radius with its edge pixels as the
+// direct path does, padded to a power of two, times the transformed kernel.
+// The padding leaves room for the whole kernel, so the circular convolution
+// of the FFT never wraps into the output.
+type fftLine struct {
+	n, radius int
+	spectrum  []complex128
+}
+
+func newFFTLine(kernel []float64, length int) *fftLine {
+	r := len(kernel) / 2
+	n := nextPowerOfTwo(length + 2*r)
+	spectrum := make([]complex128, n)
+	for i, w := range kernel {
+		spectrum[(i-r+n)%n] = complex(w, 0)
+	}
+	fft(spectrum, false)
+	return &fftLine{n, r, spectrum}
+}
+
+// convolve replaces a and b, two channels of a line, by their convolution.
+// As the kernel is real, both go through one complex transform, a in the
+// real part and b in the imaginary. buf is scratch space of l.n values.
+func (l *fftLine) convolve(a, b []float32, buf []complex128) {
+	length := len(a)
+	for i := range buf {
+		s := min(max(i-l.radius, 0), length-1)
+		buf[i] = complex(float64(a[s]), float64(b[s]))
+	}
+	fft(buf, false)
+	for i := range buf {
+		buf[i] *= l.spectrum[i]
+	}
+	fft(buf, true)
+	for x := range length {
+		a[x], b[x] = float32(real(buf[x+l.radius])), float32(imag(buf[x+l.radius]))
+	}
+}
+
+// fftFilter is the blur through FFTs, whose cost hardly grows with the
+// radius: the separable kernel is applied to every row of d, then to every
+// column, in place. Lines go through the transform two channels at a time,
+// or two lines at a time for a single channel, split among the workers.
+// The values stay in floats between the passes, so the result is within 1
+// of the direct path, which rounds after each.
+func fftFilter(d *ImageData[float32], kernel []float64, numWorkers int, phases *phaseLog) {
+	width, height, channels := d.Width, d.Height, d.Channels
+	pass := func(lines, length int, f *fftLine, at func(line, i int) int) {
+		units := lines * channels
+		parallelRows((units+1)/2, numWorkers, func(from, to int) {
+			buf := make([]complex128, f.n)
+			var pair [2][]float32
+			pair[0], pair[1] = make([]float32, length), make([]float32, length)
+			for p := from; p < to; p++ {
+				for j, u := range [2]int{2 * p, 2*p + 1} {
+					for i := range length {
+						if u < units {
+							pair[j][i] = d.Pix[at(u/channels, i)+u%channels]
+						} else {
+							pair[j][i] = 0
+						}
+					}
+				}
+				f.convolve(pair[0], pair[1], buf)
+				for j, u := range [2]int{2 * p, 2*p + 1} {
+					for i := range length {
+						if u < units {
+							d.Pix[at(u/channels, i)+u%channels] = pair[j][i]
+						}
+					}
+				}
+			}
+		})
+	}
+	start := time.Now()
+	pass(height, width, newFFTLine(kernel, width), func(y, x int) int { return (y*width + x) * channels })
+	phases.record("FFT rows", time.Since(start))
+	start = time.Now()
+	pass(width, height, newFFTLine(kernel, height), func(x, y int) int { return (y*width + x) * channels })
+	phases.record("FFT columns", time.Since(start))
+}
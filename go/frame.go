@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parseColor accepts #rgb, #rrggbb and #rrggbbaa.
+func parseColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+func parseOffset(s string) (int, int, error) {
+	a, b, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected dx,dy, got %q", s)
+	}
+	dx, err := strconv.Atoi(strings.TrimSpace(a))
+	if err != nil {
+		return 0, 0, err
+	}
+	dy, err := strconv.Atoi(strings.TrimSpace(b))
+	return dx, dy, err
+}
+
+// roundedCoverage is the antialiased coverage of pixel (x, y) by a w x h
+// rectangle at the origin with corner radius r.
+func roundedCoverage(x, y, w, h int, r float64) float64 {
+	px, py := float64(x)+0.5, float64(y)+0.5
+	if px < 0 || py < 0 || px > float64(w) || py > float64(h) {
+		return 0
+	}
+	if r <= 0 {
+		return 1
+	}
+	cx := math.Min(math.Max(px, r), float64(w)-r)
+	cy := math.Min(math.Max(py, r), float64(h)-r)
+	dist := math.Hypot(px-cx, py-cy)
+	return math.Min(math.Max(r-dist+0.5, 0), 1)
+}
+
+type frameOptions struct {
+	border       int
+	borderColor  color.NRGBA
+	cornerRadius int
+	shadowDX     int
+	shadowDY     int
+	shadowBlur   int
+	shadowColor  color.NRGBA
+	margin       int
+	background   color.NRGBA
+	numWorkers   int
+}
+
+// parallelRows calls fn on the rows of an image of the given height, split
+// among numWorkers goroutines by the current scheduler (one band per worker
+// by default). Chunks are further cut at the yield interval, if one is set.
+func parallelRows(height, numWorkers int, fn func(start, end int)) {
+	currentScheduler().Run(height, numWorkers, func(_, start, end int) {
+		forRowChunks(start, end, fn)
+	})
+}
+
+// applyFrame rounds the corners of the image, surrounds it with a border
+// and places it on a larger canvas above a soft drop shadow. The shadow is
+// the frame's silhouette blurred with the regular Gaussian blur.
+func applyFrame(srcImg image.Image, opts frameOptions) *image.RGBA {
+	src := toRGBA(srcImg)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	b := opts.border
+	fw, fh := w+2*b, h+2*b
+	outerRadius := 0.0
+	if opts.cornerRadius > 0 {
+		outerRadius = float64(opts.cornerRadius + b)
+	}
+
+	// Frame: border colour under the image, both clipped to rounded corners.
+	frame := image.NewRGBA(image.Rect(0, 0, fw, fh))
+	parallelRows(fh, opts.numWorkers, func(start, end int) {
+		bc := opts.borderColor
+		for y := start; y < end; y++ {
+			for x := range fw {
+				outer := roundedCoverage(x, y, fw, fh, outerRadius)
+				inner := roundedCoverage(x-b, y-b, w, h, float64(opts.cornerRadius))
+				var r, g, bl, a float64
+				if inner > 0 {
+					p := src.Pix[(y-b)*src.Stride+(x-b)*4:]
+					r, g, bl, a = float64(p[0])*inner, float64(p[1])*inner, float64(p[2])*inner, float64(p[3])*inner
+				}
+				// Border shows through where the image is missing or transparent.
+				bw := outer * (1 - a/255) * float64(bc.A) / 255
+				frame.SetRGBA(x, y, color.RGBA{
+					R: uint8(math.Round(r + float64(bc.R)*bw)),
+					G: uint8(math.Round(g + float64(bc.G)*bw)),
+					B: uint8(math.Round(bl + float64(bc.B)*bw)),
+					A: uint8(math.Round(a + 255*bw)),
+				})
+			}
+		}
+	})
+
+	pad := opts.margin
+	if opts.shadowBlur > 0 || opts.shadowDX != 0 || opts.shadowDY != 0 {
+		pad += opts.shadowBlur + max(abs(opts.shadowDX), abs(opts.shadowDY))
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, fw+2*pad, fh+2*pad))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(opts.background), image.Point{}, draw.Src)
+
+	if opts.shadowColor.A > 0 && (opts.shadowBlur > 0 || opts.shadowDX != 0 || opts.shadowDY != 0) {
+		shadow := image.NewRGBA(canvas.Bounds())
+		sc := opts.shadowColor
+		ox, oy := pad+opts.shadowDX, pad+opts.shadowDY
+		parallelRows(fh, opts.numWorkers, func(start, end int) {
+			for y := start; y < end; y++ {
+				for x := range fw {
+					a := float64(frame.Pix[y*frame.Stride+x*4+3]) / 255 * float64(sc.A) / 255
+					shadow.SetRGBA(ox+x, oy+y, color.RGBA{
+						R: uint8(float64(sc.R) * a),
+						G: uint8(float64(sc.G) * a),
+						B: uint8(float64(sc.B) * a),
+						A: uint8(255 * a),
+					})
+				}
+			}
+		})
+		if opts.shadowBlur > 0 {
+			shadow = applyGaussianBlur(shadow, opts.shadowBlur, opts.numWorkers, nil)
+		}
+		compositeOver(canvas, shadow, image.Point{}, opts.numWorkers)
+	}
+	compositeOver(canvas, frame, image.Pt(pad, pad), opts.numWorkers)
+	return canvas
+}
+
+// compositeOver draws src over dst at offset, splitting the rows between
+// workers.
+func compositeOver(dst *image.RGBA, src *image.RGBA, offset image.Point, numWorkers int) {
+	bounds := src.Bounds()
+	parallelRows(bounds.Dy(), numWorkers, func(start, end int) {
+		r := image.Rect(bounds.Min.X, bounds.Min.Y+start, bounds.Max.X, bounds.Min.Y+end)
+		draw.Draw(dst, r.Add(offset), src, r.Min, draw.Over)
+	})
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func frameCommand(program string, args []string) {
+	var opts frameOptions
+	var borderColor, shadowColor, shadowOffset, background string
+	fs := flag.NewFlagSet("frame", flag.ExitOnError)
+	fs.IntVar(&opts.border, "border", 0, "border width in pixels")
+	fs.StringVar(&borderColor, "border-color", "#ffffff", "border color")
+	fs.IntVar(&opts.cornerRadius, "corner-radius", 0, "radius of the rounded corners")
+	fs.StringVar(&shadowOffset, "shadow-offset", "8,8", "drop shadow offset 'dx,dy'")
+	fs.IntVar(&opts.shadowBlur, "shadow-blur", 12, "drop shadow blur radius (0 for a hard shadow)")
+	fs.StringVar(&shadowColor, "shadow-color", "#00000099", "drop shadow color; alpha sets the opacity (#00000000 disables)")
+	fs.IntVar(&opts.margin, "margin", 0, "extra transparent canvas around the result")
+	fs.StringVar(&background, "background", "#00000000", "canvas background color")
+	fs.IntVar(&opts.numWorkers, "workers", cpuCount(), "number of workers")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s frame [flags] <input_image> <output_image>\n", program)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 || opts.border < 0 || opts.cornerRadius < 0 || opts.shadowBlur < 0 || opts.margin < 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if opts.numWorkers <= 0 {
+		opts.numWorkers = cpuCount()
+	}
+	for _, c := range []struct {
+		dst  *color.NRGBA
+		flag string
+	}{
+		{&opts.borderColor, borderColor},
+		{&opts.shadowColor, shadowColor},
+		{&opts.background, background},
+	} {
+		v, err := parseColor(c.flag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitUsage)
+		}
+		*c.dst = v
+	}
+	var err error
+	if opts.shadowDX, opts.shadowDY, err = parseOffset(shadowOffset); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --shadow-offset: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	srcImg, err := loadImage(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	dstImg := applyFrame(srcImg, opts)
+	if err := saveImage(fs.Arg(1), dstImg); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	fmt.Printf("Framed image: %dx%d\n", dstImg.Bounds().Dx(), dstImg.Bounds().Dy())
+}
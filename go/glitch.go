@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strings"
+)
+
+var glitchEffectNames = []string{"scanlines", "shift", "blocks", "wobble"}
+
+// glitchBlock is the edge length of the blocks moved by block corruption.
+const glitchBlock = 16
+
+type glitchOptions struct {
+	scanlines, shift, blocks, wobble bool
+	intensity                        float64
+	seed                             uint64
+	numWorkers                       int
+}
+
+func parseGlitchEffects(list string, opts *glitchOptions) error {
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "scanlines":
+			opts.scanlines = true
+		case "shift":
+			opts.shift = true
+		case "blocks":
+			opts.blocks = true
+		case "wobble":
+			opts.wobble = true
+		default:
+			return fmt.Errorf("unknown effect %q: use any of %v", name, glitchEffectNames)
+		}
+	}
+	return nil
+}
+
+// glitchRand is a uniform value in [0, 1) that depends only on the seed and
+// the pair (a, b), so every worker sees the same noise for the same row or
+// block regardless of how the image is split.
+func glitchRand(seed uint64, a, b int) float64 {
+	s := seed ^ uint64(a)*0x9e3779b97f4a7c15 ^ uint64(b)*0xc2b2ae3d27d4eb4f
+	return float64(splitMix64(&s)>>11) / (1 << 53)
+}
+
+// applyGlitch renders VHS-style distortions. Each output pixel looks up its
+// red, green and blue values at displaced source positions:
+//   - scanlines shifts bands of rows sideways and darkens alternate lines,
+//   - shift offsets red and blue horizontally in opposite directions,
+//   - wobble makes that channel offset oscillate down the image,
+//   - blocks replaces random blocks with content from elsewhere.
+//
+// Rows are processed in parallel; all randomness comes from glitchRand.
+func applyGlitch(srcImg image.Image, opts glitchOptions) *image.RGBA {
+	src := toRGBA(srcImg)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	k := opts.intensity
+
+	maxRowShift := k * float64(width) * 0.05
+	channelShift := k * float64(width) * 0.01
+	bandHeight := max(height/32, 1)
+	corruptFraction := 0.15 * k
+
+	parallelRows(height, opts.numWorkers, func(start, end int) {
+		for y := start; y < end; y++ {
+			rowShift := 0
+			if opts.scanlines {
+				band := y / bandHeight
+				// About a third of the bands tear sideways.
+				if glitchRand(opts.seed, band, 0) < 0.35 {
+					rowShift = int(math.Round((2*glitchRand(opts.seed, band, 1) - 1) * maxRowShift))
+				}
+			}
+			split := 0.0
+			if opts.shift {
+				split = channelShift
+			}
+			if opts.wobble {
+				phase := 2 * math.Pi * glitchRand(opts.seed, 0, 2)
+				split += k * float64(width) * 0.01 * math.Sin(2*math.Pi*float64(y)/float64(max(height/6, 1))+phase)
+			}
+			offsets := [3]int{int(math.Round(split)), 0, int(math.Round(-split))}
+			shade := 1.0
+			if opts.scanlines && y%2 == 1 {
+				shade = 1 - 0.25*k
+			}
+
+			out := dst.Pix[y*dst.Stride:]
+			for x := range width {
+				sx, sy := x+rowShift, y
+				if opts.blocks {
+					bx, by := x/glitchBlock, y/glitchBlock
+					if glitchRand(opts.seed, bx, by+1<<20) < corruptFraction {
+						// Copy the same position from another block in this block row.
+						jump := int((2*glitchRand(opts.seed, bx, by+2<<20) - 1) * float64(width) / 4)
+						sx += jump
+					}
+				}
+				for c := range 3 {
+					px := reflect(sx+offsets[c], width)
+					v := float64(src.Pix[sy*src.Stride+px*4+c]) * shade
+					out[x*4+c] = uint8(math.Round(v))
+				}
+				out[x*4+3] = src.Pix[sy*src.Stride+reflect(sx, width)*4+3]
+			}
+		}
+	})
+	return dst
+}
+
+func glitchCommand(program string, args []string) {
+	opts := glitchOptions{}
+	var effects string
+	var seed int64
+	fs := flag.NewFlagSet("glitch", flag.ExitOnError)
+	fs.StringVar(&effects, "effects", strings.Join(glitchEffectNames, ","), "comma-separated effects to apply")
+	fs.Float64Var(&opts.intensity, "intensity", 0.5, "effect strength from 0 to 1")
+	fs.Int64Var(&seed, "seed", 1, "random seed; the same seed gives the same output")
+	fs.IntVar(&opts.numWorkers, "workers", cpuCount(), "number of workers")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s glitch [flags] <input_image> <output_image>\n", program)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 || opts.intensity < 0 || opts.intensity > 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if opts.numWorkers <= 0 {
+		opts.numWorkers = cpuCount()
+	}
+	if err := parseGlitchEffects(effects, &opts); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitUsage)
+	}
+	opts.seed = uint64(seed)
+
+	srcImg, err := loadImage(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	dstImg := applyGlitch(srcImg, opts)
+	if err := saveImage(fs.Arg(1), dstImg); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	fmt.Printf("Applied %s with intensity %.2f (seed %d)\n", effects, opts.intensity, seed)
+}
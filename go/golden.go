@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"slices"
+)
+
+// Synthetic inputs are generated in code so the golden checksums don't depend
+// on image codecs. Odd sizes exercise the uneven row split between workers.
+type syntheticImage struct {
+	name   string
+	width  int
+	height int
+	pixel  func(x, y int, seed *uint32) color.RGBA
+}
+
+var syntheticImages = []syntheticImage{
+	{"gradient", 64, 48, func(x, y int, _ *uint32) color.RGBA {
+		return color.RGBA{uint8(x * 255 / 63), uint8(y * 255 / 47), uint8((x + y) * 255 / 110), 255}
+	}},
+	{"checkerboard", 37, 23, func(x, y int, _ *uint32) color.RGBA {
+		if (x/4+y/4)%2 == 0 {
+			return color.RGBA{230, 230, 230, 255}
+		}
+		return color.RGBA{20, 40, 60, 200}
+	}},
+	{"noise", 50, 31, func(_, _ int, seed *uint32) color.RGBA {
+		return color.RGBA{
+			uint8(lcgRandom(seed) * 255),
+			uint8(lcgRandom(seed) * 255),
+			uint8(lcgRandom(seed) * 255),
+			255,
+		}
+	}},
+}
+
+func (s syntheticImage) generate() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	seed := uint32(12345)
+	for y := range s.height {
+		for x := range s.width {
+			img.SetRGBA(x, y, s.pixel(x, y, &seed))
+		}
+	}
+	return img
+}
+
+// pixelChecksum hashes the raw RGBA bytes row by row, ignoring stride padding.
+func pixelChecksum(img *image.RGBA) string {
+	h := sha256.New()
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		offset := img.PixOffset(bounds.Min.X, y)
+		h.Write(img.Pix[offset : offset+bounds.Dx()*4])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+var (
+	goldenRadii   = []int{1, 3, 5}
+	goldenWorkers = []int{1, 3, 8}
+)
+
+// goldenCase is an operation run at some radii, with setup changing the
+// settings it reads for the run and returning what restores them.
+type goldenCase struct {
+	name      string
+	operation string
+	radii     []int
+	setup     func() (restore func())
+}
+
+// goldenSettings is the setup for operations that need more than a radius.
+var goldenSettings = map[string]func() func(){
+	"custom": func() func() {
+		prev := customProgram
+		customProgram = "l = gray(); r = clamp(r*1.2); g = l; b = b*b*(1 - x/w)"
+		return func() { customProgram = prev }
+	},
+	"convolve": func() func() {
+		prev := kernelPath
+		kernelPath = "testdata/golden_kernel.txt"
+		return func() { kernelPath = prev }
+	},
+}
+
+// withBlurAlgorithm is the setup that forces a blur path.
+func withBlurAlgorithm(name string) func() func() {
+	return func() func() {
+		prev := blurAlgorithm
+		blurAlgorithm = name
+		return func() { blurAlgorithm = prev }
+	}
+}
+
+// goldenCases is every operation, registered filters included, at
+// goldenRadii, or once for those without a parameter, and the blur forced
+// onto its fft and iir paths, iir above the sigma it falls back below.
+func goldenCases() []goldenCase {
+	var cases []goldenCase
+	for _, op := range operations {
+		radii := goldenRadii
+		if op.param == "" {
+			radii = []int{0}
+		}
+		cases = append(cases, goldenCase{op.name, op.name, radii, goldenSettings[op.name]})
+	}
+	return append(cases,
+		goldenCase{"blur-fft", "blur", goldenRadii, withBlurAlgorithm("fft")},
+		goldenCase{"blur-iir", "blur", []int{6, 9, fftMinRadius}, withBlurAlgorithm("iir")},
+	)
+}
+
+// runGolden applies every golden case to every synthetic image and returns
+// the checksum per case. All worker counts must agree with each other; a
+// mismatch is reported as an error because it points at a race or a
+// partitioning bug rather than a numeric change.
+func runGolden() (map[string]string, []string) {
+	sums := make(map[string]string)
+	var failures []string
+	for _, s := range syntheticImages {
+		img := s.generate()
+		for _, c := range goldenCases() {
+			restore := func() {}
+			if c.setup != nil {
+				restore = c.setup()
+			}
+			for _, radius := range c.radii {
+				key := fmt.Sprintf("%s_%dx%d/%s/r%d", s.name, s.width, s.height, c.name, radius)
+				for _, workers := range goldenWorkers {
+					dst, err := applyOperation(c.operation, img, radius, workers)
+					if err != nil {
+						failures = append(failures, fmt.Sprintf("%s: %v", key, err))
+						break
+					}
+					takePhases()
+					sum := pixelChecksum(dst)
+					if prev, ok := sums[key]; ok && prev != sum {
+						failures = append(failures, fmt.Sprintf("%s: %d workers differ from %d worker", key, workers, goldenWorkers[0]))
+						continue
+					}
+					sums[key] = sum
+				}
+			}
+			restore()
+		}
+	}
+	return sums, failures
+}
+
+func goldenCommand(program string, args []string) {
+	var path string
+	var update bool
+	fs := flag.NewFlagSet("golden", flag.ExitOnError)
+	fs.StringVar(&path, "file", "testdata/golden.json", "golden checksum file")
+	fs.BoolVar(&update, "update", false, "rewrite the golden file with the current checksums")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s golden [flags]\n", program)
+		fmt.Fprintf(os.Stderr, "  Runs every filter on generated images and compares against golden checksums\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	sums, failures := runGolden()
+
+	if update {
+		if len(failures) > 0 {
+			for _, f := range failures {
+				fmt.Fprintf(os.Stderr, "FAIL %s\n", f)
+			}
+			fmt.Fprintf(os.Stderr, "Refusing to update golden file while worker counts disagree\n")
+			os.Exit(exitFailure)
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write golden file: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		defer file.Close()
+		if err := writeJSON(file, sums); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write golden file: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		fmt.Printf("Wrote %d golden checksums to %s\n", len(sums), path)
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read golden file: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	var golden map[string]string
+	if err := json.Unmarshal(data, &golden); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid golden file: %v\n", err)
+		os.Exit(exitFailure)
+	}
+
+	keys := make([]string, 0, len(sums))
+	for key := range sums {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		want, ok := golden[key]
+		switch {
+		case !ok:
+			failures = append(failures, fmt.Sprintf("%s: no golden checksum (run with --update)", key))
+		case want != sums[key]:
+			failures = append(failures, fmt.Sprintf("%s: checksum %.12s, want %.12s", key, sums[key], want))
+		}
+	}
+
+	for _, f := range failures {
+		fmt.Printf("FAIL %s\n", f)
+	}
+	fmt.Printf("%d cases, %d failures\n", len(keys), len(failures))
+	if len(failures) > 0 {
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestGolden(t *testing.T) {
+	data, err := os.ReadFile("testdata/golden.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var golden map[string]string
+	if err := json.Unmarshal(data, &golden); err != nil {
+		t.Fatal(err)
+	}
+
+	sums, failures := runGolden()
+	for _, f := range failures {
+		t.Error(f)
+	}
+	for key, want := range golden {
+		t.Run(key, func(t *testing.T) {
+			got, ok := sums[key]
+			if !ok {
+				t.Fatal("case not run")
+			}
+			if got != want {
+				t.Errorf("checksum %s, want %s", got, want)
+			}
+		})
+	}
+	for key := range sums {
+		if _, ok := golden[key]; !ok {
+			t.Errorf("%s: no golden checksum", key)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"time"
+)
+
+// backend is --backend: "cpu" runs every filter on goroutines, "gpu" runs
+// blur and kuwahara on the GPU backend built in and everything else on the
+// CPU. Without a GPU backend, or when it fails, those fall back to the CPU
+// with a warning.
+var backend = "cpu"
+
+// gpuBackend runs filters on a GPU. The default build has none; building
+// with -tags cuda adds one on the CUDA driver API, which needs the CUDA
+// toolkit to build and an NVIDIA driver to run.
+type gpuBackend interface {
+	Name() string
+	// Blur and Kuwahara match the CPU filters up to float rounding: the
+	// same kernel weights, edge clamping and rounding after each pass, and
+	// for Kuwahara the same quadrants and ties.
+	Blur(src *image.RGBA, kernel []float64) (*image.RGBA, error)
+	Kuwahara(src *image.RGBA, radius int) (*image.RGBA, error)
+}
+
+// gpu is the backend built in, nil if none.
+var gpu gpuBackend
+
+var errNoGPU = errors.New("no GPU backend in this build, rebuild with -tags cuda")
+
+var gpuFallbackOnce sync.Once
+
+// gpuOperation reports whether operation has a GPU implementation.
+func gpuOperation(operation string) bool {
+	return operation == "blur" || operation == "kuwahara"
+}
+
+// runGPU runs operation on the GPU backend.
+func runGPU(operation string, srcImg image.Image, radius int, phases *phaseLog) (*image.RGBA, error) {
+	if gpu == nil {
+		return nil, errNoGPU
+	}
+	src := toRGBA(srcImg)
+	start := time.Now()
+	var dst *image.RGBA
+	var err error
+	switch operation {
+	case "blur":
+		dst, err = gpu.Blur(src, blurKernel(radius))
+	case "kuwahara":
+		dst, err = gpu.Kuwahara(src, radius)
+	}
+	if err != nil {
+		return nil, err
+	}
+	phases.record("GPU "+gpu.Name(), time.Since(start))
+	return dst, nil
+}
+
+// applyGPU is runFilter's hook for --backend gpu. It reports false when
+// the CPU should run the operation, warning once if that is a fallback.
+func applyGPU(operation string, srcImg image.Image, radius int, phases *phaseLog) (*image.RGBA, bool) {
+	if backend != "gpu" || !gpuOperation(operation) {
+		return nil, false
+	}
+	dst, err := runGPU(operation, srcImg, radius, phases)
+	if err != nil {
+		gpuFallbackOnce.Do(func() {
+			logger.Warn("GPU backend unavailable, filtering on the CPU", "err", err)
+		})
+		return nil, false
+	}
+	return dst, true
+}
+
+// benchGPU times job, a GPU run of operation, and prints it below the
+// worker counts of report with its speedup over the 1-worker run.
+func benchGPU(out io.Writer, operation string, radius int, cfg benchConfig, job func(), report ScalingReport) *BenchResult {
+	result := runBench(job, cfg)
+	result.Operation = operation
+	result.Radius = radius
+	result.Backend = gpu.Name()
+	for _, r := range report.Results {
+		if r.Speedup > 0 && result.MedianMs > 0 {
+			// Speedups are over the 1-worker median.
+			result.Speedup = r.MedianMs * r.Speedup / result.MedianMs
+			break
+		}
+	}
+	fmt.Fprintf(out, "%8s %8d %10.2fms %10.2fms %10.2fms %7.2fx  %s\n",
+		"gpu", result.WarmupRuns, result.MeanMs, result.MedianMs, result.StddevMs, result.Speedup, result.Backend)
+	return &result
+}
@@ -0,0 +1,304 @@
+//go:build cuda
+
+package main
+
+// The CUDA backend compiles its kernels with NVRTC when first used and
+// runs them on the primary context of device 0. Build with
+//
+//	go build -tags cuda
+//
+// with the CUDA toolkit's include and lib directories in CGO_CFLAGS and
+// CGO_LDFLAGS if they aren't on the default paths.
+
+/*
+#cgo LDFLAGS: -lcuda -lnvrtc
+#include <cuda.h>
+#include <nvrtc.h>
+#include <stdlib.h>
+
+static const char *kernelSource =
+"extern \"C\" __global__ void blur_pass(const uchar4 *src, uchar4 *dst, const float *weights,\n"
+"                                      int w, int h, int radius, int dx, int dy) {\n"
+"    int x = blockIdx.x * blockDim.x + threadIdx.x;\n"
+"    int y = blockIdx.y * blockDim.y + threadIdx.y;\n"
+"    if (x >= w || y >= h) return;\n"
+"    float4 sum = make_float4(0, 0, 0, 0);\n"
+"    for (int k = -radius; k <= radius; k++) {\n"
+"        int sx = min(max(x + k * dx, 0), w - 1);\n"
+"        int sy = min(max(y + k * dy, 0), h - 1);\n"
+"        uchar4 p = src[sy * w + sx];\n"
+"        float wt = weights[k + radius];\n"
+"        sum.x += p.x * wt; sum.y += p.y * wt; sum.z += p.z * wt; sum.w += p.w * wt;\n"
+"    }\n"
+"    dst[y * w + x] = make_uchar4(roundf(sum.x), roundf(sum.y), roundf(sum.z), roundf(sum.w));\n"
+"}\n"
+"\n"
+"extern \"C\" __global__ void kuwahara(const uchar4 *src, uchar4 *dst, int w, int h, int radius) {\n"
+"    int x = blockIdx.x * blockDim.x + threadIdx.x;\n"
+"    int y = blockIdx.y * blockDim.y + threadIdx.y;\n"
+"    if (x >= w || y >= h) return;\n"
+"    int x0[4] = {x - radius, x, x - radius, x};\n"
+"    int y0[4] = {y - radius, y - radius, y, y};\n"
+"    float best = 3.4e38f;\n"
+"    float3 mean = make_float3(0, 0, 0);\n"
+"    for (int q = 0; q < 4; q++) {\n"
+"        int x1 = max(x0[q], 0), x2 = min(x0[q] + radius, w - 1);\n"
+"        int y1 = max(y0[q], 0), y2 = min(y0[q] + radius, h - 1);\n"
+"        float3 s = make_float3(0, 0, 0), s2 = make_float3(0, 0, 0);\n"
+"        for (int sy = y1; sy <= y2; sy++) {\n"
+"            for (int sx = x1; sx <= x2; sx++) {\n"
+"                uchar4 p = src[sy * w + sx];\n"
+"                s.x += p.x; s.y += p.y; s.z += p.z;\n"
+"                s2.x += p.x * p.x; s2.y += p.y * p.y; s2.z += p.z * p.z;\n"
+"            }\n"
+"        }\n"
+"        float n = (x2 - x1 + 1) * (y2 - y1 + 1);\n"
+"        float3 m = make_float3(s.x / n, s.y / n, s.z / n);\n"
+"        float v = fmaxf(s2.x / n - m.x * m.x, 0) + fmaxf(s2.y / n - m.y * m.y, 0) + fmaxf(s2.z / n - m.z * m.z, 0);\n"
+"        if (v < best) { best = v; mean = m; }\n"
+"    }\n"
+"    dst[y * w + x] = make_uchar4(fminf(255, mean.x), fminf(255, mean.y), fminf(255, mean.z), src[y * w + x].w);\n"
+"}\n";
+
+// loadKernels compiles kernelSource for the current device and loads it,
+// leaving the NVRTC log in *log (to be freed) when compiling fails.
+static CUresult loadKernels(CUmodule *module, CUfunction *blur, CUfunction *kuwahara, char **log, nvrtcResult *nvrtcErr) {
+	nvrtcProgram prog;
+	*log = NULL;
+	*nvrtcErr = nvrtcCreateProgram(&prog, kernelSource, "filter.cu", 0, NULL, NULL);
+	if (*nvrtcErr != NVRTC_SUCCESS) return CUDA_ERROR_INVALID_SOURCE;
+	*nvrtcErr = nvrtcCompileProgram(prog, 0, NULL);
+	if (*nvrtcErr != NVRTC_SUCCESS) {
+		size_t size;
+		nvrtcGetProgramLogSize(prog, &size);
+		*log = malloc(size);
+		nvrtcGetProgramLog(prog, *log);
+		nvrtcDestroyProgram(&prog);
+		return CUDA_ERROR_INVALID_SOURCE;
+	}
+	size_t size;
+	nvrtcGetPTXSize(prog, &size);
+	char *ptx = malloc(size);
+	nvrtcGetPTX(prog, ptx);
+	nvrtcDestroyProgram(&prog);
+	CUresult err = cuModuleLoadData(module, ptx);
+	free(ptx);
+	if (err != CUDA_SUCCESS) return err;
+	err = cuModuleGetFunction(blur, *module, "blur_pass");
+	if (err != CUDA_SUCCESS) return err;
+	return cuModuleGetFunction(kuwahara, *module, "kuwahara");
+}
+
+// The launches build the argument arrays here, as cgo can't pass Go
+// pointers to Go pointers.
+static CUresult launchBlur(CUfunction f, CUdeviceptr src, CUdeviceptr dst, CUdeviceptr weights,
+                           int w, int h, int radius, int dx, int dy) {
+	void *args[] = {&src, &dst, &weights, &w, &h, &radius, &dx, &dy};
+	return cuLaunchKernel(f, (w + 15) / 16, (h + 15) / 16, 1, 16, 16, 1, 0, NULL, args, NULL);
+}
+
+static CUresult launchKuwahara(CUfunction f, CUdeviceptr src, CUdeviceptr dst, int w, int h, int radius) {
+	void *args[] = {&src, &dst, &w, &h, &radius};
+	return cuLaunchKernel(f, (w + 15) / 16, (h + 15) / 16, 1, 16, 16, 1, 0, NULL, args, NULL);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+func init() {
+	gpu = &cudaBackend{}
+}
+
+// cudaBackend serializes its calls: the context is made current on the OS
+// thread of each call, and one image at a time keeps the device memory
+// bounded.
+type cudaBackend struct {
+	mu       sync.Mutex
+	initOnce sync.Once
+	initErr  error
+	name     string
+	context  C.CUcontext
+	module   C.CUmodule
+	blur     C.CUfunction
+	kuwahara C.CUfunction
+}
+
+func cudaError(call string, res C.CUresult) error {
+	if res == C.CUDA_SUCCESS {
+		return nil
+	}
+	var msg *C.char
+	C.cuGetErrorString(res, &msg)
+	if msg == nil {
+		return fmt.Errorf("%s: CUDA error %d", call, int(res))
+	}
+	return fmt.Errorf("%s: %s", call, C.GoString(msg))
+}
+
+func (b *cudaBackend) init() error {
+	b.initOnce.Do(func() {
+		if err := cudaError("cuInit", C.cuInit(0)); err != nil {
+			b.initErr = err
+			return
+		}
+		var dev C.CUdevice
+		if err := cudaError("cuDeviceGet", C.cuDeviceGet(&dev, 0)); err != nil {
+			b.initErr = err
+			return
+		}
+		var name [256]C.char
+		C.cuDeviceGetName(&name[0], C.int(len(name)), dev)
+		b.name = "CUDA " + C.GoString(&name[0])
+		if err := cudaError("cuDevicePrimaryCtxRetain", C.cuDevicePrimaryCtxRetain(&b.context, dev)); err != nil {
+			b.initErr = err
+			return
+		}
+		if err := cudaError("cuCtxSetCurrent", C.cuCtxSetCurrent(b.context)); err != nil {
+			b.initErr = err
+			return
+		}
+		var log *C.char
+		var nvrtcErr C.nvrtcResult
+		res := C.loadKernels(&b.module, &b.blur, &b.kuwahara, &log, &nvrtcErr)
+		if log != nil {
+			b.initErr = fmt.Errorf("compiling the kernels: %s", C.GoString(log))
+			C.free(unsafe.Pointer(log))
+			return
+		}
+		if nvrtcErr != C.NVRTC_SUCCESS {
+			b.initErr = fmt.Errorf("compiling the kernels: %s", C.GoString(C.nvrtcGetErrorString(nvrtcErr)))
+			return
+		}
+		b.initErr = cudaError("loading the kernels", res)
+	})
+	return b.initErr
+}
+
+func (b *cudaBackend) Name() string {
+	if b.name == "" {
+		return "CUDA"
+	}
+	return b.name
+}
+
+// begin locks the backend to this goroutine's OS thread with the context
+// current; the returned function undoes it.
+func (b *cudaBackend) begin() (func(), error) {
+	if err := b.init(); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	runtime.LockOSThread()
+	end := func() {
+		runtime.UnlockOSThread()
+		b.mu.Unlock()
+	}
+	if err := cudaError("cuCtxSetCurrent", C.cuCtxSetCurrent(b.context)); err != nil {
+		end()
+		return nil, err
+	}
+	return end, nil
+}
+
+// deviceBuffers allocates n buffers of size bytes, freeing them all if one
+// fails.
+func deviceBuffers(n int, size int) ([]C.CUdeviceptr, func(), error) {
+	bufs := make([]C.CUdeviceptr, 0, n)
+	free := func() {
+		for _, p := range bufs {
+			C.cuMemFree(p)
+		}
+	}
+	for range n {
+		var p C.CUdeviceptr
+		if err := cudaError("cuMemAlloc", C.cuMemAlloc(&p, C.size_t(size))); err != nil {
+			free()
+			return nil, nil, err
+		}
+		bufs = append(bufs, p)
+	}
+	return bufs, free, nil
+}
+
+func (b *cudaBackend) Blur(src *image.RGBA, kernel []float64) (*image.RGBA, error) {
+	end, err := b.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	size := width * height * 4
+	bufs, free, err := deviceBuffers(3, max(size, len(kernel)*4))
+	if err != nil {
+		return nil, err
+	}
+	defer free()
+	in, tmp, weights := bufs[0], bufs[1], bufs[2]
+
+	w32 := make([]float32, len(kernel))
+	for i, v := range kernel {
+		w32[i] = float32(v)
+	}
+	pix := packedPix(src)
+	if err := cudaError("cuMemcpyHtoD", C.cuMemcpyHtoD(in, unsafe.Pointer(&pix[0]), C.size_t(size))); err != nil {
+		return nil, err
+	}
+	if err := cudaError("cuMemcpyHtoD", C.cuMemcpyHtoD(weights, unsafe.Pointer(&w32[0]), C.size_t(len(w32)*4))); err != nil {
+		return nil, err
+	}
+	radius := C.int(len(kernel) / 2)
+	w, h := C.int(width), C.int(height)
+	// Horizontal into tmp, then vertical back into in.
+	if err := cudaError("blur_pass", C.launchBlur(b.blur, in, tmp, weights, w, h, radius, 1, 0)); err != nil {
+		return nil, err
+	}
+	if err := cudaError("blur_pass", C.launchBlur(b.blur, tmp, in, weights, w, h, radius, 0, 1)); err != nil {
+		return nil, err
+	}
+	return b.download(in, width, height)
+}
+
+func (b *cudaBackend) Kuwahara(src *image.RGBA, radius int) (*image.RGBA, error) {
+	end, err := b.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	size := width * height * 4
+	bufs, free, err := deviceBuffers(2, size)
+	if err != nil {
+		return nil, err
+	}
+	defer free()
+
+	pix := packedPix(src)
+	if err := cudaError("cuMemcpyHtoD", C.cuMemcpyHtoD(bufs[0], unsafe.Pointer(&pix[0]), C.size_t(size))); err != nil {
+		return nil, err
+	}
+	if err := cudaError("kuwahara", C.launchKuwahara(b.kuwahara, bufs[0], bufs[1], C.int(width), C.int(height), C.int(radius))); err != nil {
+		return nil, err
+	}
+	return b.download(bufs[1], width, height)
+}
+
+// download waits for the kernels and copies a width x height image back.
+func (b *cudaBackend) download(p C.CUdeviceptr, width, height int) (*image.RGBA, error) {
+	if err := cudaError("cuCtxSynchronize", C.cuCtxSynchronize()); err != nil {
+		return nil, err
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if err := cudaError("cuMemcpyDtoH", C.cuMemcpyDtoH(unsafe.Pointer(&dst.Pix[0]), p, C.size_t(len(dst.Pix)))); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
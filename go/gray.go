@@ -0,0 +1,101 @@
+package main
+
+import "image"
+
+// applyGrayOperation runs blur or grayscale on a single-channel input, one
+// channel rather than RGBA's four: a Gray or Gray16 image, which it returns
+// the result as, keeping 16-bit levels, or an opaque RGBA or NRGBA one
+// whose pixels are all gray, returned as RGBA. It returns nil for other
+// operations and inputs, which take applyOperation's path.
+func applyGrayOperation(operation string, srcImg image.Image, radius, numWorkers int) (image.Image, error) {
+	if operation != "blur" && operation != "grayscale" {
+		return nil, nil
+	}
+	bounds := srcImg.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rect := image.Rect(0, 0, width, height)
+	var dstImg image.Image
+	if src, ok := srcImg.(*image.Gray16); ok {
+		plane := NewImageData[uint16](width, height, 1)
+		for y := range height {
+			row := src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			for x := range width {
+				plane.Pix[y*width+x] = uint16(row[x*2])<<8 | uint16(row[x*2+1])
+			}
+		}
+		plane = grayFilter(operation, plane, radius, numWorkers)
+		dst := image.NewGray16(rect)
+		for i, v := range plane.Pix {
+			dst.Pix[i*2], dst.Pix[i*2+1] = uint8(v>>8), uint8(v)
+		}
+		dstImg = dst
+	} else {
+		plane, ok := grayBytes(srcImg)
+		if !ok {
+			return nil, nil
+		}
+		plane = grayFilter(operation, plane, radius, numWorkers)
+		if _, ok := srcImg.(*image.Gray); ok {
+			dstImg = &image.Gray{Pix: plane.Pix, Stride: width, Rect: rect}
+		} else {
+			dst := image.NewRGBA(rect)
+			parallelRows(height, numWorkers, func(from, to int) {
+				for i := from * width; i < to*width; i++ {
+					v := plane.Pix[i]
+					dst.Pix[i*4], dst.Pix[i*4+1], dst.Pix[i*4+2], dst.Pix[i*4+3] = v, v, v, 255
+				}
+			})
+			dstImg = dst
+		}
+	}
+	if err := cancelled(); err != nil {
+		return nil, err
+	}
+	return dstImg, nil
+}
+
+// grayFilter runs operation on a plane. The luma of a gray pixel is its
+// own value, so grayscale returns it unchanged.
+func grayFilter[T channelValue](operation string, src *ImageData[T], radius, numWorkers int) *ImageData[T] {
+	if operation == "grayscale" {
+		return src
+	}
+	dst := NewImageData[T](src.Width, src.Height, 1)
+	blurData(src, dst, blurKernel(radius), blurPath(radius), numWorkers, nil)
+	return dst
+}
+
+// grayBytes is the plane of a Gray image, or of an opaque RGBA or NRGBA one
+// whose pixels all have equal red, green and blue, which it stops scanning
+// for at the first that doesn't. An unpadded Gray is used as it is.
+func grayBytes(img image.Image) (*ImageData[uint8], bool) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	var pix []uint8
+	var stride, step int
+	switch img := img.(type) {
+	case *image.Gray:
+		pix, stride, step = img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):], img.Stride, 1
+	case *image.RGBA:
+		pix, stride, step = img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):], img.Stride, 4
+	case *image.NRGBA:
+		pix, stride, step = img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):], img.Stride, 4
+	default:
+		return nil, false
+	}
+	if step == 1 && stride == width {
+		return &ImageData[uint8]{width, height, 1, pix[:width*height]}, true
+	}
+	plane := NewImageData[uint8](width, height, 1)
+	for y := range height {
+		row := pix[y*stride:]
+		for x := range width {
+			p := row[x*step:]
+			if step == 4 && (p[1] != p[0] || p[2] != p[0] || p[3] != 255) {
+				return nil, false
+			}
+			plane.Pix[y*width+x] = p[0]
+		}
+	}
+	return plane, true
+}
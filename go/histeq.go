@@ -0,0 +1,99 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"time"
+)
+
+// unpremultiply returns the straight-alpha colour of a premultiplied pixel.
+func unpremultiply(r, g, b, a uint8) (uint8, uint8, uint8) {
+	if a == 255 || a == 0 {
+		return r, g, b
+	}
+	return uint8(uint16(r) * 255 / uint16(a)), uint8(uint16(g) * 255 / uint16(a)), uint8(uint16(b) * 255 / uint16(a))
+}
+
+// applyHistogramEqualization spreads the luma of the image over the full
+// range. Each worker builds a histogram of its band of rows; the band
+// histograms are summed into one, whose cumulative distribution becomes a
+// lookup table that the workers then apply to their rows. Chroma is kept, so
+// colours don't shift.
+func applyHistogramEqualization(srcImg image.Image, numWorkers int, phases *phaseLog) *image.RGBA {
+	src := toRGBA(srcImg)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+
+	start := time.Now()
+	bands := splitRows(height, numWorkers)
+	histograms := make([][256]int, len(bands))
+	var wg workerGroup
+	for i, r := range bands {
+		spawnWorker(&wg, func() {
+			hist := &histograms[i]
+			forRowChunks(r.start, r.end, func(from, to int) {
+				for y := from; y < to; y++ {
+					row := src.Pix[y*src.Stride : y*src.Stride+width*4]
+					for x := 0; x < len(row); x += 4 {
+						if row[x+3] == 0 {
+							continue
+						}
+						r, g, b := unpremultiply(row[x], row[x+1], row[x+2], row[x+3])
+						luma, _, _ := color.RGBToYCbCr(r, g, b)
+						hist[luma]++
+					}
+				}
+			})
+		})
+	}
+	wg.Wait()
+	var hist [256]int
+	for _, h := range histograms {
+		for v, n := range h {
+			hist[v] += n
+		}
+	}
+	phases.record("Histogram", time.Since(start))
+
+	// The lookup table maps the darkest occupied level to 0 and the
+	// brightest to 255.
+	var lut [256]uint8
+	total, cdfMin, cdf := 0, 0, 0
+	for _, n := range hist {
+		total += n
+	}
+	for v, n := range hist {
+		if cdfMin == 0 {
+			cdfMin = n
+		}
+		cdf += n
+		if total > cdfMin {
+			lut[v] = uint8((cdf - cdfMin) * 255 / (total - cdfMin))
+		} else {
+			lut[v] = uint8(v)
+		}
+	}
+
+	start = time.Now()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	parallelRows(height, numWorkers, func(from, to int) {
+		for y := from; y < to; y++ {
+			in := src.Pix[y*src.Stride : y*src.Stride+width*4]
+			out := dst.Pix[y*dst.Stride : y*dst.Stride+width*4]
+			for x := 0; x < len(in); x += 4 {
+				a := in[x+3]
+				if a == 0 {
+					continue
+				}
+				r, g, b := unpremultiply(in[x], in[x+1], in[x+2], a)
+				luma, cb, cr := color.RGBToYCbCr(r, g, b)
+				r, g, b = color.YCbCrToRGB(lut[luma], cb, cr)
+				out[x] = uint8(uint16(r) * uint16(a) / 255)
+				out[x+1] = uint8(uint16(g) * uint16(a) / 255)
+				out[x+2] = uint8(uint16(b) * uint16(a) / 255)
+				out[x+3] = a
+			}
+		}
+	})
+	phases.record("Apply LUT", time.Since(start))
+	return dst
+}
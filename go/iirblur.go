@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// iirCoefficients are those of the recursive Gaussian of Young and van
+// Vliet ("Recursive implementation of the Gaussian filter", 1995): a third
+// order causal pass, then the same anticausal, costing 14 multiply-adds a
+// pixel and pass at any sigma.
+type iirCoefficients struct {
+	b    float64       // gain of the input
+	a    [3]float64    // feedback of the three previous outputs
+	tail [3][3]float64 // anticausal state past the end from the causal one
+}
+
+func newIIRCoefficients(sigma float64) iirCoefficients {
+	var q float64
+	if sigma >= 2.5 {
+		q = 0.98711*sigma - 0.96330
+	} else {
+		q = 3.97156 - 4.14554*math.Sqrt(1-0.26891*sigma)
+	}
+	q2, q3 := q*q, q*q*q
+	b0 := 1.57825 + 2.44413*q + 1.4281*q2 + 0.422205*q3
+	b1 := 2.44413*q + 2.85619*q2 + 1.26661*q3
+	b2 := -(1.4281*q2 + 1.26661*q3)
+	b3 := 0.422205 * q3
+	k := iirCoefficients{b: 1 - (b1+b2+b3)/b0, a: [3]float64{b1 / b0, b2 / b0, b3 / b0}}
+	k.settleTail(int(10*sigma) + 64)
+	return k
+}
+
+// settleTail finds how the anticausal pass should start at the end of a
+// line that continues with its last pixel, as Triggs and Sdika do
+// ("Boundary conditions for Young-van Vliet recursive filtering", 2006).
+// Past the end both passes only move by how far the causal one still is
+// from that pixel, linearly in its last three outputs, so running each of
+// them alone through length more steps of the causal pass, then back
+// through the anticausal from rest, gives the matrix.
+func (k *iirCoefficients) settleTail(length int) {
+	tail := make([]float64, length)
+	for j := range 3 {
+		var w [3]float64
+		w[j] = 1
+		for n := range tail {
+			tail[n] = k.a[0]*w[0] + k.a[1]*w[1] + k.a[2]*w[2]
+			w = [3]float64{tail[n], w[0], w[1]}
+		}
+		var y [3]float64
+		for n := length - 1; n >= 0; n-- {
+			y = [3]float64{k.b*tail[n] + k.a[0]*y[0] + k.a[1]*y[1] + k.a[2]*y[2], y[0], y[1]}
+		}
+		for i := range 3 {
+			k.tail[i][j] = y[i]
+		}
+	}
+}
+
+// anticausalStart is the anticausal state past the end of a line whose
+// last pixel is edge and causal outputs were w1, w2, w3 from the end.
+func (k *iirCoefficients) anticausalStart(edge, w1, w2, w3 float32) (y1, y2, y3 float32) {
+	d := [3]float64{float64(w1 - edge), float64(w2 - edge), float64(w3 - edge)}
+	var y [3]float32
+	for i, m := range k.tail {
+		y[i] = edge + float32(m[0]*d[0]+m[1]*d[1]+m[2]*d[2])
+	}
+	return y[0], y[1], y[2]
+}
+
+// iirMinSigma is the sigma below which blur runs the direct passes when
+// asked for iir: the recursive Gaussian drifts from the kernel there, by up
+// to 19 levels at radius 3. It is a little under 2 because a kernel cut at
+// three sigmas measures narrower than asked, 1.99 at radius 6.
+const iirMinSigma = 1.95
+
+// kernelSigma is the sigma of a normalized symmetric kernel, from its
+// second moment, so the IIR path matches whatever Gaussian blur was asked
+// for however its sigma was given.
+func kernelSigma(kernel []float64) float64 {
+	r := len(kernel) / 2
+	variance := 0.0
+	for i, w := range kernel {
+		variance += w * float64((i-r)*(i-r))
+	}
+	return math.Sqrt(variance)
+}
+
+// iirFilter runs the recursive Gaussian over d in place: rows split among
+// the workers, then bands of columns, each pass run down the band a row
+// at a time so it reads memory in order. Past the edges the image is
+// taken to repeat its edge pixels, as the direct path does: the causal
+// pass starts in the steady state of the first pixel and the anticausal
+// from settleTail's state past the last.
+func iirFilter(d *ImageData[float32], sigma float64, numWorkers int, phases *phaseLog) {
+	width, height, channels := d.Width, d.Height, d.Channels
+	k := newIIRCoefficients(sigma)
+	a0, a1, a2 := float32(k.a[0]), float32(k.a[1]), float32(k.a[2])
+	b := float32(k.b)
+
+	start := time.Now()
+	parallelRows(height, numWorkers, func(from, to int) {
+		for y := from; y < to; y++ {
+			row := d.Pix[y*width*channels : (y+1)*width*channels]
+			for c := range channels {
+				edge := row[(width-1)*channels+c]
+				w1, w2, w3 := row[c], row[c], row[c]
+				for x := range width {
+					w := b*row[x*channels+c] + a0*w1 + a1*w2 + a2*w3
+					row[x*channels+c] = w
+					w1, w2, w3 = w, w1, w2
+				}
+				y1, y2, y3 := k.anticausalStart(edge, w1, w2, w3)
+				for x := width - 1; x >= 0; x-- {
+					v := b*row[x*channels+c] + a0*y1 + a1*y2 + a2*y3
+					row[x*channels+c] = v
+					y1, y2, y3 = v, y1, y2
+				}
+			}
+		}
+	})
+	phases.record("IIR rows", time.Since(start))
+
+	start = time.Now()
+	parallelRows(width, numWorkers, func(from, to int) {
+		n := (to - from) * channels
+		line := func(y int) []float32 { return d.Pix[(y*width+from)*channels : (y*width+from)*channels+n] }
+		w1, w2, w3 := make([]float32, n), make([]float32, n), make([]float32, n)
+		edge := make([]float32, n)
+		copy(edge, line(height-1))
+		copy(w1, line(0))
+		copy(w2, w1)
+		copy(w3, w1)
+		for y := range height {
+			cur := line(y)
+			for i, v := range cur {
+				w := b*v + a0*w1[i] + a1*w2[i] + a2*w3[i]
+				cur[i] = w
+				w3[i], w2[i], w1[i] = w2[i], w1[i], w
+			}
+		}
+		for i := range n {
+			w1[i], w2[i], w3[i] = k.anticausalStart(edge[i], w1[i], w2[i], w3[i])
+		}
+		for y := height - 1; y >= 0; y-- {
+			cur := line(y)
+			for i, v := range cur {
+				w := b*v + a0*w1[i] + a1*w2[i] + a2*w3[i]
+				cur[i] = w
+				w3[i], w2[i], w1[i] = w2[i], w1[i], w
+			}
+		}
+	})
+	phases.record("IIR columns", time.Since(start))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// channelValue is the element type of ImageData: bytes, 16-bit levels, or
+// floats, on the scale of the values they came from.
+type channelValue interface {
+	uint8 | uint16 | float32 | float64
+}
+
+// ImageData is an image as rows of interleaved channels of type T with no
+// padding, 4 for premultiplied RGBA as image.RGBA, 1 for a single plane.
+// The blurs convert to it once, run the convolution code shared by every
+// precision, and convert back.
+type ImageData[T channelValue] struct {
+	Width, Height, Channels int
+	Pix                     []T
+}
+
+// NewImageData allocates a zeroed image of width x height pixels.
+func NewImageData[T channelValue](width, height, channels int) *ImageData[T] {
+	return &ImageData[T]{width, height, channels, make([]T, width*height*channels)}
+}
+
+// channelLimit is the largest value of an integer T, which results are
+// rounded and clamped to, and 0 for floats, which are stored as computed.
+func channelLimit[T channelValue]() float64 {
+	switch any(T(0)).(type) {
+	case uint8:
+		return math.MaxUint8
+	case uint16:
+		return math.MaxUint16
+	}
+	return 0
+}
+
+// imageDataFrom converts img to 4 channels. 16-bit levels keep all the
+// precision of 16-bit sources; the other types take the bytes of toRGBA.
+func imageDataFrom[T channelValue](img image.Image, numWorkers int) *ImageData[T] {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	d := NewImageData[T](width, height, 4)
+	src, isRGBA := img.(*image.RGBA)
+	deep, _ := any(d.Pix).([]uint16)
+	if deep != nil && !isRGBA {
+		parallelRows(height, numWorkers, func(from, to int) {
+			for y := from; y < to; y++ {
+				out := deep[y*width*4:]
+				for x := range width {
+					c := color.RGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.RGBA64)
+					out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = c.R, c.G, c.B, c.A
+				}
+			}
+		})
+		return d
+	}
+	if !isRGBA {
+		src = toRGBA(img)
+	}
+	parallelRows(height, numWorkers, func(from, to int) {
+		for y := from; y < to; y++ {
+			in := src.Pix[src.PixOffset(src.Bounds().Min.X, src.Bounds().Min.Y+y):][:width*4]
+			if deep != nil {
+				for i, v := range in {
+					deep[y*width*4+i] = uint16(v) * 257
+				}
+				continue
+			}
+			out := d.Pix[y*width*4:]
+			for i, v := range in {
+				out[i] = T(v)
+			}
+		}
+	})
+	return d
+}
+
+// RGBA converts 4-channel data to an image, rounding and clamping floats.
+// Bytes are wrapped rather than copied.
+func (d *ImageData[T]) RGBA(numWorkers int) *image.RGBA {
+	rect := image.Rect(0, 0, d.Width, d.Height)
+	if pix, ok := any(d.Pix).([]uint8); ok {
+		return &image.RGBA{Pix: pix, Stride: d.Width * 4, Rect: rect}
+	}
+	dst := image.NewRGBA(rect)
+	_, deep := any(d.Pix).([]uint16)
+	parallelRows(d.Height, numWorkers, func(from, to int) {
+		for i := from * d.Width * 4; i < to*d.Width*4; i++ {
+			if deep {
+				dst.Pix[i] = uint8(uint16(d.Pix[i]) >> 8)
+			} else {
+				dst.Pix[i] = uint8(min(max(math.Round(float64(d.Pix[i])), 0), 255))
+			}
+		}
+	})
+	return dst
+}
+
+// convolveRows applies a normalized symmetric kernel along the rows of src
+// into dst, of the same size, repeating the edge pixels, the rows split
+// among the workers.
+func convolveRows[T channelValue](src, dst *ImageData[T], kernel []float64, numWorkers int) {
+	radius, width, channels := len(kernel)/2, src.Width, src.Channels
+	limit := channelLimit[T]()
+	parallelRows(src.Height, numWorkers, func(from, to int) {
+		for y := from; y < to; y++ {
+			in := src.Pix[y*width*channels : (y+1)*width*channels]
+			out := dst.Pix[y*width*channels : (y+1)*width*channels]
+			for x := range width {
+				for c := range channels {
+					var sum float64
+					for k, w := range kernel {
+						sum += w * float64(in[min(max(x+k-radius, 0), width-1)*channels+c])
+					}
+					if limit > 0 {
+						sum = min(max(math.Round(sum), 0), limit)
+					}
+					out[x*channels+c] = T(sum)
+				}
+			}
+		}
+	})
+}
+
+// convolveColumns is convolveRows down the columns. Each output row sums
+// whole input rows, a contiguous multiply-add, rather than reading down a
+// column for every pixel.
+func convolveColumns[T channelValue](src, dst *ImageData[T], kernel []float64, numWorkers int) {
+	radius, height, n := len(kernel)/2, src.Height, src.Width*src.Channels
+	limit := channelLimit[T]()
+	parallelRows(height, numWorkers, func(from, to int) {
+		acc := make([]float64, n)
+		for y := from; y < to; y++ {
+			clear(acc)
+			for k, w := range kernel {
+				sy := min(max(y+k-radius, 0), height-1)
+				for i, v := range src.Pix[sy*n : (sy+1)*n] {
+					acc[i] += w * float64(v)
+				}
+			}
+			out := dst.Pix[y*n : (y+1)*n]
+			for i, sum := range acc {
+				if limit > 0 {
+					sum = min(max(math.Round(sum), 0), limit)
+				}
+				out[i] = T(sum)
+			}
+		}
+	})
+}
+
+// convertImageData copies src into dst of the same size and channels,
+// rounding and clamping to an integer T. The values keep their scale, so
+// floats of 16-bit levels span 0..65535.
+func convertImageData[S, T channelValue](src *ImageData[S], dst *ImageData[T], numWorkers int) {
+	limit := channelLimit[T]()
+	n := src.Width * src.Channels
+	parallelRows(src.Height, numWorkers, func(from, to int) {
+		out := dst.Pix[from*n : to*n]
+		for i, v := range src.Pix[from*n : to*n] {
+			if limit > 0 {
+				out[i] = T(min(max(math.Round(float64(v)), 0), limit))
+			} else {
+				out[i] = T(v)
+			}
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Register JPEG decoder
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadImage decodes a PNG, JPEG or QOI file, or reads a raw RGBA one
+// (.raw, .rgba); path may be an http(s) URL. With an I/O pool the file is
+// read whole on it and decoded here. Errors wrap ErrUnsupportedFormat or
+// ErrDecode, except those of the file system and the download.
+func loadImage(path string) (image.Image, error) {
+	if pool := activeIOPool.Load(); pool != nil {
+		var data []byte
+		err := pool.read(func() (int64, error) {
+			local, err := localInput(path)
+			if err != nil {
+				return 0, err
+			}
+			path = local
+			data, err = os.ReadFile(path)
+			return int64(len(data)), err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if isRawRGBA(path) {
+			return decodeRawRGBA(data)
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		return img, decodeError(err)
+	}
+
+	path, err := localInput(path)
+	if err != nil {
+		return nil, err
+	}
+	if isRawRGBA(path) {
+		return loadRawRGBA(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return img, nil
+}
+
+// decodeError classifies an error of image.Decode for loadImage.
+func decodeError(err error) error {
+	var pathErr *fs.PathError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, image.ErrFormat):
+		return ErrUnsupportedFormat
+	case errors.As(err, &pathErr):
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrDecode, err)
+}
+
+// saveImage writes img in the format named by the extension of path: QOI
+// for .qoi, raw RGBA for .raw and .rgba, otherwise PNG at the --compression level, encoding
+// *image.RGBA, which is what the filters return, in parallel.
+func saveImage(path string, img image.Image) error {
+	return saveImageMetadata(path, img, nil)
+}
+
+// saveImageMetadata is saveImage also storing meta, if any, in PNG outputs;
+// QOI and raw RGBA have no place for it.
+func saveImageMetadata(path string, img image.Image, meta *imageMetadata) error {
+	return writeFileAtomic(path, func(w io.Writer) error { return encodeImage(w, path, img, meta) })
+}
+
+// encodeImage writes img to w in the format saveImageMetadata picks for
+// path.
+func encodeImage(w io.Writer, path string, img image.Image, meta *imageMetadata) error {
+	if strings.EqualFold(filepath.Ext(path), ".qoi") {
+		return encodeQOI(w, toRGBA(img))
+	}
+	if isRawRGBA(path) {
+		return encodeRawRGBA(w, toRGBA(img))
+	}
+	if !meta.empty() {
+		w = &chunkInjector{w: w, chunks: meta.pngChunks()}
+	}
+	if rgba, ok := img.(*image.RGBA); ok {
+		return encodePNG(w, rgba, pngCompression, cpuCount())
+	}
+	return (&png.Encoder{CompressionLevel: pngLevel(pngCompression)}).Encode(w, img)
+}
+
+// imageSize reads the dimensions and format of an input from its header
+// without decoding the pixels; raw RGBA reports "raw".
+func imageSize(path string) (width, height int, format string, err error) {
+	if path, err = localInput(path); err != nil {
+		return 0, 0, "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer file.Close()
+	if isRawRGBA(path) {
+		var header [rawHeaderSize]byte
+		if _, err := io.ReadFull(file, header[:]); err != nil {
+			return 0, 0, "", fmt.Errorf("%w: raw rgba: %w", ErrDecode, err)
+		}
+		return int(binary.LittleEndian.Uint32(header[0:])), int(binary.LittleEndian.Uint32(header[4:])), "raw", nil
+	}
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, "", decodeError(err)
+	}
+	return config.Width, config.Height, format, nil
+}
+
+// noClobber makes writeFileAtomic refuse to replace existing files; it is
+// set from --no-clobber.
+var noClobber bool
+
+// writeFileAtomic writes path through a temporary file in the same
+// directory that is renamed over path once write and the sync succeed, so
+// a crash or an interrupt never leaves a truncated file behind: path holds
+// either its old contents or the complete new ones. With noClobber the
+// temporary file is hard-linked into place instead, which fails rather
+// than replace a file that exists, even one created meanwhile. With an
+// I/O pool, write runs here into memory and the file is written on the
+// pool.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	if pool := activeIOPool.Load(); pool != nil {
+		var buf bytes.Buffer
+		if err := write(&buf); err != nil {
+			return err
+		}
+		return pool.write(func() (int64, error) {
+			return int64(buf.Len()), writeFile(path, func(w io.Writer) error {
+				_, err := w.Write(buf.Bytes())
+				return err
+			})
+		})
+	}
+	return writeFile(path, write)
+}
+
+// writeFile is writeFileAtomic writing as write produces the contents.
+func writeFile(path string, write func(io.Writer) error) error {
+	if noClobber {
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("%s: %w", path, fs.ErrExist)
+		}
+	}
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	err = tmp.Chmod(0o644)
+	if err == nil {
+		err = write(tmp)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if noClobber {
+		if err := os.Link(tmp.Name(), path); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return fmt.Errorf("%s: %w", path, fs.ErrExist)
+			}
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmp.Name(), path)
+}
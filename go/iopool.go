@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ioPoolSize is the --io-pool flag: goroutines doing file and network I/O,
+// 0 for none, and below 0 for the default of the command (ioPoolDefault
+// in batch and consume, none otherwise).
+var ioPoolSize = -1
+
+// ioPoolDefault is the I/O pool size of batch and consume per CPU. The
+// goroutines spend their time blocked in the kernel or on the network, so
+// more of them than CPUs keeps a slow disk or server busy on several
+// requests without taking CPU from the filters.
+const ioPoolDefault = 4
+
+// ioPool runs the blocking part of reading inputs and writing outputs, the
+// file system calls and downloads, on goroutines of its own, apart from
+// the worker pool filtering. loadImage reads a whole file through it and
+// decodes on the caller, writeFileAtomic encodes on the caller and writes
+// through it. A slow disk then queues tasks here while the decoders,
+// encoders and filter workers stay free for images in memory, and a busy
+// CPU doesn't hold back I/O already issued. Unlike workerPool, a task
+// waits for an idle goroutine rather than running inline, so the size
+// bounds the I/O in flight.
+type ioPool struct {
+	size    int
+	tasks   chan func() // unbuffered: a send succeeds only on an idle goroutine
+	started time.Time
+
+	reads, writes           atomic.Int64
+	bytesRead, bytesWritten atomic.Int64
+	busy                    atomic.Int64 // nanoseconds spent running tasks
+	queued                  atomic.Int64 // nanoseconds tasks waited for a goroutine
+}
+
+var activeIOPool atomic.Pointer[ioPool]
+
+// IOPoolStats describes the work done by the I/O pool.
+type IOPoolStats struct {
+	Size         int     `json:"size"`
+	Reads        int64   `json:"reads"`
+	Writes       int64   `json:"writes"`
+	BytesRead    int64   `json:"bytes_read"`
+	BytesWritten int64   `json:"bytes_written"`
+	BusyMs       float64 `json:"busy_ms"`
+	QueuedMs     float64 `json:"queued_ms"` // time tasks waited for an idle goroutine
+	Utilization  float64 `json:"utilization"`
+}
+
+// StartIOPool starts n persistent I/O goroutines; it does nothing if a pool
+// is running or n <= 0.
+func StartIOPool(n int) {
+	if n <= 0 || activeIOPool.Load() != nil {
+		return
+	}
+	p := &ioPool{size: n, tasks: make(chan func()), started: time.Now()}
+	for range n {
+		go func() {
+			for task := range p.tasks {
+				start := time.Now()
+				task()
+				p.busy.Add(int64(time.Since(start)))
+			}
+		}()
+	}
+	activeIOPool.Store(p)
+	logger.Debug("started the I/O pool", "size", n)
+}
+
+// startDefaultIOPool starts the I/O pool of batch and consume.
+func startDefaultIOPool() {
+	n := ioPoolSize
+	if n < 0 {
+		n = ioPoolDefault * cpuCount()
+	}
+	StartIOPool(n)
+}
+
+// read runs fn, which returns the bytes it read, on an I/O goroutine.
+func (p *ioPool) read(fn func() (int64, error)) error {
+	n, err := p.run(fn)
+	p.reads.Add(1)
+	p.bytesRead.Add(n)
+	return err
+}
+
+// write runs fn, which returns the bytes it wrote, on an I/O goroutine.
+func (p *ioPool) write(fn func() (int64, error)) error {
+	n, err := p.run(fn)
+	p.writes.Add(1)
+	p.bytesWritten.Add(n)
+	return err
+}
+
+func (p *ioPool) run(fn func() (int64, error)) (int64, error) {
+	var n int64
+	var err error
+	done := make(chan struct{})
+	start := time.Now()
+	p.tasks <- func() {
+		defer close(done)
+		n, err = fn()
+	}
+	p.queued.Add(int64(time.Since(start)))
+	<-done
+	return n, err
+}
+
+// ioPoolStats reports the running I/O pool, nil if there is none.
+func ioPoolStats() *IOPoolStats {
+	p := activeIOPool.Load()
+	if p == nil {
+		return nil
+	}
+	busy := time.Duration(p.busy.Load())
+	stats := &IOPoolStats{
+		Size:         p.size,
+		Reads:        p.reads.Load(),
+		Writes:       p.writes.Load(),
+		BytesRead:    p.bytesRead.Load(),
+		BytesWritten: p.bytesWritten.Load(),
+		BusyMs:       ms(busy),
+		QueuedMs:     ms(time.Duration(p.queued.Load())),
+	}
+	if uptime := time.Since(p.started); uptime > 0 {
+		stats.Utilization = busy.Seconds() / (uptime.Seconds() * float64(p.size))
+	}
+	return stats
+}
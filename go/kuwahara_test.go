@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The summed-area tables of kuwaharaFilter come in three element types;
+// float64 is the reference.
+
+func TestKuwaharaUint32SAT(t *testing.T) {
+	for _, s := range syntheticImages {
+		img := s.generate()
+		for _, workers := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%s_w%d", s.name, workers), func(t *testing.T) {
+				// Exact; repeated runs also exercise the reuse of slab
+				// buffers of other sizes.
+				for _, radius := range []int{1, 3, 5} {
+					got := kuwaharaFilter[uint32](img, radius, false, workers, nil)
+					want := kuwaharaFilter[float64](img, radius, false, workers, nil)
+					if pixelChecksum(got) != pixelChecksum(want) {
+						t.Errorf("r%d: output differs from the float64 tables", radius)
+					}
+				}
+				takePhases()
+			})
+		}
+	}
+}
+
+func TestKuwaharaFloat32SAT(t *testing.T) {
+	noise := syntheticImages[len(syntheticImages)-1]
+	for _, size := range selftestSizes {
+		s := noise
+		s.width, s.height = size.X, size.Y
+		img := s.generate()
+		t.Run(fmt.Sprintf("%dx%d", size.X, size.Y), func(t *testing.T) {
+			// Mostly equal to the float64 tables: near ties between
+			// quadrants may flip, but most pixels must agree.
+			got := kuwaharaFilter[float32](img, 3, false, 2, nil)
+			_, differing, err := compareImages(got, kuwaharaFilter[float64](img, 3, false, 2, nil))
+			takePhases()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pixels := got.Bounds().Dx() * got.Bounds().Dy(); differing*100 > pixels {
+				t.Errorf("%d of %d pixels differ from the float64 tables", differing, pixels)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LabelStats is the result of labeling an image.
+type LabelStats struct {
+	Width        int     `json:"width"`
+	Height       int     `json:"height"`
+	Bands        int     `json:"bands"`
+	Foreground   int     `json:"foreground_pixels"`
+	Components   int     `json:"components"`
+	Largest      int     `json:"largest_component"`
+	ThresholdMs  float64 `json:"threshold_ms"`
+	LocalMs      float64 `json:"local_ms"`
+	MergeMs      float64 `json:"merge_ms"`
+	RelabelMs    float64 `json:"relabel_ms"`
+	TotalLabelMs float64 `json:"label_ms"`
+}
+
+// labelComponents labels the connected components of the pixels whose
+// luma is at least threshold (below it with invert), 4- or 8-connected.
+// It returns the component of each pixel, numbered from 0 in raster order
+// of their first pixel, and -1 for the background.
+//
+// Each worker takes a band of rows and runs union-find over it, with every
+// pixel's provisional label its own index, so bands need no coordination.
+// The workers then merge the trees across the band borders with lock-free
+// unions, always linking the larger root under the smaller, so every
+// component ends up rooted at its first pixel whatever order the unions
+// ran in. A final pass numbers the roots band by band and relabels.
+func labelComponents(img *image.RGBA, threshold int, invert bool, connectivity, numWorkers int) ([]int32, LabelStats) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	stats := LabelStats{Width: width, Height: height}
+	bands := splitRows(height, numWorkers)
+	stats.Bands = len(bands)
+	parent := make([]int32, width*height)
+	start := time.Now()
+
+	forEachParallel(len(bands), len(bands), func(b int) error {
+		for y := bands[b].start; y < bands[b].end; y++ {
+			row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			for x := range width {
+				p := row[x*4:]
+				luma := (299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000
+				i := int32(y*width + x)
+				if (luma >= threshold) != invert {
+					parent[i] = i
+				} else {
+					parent[i] = -1
+				}
+			}
+		}
+		return nil
+	})
+	stats.ThresholdMs = ms(time.Since(start))
+	phase := time.Now()
+
+	// neighbours visits the earlier neighbours of (x, y) in rows from top.
+	neighbours := func(x, y, top int, fn func(j int32)) {
+		if x > 0 {
+			fn(int32(y*width + x - 1))
+		}
+		if y-1 < top {
+			return
+		}
+		up := (y - 1) * width
+		fn(int32(up + x))
+		if connectivity == 8 {
+			if x > 0 {
+				fn(int32(up + x - 1))
+			}
+			if x+1 < width {
+				fn(int32(up + x + 1))
+			}
+		}
+	}
+	forEachParallel(len(bands), len(bands), func(b int) error {
+		top := bands[b].start
+		for y := top; y < bands[b].end; y++ {
+			for x := range width {
+				i := int32(y*width + x)
+				if parent[i] < 0 {
+					continue
+				}
+				neighbours(x, y, top, func(j int32) {
+					if parent[j] >= 0 {
+						unionLocal(parent, i, j)
+					}
+				})
+			}
+		}
+		return nil
+	})
+	stats.LocalMs = ms(time.Since(phase))
+	phase = time.Now()
+
+	// Merging a border links trees of two bands, which neighbouring borders
+	// may be linking at the same time.
+	forEachParallel(len(bands)-1, len(bands), func(b int) error {
+		y := bands[b+1].start
+		for x := range width {
+			i := int32(y*width + x)
+			if atomic.LoadInt32(&parent[i]) < 0 {
+				continue
+			}
+			neighbours(x, y, y-1, func(j int32) {
+				if int(j) < y*width && atomic.LoadInt32(&parent[j]) >= 0 {
+					unionShared(parent, i, j)
+				}
+			})
+		}
+		return nil
+	})
+	stats.MergeMs = ms(time.Since(phase))
+	phase = time.Now()
+
+	labels := make([]int32, width*height)
+	roots := make([]int, len(bands))
+	forEachParallel(len(bands), len(bands), func(b int) error {
+		for i := bands[b].start * width; i < bands[b].end*width; i++ {
+			labels[i] = -1
+			if parent[i] >= 0 {
+				labels[i] = findRoot(parent, int32(i))
+				if labels[i] == int32(i) {
+					roots[b]++
+				}
+			}
+		}
+		return nil
+	})
+	first := make([]int32, len(bands))
+	for b := range bands {
+		stats.Components += roots[b]
+		if b+1 < len(bands) {
+			first[b+1] = first[b] + int32(roots[b])
+		}
+	}
+	// Roots take their component number in parent, which nothing reads
+	// until every band is numbered.
+	forEachParallel(len(bands), len(bands), func(b int) error {
+		next := first[b]
+		for i := bands[b].start * width; i < bands[b].end*width; i++ {
+			if labels[i] == int32(i) {
+				parent[i] = next
+				next++
+			}
+		}
+		return nil
+	})
+	sizes := make([]int32, stats.Components)
+	var foreground atomic.Int64
+	forEachParallel(len(bands), len(bands), func(b int) error {
+		count := 0
+		for i := bands[b].start * width; i < bands[b].end*width; i++ {
+			if labels[i] >= 0 {
+				labels[i] = parent[labels[i]]
+				atomic.AddInt32(&sizes[labels[i]], 1)
+				count++
+			}
+		}
+		foreground.Add(int64(count))
+		return nil
+	})
+	stats.RelabelMs = ms(time.Since(phase))
+	stats.TotalLabelMs = ms(time.Since(start))
+	stats.Foreground = int(foreground.Load())
+	for _, n := range sizes {
+		stats.Largest = max(stats.Largest, int(n))
+	}
+	return labels, stats
+}
+
+// findRoot follows parent links to the root of i, reading them atomically
+// as the merge may be relinking roots meanwhile.
+func findRoot(parent []int32, i int32) int32 {
+	for {
+		p := atomic.LoadInt32(&parent[i])
+		if p == i {
+			return i
+		}
+		i = p
+	}
+}
+
+// unionLocal joins the trees of i and j within one band, halving the
+// paths it walks.
+func unionLocal(parent []int32, i, j int32) {
+	for parent[i] != i {
+		parent[i] = parent[parent[i]]
+		i = parent[i]
+	}
+	for parent[j] != j {
+		parent[j] = parent[parent[j]]
+		j = parent[j]
+	}
+	if i < j {
+		parent[j] = i
+	} else if j < i {
+		parent[i] = j
+	}
+}
+
+// unionShared joins the trees of i and j while other workers may be
+// joining trees too: a root is only relinked by a compare-and-swap that
+// checks it is still a root, and retried from the new roots otherwise.
+func unionShared(parent []int32, i, j int32) {
+	for {
+		i, j = findRoot(parent, i), findRoot(parent, j)
+		if i == j {
+			return
+		}
+		if i < j {
+			i, j = j, i
+		}
+		if atomic.CompareAndSwapInt32(&parent[i], i, j) {
+			return
+		}
+	}
+}
+
+// colorizeLabels gives every component a colour of its own, spreading the
+// hues by the golden angle, on a black background.
+func colorizeLabels(labels []int32, width, height, numWorkers int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	forEachParallel(height, numWorkers, func(y int) error {
+		for x := range width {
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[3] = 255
+			if id := labels[y*width+x]; id >= 0 {
+				r, g, b := hslToRGB(math.Mod(float64(id)*137.508, 360), 0.75, 0.35+0.3*float64(id%3)/2)
+				d[0], d[1], d[2] = uint8(r*255+0.5), uint8(g*255+0.5), uint8(b*255+0.5)
+			}
+		}
+		return nil
+	})
+	return dst
+}
+
+func labelCommand(program string, args []string, jsonOutput bool) {
+	fs := flag.NewFlagSet("label", flag.ExitOnError)
+	threshold := fs.Int("threshold", 128, "luma (0-255) from which a pixel is foreground")
+	invert := fs.Bool("invert", false, "label the pixels below the threshold instead")
+	connectivity := fs.Int("connectivity", 8, "4 (edges) or 8 (edges and corners)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s label [flags] <input_image> <output_image> [workers]\n", program)
+		fmt.Fprintf(os.Stderr, "  Thresholds the image, labels its connected components with a parallel union-find\n")
+		fmt.Fprintf(os.Stderr, "  and writes them in a colour each, printing how many there are\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 || fs.NArg() > 3 || *threshold < 0 || *threshold > 256 || (*connectivity != 4 && *connectivity != 8) {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	numWorkers := cpuCount()
+	if fs.NArg() == 3 {
+		var err error
+		if numWorkers, err = strconv.Atoi(fs.Arg(2)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+	}
+
+	srcImg, err := loadImage(fs.Arg(0))
+	if err != nil {
+		fatal("failed to load image", "path", fs.Arg(0), "err", err)
+	}
+	img := toRGBA(srcImg)
+	labels, stats := labelComponents(img, *threshold, *invert, *connectivity, numWorkers)
+	if err := saveImage(fs.Arg(1), colorizeLabels(labels, stats.Width, stats.Height, numWorkers)); err != nil {
+		fatal("failed to save image", "path", fs.Arg(1), "err", err)
+	}
+	if jsonOutput {
+		writeJSON(os.Stdout, stats)
+		return
+	}
+	fmt.Printf("Components: %d, the largest %d pixels; %d of %d pixels foreground\n",
+		stats.Components, stats.Largest, stats.Foreground, stats.Width*stats.Height)
+	fmt.Printf("Label time: %.0fms (threshold %.0fms, %d bands %.0fms, merge %.0fms, relabel %.0fms)\n",
+		stats.TotalLabelMs, stats.ThresholdMs, stats.Bands, stats.LocalMs, stats.MergeMs, stats.RelabelMs)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// weighted is a counting semaphore whose capacity can change while it is in
+// use. A capacity of 0 means unlimited.
+type weighted struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+}
+
+func (s *weighted) tryAcquire(n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.capacity > 0 && s.used+n > s.capacity {
+		return false
+	}
+	s.used += n
+	return true
+}
+
+func (s *weighted) release(n int64) {
+	s.mu.Lock()
+	s.used -= n
+	s.mu.Unlock()
+}
+
+func (s *weighted) setCapacity(n int64) {
+	s.mu.Lock()
+	s.capacity = n
+	s.mu.Unlock()
+}
+
+// workerSlots bounds the worker goroutines started by all filters together.
+var workerSlots weighted
+
+// SetMaxConcurrency caps the number of worker goroutines that all filter
+// calls in the process may run at once, however many calls are in flight;
+// n <= 0 removes the cap. Lowering the cap does not interrupt workers that
+// are already running.
+func SetMaxConcurrency(n int) {
+	workerSlots.setCapacity(int64(max(n, 0)))
+}
+
+// workerGroup is the WaitGroup of spawnWorker. A panic in a worker is
+// recovered there and raised again by Wait, on the goroutine that started
+// the workers, so a recover around the filter call (the shard worker's)
+// catches it instead of the whole process going down.
+type workerGroup struct {
+	sync.WaitGroup
+	panicked atomic.Pointer[workerPanic]
+}
+
+// workerPanic is a panic carried over from a worker, with its stack.
+type workerPanic struct {
+	value any
+	stack []byte
+}
+
+func (p *workerPanic) Error() string {
+	return fmt.Sprintf("%v\n\nworker goroutine:\n%s", p.value, p.stack)
+}
+
+// Wait waits for the workers and panics with the first worker panic.
+func (wg *workerGroup) Wait() {
+	wg.WaitGroup.Wait()
+	if p := wg.panicked.Load(); p != nil {
+		panic(p)
+	}
+}
+
+// spawnWorker runs fn on a new goroutine when a worker slot is free and on
+// the calling goroutine otherwise, so a filter always makes progress and
+// nested parallel sections (a tiled filter calling a parallel filter) cannot
+// deadlock waiting for each other's slots. With a worker pool running, the
+// goroutine is an idle one of the pool, and the calling goroutine runs fn
+// when there is none. wg tracks fn either way.
+//
+// Because of the inline fallback, workers must not wait on each other: a
+// worker that only finishes once a sibling has started would hang.
+func spawnWorker(wg *workerGroup, fn func()) {
+	wg.Add(1)
+	if !workerSlots.tryAcquire(1) {
+		defer wg.Done()
+		fn()
+		return
+	}
+	task := func() {
+		defer wg.Done()
+		defer workerSlots.release(1)
+		defer func() {
+			if r := recover(); r != nil {
+				wg.panicked.CompareAndSwap(nil, &workerPanic{r, debug.Stack()})
+			}
+		}()
+		fn()
+	}
+	if p := activePool.Load(); p != nil {
+		if !p.submit(task) {
+			task()
+		}
+		return
+	}
+	go task()
+}
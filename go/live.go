@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The live preview serves a page with the filtered image and controls for
+// the operation, radius and workers; the browser is its window, which
+// keeps the module free of GUI toolkits. Every change asks for a new
+// render. One render runs at a time: a newer request cancels the one in
+// flight through the yield checkpoints and is rendered next, and requests
+// superseded before their turn are never rendered.
+
+// errStaleRender cancels a render a newer request has superseded.
+var errStaleRender = errors.New("superseded by a newer request")
+
+type liveParams struct {
+	operation  string
+	radius     int
+	numWorkers int
+	gen        int64
+}
+
+type liveResult struct {
+	gen int64
+	img *image.RGBA
+	png []byte
+	ms  float64
+	err error
+}
+
+type liveServer struct {
+	src    image.Image
+	output string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	want liveParams // the latest request
+	done liveResult // the latest finished render
+
+	latest  atomic.Int64 // want.gen, for the yield check
+	running atomic.Int64 // gen of the render in flight
+}
+
+// render runs the latest request whenever there is a newer one than the
+// last finished, forever.
+func (s *liveServer) render() {
+	for {
+		s.mu.Lock()
+		for s.want.gen == s.done.gen || s.want.gen == s.running.Load() {
+			s.cond.Wait()
+		}
+		p := s.want
+		s.running.Store(p.gen)
+		s.mu.Unlock()
+
+		start := time.Now()
+		dst, err := applyOperation(p.operation, s.src, p.radius, p.numWorkers)
+		takePhases()
+		result := liveResult{gen: p.gen, img: dst, err: err, ms: ms(time.Since(start))}
+		if errors.Is(err, errStaleRender) {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			continue
+		}
+		if err == nil {
+			var buf bytes.Buffer
+			(&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(&buf, dst)
+			result.png = buf.Bytes()
+		}
+		s.mu.Lock()
+		s.done = result
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+func (s *liveServer) handleRender(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := liveParams{operation: q.Get("operation")}
+	var err1, err2 error
+	p.radius, err1 = strconv.Atoi(q.Get("radius"))
+	p.numWorkers, err2 = strconv.Atoi(q.Get("workers"))
+	if _, ok := lookupOperation(p.operation); !ok || err1 != nil || err2 != nil || p.numWorkers <= 0 {
+		http.Error(w, "want operation, radius and workers", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	p.gen = s.want.gen + 1
+	s.want = p
+	s.latest.Store(p.gen)
+	s.cond.Broadcast()
+	for s.done.gen < p.gen && s.want.gen == p.gen {
+		s.cond.Wait()
+	}
+	result := s.done
+	s.mu.Unlock()
+
+	switch {
+	case result.gen != p.gen:
+		// A newer request will show instead.
+		w.WriteHeader(http.StatusNoContent)
+	case result.err != nil:
+		http.Error(w, result.err.Error(), http.StatusUnprocessableEntity)
+	default:
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Filter-Ms", strconv.FormatFloat(result.ms, 'f', 1, 64))
+		w.Write(result.png)
+	}
+}
+
+func (s *liveServer) handleSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST to save", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	img := s.done.img
+	s.mu.Unlock()
+	if img == nil {
+		http.Error(w, "nothing rendered yet", http.StatusConflict)
+		return
+	}
+	if err := saveImage(s.output, img); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Saved %s", s.output)
+}
+
+var livePage = template.Must(template.New("live").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>filter preview</title>
+<style>
+  body { font-family: sans-serif; margin: 1em; }
+  label { margin-right: 1em; }
+  img { display: block; margin-top: 1em; max-width: 100%; }
+</style>
+</head>
+<body>
+<label>operation <select id="operation">
+{{range .Operations}}<option{{if eq . $.Operation}} selected{{end}}>{{.}}</option>{{end}}
+</select></label>
+<label>radius <input type="range" id="radius" min="0" max="{{.MaxRadius}}" value="{{.Radius}}"> <span id="radiusValue"></span></label>
+<label>workers <input type="range" id="workers" min="1" max="{{.MaxWorkers}}" value="{{.Workers}}"> <span id="workersValue"></span></label>
+<button id="save">Save to {{.Output}}</button>
+<span id="status"></span>
+<img id="result">
+<script>
+const $ = (id) => document.getElementById(id);
+let shown = 0, sent = 0;
+
+async function render() {
+  $("radiusValue").textContent = $("radius").value;
+  $("workersValue").textContent = $("workers").value;
+  const n = ++sent;
+  const params = new URLSearchParams({ operation: $("operation").value, radius: $("radius").value, workers: $("workers").value });
+  $("status").textContent = "Filtering...";
+  const resp = await fetch("render?" + params);
+  if (resp.status === 204 || n < shown) return; // superseded
+  shown = n;
+  if (!resp.ok) {
+    $("status").textContent = await resp.text();
+    return;
+  }
+  const old = $("result").src;
+  $("result").src = URL.createObjectURL(await resp.blob());
+  if (old) URL.revokeObjectURL(old);
+  $("status").textContent = resp.headers.get("X-Filter-Ms") + "ms";
+}
+
+for (const id of ["operation", "radius", "workers"]) $(id).oninput = render;
+$("save").onclick = async () => { $("status").textContent = await (await fetch("save", { method: "POST" })).text(); };
+render();
+</script>
+</body>
+</html>
+`))
+
+// serveLivePreview serves the live preview of srcImg on addr until the
+// process is killed; Save writes the shown image to output.
+func serveLivePreview(addr, operation string, srcImg image.Image, radius, numWorkers int, output string) error {
+	s := &liveServer{src: toRGBA(srcImg), output: output}
+	s.cond = sync.NewCond(&s.mu)
+	SetYieldInterval(16, func() error {
+		if s.running.Load() != s.latest.Load() {
+			return errStaleRender
+		}
+		return nil
+	})
+	go s.render()
+
+	var names []string
+	for _, op := range operations {
+		names = append(names, op.name)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		livePage.Execute(w, map[string]any{
+			"Operations": names,
+			"Operation":  operation,
+			"Radius":     radius,
+			"MaxRadius":  maxRadius(srcImg.Bounds()),
+			"Workers":    numWorkers,
+			"MaxWorkers": max(2*cpuCount(), numWorkers),
+			"Output":     output,
+		})
+	})
+	mux.HandleFunc("/render", s.handleRender)
+	mux.HandleFunc("/save", s.handleSave)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Live preview at http://%s/ (Ctrl-C to stop)\n", listener.Addr())
+	return http.Serve(listener, mux)
+}
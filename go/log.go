@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logger carries the diagnostics of the filter and batch commands: errors,
+// warnings and, with --verbose, the details of each run. It always writes
+// to stderr, so stdout holds only results.
+var logger = slog.New(newLogHandler(os.Stderr, "text", slog.LevelInfo))
+
+// quiet drops the progress lines the filter and batch commands print to
+// stdout, and all logs short of errors; it is set from --quiet.
+var quiet bool
+
+// newLogHandler returns a text handler without timestamps, which only
+// clutter a terminal, or a JSON handler with them for log collectors.
+func newLogHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.TimeKey && len(groups) == 0 {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging applies --quiet, --verbose and --log-format.
+func setupLogging(beQuiet, verbose bool, format string) error {
+	if beQuiet && verbose {
+		return fmt.Errorf("--quiet and --verbose exclude each other")
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+	level := slog.LevelInfo
+	switch {
+	case beQuiet:
+		level = slog.LevelError
+	case verbose:
+		level = slog.LevelDebug
+	}
+	quiet = beQuiet
+	logger = slog.New(newLogHandler(os.Stderr, format, level))
+	return nil
+}
+
+// progressOut is where a command prints its human-readable progress:
+// stdout, or nowhere under --quiet or when a JSON report replaces it.
+func progressOut(jsonOutput bool) io.Writer {
+	if quiet || jsonOutput {
+		return io.Discard
+	}
+	return os.Stdout
+}
+
+// fatal logs an error and exits with the status exitCode gives for the
+// first error among args, 1 if there is none.
+func fatal(msg string, args ...any) {
+	code := exitFailure
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			code = exitCode(err)
+			break
+		}
+	}
+	fatalCode(code, msg, args...)
+}
+
+// fatalCode logs an error and exits with code.
+func fatalCode(code int, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(code)
+}
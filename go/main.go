@@ -1,118 +1,701 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
-	_ "image/jpeg" // Register JPEG decoder
-	"image/png"
 	"os"
-	"runtime"
-	"strconv"
+	"runtime/debug"
+	"strings"
 	"time"
 )
 
-func loadImage(path string) (image.Image, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// applyOperation runs the named image filter.
+func applyOperation(operation string, srcImg image.Image, radius int, numWorkers int) (*image.RGBA, error) {
+	switch operation {
+	case "blur", "blur_u8", "kuwahara", "kuwahara_adaptive", "saliency", "dog", "xdog", "histeq", "grayscale", "sepia", "hsl":
+		var err error
+		if radius, err = checkRadius(operation, radius, srcImg.Bounds()); err != nil {
+			return nil, err
+		}
 	}
-	defer file.Close()
 
-	img, _, err := image.Decode(file)
+	dstImg, err := runFilter(operation, srcImg, radius, numWorkers, nil)
 	if err != nil {
 		return nil, err
 	}
+	// A cancelled run leaves rows unfiltered; don't hand those out.
+	if err := cancelled(); err != nil {
+		return nil, err
+	}
+	return dstImg, nil
+}
 
-	return img, nil
+// runFilter dispatches to the named filter without checking the radius
+// against the image, for callers filtering a tile of a larger image. The
+// filter records its phases in phases, nil for the process-wide log.
+func runFilter(operation string, srcImg image.Image, radius int, numWorkers int, phases *phaseLog) (*image.RGBA, error) {
+	if dstImg, ok := applyGPU(operation, srcImg, radius, phases); ok {
+		return dstImg, nil
+	}
+	switch operation {
+	case "blur":
+		return applyGaussianBlur(srcImg, radius, numWorkers, phases), nil
+	case "blur_u8":
+		return applyGaussianBlurU8(srcImg, radius, numWorkers, phases), nil
+	case "kuwahara":
+		return applyKuwaharaFilter(srcImg, radius, numWorkers, phases), nil
+	case "kuwahara_adaptive":
+		return applyAdaptiveKuwahara(srcImg, radius, numWorkers, phases), nil
+	case "saliency":
+		return applySaliency(srcImg, radius, numWorkers), nil
+	case "dog":
+		opts := defaultDogOptions(radius)
+		opts.tau, opts.eps = 1, -0.01
+		return applyDoG(srcImg, opts, false, numWorkers, phases), nil
+	case "xdog":
+		return applyDoG(srcImg, defaultDogOptions(radius), true, numWorkers, phases), nil
+	case "histeq":
+		return applyHistogramEqualization(srcImg, numWorkers, phases), nil
+	case "grayscale":
+		return applyGrayscale(srcImg, numWorkers), nil
+	case "sepia":
+		return applySepia(srcImg, numWorkers), nil
+	case "hsl":
+		return applyHSL(srcImg, hslAdjust{hue: float64(radius), saturation: 1}, numWorkers), nil
+	}
+	if p, ok := filterPlugins[operation]; ok {
+		return applyPlugin(p, srcImg, radius, numWorkers, phases)
+	}
+	return nil, fmt.Errorf("%w: %s. Use %s", ErrUnknownOperation, operation, operationList())
 }
 
-func saveImage(path string, img image.Image) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
+func startProfiling(prof *profiler) {
+	if err := prof.start(); err != nil {
+		fatal("failed to start profiling", "err", err)
 	}
-	defer file.Close()
+}
 
-	return png.Encode(file, img)
+func stopProfiling(prof *profiler) {
+	if err := prof.stop(); err != nil {
+		fatal("failed to write profile", "err", err)
+	}
 }
 
 func printUsage(program string) {
-	fmt.Fprintf(os.Stderr, "Usage: %s <operation> <input_image> <output_image> <radius> <workers>\n", program)
-	fmt.Fprintf(os.Stderr, "  operation: 'blur', 'kuwahara', or 'monte_carlo'\n")
+	fmt.Fprintf(os.Stderr, "Usage: %s [--json] <operation> [--radius n] [--workers n] <input_image> <output_image>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] <operation> <input_image> <output_image> <radius> <workers>\n", program)
+	fmt.Fprintf(os.Stderr, "  operation: 'blur', 'blur_u8', 'kuwahara', 'kuwahara_adaptive', 'saliency', 'dog', 'xdog',\n")
+	fmt.Fprintf(os.Stderr, "             'histeq', 'grayscale', 'sepia', 'hsl', or 'monte_carlo'\n")
+	if names := pluginNames(); len(names) > 0 {
+		fmt.Fprintf(os.Stderr, "  plugin filters: %s\n", strings.Join(names, ", "))
+	}
+	fmt.Fprintf(os.Stderr, "  Images are PNG, JPEG, QOI (.qoi) or raw RGBA (.raw, .rgba: uint32 LE width and height, then\n")
+	fmt.Fprintf(os.Stderr, "    the pixels, codec-free); outputs are written in the format of their extension, else PNG\n")
+	fmt.Fprintf(os.Stderr, "  '%s <operation> -h' describes the operation and its defaults\n", program)
+	fmt.Fprintf(os.Stderr, "  blur_u8: experimental fixed-point blur on raw bytes, compare with 'bench blur_u8'\n")
+	fmt.Fprintf(os.Stderr, "  radius: at least 1, at most half the smaller image dimension (larger values are clamped)\n")
+	fmt.Fprintf(os.Stderr, "  For kuwahara_adaptive: radius is used in flat areas and shrinks to a quarter on edges\n")
+	fmt.Fprintf(os.Stderr, "  For saliency: radius smooths the spectral residual map (0 to %d)\n", saliencySize/2)
+	fmt.Fprintf(os.Stderr, "  For histeq, grayscale and sepia: radius is ignored (pass 0)\n")
+	fmt.Fprintf(os.Stderr, "  For hsl: radius is the hue rotation in degrees (see 'adjust' for all controls)\n")
 	fmt.Fprintf(os.Stderr, "  For monte_carlo: radius represents the number of samples\n")
+	fmt.Fprintf(os.Stderr, "  --json: print timings as a single JSON object instead of text\n")
+	fmt.Fprintf(os.Stderr, "  --auto-workers: ignore <workers> and pick a count suited to the image size\n")
+	fmt.Fprintf(os.Stderr, "  --cpuprofile, --memprofile, --trace <file>: profile the filter run\n")
+	fmt.Fprintf(os.Stderr, "  --gomaxprocs <n>: threads running Go code; by default the cgroup CPU quota when below the CPU\n")
+	fmt.Fprintf(os.Stderr, "    count, as GOMAXPROCS sizes every default worker count\n")
+	fmt.Fprintf(os.Stderr, "  --max-concurrency <n>: run at most n worker goroutines at once, whatever <workers> says\n")
+	fmt.Fprintf(os.Stderr, "  --tile-heatmap <file>: write an image of per-tile filter cost to reveal load imbalance\n")
+	fmt.Fprintf(os.Stderr, "  --schedule <policy>: split filter rows among workers by static, dynamic, guided,\n")
+	fmt.Fprintf(os.Stderr, "    stealing or adaptive (chunks sized from their measured cost, reported with the timings)\n")
+	fmt.Fprintf(os.Stderr, "  --sigma <s>: blur strength for blur, blur_u8, dog and xdog instead of radius/3;\n")
+	fmt.Fprintf(os.Stderr, "    pass a radius of 0 to cover 3 sigma\n")
+	fmt.Fprintf(os.Stderr, "  --algorithm <name>: how blur applies its kernel: direct (cost growing with the radius), fft\n")
+	fmt.Fprintf(os.Stderr, "    (row and column FFTs, cost nearly flat), auto (fft from radius %d) or iir (recursive\n", fftMinRadius)
+	fmt.Fprintf(os.Stderr, "    Gaussian, flat and cheaper, within a few levels; direct below sigma 2)\n")
+	fmt.Fprintf(os.Stderr, "  Gray inputs (and opaque RGB ones with gray pixels only) blur on one channel rather than four;\n")
+	fmt.Fprintf(os.Stderr, "    gray PNGs stay gray, 16-bit ones at 16 bits, unless --verify or --backend gpu is given\n")
+	fmt.Fprintf(os.Stderr, "  --expr <program>: what custom computes for each pixel, assignments to r, g, b, a (0..1, not\n")
+	fmt.Fprintf(os.Stderr, "    premultiplied) or names of your own separated by ';', over those and x, y, w, h, with\n")
+	fmt.Fprintf(os.Stderr, "    + - * / ^, sin ... sqrt, abs, clamp, min, max, mix, step and gray(): 'l = gray(); r = l; g = l^2'\n")
+	fmt.Fprintf(os.Stderr, "  --kernel <file>: the NxN kernel of convolve, N odd: rows of weights separated by spaces or\n")
+	fmt.Fprintf(os.Stderr, "    commas, or JSON {\"kernel\": [[...]], \"divisor\": d, \"bias\": b}; separable kernels run in two passes\n")
+	fmt.Fprintf(os.Stderr, "  --resize <WxH>: resample the input with Lanczos3 before filtering\n")
+	fmt.Fprintf(os.Stderr, "  --verify: compare the output with a single-threaded run, exit 1 if any channel differs\n")
+	fmt.Fprintf(os.Stderr, "  SIGINT or SIGTERM stops the filter without writing output and exits with status %d\n", exitInterrupted)
+	fmt.Fprintf(os.Stderr, "  --compression <level>: PNG deflate level, none, fast, default, best or 0-9;\n")
+	fmt.Fprintf(os.Stderr, "    outputs are compressed in parallel bands\n")
+	fmt.Fprintf(os.Stderr, "  --thumbnail <WxH>: also write <output>.thumb.png scaled to fit WxH, encoded alongside the output\n")
+	fmt.Fprintf(os.Stderr, "  --keep-metadata: copy the ICC profile, EXIF and XMP of a PNG or JPEG input into the output\n")
+	fmt.Fprintf(os.Stderr, "  --no-clobber: fail rather than overwrite an existing output file\n")
+	fmt.Fprintf(os.Stderr, "  --diff <file>: write a heatmap of how much each output pixel differs from the input,\n")
+	fmt.Fprintf(os.Stderr, "    or with --verify from the single-threaded output\n")
+	fmt.Fprintf(os.Stderr, "  --otlp-endpoint <url>: send decode, filter phase and encode spans to an OpenTelemetry\n")
+	fmt.Fprintf(os.Stderr, "    collector, e.g. http://localhost:4318; OTEL_EXPORTER_OTLP_ENDPOINT works too\n")
+	fmt.Fprintf(os.Stderr, "  --sat <type>: kuwahara summed-area tables in float64, uint32 (half the memory, exact up to\n")
+	fmt.Fprintf(os.Stderr, "    radius %d) or float32 (half the memory, lossy on all but small images)\n", satUint32MaxRadius)
+	fmt.Fprintf(os.Stderr, "  --sat-tiles <mode>: kuwahara builds a table per %dpx tile with a halo rather than one for\n", satTileSize)
+	fmt.Fprintf(os.Stderr, "    the whole image: auto (from %dM pixels), on or off\n", satTiledPixels>>20)
+	fmt.Fprintf(os.Stderr, "  --luma-variance: kuwahara picks quadrants by luma variance rather than R+G+B, building one\n")
+	fmt.Fprintf(os.Stderr, "    table of squares instead of three (a third less memory, nearly the same look)\n")
+	fmt.Fprintf(os.Stderr, "  --max-memory <size>: memory budget (512M, 2G); blur, blur_u8 and kuwahara run tile by tile\n")
+	fmt.Fprintf(os.Stderr, "    with smaller or fewer tiles in flight to stay within it, other filters fail if over\n")
+	fmt.Fprintf(os.Stderr, "  --backend gpu: run blur and kuwahara on the GPU backend of builds with -tags cuda, falling\n")
+	fmt.Fprintf(os.Stderr, "    back to the CPU without one; 'bench --gpu' compares it with the worker counts\n")
+	fmt.Fprintf(os.Stderr, "  Inputs may be http(s) URLs, cached in --http-cache <dir> and revalidated by ETag;\n")
+	fmt.Fprintf(os.Stderr, "    batches download the next inputs while filtering earlier ones\n")
+	fmt.Fprintf(os.Stderr, "  --pool <n>: run the filter workers on n goroutines started once, running a worker inline\n")
+	fmt.Fprintf(os.Stderr, "    when all are busy; batch, serve, consume, video and camera default to one per CPU\n")
+	fmt.Fprintf(os.Stderr, "  --io-pool <n>: read inputs and write outputs on n goroutines of their own, decoding and\n")
+	fmt.Fprintf(os.Stderr, "    encoding in memory, so slow storage and busy CPUs don't hold each other up; batch and\n")
+	fmt.Fprintf(os.Stderr, "    consume default to %d per CPU, 0 does the I/O on the decoding and encoding goroutines\n", ioPoolDefault)
+	fmt.Fprintf(os.Stderr, "  --dry-run: read only the image headers and print the memory and time each job would\n")
+	fmt.Fprintf(os.Stderr, "    take, from cost constants measured on first use and kept in the user cache directory\n")
+	fmt.Fprintf(os.Stderr, "  --quiet: print only results and errors, for scripts; --verbose: also log settings and\n")
+	fmt.Fprintf(os.Stderr, "    phase timings; --log-format json: write the logs on stderr as JSON lines\n")
+	fmt.Fprintf(os.Stderr, "  Exit status: 0 success, 1 other failure, %d bad arguments or unknown operation, %d invalid radius,\n", exitUsage, exitInvalidRadius)
+	fmt.Fprintf(os.Stderr, "    %d unsupported image format, %d corrupt image, %d file I/O error, %d --verify mismatch,\n",
+		exitUnsupportedFormat, exitDecode, exitIO, exitVerifyMismatch)
+	fmt.Fprintf(os.Stderr, "    %d over --max-memory\n", exitMemoryBudget)
+	fmt.Fprintf(os.Stderr, "  --checksum: print the SHA-256 of the raw RGBA output, row by row without padding,\n")
+	fmt.Fprintf(os.Stderr, "    to compare with other implementations independently of the PNG encoder\n")
+	fmt.Fprintf(os.Stderr, "       %s [--json] montecarlo [--workload pi|integrate|option] [--rng name] [flags] <samples> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] bench [flags] <operation> <input_image> <radius> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] ab [flags] \"<command A>\" \"<command B>\"\n", program)
+	fmt.Fprintf(os.Stderr, "       %s tile [flags] <input_image> <output_dir>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s untile [flags] <index.json> <output_image>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s normalize [flags] <input_image> <output.npy|output.raw>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s golden [flags]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s stress [flags]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s smartcrop [flags] <input_image> <output_image> <WxH>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s matte [flags] <input_image> <mask_image> <output_image>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s grabcut [flags] <input_image> <output_image>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s frame [flags] <input_image> <output_image>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s extend [flags] <input_image> <output_image>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s glitch [flags] <input_image> <output_image>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s selftest [flags]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s mandelbrot [flags] <output_image> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s raytrace [flags] <output_image> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s sort [flags] <count> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s sieve [flags] <limit> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] wordcount [flags] <dir> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] pipeline [flags] <items>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s resize [flags] <input_image> <output_image> <WxH> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s preview [flags] <operation> <input_image> <output_image> <radius> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s adjust [flags] <input_image> <output_image> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s pyramid [flags] <input_image> <output_dir> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] batch [flags] <jobs.json>\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] metrics <reference> <image> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] diff <image_a> <image_b> <heatmap_out> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s consume [--redis addr] [--queue list] [--concurrency n] [flags]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s worker [--listen addr] [--workers n]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] coordinate --workers host:port,... [flags] <operation> <input_image> <output_image> [radius]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] video --size WxH [flags] <operation> [radius] < frames.raw > filtered.raw\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] camera [--device /dev/videoN] [flags] <operation> [radius]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s serve [--listen addr] [--max-pixels n] [--rate r] [flags]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] calibrate [--size n] [--radii r,...]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] label [--threshold n] [--connectivity 4|8] [flags] <input_image> <output_image> [workers]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s [--json] blend [--at X,Y] [--mask image] [--mixed] [flags] <background_image> <source_image> <output_image>\n", program)
 }
 
+// platformMain replaces the command line where there is none, such as the
+// js/wasm build.
+var platformMain func()
+
 func main() {
-	if len(os.Args) != 6 {
-		printUsage(os.Args[0])
-		os.Exit(1)
+	if platformMain != nil {
+		platformMain()
+		return
 	}
-
-	operation := os.Args[1]
-	inputPath := os.Args[2]
-	outputPath := os.Args[3]
-	radius, err := strconv.Atoi(os.Args[4])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid radius: %v\n", err)
-		os.Exit(1)
+	jsonOutput := flag.Bool("json", false, "print timings as JSON")
+	autoWorkers := flag.Bool("auto-workers", false, "choose the worker count and tile size from the image size")
+	var prof profiler
+	flag.StringVar(&prof.cpuPath, "cpuprofile", "", "write a CPU profile of the filter run to this file")
+	flag.StringVar(&prof.memPath, "memprofile", "", "write an allocation profile of the filter run to this file")
+	flag.StringVar(&prof.tracePath, "trace", "", "write an execution trace of the filter run to this file")
+	gomaxprocs := flag.Int("gomaxprocs", 0, "OS threads running Go code at once (0 = $GOMAXPROCS, else the container CPU quota or all CPUs)")
+	maxConcurrency := flag.Int("max-concurrency", 0, "cap the worker goroutines running at once across all filters (0 = no cap)")
+	tileHeatmap := flag.String("tile-heatmap", "", "also time the filter tile by tile and write a heatmap of tile cost to this file")
+	schedule := flag.String("schedule", "static", "how the filters split rows among workers: "+strings.Join(schedulerNames, ", "))
+	flag.Float64Var(&blurSigma, "sigma", 0, "Gaussian sigma for blur, blur_u8, dog and xdog (0 = radius/3); a radius of 0 is then derived from it")
+	flag.StringVar(&blurAlgorithm, "algorithm", "auto", fmt.Sprintf("how blur applies its kernel: direct, fft, auto (fft from radius %d) or iir", fftMinRadius))
+	flag.StringVar(&customProgram, "expr", "", "program of the custom operation, such as 'r = clamp(r*1.2); g = gray()'")
+	flag.StringVar(&kernelPath, "kernel", "", "kernel file of the convolve operation: rows of weights, or JSON")
+	resizeTo := flag.String("resize", "", "resample the input to WxH with Lanczos3 before filtering")
+	verify := flag.Bool("verify", false, "rerun the filter with 1 worker and fail if the output differs")
+	thumbnail := flag.String("thumbnail", "", "also write a thumbnail fitting in WxH next to each output, as <name>.thumb.<ext>")
+	flag.BoolVar(&keepMetadata, "keep-metadata", false, "copy the ICC profile, EXIF and XMP of the input into PNG outputs")
+	flag.BoolVar(&noClobber, "no-clobber", false, "fail instead of overwriting existing output files")
+	compression := flag.String("compression", "default", "PNG deflate level: none, fast, default, best or 0-9")
+	diffPath := flag.String("diff", "", "write a heatmap of the per-pixel difference between input and output (the 1-worker output with --verify)")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "export spans of the run to this OpenTelemetry collector over OTLP/HTTP (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.StringVar(&satPrecision, "sat", "float64", "element type of the Kuwahara summed-area tables: float64, or uint32 or float32 for half the memory")
+	flag.StringVar(&satTiling, "sat-tiles", "auto", "Kuwahara summed-area tables per tile: auto (large images), on or off")
+	flag.BoolVar(&kuwaharaLuma, "luma-variance", false, "kuwahara compares the luma variance of quadrants, with a third less table memory")
+	flag.StringVar(&backend, "backend", "cpu", "where blur and kuwahara run: cpu, or gpu with a CUDA build (falls back to cpu)")
+	flag.IntVar(&poolSize, "pool", -1, "run filter workers on this many persistent goroutines (0 = a goroutine per worker; default one per CPU for batch, serve, consume, video and camera, else 0)")
+	flag.IntVar(&ioPoolSize, "io-pool", -1, "do file and network I/O on this many goroutines apart from the filter workers (0 = none; default 4 per CPU for batch and consume, else 0)")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the sizes, memory and predicted time of the work instead of doing it (single runs and batch)")
+	flag.StringVar(&httpCacheDir, "http-cache", "", "directory keeping downloaded http(s) inputs (default: the user cache directory)")
+	maxMemory := flag.String("max-memory", "", "memory budget such as 512M or 2G: tile the filter to fit, fail if it can't")
+	beQuiet := flag.Bool("quiet", false, "print only results and errors")
+	verbose := flag.Bool("verbose", false, "also log settings, phase timings and per-job details")
+	logFormat := flag.String("log-format", "text", "format of the logs on stderr: text or json")
+	checksum := flag.Bool("checksum", false, "print the SHA-256 of the raw RGBA output before encoding")
+	flag.Usage = func() { printUsage(os.Args[0]) }
+	flag.Parse()
+	if err := setupLogging(*beQuiet, *verbose, *logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitUsage)
+	}
+	setGOMAXPROCS(*gomaxprocs)
+	SetMaxConcurrency(*maxConcurrency)
+	StartWorkerPool(poolSize)
+	StartIOPool(ioPoolSize)
+	if blurSigma < 0 {
+		fatalCode(exitUsage, "invalid --sigma", "sigma", blurSigma)
+	}
+	if err := checkBlurAlgorithm(blurAlgorithm); err != nil {
+		fatalCode(exitUsage, "invalid --algorithm", "err", err)
 	}
-	numWorkers, err := strconv.Atoi(os.Args[5])
+	if customProgram != "" {
+		if _, err := compilePixelProgram(customProgram); err != nil {
+			fatalCode(exitUsage, "invalid --expr", "err", err)
+		}
+	}
+	if kernelPath != "" {
+		if _, err := loadKernel(kernelPath); err != nil {
+			fatalCode(exitUsage, "invalid --kernel", "err", err)
+		}
+	}
+	sched, err := newScheduler(*schedule)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
-		os.Exit(1)
+		fatalCode(exitUsage, "invalid --schedule", "err", err)
+	}
+	SetScheduler(sched)
+	if *thumbnail != "" {
+		width, height, err := parseSize(*thumbnail)
+		if err != nil {
+			fatalCode(exitUsage, "invalid --thumbnail", "err", err)
+		}
+		thumbnailBox = image.Pt(width, height)
+	}
+	if satPrecision != "float64" && satPrecision != "float32" && satPrecision != "uint32" {
+		fatalCode(exitUsage, "invalid --sat, use float64, uint32 or float32", "sat", satPrecision)
+	}
+	if backend != "cpu" && backend != "gpu" {
+		fatalCode(exitUsage, "invalid --backend, use cpu or gpu", "backend", backend)
+	}
+	if satTiling != "auto" && satTiling != "on" && satTiling != "off" {
+		fatalCode(exitUsage, "invalid --sat-tiles, use auto, on or off", "sat-tiles", satTiling)
+	}
+	var memoryBudget int64
+	if *maxMemory != "" {
+		if memoryBudget, err = parseBytes(*maxMemory); err != nil {
+			fatalCode(exitUsage, "invalid --max-memory", "err", err)
+		}
+		// The GC works harder as the heap nears the budget rather than
+		// letting garbage pile up past it.
+		debug.SetMemoryLimit(memoryBudget)
+	}
+	if pngCompression, err = parseCompression(*compression); err != nil {
+		fatalCode(exitUsage, "invalid --compression", "err", err)
+	}
+
+	args := flag.Args()
+	if len(args) > 0 {
+		switch args[0] {
+		case "bench":
+			benchCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "ab":
+			abCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "tile":
+			tileCommand(os.Args[0], args[1:])
+			return
+		case "untile":
+			untileCommand(os.Args[0], args[1:])
+			return
+		case "normalize":
+			normalizeCommand(os.Args[0], args[1:])
+			return
+		case "golden":
+			goldenCommand(os.Args[0], args[1:])
+			return
+		case "stress":
+			stressCommand(os.Args[0], args[1:])
+			return
+		case "selftest":
+			selftestCommand(os.Args[0], args[1:])
+			return
+		case "smartcrop":
+			smartcropCommand(os.Args[0], args[1:])
+			return
+		case "matte":
+			matteCommand(os.Args[0], args[1:])
+			return
+		case "grabcut":
+			grabcutCommand(os.Args[0], args[1:])
+			return
+		case "frame":
+			frameCommand(os.Args[0], args[1:])
+			return
+		case "extend":
+			extendCommand(os.Args[0], args[1:])
+			return
+		case "glitch":
+			glitchCommand(os.Args[0], args[1:])
+			return
+		case "mandelbrot":
+			mandelbrotCommand(os.Args[0], args[1:])
+			return
+		case "raytrace":
+			raytraceCommand(os.Args[0], args[1:])
+			return
+		case "sort":
+			sortCommand(os.Args[0], args[1:])
+			return
+		case "sieve":
+			sieveCommand(os.Args[0], args[1:])
+			return
+		case "wordcount":
+			wordcountCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "pipeline":
+			pipelineCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "resize":
+			resizeCommand(os.Args[0], args[1:])
+			return
+		case "preview":
+			previewCommand(os.Args[0], args[1:])
+			return
+		case "adjust":
+			adjustCommand(os.Args[0], args[1:])
+			return
+		case "pyramid":
+			pyramidCommand(os.Args[0], args[1:])
+			return
+		case "metrics":
+			metricsCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "diff":
+			diffCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "worker":
+			workerCommand(os.Args[0], args[1:])
+			return
+		case "coordinate":
+			coordinateCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "consume":
+			consumeCommand(os.Args[0], args[1:])
+			return
+		case "video":
+			videoCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "camera":
+			cameraCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "serve":
+			serveCommand(os.Args[0], args[1:])
+			return
+		case "calibrate":
+			calibrateCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "label":
+			labelCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "blend":
+			blendCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "batch":
+			batchCommand(os.Args[0], args[1:], *jsonOutput)
+			return
+		case "montecarlo":
+			montecarloCommand(os.Args[0], args[1:], &prof, *jsonOutput)
+			return
+		}
+	}
+	if len(args) == 0 {
+		printUsage(os.Args[0])
+		os.Exit(exitUsage)
 	}
+	operation, inputPath, outputPath, radius, numWorkers := parseOperationArgs(os.Args[0], args)
 
-	if numWorkers <= 0 {
-		numWorkers = runtime.NumCPU()
+	// In JSON mode the human-readable lines are discarded and a single report
+	// is written to stdout at the end.
+	out := progressOut(*jsonOutput)
+	report := &Report{
+		Operation:  operation,
+		Workers:    numWorkers,
+		Parameters: map[string]any{},
 	}
 
 	if operation == "monte_carlo" {
-		samples := radius
-		fmt.Printf("Monte Carlo Pi estimation with %d samples using %d workers\n", samples, numWorkers)
-		start := time.Now()
-		monteCarloOperation(samples, numWorkers)
-		elapsed := time.Since(start)
-		fmt.Printf("Time: %dms\n", elapsed.Milliseconds())
+		runMonteCarlo(radius, numWorkers, monteCarloOptions{RNG: "lcg"}, &prof, *jsonOutput)
 		return
 	}
 
+	if blurSigma > 0 {
+		switch operation {
+		case "blur", "blur_u8", "dog", "xdog":
+			if radius == 0 {
+				radius = sigmaRadius(blurSigma)
+			}
+			report.Parameters["sigma"] = blurSigma
+		}
+	}
+
+	if dryRun {
+		job := Job{Input: inputPath, Output: outputPath, Steps: []JobStep{{Operation: operation, Radius: radius}}}
+		reportPlan(planJobs([]Job{job}, 1, numWorkers, 0), *jsonOutput)
+		return
+	}
+
+	trapSignals()
+	report.Input = inputPath
+	report.Output = outputPath
+	report.Parameters["radius"] = radius
+
+	startTracing(*otlpEndpoint)
+	root := startSpan(operation, nil)
+	root.setAttr("radius", radius)
+	root.setAttr("workers", numWorkers)
+
 	start := time.Now()
+	span := startSpan("decode", root)
 	srcImg, err := loadImage(inputPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
-		os.Exit(1)
+		fatal("failed to load image", "path", inputPath, "err", err)
 	}
+	span.finish()
 	loadTime := time.Since(start)
 
 	bounds := srcImg.Bounds()
-	fmt.Printf("Image loaded: %dx%d pixels\n", bounds.Max.X, bounds.Max.Y)
-	fmt.Printf("Load time: %dms\n", loadTime.Milliseconds())
+	fmt.Fprintf(out, "Image loaded: %dx%d pixels\n", bounds.Max.X, bounds.Max.Y)
+	fmt.Fprintf(out, "Load time: %dms\n", loadTime.Milliseconds())
+
+	if *resizeTo != "" {
+		width, height, err := parseSize(*resizeTo)
+		if err != nil {
+			fatalCode(exitUsage, "invalid --resize", "err", err)
+		}
+		start = time.Now()
+		span = startSpan("resize", root)
+		setPhaseParent(span)
+		resized, err := resizeImage(srcImg, width, height, "lanczos3", numWorkers, nil)
+		if err != nil {
+			fatal("failed to resize", "err", err)
+		}
+		span.finish()
+		takePhases()
+		resizeTime := time.Since(start)
+		// Resampling counts as part of loading the input.
+		loadTime += resizeTime
+		srcImg, bounds = resized, resized.Bounds()
+		report.Parameters["resize"] = *resizeTo
+		fmt.Fprintf(out, "Resized to %dx%d in %dms\n", width, height, resizeTime.Milliseconds())
+	}
+	report.Width = bounds.Dx()
+	report.Height = bounds.Dy()
+	root.setAttr("width", bounds.Dx())
+	root.setAttr("height", bounds.Dy())
+
+	if *autoWorkers {
+		tune := autoTune(operation, bounds.Dx(), bounds.Dy())
+		numWorkers = tune.Workers
+		tileSize = tune.TileSize
+		report.Workers = numWorkers
+		report.Parameters["tile_size"] = tileSize
+		fmt.Fprintf(out, "Auto-selected %d workers, tile size %d\n", numWorkers, tileSize)
+	}
+
+	clamped, err := checkRadius(operation, radius, bounds)
+	if err != nil {
+		fatal("invalid radius", "err", err)
+	}
+	if clamped != radius {
+		logger.Warn("radius exceeds the maximum for the image size, clamping",
+			"radius", radius, "max", clamped, "width", bounds.Dx(), "height", bounds.Dy())
+		radius = clamped
+		report.Parameters["radius"] = radius
+	}
 
 	var dstImg *image.RGBA
-	start = time.Now()
+	var output image.Image // dstImg, or the single-channel result of a gray input
 
 	switch operation {
 	case "blur":
-		fmt.Printf("Applying Gaussian blur with radius %d using %d workers\n", radius, numWorkers)
-		dstImg = applyGaussianBlur(srcImg, radius, numWorkers)
+		fmt.Fprintf(out, "Applying Gaussian blur with radius %d using %d workers\n", radius, numWorkers)
+	case "blur_u8":
+		fmt.Fprintf(out, "Applying fixed-point Gaussian blur with radius %d using %d workers\n", radius, numWorkers)
 	case "kuwahara":
-		fmt.Printf("Applying Kuwahara filter with radius %d using %d workers\n", radius, numWorkers)
-		dstImg = applyKuwaharaFilter(srcImg, radius, numWorkers)
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown operation: %s. Use 'blur', 'kuwahara', or 'monte_carlo'\n", operation)
-		os.Exit(1)
+		fmt.Fprintf(out, "Applying Kuwahara filter with radius %d using %d workers\n", radius, numWorkers)
+	case "kuwahara_adaptive":
+		fmt.Fprintf(out, "Applying adaptive Kuwahara filter with radius up to %d using %d workers\n", radius, numWorkers)
+	case "saliency":
+		fmt.Fprintf(out, "Computing spectral residual saliency with radius %d using %d workers\n", radius, numWorkers)
+	case "dog", "xdog":
+		fmt.Fprintf(out, "Applying %s line art with radius %d using %d workers\n", strings.ToUpper(operation), radius, numWorkers)
+	case "histeq":
+		fmt.Fprintf(out, "Equalizing the histogram using %d workers\n", numWorkers)
+	case "grayscale", "sepia":
+		fmt.Fprintf(out, "Converting to %s using %d workers\n", operation, numWorkers)
+	case "hsl":
+		fmt.Fprintf(out, "Rotating hue by %d degrees using %d workers\n", radius, numWorkers)
+	}
+	startProfiling(&prof)
+	start = time.Now()
+	span = startSpan("filter", root)
+	setPhaseParent(span)
+	logger.Debug("filtering", "operation", operation, "radius", radius, "workers", numWorkers,
+		"schedule", *schedule, "max_concurrency", *maxConcurrency)
+	memory := &MemoryStats{
+		EstimatedBytes: 4*int64(bounds.Dx())*int64(bounds.Dy()) + estimateFilterBytes(operation, bounds.Dx(), bounds.Dy()),
+		Budget:         memoryBudget,
+	}
+	if memoryBudget > 0 && memory.EstimatedBytes > memoryBudget {
+		// Over budget as a whole image: local filters go through the tiled
+		// pipeline, which holds only the tiles in flight besides the input
+		// and output.
+		if !localOperation(operation) {
+			fatal("cannot fit the filter in the memory budget", "err", fmt.Errorf("%w: %s needs about %.0f MiB and has no tiled mode",
+				ErrMemoryBudget, operation, mib(memory.EstimatedBytes)))
+		}
+		plan, err := fitTiles(operation, bounds.Dx(), bounds.Dy(), radius, numWorkers, memoryBudget)
+		if err != nil {
+			fatal("cannot fit the filter in the memory budget", "err", err)
+		}
+		memory.TileSize, memory.TilesInFlight = plan.size, plan.inFlight
+		fmt.Fprintf(out, "Memory budget: filtering %dpx tiles, %d at a time\n", plan.size, plan.inFlight)
+		dstImg, err = applyTiled(operation, srcImg, radius, plan)
+	} else {
+		// --verify compares with the RGBA path, and the GPU runs RGBA.
+		if !*verify && backend != "gpu" {
+			output, err = applyGrayOperation(operation, srcImg, radius, numWorkers)
+		}
+		// The radius is already checked and clamped above.
+		if output == nil && err == nil {
+			if dstImg, err = runFilter(operation, srcImg, radius, numWorkers, nil); err == nil {
+				err = cancelled()
+			}
+		}
+	}
+	if err != nil {
+		exitIfInterrupted()
+		fatal("filter failed", "operation", operation, "err", err)
+	}
+	span.finish()
+	if output != nil {
+		fmt.Fprintf(out, "Single-channel input: filtered one channel\n")
+		report.Parameters["single_channel"] = true
+		if *diffPath != "" || *checksum {
+			dstImg = toRGBA(output)
+		}
+	} else {
+		output = dstImg
 	}
 
 	filterTime := time.Since(start)
-	fmt.Printf("Filter time: %dms\n", filterTime.Milliseconds())
+	stopProfiling(&prof)
+	phaseList := takePhases()
+	for _, p := range phaseList {
+		fmt.Fprintf(out, "%s time: %dms\n", p.name, p.duration.Milliseconds())
+		logger.Debug("phase", "name", p.name, "ms", ms(p.duration))
+	}
+	fmt.Fprintf(out, "Filter time: %dms\n", filterTime.Milliseconds())
+	if adaptive, ok := sched.(*adaptiveScheduler); ok {
+		chunks := adaptive.chunkStats()
+		fmt.Fprintf(out, "Adaptive chunks: %d over %d passes, settled at %d rows (largest %d)\n",
+			chunks.Chunks, chunks.Runs, chunks.LastChunk, chunks.MaxChunk)
+		report.Parameters["chunks"] = chunks
+	}
+
+	// The image --diff compares the output with: the single-threaded run
+	// under --verify, the input otherwise.
+	diffBase := toRGBA(srcImg)
+	if *verify {
+		span = startSpan("verify", root)
+		setPhaseParent(span)
+		result, ref, err := verifyOperation(operation, srcImg, radius, numWorkers, dstImg)
+		if err != nil {
+			exitIfInterrupted()
+			fatal("verify failed", "err", err)
+		}
+		fmt.Fprintf(out, "Verify: %d workers vs 1, max channel difference R %d G %d B %d A %d, %d pixels differ (reference %.0fms)\n",
+			numWorkers, result.MaxDiff[0], result.MaxDiff[1], result.MaxDiff[2], result.MaxDiff[3], result.DifferingPixels, result.ReferenceMs)
+		span.finish()
+		report.Verify = result
+		diffBase = ref
+	}
+	if *diffPath != "" {
+		heatmap, stats, err := renderDiffHeatmap(diffBase, dstImg, numWorkers)
+		if err == nil {
+			err = saveImage(*diffPath, heatmap)
+		}
+		if err != nil {
+			fatal("failed to write --diff heatmap", "path", *diffPath, "err", err)
+		}
+		printDiffStatsTo(out, stats, bounds.Dx()*bounds.Dy())
+		report.Diff = &stats
+	}
+
+	if *checksum {
+		// Hash the pixels rather than the file: encoders differ between
+		// languages even when the filtered bytes agree.
+		report.Checksum = pixelChecksum(dstImg)
+		fmt.Fprintf(out, "Checksum (SHA-256 of RGBA): %s\n", report.Checksum)
+	}
 
 	start = time.Now()
-	if err := saveImage(outputPath, dstImg); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to save image: %v\n", err)
-		os.Exit(1)
+	span = startSpan("encode", root)
+	var meta *imageMetadata
+	if keepMetadata {
+		if meta, err = readMetadata(inputPath); err != nil {
+			logger.Warn("failed to read metadata, saving without", "path", inputPath, "err", err)
+		}
 	}
+	if err := saveOutput(outputPath, output, meta, numWorkers); err != nil {
+		fatal("failed to save image", "path", outputPath, "err", err)
+	}
+	span.finish()
 	saveTime := time.Since(start)
 
-	fmt.Printf("Save time: %dms\n", saveTime.Milliseconds())
-	fmt.Printf("Total time: %dms\n", (loadTime + filterTime + saveTime).Milliseconds())
+	fmt.Fprintf(out, "Save time: %dms\n", saveTime.Milliseconds())
+	memory.PeakRSSBytes, memory.TotalAllocated = peakRSS(), totalAllocated()
+	report.Memory = memory
+	fmt.Fprintf(out, "Memory: peak RSS %.0f MiB, image buffers estimated at %.0f MiB, %.0f MiB allocated in total\n",
+		mib(memory.PeakRSSBytes), mib(memory.EstimatedBytes), mib(memory.TotalAllocated))
+	fmt.Fprintf(out, "Total time: %dms\n", (loadTime + filterTime + saveTime).Milliseconds())
+
+	if *tileHeatmap != "" {
+		timings, err := timeTiles(operation, srcImg, radius, numWorkers)
+		if err != nil {
+			fatal("failed to time tiles", "err", err)
+		}
+		heatmap, stats := renderTileHeatmap(timings, bounds.Dx(), bounds.Dy())
+		if err := saveImage(*tileHeatmap, heatmap); err != nil {
+			fatal("failed to save tile heatmap", "path", *tileHeatmap, "err", err)
+		}
+		fmt.Fprintf(out, "Tile heatmap: %d tiles of %dpx, %.2fms to %.2fms per tile, slowest %.2fx the mean\n",
+			stats.Tiles, stats.TileSize, stats.MinMs, stats.MaxMs, stats.MaxOverMean)
+		report.Result = stats
+	}
+
+	if *jsonOutput {
+		report.LoadMs = ms(loadTime)
+		report.FilterMs = ms(filterTime)
+		report.SaveMs = ms(saveTime)
+		report.TotalMs = ms(loadTime + filterTime + saveTime)
+		report.addPhases(phaseList)
+		report.write(os.Stdout)
+	}
+	root.finish()
+	exportSpans()
+	if report.Verify != nil && !report.Verify.Match {
+		fatal("verify failed", "err", fmt.Errorf("%w with %d workers", ErrVerifyMismatch, numWorkers))
+	}
 }
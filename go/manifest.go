@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ManifestEntry records one finished job. The input's size and modification
+// time are part of it, so an input replaced since is processed again.
+type ManifestEntry struct {
+	Input   string `json:"input"`
+	Output  string `json:"output"`
+	Steps   string `json:"steps"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"` // Unix nanoseconds
+}
+
+// manifest is the progress file of a batch: one JSON line is appended and
+// synced per finished job, so after a crash it holds every job that
+// completed, plus at most one torn line, which loading skips.
+type manifest struct {
+	mu      sync.Mutex
+	file    *os.File
+	done    map[ManifestEntry]bool
+	started map[string]ManifestEntry // by output, as the inputs were when queued
+}
+
+func stepsKey(steps []JobStep) string {
+	parts := make([]string, len(steps))
+	for i, s := range steps {
+		parts[i] = fmt.Sprintf("%s:%d", s.Operation, s.Radius)
+	}
+	return strings.Join(parts, ",")
+}
+
+// manifestEntry describes job as it would be recorded now; ok is false if
+// the input can't be read.
+func manifestEntry(job Job) (ManifestEntry, bool) {
+	info, err := os.Stat(job.Input)
+	if err != nil {
+		return ManifestEntry{}, false
+	}
+	return ManifestEntry{job.Input, job.Output, stepsKey(job.Steps), info.Size(), info.ModTime().UnixNano()}, true
+}
+
+// loadManifest reads the entries already in path, or none if force is set
+// or there is no such file. It doesn't touch the file; a batch that goes
+// on to run calls open before recording anything.
+func loadManifest(path string, force bool) (*manifest, error) {
+	m := &manifest{done: make(map[ManifestEntry]bool), started: make(map[string]ManifestEntry)}
+	if force {
+		return m, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry ManifestEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			m.done[entry] = true
+		}
+	}
+	return m, scanner.Err()
+}
+
+// open opens path for appending the jobs finished from now on, starting
+// it afresh if force is set.
+func (m *manifest) open(path string, force bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if force {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	m.file = file
+	return nil
+}
+
+// pending drops the jobs the manifest records as done whose output still
+// exists, and notes the state of the inputs of the rest.
+func (m *manifest) pending(jobs []Job) []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var left []Job
+	for _, job := range jobs {
+		entry, ok := manifestEntry(job)
+		if ok && m.done[entry] {
+			if _, err := os.Stat(job.Output); err == nil {
+				continue
+			}
+		}
+		if ok {
+			m.started[job.Output] = entry
+		}
+		left = append(left, job)
+	}
+	return left
+}
+
+// record appends the job writing output, finished successfully, to the
+// manifest. The entry is the input as it was when queued, so an input
+// replaced during the run is not marked done.
+func (m *manifest) record(output string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.started[output]
+	if !ok {
+		return nil
+	}
+	delete(m.started, output)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.done[entry] = true
+	if _, err := m.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+func (m *manifest) Close() error {
+	if m.file == nil {
+		return nil
+	}
+	return m.file.Close()
+}
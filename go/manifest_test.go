@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadManifestWritesNothing(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "progress.jsonl")
+	if _, err := loadManifest(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("loading a missing manifest created it: %v", err)
+	}
+
+	line := `{"input":"a.png","output":"b.png","steps":"blur:3","size":1,"mod_time":2}` + "\n"
+	if err := os.WriteFile(path, []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadManifest(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.done) != 1 {
+		t.Errorf("loaded %d entries, want 1", len(m.done))
+	}
+	if _, err := loadManifest(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != line {
+		t.Errorf("loading with force changed the file to %q", data)
+	}
+
+	if err := m.open(path, true); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Errorf("open with force left %q", data)
+	}
+}
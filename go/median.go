@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// The median filter is added through RegisterFilter, the way filters
+// outside the core are.
+func init() {
+	RegisterFilter(FilterPlugin{
+		Name:        "median",
+		Description: "median of each channel over a square window, removing speckle noise",
+		Param:       "radius",
+		ParamHelp:   "window radius",
+		Default:     2,
+		New: func(radius int) (Filter, error) {
+			if radius < 1 {
+				return nil, fmt.Errorf("%w %d for median: must be at least 1", ErrInvalidRadius, radius)
+			}
+			return medianFilter{radius}, nil
+		},
+	})
+}
+
+type medianFilter struct{ radius int }
+
+func (m medianFilter) Halo() int { return m.radius }
+
+// Apply slides a histogram per channel along each row (Huang's algorithm):
+// moving one pixel right removes a column of the window and adds one, 2r+1
+// pixels rather than (2r+1)². The window is clipped at the image edges.
+func (m medianFilter) Apply(dst *image.RGBA, tile image.Rectangle, halo *image.RGBA) error {
+	r := m.radius
+	bounds := halo.Bounds()
+	var hist [4][256]int32
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		top, bottom := max(y-r, bounds.Min.Y), min(y+r+1, bounds.Max.Y)
+		count := 0
+		column := func(x int, delta int32) {
+			if x < bounds.Min.X || x >= bounds.Max.X {
+				return
+			}
+			for yy := top; yy < bottom; yy++ {
+				p := halo.Pix[halo.PixOffset(x, yy):]
+				for c := range 4 {
+					hist[c][p[c]] += delta
+				}
+			}
+			count += int(delta) * (bottom - top)
+		}
+		hist = [4][256]int32{}
+		for x := tile.Min.X - r; x <= tile.Min.X+r; x++ {
+			column(x, 1)
+		}
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			if x > tile.Min.X {
+				column(x-r-1, -1)
+				column(x+r, 1)
+			}
+			d := dst.Pix[dst.PixOffset(x, y):]
+			a := medianOf(&hist[3], count)
+			for c := range 3 {
+				// Premultiplied colour never exceeds alpha.
+				d[c] = min(medianOf(&hist[c], count), a)
+			}
+			d[3] = a
+		}
+	}
+	return nil
+}
+
+// medianOf returns the median of the count values in hist.
+func medianOf(hist *[256]int32, count int) uint8 {
+	half := int32(count+1) / 2
+	sum := int32(0)
+	for v := range hist {
+		if sum += hist[v]; sum >= half {
+			return uint8(v)
+		}
+	}
+	return 255
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// MemoryResult is the achieved bandwidth of one memory stage or filter at
+// one worker count.
+type MemoryResult struct {
+	Stage    string  `json:"stage"`
+	Kind     string  `json:"kind"` // "memory" or "filter"
+	Workers  int     `json:"workers"`
+	Bytes    int     `json:"bytes"`
+	MedianMs float64 `json:"median_ms"`
+	GBps     float64 `json:"gb_per_s"`
+	OfPeak   float64 `json:"of_peak"`
+}
+
+type MemoryReport struct {
+	Width    int            `json:"width"`
+	Height   int            `json:"height"`
+	PeakGBps float64        `json:"peak_gb_per_s"`
+	Measured bool           `json:"peak_measured"` // peak is the best copy rate, not --peak-gbps
+	Results  []MemoryResult `json:"results"`
+}
+
+// bandwidthBound is the fraction of peak above which a filter is reported
+// as limited by memory rather than arithmetic.
+const bandwidthBound = 0.5
+
+type memoryStage struct {
+	name  string
+	bytes int // bytes read plus bytes written per run
+	job   func(numWorkers int) func()
+}
+
+// memoryStages are the pure data-movement steps the filters are built from:
+// the conversion copy that toRGBA does after decoding, a plain row copy, the
+// transpose between the blur passes and zeroing a fresh buffer.
+func memoryStages(srcImg image.Image) []memoryStage {
+	src := toRGBA(srcImg)
+	bounds := srcImg.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	n := len(src.Pix)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	return []memoryStage{
+		{"convert", 2 * n, func(numWorkers int) func() {
+			return func() {
+				parallelRows(h, numWorkers, func(start, end int) {
+					r := image.Rect(0, start, w, end)
+					draw.Draw(dst, r, srcImg, bounds.Min.Add(r.Min), draw.Src)
+				})
+			}
+		}},
+		{"copy", 2 * n, func(numWorkers int) func() {
+			return func() {
+				parallelRows(h, numWorkers, func(start, end int) {
+					copy(dst.Pix[start*dst.Stride:end*dst.Stride], src.Pix[start*src.Stride:end*src.Stride])
+				})
+			}
+		}},
+		// transposeImage is single-threaded whatever the worker count.
+		{"transpose", 2 * n, func(int) func() {
+			return func() { transposeImage(src) }
+		}},
+		{"zero", n, func(numWorkers int) func() {
+			return func() {
+				parallelRows(h, numWorkers, func(start, end int) {
+					clear(dst.Pix[start*dst.Stride : end*dst.Stride])
+				})
+			}
+		}},
+	}
+}
+
+// memoryFilters are compared against the memory stages. Each must read its
+// input and write its output at least once, so that traffic over the filter
+// time is a lower bound on the bandwidth it uses.
+var memoryFilters = []string{"blur", "blur_u8", "kuwahara", "saliency", "histeq", "grayscale", "sepia", "hsl"}
+
+// memoryBench measures the memory stages and the filters at each worker
+// count and reports their rates against peakGBps, or against the best copy
+// rate seen when peakGBps is 0. A filter moving its minimal traffic at a
+// rate close to the peak is bandwidth-bound; one far below it spends its
+// time on arithmetic.
+func memoryBench(out io.Writer, srcImg image.Image, radius int, counts []int, cfg benchConfig, peakGBps float64) MemoryReport {
+	bounds := srcImg.Bounds()
+	report := MemoryReport{Width: bounds.Dx(), Height: bounds.Dy(), PeakGBps: peakGBps}
+	n := bounds.Dx() * bounds.Dy() * 4
+
+	fmt.Fprintf(out, "Memory bandwidth on %dx%d (%.1f MB per image), %d runs per stage\n",
+		bounds.Dx(), bounds.Dy(), float64(n)/1e6, cfg.runs)
+	for _, numWorkers := range counts {
+		for _, stage := range memoryStages(srcImg) {
+			result := runBench(stage.job(numWorkers), cfg)
+			report.Results = append(report.Results, MemoryResult{
+				Stage: stage.name, Kind: "memory", Workers: numWorkers, Bytes: stage.bytes, MedianMs: result.MedianMs,
+			})
+		}
+		for _, op := range memoryFilters {
+			result := runBench(func() { applyOperation(op, srcImg, radius, numWorkers) }, cfg)
+			report.Results = append(report.Results, MemoryResult{
+				Stage: op, Kind: "filter", Workers: numWorkers, Bytes: 2 * n, MedianMs: result.MedianMs,
+			})
+		}
+	}
+
+	for i := range report.Results {
+		r := &report.Results[i]
+		if r.MedianMs > 0 {
+			r.GBps = float64(r.Bytes) / (r.MedianMs / 1000) / 1e9
+		}
+		if peakGBps == 0 && r.Stage == "copy" {
+			report.PeakGBps = max(report.PeakGBps, r.GBps)
+			report.Measured = true
+		}
+	}
+	for i := range report.Results {
+		if report.PeakGBps > 0 {
+			report.Results[i].OfPeak = report.Results[i].GBps / report.PeakGBps
+		}
+	}
+
+	if report.Measured {
+		fmt.Fprintf(out, "Peak: %.2f GB/s (best copy rate; set --peak-gbps for the theoretical figure)\n", report.PeakGBps)
+	} else {
+		fmt.Fprintf(out, "Peak: %.2f GB/s (theoretical)\n", report.PeakGBps)
+	}
+	fmt.Fprintf(out, "%-10s %8s %12s %10s %8s %8s\n", "stage", "workers", "median", "GB/s", "of peak", "bound")
+	for _, r := range report.Results {
+		bound := ""
+		if r.Kind == "filter" {
+			bound = "compute"
+			if r.OfPeak >= bandwidthBound {
+				bound = "memory"
+			}
+		}
+		fmt.Fprintf(out, "%-10s %8d %10.2fms %10.2f %7.1f%% %8s\n", r.Stage, r.Workers, r.MedianMs, r.GBps, r.OfPeak*100, bound)
+	}
+	return report
+}
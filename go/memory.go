@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// MemoryStats is the memory side of a run: what the process peaked at and
+// what the image buffers were expected to take.
+type MemoryStats struct {
+	PeakRSSBytes   int64 `json:"peak_rss_bytes,omitempty"` // 0 where the OS doesn't report it
+	EstimatedBytes int64 `json:"estimated_bytes"`
+	TotalAllocated int64 `json:"total_allocated_bytes"`
+	Budget         int64 `json:"budget_bytes,omitempty"`
+	TileSize       int   `json:"tile_size,omitempty"` // set when the budget forced tiling
+	TilesInFlight  int   `json:"tiles_in_flight,omitempty"`
+}
+
+// estimateFilterBytes is the memory applyOperation allocates for a width x
+// height image on top of its input: the output plus the intermediates of
+// each filter (the float channels of the blur's FFT and IIR paths, more
+// than the two byte copies of its direct passes, the Kuwahara tables of
+// sums and squares, the DoG luma planes, the adaptive Kuwahara's gradient
+// maps and radii). Per-tile Kuwahara tables are counted for one per CPU
+// with a halo of 32.
+func estimateFilterBytes(operation string, width, height int) int64 {
+	n := int64(width) * int64(height)
+	sat := int64(width+1) * int64(height+1) * 8 // one float64 table channel
+	switch operation {
+	case "blur":
+		return 20 * n
+	case "blur_u8":
+		return 8 * n
+	case "kuwahara", "kuwahara_adaptive":
+		extra := int64(0)
+		if operation == "kuwahara_adaptive" {
+			extra = 10 * n
+		}
+		if useTiledSAT(width, height) {
+			side := int64(satTileSize + 2*32 + 1)
+			sat = side * side * 8 * int64(runtime.GOMAXPROCS(0))
+		}
+		if satPrecision != "float64" {
+			sat /= 2
+		}
+		if kuwaharaLuma {
+			return 4*sat + 4*n + extra // three channels of sums, one of squares
+		}
+		return 6*sat + 4*n + extra
+	case "saliency":
+		return 12*n + saliencySize*saliencySize*64
+	case "dog", "xdog":
+		return 20 * n
+	}
+	return 4 * n
+}
+
+// peakRSS is the largest resident set of the process so far, read from
+// /proc on Linux, 0 elsewhere.
+func peakRSS() int64 {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rest, ok := strings.CutPrefix(scanner.Text(), "VmHWM:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(rest), " kB"), 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+func totalAllocated() int64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.TotalAlloc)
+}
+
+// parseBytes reads a size such as 512M, 2G or 1500000 (bytes); the
+// suffixes are powers of 1024.
+func parseBytes(arg string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(arg)), "B")
+	scale := int64(1)
+	if s != "" {
+		if u, ok := units[s[len(s)-1]]; ok {
+			scale, s = u, s[:len(s)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid size %q, use bytes or a K, M, G or T suffix", arg)
+	}
+	return int64(v * float64(scale)), nil
+}
+
+func mib(b int64) float64 {
+	return float64(b) / (1 << 20)
+}
+
+// tilePlan is how the tiled pipeline cuts an image to stay within a memory
+// budget.
+type tilePlan struct {
+	size     int // tile edge, before the halo
+	inFlight int // tiles filtered at once
+}
+
+// minBudgetTile is the smallest tile fitTiles shrinks to. Below it the halo
+// of larger radii dominates and tiles mostly refilter their neighbours.
+const minBudgetTile = 32
+
+// fitTiles plans the tiled pipeline for budget bytes. The input and output
+// stay whole; each tile in flight adds its copy with a halo of radius and
+// the filter's buffers for that copy. Tiles start at tileSize and are
+// halved until numWorkers of them fit, then fewer run at once.
+func fitTiles(operation string, width, height, radius, numWorkers int, budget int64) (tilePlan, error) {
+	fixed := 8 * int64(width) * int64(height)
+	perTile := func(size int) int64 {
+		side := size + 2*radius
+		return 4*int64(side)*int64(side) + estimateFilterBytes(operation, side, side)
+	}
+	if fixed+perTile(minBudgetTile) > budget {
+		return tilePlan{}, fmt.Errorf("%w: %dx%d needs at least %.1f MiB, the budget is %.1f MiB",
+			ErrMemoryBudget, width, height, mib(fixed+perTile(minBudgetTile)), mib(budget))
+	}
+	size := min(tileSize, max(width, height))
+	for size > minBudgetTile && fixed+int64(numWorkers)*perTile(size) > budget {
+		size = max(size/2, minBudgetTile)
+	}
+	inFlight := int(min(int64(numWorkers), (budget-fixed)/perTile(size)))
+	return tilePlan{size: size, inFlight: max(inFlight, 1)}, nil
+}
+
+// applyTiled is applyOperation for local operations run tile by tile, each
+// tile filtered on one worker with a halo of radius so the result matches
+// the whole-image filter, at most plan.inFlight tiles at a time. The radius
+// is checked against the whole image, not the tiles, which would clamp it
+// differently at the edges.
+func applyTiled(operation string, srcImg image.Image, radius int, plan tilePlan) (*image.RGBA, error) {
+	src := toRGBA(srcImg)
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	radius, err := checkRadius(operation, radius, bounds)
+	if err != nil {
+		return nil, err
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	tiles := gridTiles(width, height, plan.size)
+	err = forEachParallel(len(tiles), plan.inFlight, func(i int) error {
+		r := tiles[i]
+		halo := r.Inset(-radius).Intersect(image.Rect(0, 0, width, height))
+		tile := image.NewRGBA(image.Rect(0, 0, halo.Dx(), halo.Dy()))
+		draw.Draw(tile, tile.Bounds(), src, bounds.Min.Add(halo.Min), draw.Src)
+		out, err := runFilter(operation, tile, radius, 1, nil)
+		if err != nil {
+			return err
+		}
+		if err := cancelled(); err != nil {
+			return err
+		}
+		// Grid tiles don't overlap, so workers write dst without locking.
+		draw.Draw(dst, r, out, r.Min.Sub(halo.Min), draw.Src)
+		return nil
+	})
+	// Per-tile runs record phases of their own.
+	takePhases()
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyTiledMatchesWhole(t *testing.T) {
+	noise := syntheticImages[len(syntheticImages)-1]
+	noise.width, noise.height = 100, 60
+	img := noise.generate()
+	for _, op := range []string{"blur", "kuwahara"} {
+		// Corner tiles with their halo are smaller than twice the radius.
+		for _, radius := range []int{3, 25} {
+			t.Run(fmt.Sprintf("%s_r%d", op, radius), func(t *testing.T) {
+				want, err := applyOperation(op, img, radius, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := applyTiled(op, img, radius, tilePlan{size: 16, inFlight: 3})
+				if err != nil {
+					t.Fatal(err)
+				}
+				takePhases()
+				if pixelChecksum(got) != pixelChecksum(want) {
+					t.Error("tiled output differs from the whole-image filter")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/bits"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// parallelMergeSort sorts data using buf (same length) as scratch space.
+// Each level above depth 0 sorts its left half on a new goroutine and its
+// right half on the current one, then merges; below the cutoff, or for
+// fewer than minParallel elements, it sorts serially.
+func parallelMergeSort(data, buf []int, depth, minParallel int) {
+	if depth <= 0 || len(data) < minParallel {
+		slices.Sort(data)
+		return
+	}
+	mid := len(data) / 2
+	var wg workerGroup
+	spawnWorker(&wg, func() {
+		parallelMergeSort(data[:mid], buf[:mid], depth-1, minParallel)
+	})
+	parallelMergeSort(data[mid:], buf[mid:], depth-1, minParallel)
+	wg.Wait()
+
+	// Merge the sorted halves into buf, then copy back.
+	i, j, k := 0, mid, 0
+	for i < mid && j < len(data) {
+		if data[j] < data[i] {
+			buf[k] = data[j]
+			j++
+		} else {
+			buf[k] = data[i]
+			i++
+		}
+		k++
+	}
+	k += copy(buf[k:], data[i:mid])
+	copy(buf[k:], data[j:])
+	copy(data, buf)
+}
+
+// sortDepth is the recursion depth that gives each worker about two
+// subtrees, so uneven halves still balance.
+func sortDepth(numWorkers int) int {
+	return bits.Len(uint(max(numWorkers, 1)-1)) + 1
+}
+
+func sortCommand(program string, args []string) {
+	var depth, minParallel int
+	var seed int64
+	fs := flag.NewFlagSet("sort", flag.ExitOnError)
+	fs.IntVar(&depth, "depth", 0, "levels of the recursion that spawn goroutines (0 = from the worker count)")
+	fs.IntVar(&minParallel, "min-parallel", 8192, "sort smaller subslices serially")
+	fs.Int64Var(&seed, "seed", 1, "random seed for the generated integers")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s sort [flags] <count> [workers]\n", program)
+		fmt.Fprintf(os.Stderr, "  Sorts count random integers with a parallel merge sort and with sort.Slice\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 || depth < 0 || minParallel < 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	n, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || n <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid count: %s\n", fs.Arg(0))
+		os.Exit(exitUsage)
+	}
+	numWorkers := cpuCount()
+	if fs.NArg() == 2 {
+		if numWorkers, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+	}
+	if depth == 0 {
+		depth = sortDepth(numWorkers)
+	}
+
+	rng := newXoshiro256(uint64(seed))
+	input := make([]int, n)
+	for i := range input {
+		input[i] = int(rng.Float64() * (1 << 53))
+	}
+
+	fmt.Printf("Sorting %d integers, recursion depth %d, %d workers\n", n, depth, numWorkers)
+
+	baseline := slices.Clone(input)
+	start := time.Now()
+	sort.Slice(baseline, func(i, j int) bool { return baseline[i] < baseline[j] })
+	baselineTime := time.Since(start)
+
+	data := slices.Clone(input)
+	buf := make([]int, n)
+	start = time.Now()
+	parallelMergeSort(data, buf, depth, minParallel)
+	sortTime := time.Since(start)
+
+	if !slices.Equal(data, baseline) {
+		fmt.Fprintf(os.Stderr, "Parallel merge sort result differs from sort.Slice\n")
+		os.Exit(exitFailure)
+	}
+	fmt.Printf("sort.Slice time: %dms\n", baselineTime.Milliseconds())
+	fmt.Printf("Merge sort time: %dms\n", sortTime.Milliseconds())
+	fmt.Printf("Speedup: %.2fx\n", baselineTime.Seconds()/sortTime.Seconds())
+}
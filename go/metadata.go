@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// keepMetadata makes the filter and batch commands copy the colour profile,
+// EXIF and XMP of each input into its output; it is set from
+// --keep-metadata.
+var keepMetadata bool
+
+// imageMetadata holds what a filter doesn't change but viewers need: without
+// the ICC profile, a photo in a wide-gamut space such as Display P3 is shown
+// as sRGB and its colours look wrong.
+type imageMetadata struct {
+	icc  []byte // ICC profile
+	exif []byte // TIFF-structured EXIF, starting with the byte order mark
+	xmp  []byte // XMP packet
+}
+
+func (m *imageMetadata) empty() bool {
+	return m == nil || (m.icc == nil && m.exif == nil && m.xmp == nil)
+}
+
+const (
+	pngSignature = "\x89PNG\r\n\x1a\n"
+	xmpKeyword   = "XML:com.adobe.xmp"
+	jpegExifID   = "Exif\x00\x00"
+	jpegXMPID    = "http://ns.adobe.com/xap/1.0/\x00"
+	jpegICCID    = "ICC_PROFILE\x00"
+)
+
+// readMetadata reads the metadata of a PNG or JPEG file. Other formats have
+// none and give nil.
+func readMetadata(path string) (*imageMetadata, error) {
+	path, err := localInput(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	magic, _ := r.Peek(8)
+	switch {
+	case string(magic) == pngSignature:
+		r.Discard(8)
+		return readPNGMetadata(r, info.Size()-8)
+	case len(magic) >= 2 && magic[0] == 0xff && magic[1] == 0xd8:
+		r.Discard(2)
+		return readJPEGMetadata(r)
+	}
+	return nil, nil
+}
+
+// readPNGMetadata reads the chunks after the signature; remaining is the
+// number of bytes left in the file, which no chunk can be longer than.
+func readPNGMetadata(r *bufio.Reader, remaining int64) (*imageMetadata, error) {
+	meta := &imageMetadata{}
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, fmt.Errorf("png: %w", err)
+		}
+		length, kind := binary.BigEndian.Uint32(header[:4]), string(header[4:])
+		remaining -= int64(len(header))
+		if int64(length)+4 > remaining {
+			return nil, fmt.Errorf("png: %s chunk of %d bytes runs past the end of the file", kind, length)
+		}
+		remaining -= int64(length) + 4
+		if kind != "iCCP" && kind != "eXIf" && kind != "iTXt" {
+			if kind == "IEND" {
+				return meta, nil
+			}
+			if _, err := r.Discard(int(length) + 4); err != nil {
+				return nil, fmt.Errorf("png: %w", err)
+			}
+			continue
+		}
+		data := make([]byte, length+4) // with the CRC, which image.Decode checks
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("png: %w", err)
+		}
+		data = data[:length]
+		switch kind {
+		case "iCCP":
+			// Profile name, NUL, compression method, zlib data.
+			if _, rest, ok := bytes.Cut(data, []byte{0}); ok && len(rest) > 0 {
+				if profile, err := inflate(rest[1:]); err == nil {
+					meta.icc = profile
+				}
+			}
+		case "eXIf":
+			meta.exif = data
+		case "iTXt":
+			// Keyword, NUL, compression flag and method, language tag,
+			// NUL, translated keyword, NUL, text.
+			keyword, rest, ok := bytes.Cut(data, []byte{0})
+			if !ok || string(keyword) != xmpKeyword || len(rest) < 2 {
+				continue
+			}
+			compressed := rest[0] == 1
+			fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+			if len(fields) != 3 {
+				continue
+			}
+			text := fields[2]
+			if compressed {
+				var err error
+				if text, err = inflate(text); err != nil {
+					continue
+				}
+			}
+			meta.xmp = text
+		}
+	}
+}
+
+func inflate(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// readJPEGMetadata reads the APP1 (EXIF, XMP) and APP2 (ICC) segments up to
+// the start of the scan. An ICC profile may be split over several APP2
+// segments, each numbered.
+func readJPEGMetadata(r *bufio.Reader) (*imageMetadata, error) {
+	meta := &imageMetadata{}
+	type iccPart struct {
+		seq  byte
+		data []byte
+	}
+	var iccParts []iccPart
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("jpeg: %w", err)
+		}
+		if b != 0xff {
+			return nil, errors.New("jpeg: missing marker")
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff { // fill bytes
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jpeg: %w", err)
+		}
+		if marker == 0xda || marker == 0xd9 { // start of scan, end of image
+			break
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			continue // no payload
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, fmt.Errorf("jpeg: %w", err)
+		}
+		n := int(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return nil, errors.New("jpeg: invalid segment length")
+		}
+		if marker != 0xe1 && marker != 0xe2 {
+			if _, err := r.Discard(n); err != nil {
+				return nil, fmt.Errorf("jpeg: %w", err)
+			}
+			continue
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("jpeg: %w", err)
+		}
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(data, []byte(jpegExifID)):
+			meta.exif = data[len(jpegExifID):]
+		case marker == 0xe1 && bytes.HasPrefix(data, []byte(jpegXMPID)):
+			meta.xmp = data[len(jpegXMPID):]
+		case marker == 0xe2 && bytes.HasPrefix(data, []byte(jpegICCID)) && len(data) >= len(jpegICCID)+2:
+			// Sequence number (from 1) and count, then the profile part.
+			iccParts = append(iccParts, iccPart{data[len(jpegICCID)], data[len(jpegICCID)+2:]})
+		}
+	}
+	slices.SortFunc(iccParts, func(a, b iccPart) int { return int(a.seq) - int(b.seq) })
+	for _, part := range iccParts {
+		meta.icc = append(meta.icc, part.data...)
+	}
+	return meta, nil
+}
+
+// pngChunks encodes meta as the PNG chunks that carry it.
+func (m *imageMetadata) pngChunks() []byte {
+	var buf bytes.Buffer
+	if m.icc != nil {
+		var data bytes.Buffer
+		data.WriteString("ICC profile\x00\x00") // name, NUL, zlib method
+		zw := zlib.NewWriter(&data)
+		zw.Write(m.icc)
+		zw.Close()
+		writeChunk(&buf, "iCCP", data.Bytes())
+	}
+	if m.exif != nil {
+		writeChunk(&buf, "eXIf", m.exif)
+	}
+	if m.xmp != nil {
+		// Uncompressed, no language tag or translated keyword.
+		data := append([]byte(xmpKeyword+"\x00\x00\x00\x00\x00"), m.xmp...)
+		writeChunk(&buf, "iTXt", data)
+	}
+	return buf.Bytes()
+}
+
+// chunkInjector passes a PNG stream through, inserting extra chunks right
+// after IHDR, where the specification wants iCCP, before any image data.
+// It works with any PNG encoder since IHDR is always first and 13 bytes.
+type chunkInjector struct {
+	w       io.Writer
+	chunks  []byte
+	written int
+}
+
+// pngHeaderSize is the signature and the IHDR chunk.
+const pngHeaderSize = 8 + 8 + 13 + 4
+
+func (c *chunkInjector) Write(p []byte) (int, error) {
+	n := 0
+	if c.written < pngHeaderSize {
+		head := min(len(p), pngHeaderSize-c.written)
+		m, err := c.w.Write(p[:head])
+		n += m
+		c.written += m
+		if err != nil {
+			return n, err
+		}
+		if c.written == pngHeaderSize {
+			if _, err := c.w.Write(c.chunks); err != nil {
+				return n, err
+			}
+		}
+		p = p[head:]
+	}
+	m, err := c.w.Write(p)
+	return n + m, err
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadPNGMetadataChunkPastEnd(t *testing.T) {
+	// An iCCP chunk claiming 4GB in a file of a few bytes.
+	data := pngSignature + "\xff\xff\xff\xf0iCCP" + "icc\x00\x00"
+	path := filepath.Join(t.TempDir(), "short.png")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readMetadata(path)
+	if err == nil || !strings.Contains(err.Error(), "past the end") {
+		t.Errorf("error %v, want a chunk past the end of the file", err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// QualityMetrics compares an image against a reference. PSNR is over the
+// R, G and B channels, SSIM over Rec. 601 luma; both are infinite or 1 for
+// identical images.
+type QualityMetrics struct {
+	MSE       float64    `json:"mse"`
+	PSNR      float64    `json:"psnr_db"`  // +Inf is reported as 0 in JSON
+	PSNRRGB   [3]float64 `json:"psnr_rgb"` // per channel, same convention
+	SSIM      float64    `json:"ssim"`
+	Identical bool       `json:"identical"`
+}
+
+// SSIM constants from Wang et al. 2004 for 8-bit data scaled to [0, 1]:
+// an 11-tap Gaussian window with sigma 1.5, K1 = 0.01, K2 = 0.03.
+const (
+	ssimRadius = 5
+	ssimSigma  = 1.5
+	ssimC1     = 0.01 * 0.01
+	ssimC2     = 0.03 * 0.03
+)
+
+func psnr(mse float64) float64 {
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// jsonPSNR maps the infinite PSNR of identical images to 0, which JSON can
+// carry; Identical tells the two apart.
+func jsonPSNR(v float64) float64 {
+	if math.IsInf(v, 1) {
+		return 0
+	}
+	return v
+}
+
+// computeMetrics measures how far img is from ref. The squared errors are
+// summed per worker and merged; SSIM blurs the luma planes, their squares
+// and their product with blurGray, each pass split among workers.
+func computeMetrics(ref, img *image.RGBA, numWorkers int) (QualityMetrics, error) {
+	if ref.Bounds().Size() != img.Bounds().Size() {
+		return QualityMetrics{}, fmt.Errorf("image sizes differ: %v and %v", ref.Bounds().Size(), img.Bounds().Size())
+	}
+	width, height := ref.Bounds().Dx(), ref.Bounds().Dy()
+	n := width * height
+
+	x := make([]float32, n)
+	y := make([]float32, n)
+	var sq [3]float64
+	var mu sync.Mutex
+	parallelRows(height, numWorkers, func(from, to int) {
+		var partial [3]float64
+		for row := from; row < to; row++ {
+			pa := ref.Pix[ref.PixOffset(ref.Bounds().Min.X, ref.Bounds().Min.Y+row):]
+			pb := img.Pix[img.PixOffset(img.Bounds().Min.X, img.Bounds().Min.Y+row):]
+			for col := range width {
+				a, b := pa[col*4:col*4+3], pb[col*4:col*4+3]
+				for c := range 3 {
+					d := float64(a[c]) - float64(b[c])
+					partial[c] += d * d
+				}
+				x[row*width+col] = (0.299*float32(a[0]) + 0.587*float32(a[1]) + 0.114*float32(a[2])) / 255
+				y[row*width+col] = (0.299*float32(b[0]) + 0.587*float32(b[1]) + 0.114*float32(b[2])) / 255
+			}
+		}
+		mu.Lock()
+		for c := range 3 {
+			sq[c] += partial[c]
+		}
+		mu.Unlock()
+	})
+
+	var m QualityMetrics
+	for c := range 3 {
+		m.PSNRRGB[c] = psnr(sq[c] / float64(n))
+		m.MSE += sq[c]
+	}
+	m.MSE /= float64(3 * n)
+	m.PSNR = psnr(m.MSE)
+	m.Identical = m.MSE == 0
+
+	// Local means, variances and covariance under the Gaussian window.
+	kernel := gaussianKernel(ssimRadius, ssimSigma)
+	tmp := make([]float32, n)
+	muX := make([]float32, n)
+	muY := make([]float32, n)
+	sXX := make([]float32, n)
+	sYY := make([]float32, n)
+	sXY := make([]float32, n)
+	blurGray(x, muX, tmp, width, height, kernel, numWorkers)
+	blurGray(y, muY, tmp, width, height, kernel, numWorkers)
+	product := make([]float32, n)
+	for _, p := range []struct {
+		a, b, dst []float32
+	}{{x, x, sXX}, {y, y, sYY}, {x, y, sXY}} {
+		parallelRows(height, numWorkers, func(from, to int) {
+			for i := from * width; i < to*width; i++ {
+				product[i] = p.a[i] * p.b[i]
+			}
+		})
+		blurGray(product, p.dst, tmp, width, height, kernel, numWorkers)
+	}
+
+	var total float64
+	parallelRows(height, numWorkers, func(from, to int) {
+		var sum float64
+		for i := from * width; i < to*width; i++ {
+			mx, my := float64(muX[i]), float64(muY[i])
+			vx := float64(sXX[i]) - mx*mx
+			vy := float64(sYY[i]) - my*my
+			cov := float64(sXY[i]) - mx*my
+			sum += (2*mx*my + ssimC1) * (2*cov + ssimC2) / ((mx*mx + my*my + ssimC1) * (vx + vy + ssimC2))
+		}
+		mu.Lock()
+		total += sum
+		mu.Unlock()
+	})
+	m.SSIM = total / float64(n)
+	if m.Identical {
+		m.SSIM = 1 // rather than 1 ± float32 rounding
+	}
+	return m, nil
+}
+
+func metricsCommand(program string, args []string, jsonOutput bool) {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s metrics <reference> <image> [workers]\n", program)
+		fmt.Fprintf(os.Stderr, "  Prints PSNR and SSIM of an image against a reference of the same size, such as\n")
+		fmt.Fprintf(os.Stderr, "  blur_u8 output against blur output\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	numWorkers := cpuCount()
+	if fs.NArg() == 3 {
+		var err error
+		if numWorkers, err = strconv.Atoi(fs.Arg(2)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+	}
+
+	var imgs [2]*image.RGBA
+	for i := range imgs {
+		img, err := loadImage(fs.Arg(i))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		imgs[i] = toRGBA(img)
+	}
+	m, err := computeMetrics(imgs[0], imgs[1], numWorkers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if jsonOutput {
+		out := m
+		out.PSNR = jsonPSNR(m.PSNR)
+		for c := range out.PSNRRGB {
+			out.PSNRRGB[c] = jsonPSNR(m.PSNRRGB[c])
+		}
+		writeJSON(os.Stdout, out)
+		return
+	}
+	if m.Identical {
+		fmt.Println("Images are identical: PSNR inf, SSIM 1")
+		return
+	}
+	fmt.Printf("PSNR: %.2f dB (R %.2f, G %.2f, B %.2f), MSE %.3f\n", m.PSNR, m.PSNRRGB[0], m.PSNRRGB[1], m.PSNRRGB[2], m.MSE)
+	fmt.Printf("SSIM: %.5f\n", m.SSIM)
+}
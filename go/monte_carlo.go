@@ -1,8 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"sync"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
 )
 
 // Linear Congruential Generator - same formula across all languages
@@ -11,61 +16,284 @@ func lcgRandom(seed *uint32) float64 {
 	return float64(*seed&0x7FFFFFFF) / float64(0x7FFFFFFF)
 }
 
-func monteCarloWorker(samples int, seed uint32) int {
+func monteCarloWorker(samples int, seed *uint32) int {
 	inside := 0
+	state := *seed
 
 	for range samples {
-		x := lcgRandom(&seed)
-		y := lcgRandom(&seed)
+		x := lcgRandom(&state)
+		y := lcgRandom(&state)
 		if x*x + y*y <= 1.0 {
 			inside++
 		}
 	}
 
+	*seed = state
 	return inside
 }
 
-func monteCarloOperation(totalSamples int, numWorkers int) {
+// monteCarloSourceWorker is monteCarloWorker for any generator. The LCG keeps
+// its own loop so the cross-language baseline avoids the interface calls.
+func monteCarloSourceWorker(samples int, src uniformSource) int {
+	inside := 0
+	for range samples {
+		x := src.Float64()
+		y := src.Float64()
+		if x*x+y*y <= 1.0 {
+			inside++
+		}
+	}
+	return inside
+}
+
+// convergencePoint is the running estimate after a number of samples, with
+// its standard error and 95% confidence interval.
+type convergencePoint struct {
+	Samples  int        `json:"samples"`
+	Estimate float64    `json:"estimate"`
+	StdError float64    `json:"std_error"`
+	CI95     [2]float64 `json:"ci95"`
+}
+
+// halfWidth is the distance from the estimate to either end of the interval.
+func (p convergencePoint) halfWidth() float64 {
+	return (p.CI95[1] - p.CI95[0]) / 2
+}
+
+// piConvergence treats every sample as a Bernoulli trial with p = Pi/4, so
+// the estimate 4p has standard error 4*sqrt(p(1-p)/n).
+func piConvergence(samples, inside int) convergencePoint {
+	p := float64(inside) / float64(samples)
+	estimate := 4 * p
+	stdError := 4 * math.Sqrt(p*(1-p)/float64(samples))
+	return convergencePoint{
+		Samples:  samples,
+		Estimate: estimate,
+		StdError: stdError,
+		CI95:     [2]float64{estimate - 1.96*stdError, estimate + 1.96*stdError},
+	}
+}
+
+type monteCarloResult struct {
+	RNG           string             `json:"rng"`
+	Samples       int                `json:"samples"`
+	Inside        int                `json:"inside"`
+	PiEstimate    float64            `json:"pi_estimate"`
+	Error         float64            `json:"error"`
+	StdError      float64            `json:"std_error"`
+	CI95          [2]float64         `json:"ci95"`
+	TargetReached bool               `json:"target_reached,omitempty"`
+	Convergence   []convergencePoint `json:"convergence,omitempty"`
+}
+
+// monteCarloOptions control how monteCarloOperation samples.
+type monteCarloOptions struct {
+	RNG string
+	// ReportEvery splits the run into rounds of this many samples and records
+	// the running estimate after each; 0 runs everything in one round.
+	ReportEvery int
+	// TargetError stops sampling once the 95% confidence interval half-width
+	// drops to this value; the sample count becomes an upper limit.
+	TargetError float64
+	// Progress, if set, is called after every round.
+	Progress func(convergencePoint)
+}
+
+// defaultRound is the round size used with a target error but no explicit
+// reporting interval.
+const defaultRound = 1 << 20
+
+func monteCarloOperation(totalSamples int, numWorkers int, opts monteCarloOptions) (monteCarloResult, error) {
 	if numWorkers <= 0 {
 		numWorkers = 1
 	}
 
-	samplesPerWorker := totalSamples / numWorkers
-	remainder := totalSamples % numWorkers
+	// Each worker keeps its generator between rounds so the sample stream is
+	// the same however the run is split.
+	samplers := make([]func(n int) int, numWorkers)
+	for i := range numWorkers {
+		seed := workerSeed(i)
+		if opts.RNG == "lcg" {
+			state := uint32(seed)
+			samplers[i] = func(n int) int { return monteCarloWorker(n, &state) }
+			continue
+		}
+		src, err := newSource(opts.RNG, uint64(seed))
+		if err != nil {
+			return monteCarloResult{}, err
+		}
+		samplers[i] = func(n int) int { return monteCarloSourceWorker(n, src) }
+	}
 
-	var wg sync.WaitGroup
-	results := make(chan int, numWorkers)
+	round := totalSamples
+	if opts.ReportEvery > 0 {
+		round = opts.ReportEvery
+	} else if opts.TargetError > 0 {
+		round = defaultRound
+	}
 
-	for i := range numWorkers {
-		samples := samplesPerWorker
-		if i == numWorkers-1 {
-			samples += remainder
+	result := monteCarloResult{RNG: opts.RNG}
+	var point convergencePoint
+	for result.Samples < totalSamples {
+		roundSamples := min(round, totalSamples-result.Samples)
+		stats := fanOutSamples(roundSamples, numWorkers, func(workerID, samples int) sampleStats {
+			inside := float64(samplers[workerID](samples))
+			return sampleStats{n: samples, sum: inside, sumSq: inside}
+		})
+		result.Inside += int(stats.sum)
+		result.Samples += roundSamples
+
+		point = piConvergence(result.Samples, result.Inside)
+		if round < totalSamples {
+			result.Convergence = append(result.Convergence, point)
+			if opts.Progress != nil {
+				opts.Progress(point)
+			}
+		}
+		if opts.TargetError > 0 && point.halfWidth() <= opts.TargetError {
+			result.TargetReached = true
+			break
 		}
+	}
 
-		wg.Add(1)
-		go func(workerID int, numSamples int) {
-			defer wg.Done()
-			seed := uint32(12345 + workerID*67890) // Consistent seed pattern
-			inside := monteCarloWorker(numSamples, seed)
-			results <- inside
-		}(i, samples)
+	result.PiEstimate = point.Estimate
+	result.Error = math.Pi - point.Estimate
+	result.StdError = point.StdError
+	result.CI95 = point.CI95
+	return result, nil
+}
+
+// runMonteCarlo estimates Pi and prints the result and timings, or a JSON
+// report in the same shape as the image operations.
+func runMonteCarlo(samples int, numWorkers int, opts monteCarloOptions, prof *profiler, jsonOutput bool) {
+	var out io.Writer = os.Stdout
+	if jsonOutput {
+		out = io.Discard
 	}
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+	if opts.TargetError > 0 {
+		fmt.Fprintf(out, "Monte Carlo Pi estimation to +/-%g (95%% CI) with at most %d samples using %d workers\n", opts.TargetError, samples, numWorkers)
+	} else {
+		fmt.Fprintf(out, "Monte Carlo Pi estimation with %d samples using %d workers\n", samples, numWorkers)
+	}
+	opts.Progress = func(p convergencePoint) {
+		fmt.Fprintf(out, "  %d samples: %.6f +/- %.6f (95%% CI [%.6f, %.6f])\n", p.Samples, p.Estimate, p.halfWidth(), p.CI95[0], p.CI95[1])
+	}
+	startProfiling(prof)
+	start := time.Now()
+	result, err := monteCarloOperation(samples, numWorkers, opts)
+	elapsed := time.Since(start)
+	stopProfiling(prof)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+
+	fmt.Fprintf(out, "Monte Carlo Pi Estimation\n")
+	fmt.Fprintf(out, "RNG: %s\n", result.RNG)
+	fmt.Fprintf(out, "Total samples: %d\n", result.Samples)
+	fmt.Fprintf(out, "Points inside circle: %d\n", result.Inside)
+	fmt.Fprintf(out, "Pi estimate: %.6f\n", result.PiEstimate)
+	fmt.Fprintf(out, "Error: %.6f\n", result.Error)
+	fmt.Fprintf(out, "Standard error: %.6f\n", result.StdError)
+	fmt.Fprintf(out, "95%% CI: [%.6f, %.6f]\n", result.CI95[0], result.CI95[1])
+	if opts.TargetError > 0 && !result.TargetReached {
+		fmt.Fprintf(out, "Target error %g not reached within %d samples\n", opts.TargetError, samples)
+	}
+	fmt.Fprintf(out, "Compute time: %dms\n", elapsed.Milliseconds())
+	fmt.Fprintf(out, "Total time: %dms\n", elapsed.Milliseconds())
 
-	totalInside := 0
-	for inside := range results {
-		totalInside += inside
+	if jsonOutput {
+		report := &Report{
+			Operation:  "monte_carlo",
+			Workers:    numWorkers,
+			Parameters: map[string]any{"samples": samples, "rng": opts.RNG, "report_every": opts.ReportEvery, "target_error": opts.TargetError},
+			FilterMs:   ms(elapsed),
+			TotalMs:    ms(elapsed),
+			Result:     result,
+		}
+		report.write(os.Stdout)
 	}
+}
 
-	piEstimate := 4.0 * float64(totalInside) / float64(totalSamples)
+func montecarloCommand(program string, args []string, prof *profiler, jsonOutput bool) {
+	fs := flag.NewFlagSet("montecarlo", flag.ExitOnError)
+	var opts monteCarloOptions
+	fs.StringVar(&opts.RNG, "rng", "lcg", fmt.Sprintf("random number generator, one of %v", rngNames))
+	fs.IntVar(&opts.ReportEvery, "report-every", 0, "print the running estimate every N samples (0 disables)")
+	fs.Float64Var(&opts.TargetError, "target-error", 0, "sample until the 95% confidence half-width is at most this; <samples> becomes the limit")
+	workload := fs.String("workload", "pi", "'pi', 'integrate' or 'option'")
+	expr := fs.String("expr", "exp(-(x1^2+x2^2))", "integrand over [0,1]^n for --workload integrate, in variables x1..xn")
+	var option optionParams
+	optionType := fs.String("option", "call", "'call' or 'put' for --workload option")
+	fs.Float64Var(&option.Spot, "spot", 100, "initial asset price")
+	fs.Float64Var(&option.Strike, "strike", 100, "strike price")
+	fs.Float64Var(&option.Rate, "rate", 0.05, "risk-free interest rate")
+	fs.Float64Var(&option.Volatility, "volatility", 0.2, "annualized volatility")
+	fs.Float64Var(&option.Maturity, "maturity", 1, "time to maturity in years")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s montecarlo [flags] <samples> [workers]\n", program)
+		fmt.Fprintf(os.Stderr, "  workers defaults to the number of CPUs\n")
+		fmt.Fprintf(os.Stderr, "  --report-every and --target-error apply to the pi workload\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
 
-	fmt.Printf("Monte Carlo Pi Estimation\n")
-	fmt.Printf("Total samples: %d\n", totalSamples)
-	fmt.Printf("Points inside circle: %d\n", totalInside)
-	fmt.Printf("Pi estimate: %.6f\n", piEstimate)
-	fmt.Printf("Error: %.6f\n", 3.141592653589793 - piEstimate)
+	if fs.NArg() < 1 || fs.NArg() > 2 || opts.ReportEvery < 0 || opts.TargetError < 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	samples, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || samples <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid number of samples: %s\n", fs.Arg(0))
+		os.Exit(exitUsage)
+	}
+	numWorkers := cpuCount()
+	if fs.NArg() == 2 {
+		if numWorkers, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+	}
+
+	if _, err := newSource(opts.RNG, 0); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	parameters := map[string]any{"samples": samples, "rng": opts.RNG}
+	switch *workload {
+	case "pi":
+		runMonteCarlo(samples, numWorkers, opts, prof, jsonOutput)
+	case "integrate":
+		fn, dims, err := compileExpr(*expr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitUsage)
+		}
+		parameters["expr"], parameters["dims"] = *expr, dims
+		runEstimate("integrate", numWorkers, parameters, prof, jsonOutput, func() (monteCarloEstimate, error) {
+			return monteCarloIntegrate(fn, dims, samples, numWorkers, opts.RNG)
+		})
+	case "option":
+		if *optionType != "call" && *optionType != "put" {
+			fmt.Fprintf(os.Stderr, "Invalid --option %q: use 'call' or 'put'\n", *optionType)
+			os.Exit(exitUsage)
+		}
+		if option.Spot <= 0 || option.Strike <= 0 || option.Volatility <= 0 || option.Maturity <= 0 {
+			fmt.Fprintf(os.Stderr, "--spot, --strike, --volatility and --maturity must be positive\n")
+			os.Exit(exitUsage)
+		}
+		option.Put = *optionType == "put"
+		parameters["option"] = option
+		runEstimate("option", numWorkers, parameters, prof, jsonOutput, func() (monteCarloEstimate, error) {
+			return monteCarloOption(option, samples, numWorkers, opts.RNG)
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown workload %q: use 'pi', 'integrate' or 'option'\n", *workload)
+		os.Exit(exitUsage)
+	}
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// sampleStats accumulates per-sample values for a Monte Carlo estimate.
+type sampleStats struct {
+	n          int
+	sum, sumSq float64
+}
+
+func (s sampleStats) mean() float64 { return s.sum / float64(s.n) }
+
+// stdError is the standard error of the mean, using the sample variance.
+func (s sampleStats) stdError() float64 {
+	if s.n < 2 {
+		return math.Inf(1)
+	}
+	mean := s.mean()
+	variance := max((s.sumSq-float64(s.n)*mean*mean)/float64(s.n-1), 0)
+	return math.Sqrt(variance / float64(s.n))
+}
+
+// workerSeed is the seed pattern shared by all Monte Carlo workloads.
+func workerSeed(workerID int) int {
+	return 12345 + workerID*67890
+}
+
+// fanOutSamples splits totalSamples between numWorkers goroutines, the last
+// one taking the remainder, and merges the statistics they send back. Every
+// Monte Carlo workload goes through it so they can be benchmarked alike.
+func fanOutSamples(totalSamples, numWorkers int, work func(workerID, samples int) sampleStats) sampleStats {
+	samplesPerWorker := totalSamples / numWorkers
+	remainder := totalSamples % numWorkers
+
+	var wg workerGroup
+	results := make(chan sampleStats, numWorkers)
+
+	for i := range numWorkers {
+		samples := samplesPerWorker
+		if i == numWorkers-1 {
+			samples += remainder
+		}
+
+		spawnWorker(&wg, func() {
+			results <- work(i, samples)
+		})
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var total sampleStats
+	for s := range results {
+		total.n += s.n
+		total.sum += s.sum
+		total.sumSq += s.sumSq
+	}
+	return total
+}
+
+// monteCarloEstimate is the result of the integration and option workloads.
+type monteCarloEstimate struct {
+	Workload string     `json:"workload"`
+	RNG      string     `json:"rng"`
+	Samples  int        `json:"samples"`
+	Estimate float64    `json:"estimate"`
+	StdError float64    `json:"std_error"`
+	CI95     [2]float64 `json:"ci95"`
+	// Exact is the closed-form value when one is known.
+	Exact *float64 `json:"exact,omitempty"`
+}
+
+func newEstimate(workload, rng string, stats sampleStats) monteCarloEstimate {
+	mean, se := stats.mean(), stats.stdError()
+	return monteCarloEstimate{
+		Workload: workload,
+		RNG:      rng,
+		Samples:  stats.n,
+		Estimate: mean,
+		StdError: se,
+		CI95:     [2]float64{mean - 1.96*se, mean + 1.96*se},
+	}
+}
+
+// monteCarloIntegrate estimates the integral of fn over the unit cube
+// [0,1]^dims as the mean of fn at uniformly random points.
+func monteCarloIntegrate(fn exprFunc, dims, totalSamples, numWorkers int, rng string) (monteCarloEstimate, error) {
+	if _, err := newSource(rng, 0); err != nil {
+		return monteCarloEstimate{}, err
+	}
+	stats := fanOutSamples(totalSamples, max(numWorkers, 1), func(workerID, samples int) sampleStats {
+		src, _ := newSource(rng, uint64(workerSeed(workerID)))
+		point := make([]float64, max(dims, 1))
+		s := sampleStats{n: samples}
+		for range samples {
+			for d := range point {
+				point[d] = src.Float64()
+			}
+			v := fn(point)
+			s.sum += v
+			s.sumSq += v * v
+		}
+		return s
+	})
+	return newEstimate("integrate", rng, stats), nil
+}
+
+// optionParams describe a European option under Black-Scholes dynamics.
+type optionParams struct {
+	Put        bool    `json:"put"`
+	Spot       float64 `json:"spot"`
+	Strike     float64 `json:"strike"`
+	Rate       float64 `json:"rate"`
+	Volatility float64 `json:"volatility"`
+	Maturity   float64 `json:"maturity"`
+}
+
+// monteCarloOption prices the option by simulating the terminal price
+// S_T = S_0 exp((r - sigma^2/2)T + sigma sqrt(T) Z) and averaging the
+// discounted payoff. Z is drawn with the Box-Muller transform.
+func monteCarloOption(opt optionParams, totalSamples, numWorkers int, rng string) (monteCarloEstimate, error) {
+	if _, err := newSource(rng, 0); err != nil {
+		return monteCarloEstimate{}, err
+	}
+	drift := (opt.Rate - opt.Volatility*opt.Volatility/2) * opt.Maturity
+	diffusion := opt.Volatility * math.Sqrt(opt.Maturity)
+	discount := math.Exp(-opt.Rate * opt.Maturity)
+
+	stats := fanOutSamples(totalSamples, max(numWorkers, 1), func(workerID, samples int) sampleStats {
+		src, _ := newSource(rng, uint64(workerSeed(workerID)))
+		s := sampleStats{n: samples}
+		for range samples {
+			u1, u2 := positiveUniform(src.Float64()), src.Float64()
+			z := math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+			price := opt.Spot * math.Exp(drift+diffusion*z)
+			payoff := price - opt.Strike
+			if opt.Put {
+				payoff = -payoff
+			}
+			v := discount * max(payoff, 0)
+			s.sum += v
+			s.sumSq += v * v
+		}
+		return s
+	})
+	estimate := newEstimate("option", rng, stats)
+	exact := blackScholes(opt)
+	estimate.Exact = &exact
+	return estimate, nil
+}
+
+// positiveUniform maps a uniform u in [0, 1] onto (0, 1], keeping 0 out of
+// the logarithm of Box-Muller: some sources, lcg among them, can return
+// both ends.
+func positiveUniform(u float64) float64 {
+	const steps = 1 << 53
+	return (u*steps + 1) / (steps + 1)
+}
+
+// blackScholes is the closed-form price of a European option.
+func blackScholes(opt optionParams) float64 {
+	normCDF := func(x float64) float64 { return 0.5 * math.Erfc(-x/math.Sqrt2) }
+	sqrtT := math.Sqrt(opt.Maturity)
+	d1 := (math.Log(opt.Spot/opt.Strike) + (opt.Rate+opt.Volatility*opt.Volatility/2)*opt.Maturity) / (opt.Volatility * sqrtT)
+	d2 := d1 - opt.Volatility*sqrtT
+	discounted := opt.Strike * math.Exp(-opt.Rate*opt.Maturity)
+	if opt.Put {
+		return discounted*normCDF(-d2) - opt.Spot*normCDF(-d1)
+	}
+	return opt.Spot*normCDF(d1) - discounted*normCDF(d2)
+}
+
+// runEstimate times one of the integration or option workloads and prints
+// the result, or a JSON report when requested.
+func runEstimate(workload string, numWorkers int, parameters map[string]any, prof *profiler, jsonOutput bool, run func() (monteCarloEstimate, error)) {
+	var out io.Writer = os.Stdout
+	if jsonOutput {
+		out = io.Discard
+	}
+
+	fmt.Fprintf(out, "Monte Carlo %s with %v samples using %d workers\n", workload, parameters["samples"], numWorkers)
+	startProfiling(prof)
+	start := time.Now()
+	result, err := run()
+	elapsed := time.Since(start)
+	stopProfiling(prof)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+
+	fmt.Fprintf(out, "RNG: %s\n", result.RNG)
+	fmt.Fprintf(out, "Estimate: %.6f\n", result.Estimate)
+	fmt.Fprintf(out, "Standard error: %.6f\n", result.StdError)
+	fmt.Fprintf(out, "95%% CI: [%.6f, %.6f]\n", result.CI95[0], result.CI95[1])
+	if result.Exact != nil {
+		fmt.Fprintf(out, "Exact: %.6f\n", *result.Exact)
+		fmt.Fprintf(out, "Error: %.6f\n", *result.Exact-result.Estimate)
+	}
+	fmt.Fprintf(out, "Compute time: %dms\n", elapsed.Milliseconds())
+	fmt.Fprintf(out, "Total time: %dms\n", elapsed.Milliseconds())
+
+	if jsonOutput {
+		report := &Report{
+			Operation:  "monte_carlo_" + workload,
+			Workers:    numWorkers,
+			Parameters: parameters,
+			FilterMs:   ms(elapsed),
+			TotalMs:    ms(elapsed),
+			Result:     result,
+		}
+		report.write(os.Stdout)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPositiveUniform(t *testing.T) {
+	for _, u := range []float64{0, 0.5, math.Nextafter(1, 0), 1} {
+		v := positiveUniform(u)
+		if v <= 0 || v > 1 || math.IsNaN(math.Log(v)) {
+			t.Errorf("positiveUniform(%v) = %v, want (0, 1]", u, v)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// channelStats computes the per-channel mean and standard deviation of the
+// RGB values (scaled to [0, 1]) with a parallel reduction: each worker sums a
+// band of rows and the partial sums are merged at the end.
+func channelStats(img *image.RGBA, numWorkers int) ([3]float64, [3]float64) {
+	bounds := img.Bounds()
+	height := bounds.Dy()
+	ranges := splitRows(height, numWorkers)
+
+	type partial struct{ sum, sumSq [3]float64 }
+	partials := make([]partial, len(ranges))
+
+	var wg workerGroup
+	for i, r := range ranges {
+		spawnWorker(&wg, func() {
+			p := &partials[i]
+			for y := r.start; y < r.end; y++ {
+				row := img.Pix[y*img.Stride : y*img.Stride+bounds.Dx()*4]
+				for x := 0; x < len(row); x += 4 {
+					for ch := range 3 {
+						v := float64(row[x+ch]) / 255
+						p.sum[ch] += v
+						p.sumSq[ch] += v * v
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	var sum, sumSq [3]float64
+	for _, p := range partials {
+		for ch := range 3 {
+			sum[ch] += p.sum[ch]
+			sumSq[ch] += p.sumSq[ch]
+		}
+	}
+
+	var mean, std [3]float64
+	n := float64(bounds.Dx() * height)
+	for ch := range 3 {
+		mean[ch] = sum[ch] / n
+		std[ch] = math.Sqrt(max(sumSq[ch]/n-mean[ch]*mean[ch], 0))
+	}
+	return mean, std
+}
+
+// normalizeTensor converts the RGB channels to float32 (v/255 - mean) / std in
+// either NCHW (planar) or NHWC (interleaved) order.
+func normalizeTensor(img *image.RGBA, mean, std [3]float64, nchw bool, numWorkers int) []float32 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	plane := width * height
+	tensor := make([]float32, plane*3)
+
+	var scale, offset [3]float32
+	for ch := range 3 {
+		s := std[ch]
+		if s == 0 {
+			s = 1
+		}
+		scale[ch] = float32(1 / (255 * s))
+		offset[ch] = float32(-mean[ch] / s)
+	}
+
+	var wg workerGroup
+	for _, r := range splitRows(height, numWorkers) {
+		spawnWorker(&wg, func() {
+			for y := r.start; y < r.end; y++ {
+				row := img.Pix[y*img.Stride:]
+				for x := range width {
+					for ch := range 3 {
+						v := float32(row[x*4+ch])*scale[ch] + offset[ch]
+						if nchw {
+							tensor[ch*plane+y*width+x] = v
+						} else {
+							tensor[(y*width+x)*3+ch] = v
+						}
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	return tensor
+}
+
+// writeNpy writes a little-endian float32 array in NumPy .npy format v1.0.
+func writeNpy(path string, data []float32, shape []int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dims := make([]string, len(shape))
+	for i, d := range shape {
+		dims[i] = strconv.Itoa(d)
+	}
+	header := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%s), }", strings.Join(dims, ", "))
+	// magic (6) + version (2) + header length (2) + header + '\n' must be a
+	// multiple of 64 bytes.
+	pad := 64 - (10+len(header)+1)%64
+	header += strings.Repeat(" ", pad%64) + "\n"
+
+	w := bufio.NewWriter(file)
+	w.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(w, binary.LittleEndian, uint16(len(header)))
+	w.WriteString(header)
+	if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func writeRawFloat32(path string, data []float32) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func parseTriple(s string) ([3]float64, error) {
+	var v [3]float64
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return v, fmt.Errorf("expected 3 comma-separated values, got %q", s)
+	}
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return v, err
+		}
+		v[i] = x
+	}
+	return v, nil
+}
+
+func normalizeCommand(program string, args []string) {
+	var layout, meanFlag, stdFlag string
+	var numWorkers int
+	fs := flag.NewFlagSet("normalize", flag.ExitOnError)
+	fs.StringVar(&layout, "layout", "nchw", "tensor layout: 'nchw' or 'nhwc'")
+	fs.StringVar(&meanFlag, "mean", "", "per-channel mean 'r,g,b' in [0,1] (default: computed from the image)")
+	fs.StringVar(&stdFlag, "std", "", "per-channel std 'r,g,b' in [0,1] (default: computed from the image)")
+	fs.IntVar(&numWorkers, "workers", cpuCount(), "number of workers")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s normalize [flags] <input_image> <output.npy|output.raw>\n", program)
+		fmt.Fprintf(os.Stderr, "  Writes float32 RGB values (v/255 - mean) / std; .raw has no header\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 || (layout != "nchw" && layout != "nhwc") {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if numWorkers <= 0 {
+		numWorkers = cpuCount()
+	}
+
+	srcImg, err := loadImage(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	img := toRGBA(srcImg)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	mean, std := channelStats(img, numWorkers)
+	fmt.Printf("Image mean: %.4f, %.4f, %.4f\n", mean[0], mean[1], mean[2])
+	fmt.Printf("Image std: %.4f, %.4f, %.4f\n", std[0], std[1], std[2])
+	if meanFlag != "" {
+		if mean, err = parseTriple(meanFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --mean: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if stdFlag != "" {
+		if std, err = parseTriple(stdFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --std: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	nchw := layout == "nchw"
+	tensor := normalizeTensor(img, mean, std, nchw, numWorkers)
+	shape := []int{1, height, width, 3}
+	if nchw {
+		shape = []int{1, 3, height, width}
+	}
+
+	outputPath := fs.Arg(1)
+	if filepath.Ext(outputPath) == ".npy" {
+		err = writeNpy(outputPath, tensor, shape)
+	} else {
+		err = writeRawFloat32(outputPath, tensor)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write tensor: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	fmt.Printf("Wrote %s tensor %v to %s\n", strings.ToUpper(layout), shape, outputPath)
+}
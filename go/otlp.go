@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing exports the stages of a run as OpenTelemetry spans: one root span
+// for the command with decode, filter and encode below it, and the phases
+// the filters record (SAT build, each blur pass, transpose) below the
+// filter span. Spans are buffered and sent in one OTLP/HTTP request with
+// the JSON encoding when the run ends, which any OpenTelemetry collector
+// accepts without the SDK.
+
+// span is a finished or running span. A nil *span is valid and does
+// nothing, so callers don't check whether tracing is on.
+type span struct {
+	name   string
+	id     [8]byte
+	parent *span
+	start  time.Time
+	end    time.Time
+	attrs  map[string]any
+}
+
+var tracing struct {
+	sync.Mutex
+	endpoint string // base URL of the collector, e.g. http://localhost:4318
+	service  string
+	traceID  [16]byte
+	spans    []*span
+	// phaseParent is the span the phases recorded by recordPhase belong to.
+	phaseParent *span
+}
+
+// startTracing turns tracing on for this run. The endpoint falls back to
+// the standard OTEL_EXPORTER_OTLP_ENDPOINT variable; without either,
+// tracing stays off.
+func startTracing(endpoint string) {
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return
+	}
+	tracing.endpoint = strings.TrimSuffix(endpoint, "/")
+	tracing.service = os.Getenv("OTEL_SERVICE_NAME")
+	if tracing.service == "" {
+		tracing.service = "filter"
+	}
+	rand.Read(tracing.traceID[:])
+}
+
+func startSpan(name string, parent *span) *span {
+	if tracing.endpoint == "" {
+		return nil
+	}
+	s := &span{name: name, parent: parent, start: time.Now()}
+	rand.Read(s.id[:])
+	tracing.Lock()
+	tracing.spans = append(tracing.spans, s)
+	tracing.Unlock()
+	return s
+}
+
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]any)
+	}
+	s.attrs[key] = value
+}
+
+func (s *span) finish() {
+	if s != nil {
+		s.end = time.Now()
+	}
+}
+
+// tracePhase adds a span for a phase that just took d. Phases are timed
+// where they run, so the span is reconstructed from the duration.
+func tracePhase(name string, d time.Duration) {
+	if tracing.endpoint == "" {
+		return
+	}
+	tracing.Lock()
+	parent := tracing.phaseParent
+	tracing.Unlock()
+	if s := startSpan(name, parent); s != nil {
+		s.end = time.Now()
+		s.start = s.end.Add(-d)
+	}
+}
+
+// setPhaseParent makes s the parent of the phases recorded from now on.
+func setPhaseParent(s *span) {
+	tracing.Lock()
+	tracing.phaseParent = s
+	tracing.Unlock()
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest. IDs are hex, times are
+// decimal strings of Unix nanoseconds.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+func otlpAttributes(attrs map[string]any) []otlpAttribute {
+	var list []otlpAttribute
+	for key, v := range attrs {
+		var value otlpValue
+		switch v := v.(type) {
+		case string:
+			value.StringValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		list = append(list, otlpAttribute{key, value})
+	}
+	return list
+}
+
+// exportSpans sends the spans of this run to the collector. Spans still
+// running are ended now. Failing to export is reported but doesn't fail
+// the run.
+func exportSpans() {
+	if tracing.endpoint == "" {
+		return
+	}
+	tracing.Lock()
+	list := tracing.spans
+	tracing.spans = nil
+	tracing.Unlock()
+	if len(list) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, len(list))
+	for i, s := range list {
+		if s.end.IsZero() {
+			s.end = time.Now()
+		}
+		spans[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(tracing.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.parent != nil {
+			spans[i].ParentSpanID = hex.EncodeToString(s.parent.id[:])
+		}
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": tracing.service}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "filter"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		logger.Warn("failed to export spans", "err", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(tracing.endpoint+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("failed to export spans", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logger.Warn("failed to export spans", "status", resp.Status)
+	}
+}
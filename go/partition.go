@@ -0,0 +1,29 @@
+package main
+
+// rowRange is a half-open span [start, end) of rows handed to one worker.
+type rowRange struct {
+	start int
+	end   int
+}
+
+// splitRows divides n rows into at most parts contiguous, non-empty ranges
+// whose sizes differ by at most one. When there are fewer rows than workers,
+// the extra workers are simply not used.
+func splitRows(n, parts int) []rowRange {
+	parts = min(max(parts, 1), n)
+	if parts <= 0 {
+		return nil
+	}
+	ranges := make([]rowRange, parts)
+	size, extra := n/parts, n%parts
+	start := 0
+	for i := range ranges {
+		end := start + size
+		if i < extra {
+			end++
+		}
+		ranges[i] = rowRange{start, end}
+		start = end
+	}
+	return ranges
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type pipelineOptions struct {
+	items                           int
+	generators, transformers, sinks int
+	buffer                          int
+	transformWork, sinkWork         int // hash rounds per item in each stage
+}
+
+// stageStats accumulates, across the goroutines of one stage, the time spent
+// blocked sending to a full channel (backpressure) and waiting on an empty
+// one (starvation).
+type stageStats struct {
+	Name      string  `json:"name"`
+	Workers   int     `json:"workers"`
+	Items     int64   `json:"items"`
+	BlockedMs float64 `json:"blocked_send_ms"`
+	StarvedMs float64 `json:"starved_recv_ms"`
+	MaxQueue  int     `json:"max_queue"` // peak length of the stage's output channel
+
+	items   atomic.Int64
+	blocked atomic.Int64
+	starved atomic.Int64
+	queue   atomic.Int64
+}
+
+// send delivers v, timing the wait only when the channel is full.
+func send(ch chan<- uint64, v uint64, s *stageStats) {
+	select {
+	case ch <- v:
+	default:
+		start := time.Now()
+		ch <- v
+		s.blocked.Add(int64(time.Since(start)))
+	}
+	for n := int64(len(ch)); ; {
+		cur := s.queue.Load()
+		if n <= cur || s.queue.CompareAndSwap(cur, n) {
+			break
+		}
+	}
+}
+
+// receive takes the next value, timing the wait only when the channel is
+// empty.
+func receive(ch <-chan uint64, s *stageStats) (uint64, bool) {
+	select {
+	case v, ok := <-ch:
+		return v, ok
+	default:
+		start := time.Now()
+		v, ok := <-ch
+		s.starved.Add(int64(time.Since(start)))
+		return v, ok
+	}
+}
+
+// spin stands in for per-item work: rounds of a 64-bit mix.
+func spin(v uint64, rounds int) uint64 {
+	for range rounds {
+		v ^= v >> 31
+		v *= 0x9e3779b97f4a7c15
+	}
+	return v
+}
+
+// runStage starts n goroutines running fn and closes out, if any, once they
+// all return. Stages use plain goroutines rather than spawnWorker: a stage
+// run inline would wait forever on a channel no one else is serving yet.
+func runStage(n int, out chan uint64, fn func()) *sync.WaitGroup {
+	wg := new(sync.WaitGroup)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+	if out != nil {
+		go func() {
+			wg.Wait()
+			close(out)
+		}()
+	}
+	return wg
+}
+
+// runPipeline pushes opts.items values through generate → transform →
+// aggregate, each stage its own pool of goroutines joined by channels of
+// opts.buffer slots. A slow stage fills the channel in front of it, which
+// shows up as blocked send time upstream and starved receive time
+// downstream. It returns the aggregate and the per-stage statistics.
+func runPipeline(opts pipelineOptions) (uint64, []*stageStats) {
+	gen := &stageStats{Name: "generate", Workers: opts.generators}
+	xform := &stageStats{Name: "transform", Workers: opts.transformers}
+	sink := &stageStats{Name: "aggregate", Workers: opts.sinks}
+	generated := make(chan uint64, opts.buffer)
+	transformed := make(chan uint64, opts.buffer)
+
+	var next atomic.Int64
+	runStage(opts.generators, generated, func() {
+		for {
+			i := next.Add(1) - 1
+			if i >= int64(opts.items) {
+				return
+			}
+			send(generated, uint64(i), gen)
+			gen.items.Add(1)
+		}
+	})
+	runStage(opts.transformers, transformed, func() {
+		for {
+			v, ok := receive(generated, xform)
+			if !ok {
+				return
+			}
+			send(transformed, spin(v, opts.transformWork), xform)
+			xform.items.Add(1)
+		}
+	})
+
+	var total atomic.Uint64
+	sinks := runStage(opts.sinks, nil, func() {
+		var sum uint64
+		for {
+			v, ok := receive(transformed, sink)
+			if !ok {
+				break
+			}
+			sum += spin(v, opts.sinkWork)
+			sink.items.Add(1)
+		}
+		total.Add(sum)
+	})
+	sinks.Wait()
+
+	stats := []*stageStats{gen, xform, sink}
+	for _, s := range stats {
+		s.Items = s.items.Load()
+		s.BlockedMs = ms(time.Duration(s.blocked.Load()))
+		s.StarvedMs = ms(time.Duration(s.starved.Load()))
+		s.MaxQueue = int(s.queue.Load())
+	}
+	return total.Load(), stats
+}
+
+func pipelineCommand(program string, args []string, jsonOutput bool) {
+	opts := pipelineOptions{}
+	fs := flag.NewFlagSet("pipeline", flag.ExitOnError)
+	fs.IntVar(&opts.generators, "generators", 1, "goroutines in the generate stage")
+	fs.IntVar(&opts.transformers, "transformers", 4, "goroutines in the transform stage")
+	fs.IntVar(&opts.sinks, "aggregators", 1, "goroutines in the aggregate stage")
+	fs.IntVar(&opts.buffer, "buffer", 64, "capacity of the channels between stages (0 = unbuffered)")
+	fs.IntVar(&opts.transformWork, "transform-work", 200, "hash rounds per item in the transform stage")
+	fs.IntVar(&opts.sinkWork, "aggregate-work", 10, "hash rounds per item in the aggregate stage")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s pipeline [flags] <items>\n", program)
+		fmt.Fprintf(os.Stderr, "  Runs items through a bounded generate -> transform -> aggregate pipeline\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || opts.generators <= 0 || opts.transformers <= 0 || opts.sinks <= 0 ||
+		opts.buffer < 0 || opts.transformWork < 0 || opts.sinkWork < 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	var err error
+	if opts.items, err = strconv.Atoi(fs.Arg(0)); err != nil || opts.items < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid number of items: %s\n", fs.Arg(0))
+		os.Exit(exitUsage)
+	}
+
+	start := time.Now()
+	total, stats := runPipeline(opts)
+	elapsed := time.Since(start)
+	throughput := float64(opts.items) / elapsed.Seconds()
+
+	if jsonOutput {
+		writeJSON(os.Stdout, Report{
+			Operation: "pipeline",
+			Workers:   opts.generators + opts.transformers + opts.sinks,
+			Parameters: map[string]any{
+				"items": opts.items, "buffer": opts.buffer,
+				"transform_work": opts.transformWork, "aggregate_work": opts.sinkWork,
+			},
+			FilterMs: ms(elapsed),
+			TotalMs:  ms(elapsed),
+			Result:   map[string]any{"checksum": total, "items_per_s": throughput, "stages": stats},
+		})
+		return
+	}
+
+	fmt.Printf("Pipeline of %d items, buffer %d\n", opts.items, opts.buffer)
+	fmt.Printf("%-10s %8s %10s %14s %14s %10s\n", "stage", "workers", "items", "blocked send", "starved recv", "max queue")
+	for _, s := range stats {
+		queue := strconv.Itoa(s.MaxQueue)
+		if s.Name == "aggregate" {
+			queue = "-"
+		}
+		fmt.Printf("%-10s %8d %10d %12.1fms %12.1fms %10s\n", s.Name, s.Workers, s.Items, s.BlockedMs, s.StarvedMs, queue)
+	}
+	fmt.Printf("Checksum: %016x\n", total)
+	fmt.Printf("Pipeline time: %dms (%.0f items/s)\n", elapsed.Milliseconds(), throughput)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+	"time"
+)
+
+// Filter is a filter added to the tool through RegisterFilter, by a file
+// compiled into the binary that calls it from an init function (median.go
+// is one). The core runs it like the built-in filters, tile by tile on the
+// filter workers, with the configured scheduler, worker pool and
+// cancellation, so it shows up in the CLI, batch, serve, video and the
+// rest without changes to them; the filter only states the context a tile
+// needs and computes one tile.
+type Filter interface {
+	// Halo is how far the filter reads around an output pixel: the output
+	// at (x, y) depends only on input pixels within Halo of it in x and y.
+	Halo() int
+	// Apply writes the output pixels of tile, a rectangle in image
+	// coordinates, to dst. halo holds the input over tile grown by Halo on
+	// every side, clipped to the image. Tiles are applied concurrently, so
+	// Apply must write only within tile and share no unsynchronized state
+	// between calls.
+	Apply(dst *image.RGBA, tile image.Rectangle, halo *image.RGBA) error
+}
+
+// FilterPlugin registers a Filter under an operation name.
+type FilterPlugin struct {
+	Name        string
+	Description string
+	Param       string // flag name of the integer parameter, passed as the radius; "" if it takes none
+	ParamHelp   string
+	Default     int
+	// New returns the filter for a parameter value. Errors for values it
+	// doesn't accept should wrap ErrInvalidRadius.
+	New func(param int) (Filter, error)
+}
+
+var filterPlugins = map[string]FilterPlugin{}
+
+// RegisterFilter adds a filter under p.Name. Registering a name twice, or
+// a built-in one, is a programming error and panics.
+func RegisterFilter(p FilterPlugin) {
+	if p.Name == "" || p.New == nil {
+		panic("RegisterFilter: a filter needs a name and New")
+	}
+	if _, taken := lookupOperation(p.Name); taken || p.Name == "monte_carlo" {
+		panic(fmt.Sprintf("RegisterFilter: operation %q already exists", p.Name))
+	}
+	filterPlugins[p.Name] = p
+	operations = append(operations, operationInfo{p.Name, p.Description, p.Param, p.ParamHelp, p.Default})
+}
+
+// pluginNames lists the registered filters in registration order.
+func pluginNames() []string {
+	var names []string
+	for _, op := range operations {
+		if _, ok := filterPlugins[op.name]; ok {
+			names = append(names, op.name)
+		}
+	}
+	return names
+}
+
+// operationList is the operations for error messages: 'a', 'b', or 'c'.
+func operationList() string {
+	var quoted []string
+	for _, op := range operations {
+		quoted = append(quoted, "'"+op.name+"'")
+	}
+	return strings.Join(quoted, ", ") + ", or 'monte_carlo'"
+}
+
+// applyPlugin runs the filter p registers over srcImg, a tile per index
+// of forEachBanded, each handed its halo as a sub-image of the input
+// without copying.
+func applyPlugin(p FilterPlugin, srcImg image.Image, param, numWorkers int, phases *phaseLog) (*image.RGBA, error) {
+	filter, err := p.New(param)
+	if err != nil {
+		return nil, err
+	}
+	src := toRGBA(srcImg)
+	if src.Bounds().Min != (image.Point{}) {
+		moved := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+		draw.Draw(moved, moved.Bounds(), src, src.Bounds().Min, draw.Src)
+		src = moved
+	}
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	halo := filter.Halo()
+	tiles := gridTiles(bounds.Dx(), bounds.Dy(), tileSize)
+	start := time.Now()
+	err = forEachBanded(len(tiles), numWorkers, func(i int) error {
+		if err := cancelled(); err != nil {
+			return err
+		}
+		tile := tiles[i]
+		return filter.Apply(dst, tile, src.SubImage(tile.Inset(-halo).Intersect(bounds)).(*image.RGBA))
+	})
+	phases.record(p.Name, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
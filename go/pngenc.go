@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// pngCompression is the deflate level of saved PNGs, set from --compression.
+var pngCompression = flate.DefaultCompression
+
+// parseCompression accepts none, fast, default, best or a zlib level 0-9.
+func parseCompression(s string) (int, error) {
+	switch s {
+	case "none":
+		return flate.NoCompression, nil
+	case "fast":
+		return flate.BestSpeed, nil
+	case "default":
+		return flate.DefaultCompression, nil
+	case "best":
+		return flate.BestCompression, nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 0 || level > 9 {
+		return 0, fmt.Errorf("invalid compression %q: want none, fast, default, best or 0-9", s)
+	}
+	return level, nil
+}
+
+// pngBandBytes is roughly how much filtered image data each encoder worker
+// deflates at a time. Bands much smaller than this lose compression to the
+// restart of the match search at every band boundary.
+const pngBandBytes = 1 << 20
+
+// encodePNG writes img as an 8-bit RGB or RGBA PNG, deflating bands of rows
+// in parallel the way pigz does: every band is compressed on its own, primed
+// with the last 32KB of the band before it as a preset dictionary, and
+// flushed to a byte boundary, so the compressed bands concatenate into one
+// valid deflate stream whose back-references may reach into the previous
+// band. The Adler-32 of the stream is combined from per-band checksums.
+// Row filters are chosen like image/png does, so the output decodes to the
+// same pixels as png.Encode.
+func encodePNG(w io.Writer, img *image.RGBA, level, numWorkers int) error {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return fmt.Errorf("png: invalid image size %dx%d", width, height)
+	}
+
+	var translucent atomic.Bool
+	parallelRows(height, numWorkers, func(from, to int) {
+		for y := from; y < to && !translucent.Load(); y++ {
+			row := img.Pix[img.PixOffset(img.Bounds().Min.X, img.Bounds().Min.Y+y):]
+			for x := 3; x < width*4; x += 4 {
+				if row[x] != 0xff {
+					translucent.Store(true)
+					break
+				}
+			}
+		}
+	})
+	bpp, colorType := 3, byte(2)
+	if translucent.Load() {
+		bpp, colorType = 4, 6
+	}
+
+	// Rows as PNG stores them (straight alpha), then filtered, each filtered
+	// row prefixed with its filter type.
+	stride := width * bpp
+	raw := make([]byte, height*stride)
+	parallelRows(height, numWorkers, func(from, to int) {
+		for y := from; y < to; y++ {
+			src := img.Pix[img.PixOffset(img.Bounds().Min.X, img.Bounds().Min.Y+y):]
+			dst := raw[y*stride : (y+1)*stride]
+			for x := range width {
+				s, d := src[x*4:x*4+4], dst[x*bpp:]
+				switch a := uint32(s[3]); {
+				case bpp == 3 || a == 0xff:
+					copy(d[:bpp], s)
+				case a == 0:
+					d[0], d[1], d[2], d[3] = 0, 0, 0, 0
+				default:
+					// As color.NRGBAModel: 0x101 widens to 16 bits,
+					// 0xffff/a removes the premultiplication.
+					const m = 0x101 * 0xffff
+					a *= 0x101
+					d[0] = uint8((uint32(s[0]) * m / a) >> 8)
+					d[1] = uint8((uint32(s[1]) * m / a) >> 8)
+					d[2] = uint8((uint32(s[2]) * m / a) >> 8)
+					d[3] = s[3]
+				}
+			}
+		}
+	})
+	filtered := make([]byte, height*(stride+1))
+	parallelRows(height, numWorkers, func(from, to int) {
+		candidate := make([]byte, stride)
+		for y := from; y < to; y++ {
+			var prev []byte
+			if y > 0 {
+				prev = raw[(y-1)*stride : y*stride]
+			}
+			out := filtered[y*(stride+1) : (y+1)*(stride+1)]
+			out[0] = filterRow(out[1:], candidate, raw[y*stride:(y+1)*stride], prev, bpp, level)
+		}
+	})
+
+	rowsPerBand := max(pngBandBytes/(stride+1), 1)
+	bands := (height + rowsPerBand - 1) / rowsPerBand
+	compressed := make([]bytes.Buffer, bands)
+	// zlib header for a 32KB window; FLEVEL is only informative.
+	compressed[0].Write([]byte{0x78, 0x9c})
+	sums := make([]uint32, bands)
+	err := forEachParallel(bands, numWorkers, func(i int) error {
+		start := i * rowsPerBand * (stride + 1)
+		end := min((i+1)*rowsPerBand, height) * (stride + 1)
+		data := filtered[start:end]
+		sums[i] = adler32.Checksum(data)
+		zw, err := flate.NewWriterDict(&compressed[i], level, filtered[max(start-32<<10, 0):start])
+		if err == nil {
+			_, err = zw.Write(data)
+		}
+		if err != nil {
+			return err
+		}
+		if i == bands-1 {
+			return zw.Close()
+		}
+		return zw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("\x89PNG\r\n\x1a\n")
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8], ihdr[9] = 8, colorType // bit depth, colour type; then deflate, adaptive filtering, no interlace
+	writeChunk(bw, "IHDR", ihdr[:])
+	sum := sums[0]
+	for i := 1; i < bands; i++ {
+		bandLen := int64(min((i+1)*rowsPerBand, height)-i*rowsPerBand) * int64(stride+1)
+		sum = adler32Combine(sum, sums[i], bandLen)
+	}
+	binary.Write(&compressed[bands-1], binary.BigEndian, sum)
+	for i := range compressed {
+		writeChunk(bw, "IDAT", compressed[i].Bytes())
+	}
+	writeChunk(bw, "IEND", nil)
+	return bw.Flush()
+}
+
+// filterRow writes the best PNG filter of cur into out and returns its type:
+// the one with the smallest sum of absolute differences, the heuristic
+// image/png uses. Without compression rows are stored unfiltered.
+func filterRow(out, candidate, cur, prev []byte, bpp, level int) byte {
+	if level == flate.NoCompression {
+		copy(out, cur)
+		return 0
+	}
+	best, bestSum := byte(0), -1
+	for ft := range byte(5) {
+		sum := 0
+		for i, c := range cur {
+			var a, b, d int // left, up, up-left
+			if i >= bpp {
+				a = int(cur[i-bpp])
+			}
+			if prev != nil {
+				b = int(prev[i])
+				if i >= bpp {
+					d = int(prev[i-bpp])
+				}
+			}
+			var p int
+			switch ft {
+			case 1:
+				p = a
+			case 2:
+				p = b
+			case 3:
+				p = (a + b) / 2
+			case 4:
+				p = paeth(a, b, d)
+			}
+			v := c - byte(p)
+			candidate[i] = v
+			sum += abs8(v)
+			if bestSum >= 0 && sum >= bestSum {
+				break
+			}
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = ft, sum
+			copy(out, candidate)
+		}
+	}
+	return best
+}
+
+func paeth(a, b, c int) int {
+	pa, pb, pc := abs(b-c), abs(a-c), abs(a+b-2*c)
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// abs8 is the magnitude of v read as a signed byte.
+func abs8(v byte) int {
+	return abs(int(int8(v)))
+}
+
+// adler32Combine is the Adler-32 of two concatenated pieces of data from
+// their checksums and the second piece's length, as zlib's
+// adler32_combine.
+func adler32Combine(adler1, adler2 uint32, len2 int64) uint32 {
+	const base = 65521
+	rem := uint32(len2 % base)
+	sum1 := adler1 & 0xffff
+	sum2 := rem * sum1 % base
+	sum1 += (adler2 & 0xffff) + base - 1
+	sum2 += (adler1 >> 16) + (adler2 >> 16) + base - rem
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum2 >= base<<1 {
+		sum2 -= base << 1
+	}
+	if sum2 >= base {
+		sum2 -= base
+	}
+	return sum2<<16 | sum1
+}
+
+// writeChunk writes a PNG chunk to a buffered writer, which reports any
+// error on Flush.
+func writeChunk(w io.Writer, kind string, data []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], kind)
+	w.Write(header[:])
+	w.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// pngLevel maps a zlib level to the nearest image/png setting, for images
+// encodePNG doesn't handle.
+func pngLevel(level int) png.CompressionLevel {
+	switch {
+	case level == flate.DefaultCompression:
+		return png.DefaultCompression
+	case level == flate.NoCompression:
+		return png.NoCompression
+	case level <= 3:
+		return png.BestSpeed
+	case level >= 8:
+		return png.BestCompression
+	}
+	return png.DefaultCompression
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// poolSize is the --pool flag: persistent filter workers, 0 for none, and
+// below 0 for the default of the command (one per CPU in the long-running
+// ones, none otherwise).
+var poolSize = -1
+
+// workerPool runs the workers of every filter call on goroutines started
+// once, instead of a goroutine per worker per call. spawnWorker hands a
+// worker to an idle pool goroutine or, when all are busy, runs it inline,
+// so the pool size also caps the goroutines filtering at once across
+// calls.
+type workerPool struct {
+	size    int
+	tasks   chan func() // unbuffered: a send succeeds only on an idle goroutine
+	started time.Time
+
+	pooled atomic.Int64
+	inline atomic.Int64
+	busy   atomic.Int64 // nanoseconds spent running tasks
+}
+
+var activePool atomic.Pointer[workerPool]
+
+// PoolStats describes the work done by the worker pool.
+type PoolStats struct {
+	Size        int     `json:"size"`
+	Pooled      int64   `json:"pooled"` // workers run on a pool goroutine
+	Inline      int64   `json:"inline"` // workers run by their caller, the pool being busy
+	BusyMs      float64 `json:"busy_ms"`
+	Utilization float64 `json:"utilization"` // busy time over size times uptime
+}
+
+// StartWorkerPool starts n persistent worker goroutines that all later
+// filter calls submit to; it does nothing if a pool is running or n <= 0.
+// The goroutines live as long as the process.
+func StartWorkerPool(n int) {
+	if n <= 0 || activePool.Load() != nil {
+		return
+	}
+	p := &workerPool{size: n, tasks: make(chan func()), started: time.Now()}
+	for range n {
+		go func() {
+			for task := range p.tasks {
+				start := time.Now()
+				task()
+				p.busy.Add(int64(time.Since(start)))
+			}
+		}()
+	}
+	activePool.Store(p)
+	logger.Debug("started the worker pool", "size", n)
+}
+
+// startDefaultPool starts the pool of a long-running command: --pool
+// goroutines, by default one per CPU.
+func startDefaultPool() {
+	n := poolSize
+	if n < 0 {
+		n = cpuCount()
+	}
+	StartWorkerPool(n)
+}
+
+// submit runs task on an idle pool goroutine and reports whether it could.
+func (p *workerPool) submit(task func()) bool {
+	select {
+	case p.tasks <- task:
+		p.pooled.Add(1)
+		return true
+	default:
+		p.inline.Add(1)
+		return false
+	}
+}
+
+// poolStats reports the running pool, nil if there is none.
+func poolStats() *PoolStats {
+	p := activePool.Load()
+	if p == nil {
+		return nil
+	}
+	busy := time.Duration(p.busy.Load())
+	stats := &PoolStats{Size: p.size, Pooled: p.pooled.Load(), Inline: p.inline.Load(), BusyMs: ms(busy)}
+	if uptime := time.Since(p.started); uptime > 0 {
+		stats.Utilization = busy.Seconds() / (uptime.Seconds() * float64(p.size))
+	}
+	return stats
+}
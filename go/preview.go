@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PreviewCallback receives the progressively refined image after each
+// update: first the whole coarse preview (final false), then each tile
+// rect as it reaches full quality (final true). img must not be written.
+type PreviewCallback func(img *image.RGBA, rect image.Rectangle, final bool)
+
+type previewOptions struct {
+	scale      int         // downscale factor of the coarse preview
+	focus      image.Point // tiles nearest this point are refined first
+	numWorkers int
+}
+
+// localOperation reports whether every output pixel of operation depends only
+// on input pixels within radius, so tiles filtered with a halo match the
+// whole-image result.
+func localOperation(operation string) bool {
+	return operation == "blur" || operation == "blur_u8" || operation == "kuwahara"
+}
+
+// previewOrder returns the tiles of a width x height image sorted by the
+// distance of their centres from focus.
+func previewOrder(width, height int, focus image.Point) []image.Rectangle {
+	tiles := gridTiles(width, height, tileSize)
+	dist := func(r image.Rectangle) int {
+		c := r.Min.Add(r.Max).Div(2).Sub(focus)
+		return c.X*c.X + c.Y*c.Y
+	}
+	slices.SortStableFunc(tiles, func(a, b image.Rectangle) int { return dist(a) - dist(b) })
+	return tiles
+}
+
+// ProgressiveOperation runs operation coarse-to-fine for interactive use.
+// It first filters a copy downscaled by opts.scale, at the radius scaled to
+// match, and upsamples it into the result for a quick preview. It then
+// refines the result tile by tile at full quality, starting from the tiles
+// nearest opts.focus and handing tiles to workers in that order. Each tile is
+// filtered with a halo, so the final image equals applyOperation's. Global
+// operations such as saliency are refined in one step. emit is called once
+// per update, one call at a time.
+func ProgressiveOperation(operation string, srcImg image.Image, radius int, opts previewOptions, emit PreviewCallback) (*image.RGBA, error) {
+	src := toRGBA(srcImg)
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	radius, err := checkRadius(operation, radius, bounds)
+	if err != nil {
+		return nil, err
+	}
+
+	// Coarse pass.
+	scale := max(opts.scale, 1)
+	small, err := resizeImage(src, max(width/scale, 1), max(height/scale, 1), "bilinear", opts.numWorkers, nil)
+	if err != nil {
+		return nil, err
+	}
+	smallRadius := radius / scale
+	if operation != "saliency" {
+		smallRadius = max(smallRadius, 1)
+	}
+	filtered, err := applyOperation(operation, small, smallRadius, opts.numWorkers)
+	if err != nil {
+		return nil, err
+	}
+	canvas, err := resizeImage(filtered, width, height, "bilinear", opts.numWorkers, nil)
+	if err != nil {
+		return nil, err
+	}
+	emit(canvas, canvas.Bounds(), false)
+
+	// Refinement.
+	if !localOperation(operation) {
+		dst, err := applyOperation(operation, src, radius, opts.numWorkers)
+		if err != nil {
+			return nil, err
+		}
+		draw.Draw(canvas, canvas.Bounds(), dst, image.Point{}, draw.Src)
+		emit(canvas, canvas.Bounds(), true)
+		return canvas, nil
+	}
+	var mu sync.Mutex
+	tiles := previewOrder(width, height, opts.focus)
+	err = forEachParallel(len(tiles), opts.numWorkers, func(i int) error {
+		r := tiles[i]
+		halo := r.Inset(-radius).Intersect(image.Rect(0, 0, width, height))
+		tile := image.NewRGBA(image.Rect(0, 0, halo.Dx(), halo.Dy()))
+		draw.Draw(tile, tile.Bounds(), src, bounds.Min.Add(halo.Min), draw.Src)
+		out, err := runFilter(operation, tile, radius, 1, nil)
+		if err != nil {
+			return err
+		}
+		if err := cancelled(); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		draw.Draw(canvas, r, out, r.Min.Sub(halo.Min), draw.Src)
+		emit(canvas, r, true)
+		return nil
+	})
+	// Per-tile runs record phases of their own.
+	takePhases()
+	if err != nil {
+		return nil, err
+	}
+	return canvas, nil
+}
+
+func previewCommand(program string, args []string) {
+	var opts previewOptions
+	var focus, previewPath, live string
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	fs.IntVar(&opts.scale, "scale", 4, "downscale factor of the coarse preview")
+	fs.StringVar(&focus, "focus", "", "x,y of the point refined first (default the image centre)")
+	fs.StringVar(&previewPath, "preview", "", "also save the coarse preview to this file")
+	fs.StringVar(&live, "live", "", "serve an interactive preview on this address (e.g. localhost:8080) instead")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s preview [flags] <operation> <input_image> <output_image> <radius> [workers]\n", program)
+		fmt.Fprintf(os.Stderr, "  Filters coarse-to-fine: a quick low-resolution preview, then full-quality tiles\n")
+		fmt.Fprintf(os.Stderr, "  With --live, opens a page to adjust the operation, radius and workers; Save writes <output_image>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 4 || fs.NArg() > 5 || opts.scale <= 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	operation := fs.Arg(0)
+	radius, err := strconv.Atoi(fs.Arg(3))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid radius: %v\n", err)
+		os.Exit(exitInvalidRadius)
+	}
+	opts.numWorkers = cpuCount()
+	if fs.NArg() == 5 {
+		if opts.numWorkers, err = strconv.Atoi(fs.Arg(4)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if opts.numWorkers <= 0 {
+			opts.numWorkers = cpuCount()
+		}
+	}
+
+	srcImg, err := loadImage(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if live != "" {
+		if err := serveLivePreview(live, operation, srcImg, radius, opts.numWorkers, fs.Arg(2)); err != nil {
+			fmt.Fprintf(os.Stderr, "Live preview failed: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+	bounds := srcImg.Bounds()
+	opts.focus = image.Pt(bounds.Dx()/2, bounds.Dy()/2)
+	if focus != "" {
+		if opts.focus.X, opts.focus.Y, err = parseOffset(focus); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --focus: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	start := time.Now()
+	var previewTime, firstTileTime time.Duration
+	tiles := 0
+	dst, err := ProgressiveOperation(operation, srcImg, radius, opts, func(img *image.RGBA, rect image.Rectangle, final bool) {
+		if !final {
+			previewTime = time.Since(start)
+			if previewPath != "" {
+				if err := saveImage(previewPath, img); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to save preview: %v\n", err)
+				}
+			}
+			return
+		}
+		if tiles == 0 {
+			firstTileTime = time.Since(start)
+		}
+		tiles++
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+	totalTime := time.Since(start)
+
+	fmt.Printf("Preview at 1/%d scale: %dms\n", opts.scale, previewTime.Milliseconds())
+	fmt.Printf("First refined tile: %dms\n", firstTileTime.Milliseconds())
+	fmt.Printf("Refined %d tiles, total time: %dms\n", tiles, totalTime.Milliseconds())
+
+	if err := saveImage(fs.Arg(2), dst); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// profiler wraps a section of the program with the profiles requested on the
+// command line. Empty paths disable the corresponding output.
+type profiler struct {
+	cpuPath   string
+	memPath   string
+	tracePath string
+
+	cpuFile   *os.File
+	traceFile *os.File
+}
+
+func (p *profiler) start() error {
+	if p.cpuPath != "" {
+		file, err := os.Create(p.cpuPath)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return err
+		}
+		p.cpuFile = file
+	}
+	if p.tracePath != "" {
+		file, err := os.Create(p.tracePath)
+		if err != nil {
+			return err
+		}
+		if err := trace.Start(file); err != nil {
+			file.Close()
+			return err
+		}
+		p.traceFile = file
+	}
+	return nil
+}
+
+func (p *profiler) stop() error {
+	if p.cpuFile != nil {
+		pprof.StopCPUProfile()
+		p.cpuFile.Close()
+		p.cpuFile = nil
+	}
+	if p.traceFile != nil {
+		trace.Stop()
+		p.traceFile.Close()
+		p.traceFile = nil
+	}
+	if p.memPath != "" {
+		file, err := os.Create(p.memPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		runtime.GC()
+		return pprof.Lookup("allocs").WriteTo(file, 0)
+	}
+	return nil
+}
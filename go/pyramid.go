@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// downsample2 keeps every second pixel of every second row.
+func downsample2(src *image.RGBA, numWorkers int) *image.RGBA {
+	width, height := (src.Bounds().Dx()+1)/2, (src.Bounds().Dy()+1)/2
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	parallelRows(height, numWorkers, func(from, to int) {
+		for y := from; y < to; y++ {
+			in := src.Pix[2*y*src.Stride:]
+			out := dst.Pix[y*dst.Stride:]
+			for x := range width {
+				copy(out[x*4:x*4+4], in[x*8:x*8+4])
+			}
+		}
+	})
+	return dst
+}
+
+type pyramidLevel struct {
+	img      *image.RGBA
+	build    time.Duration
+	encode   time.Duration
+	path     string
+	writeErr error
+}
+
+// buildPyramid computes a Gaussian pyramid: level 0 is the input and each
+// further level is the previous one blurred with sigma and halved. The blur
+// and decimation of a level are split among numWorkers, and every level is
+// handed to its own goroutine for encoding as soon as it exists, so writing
+// the large levels overlaps with building the small ones. Levels stop at
+// maxLevels (0 = until a side would drop below one pixel).
+func buildPyramid(src *image.RGBA, sigma float64, maxLevels int, dir string, numWorkers int) []*pyramidLevel {
+	var levels []*pyramidLevel
+	var wg sync.WaitGroup
+	save := func(level *pyramidLevel) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			level.writeErr = saveImage(level.path, level.img)
+			level.encode = time.Since(start)
+		}()
+	}
+
+	kernel := BlurOptions{Sigma: sigma}.kernel()
+	img := src
+	var build time.Duration
+	for i := 0; ; i++ {
+		level := &pyramidLevel{img: img, build: build, path: filepath.Join(dir, fmt.Sprintf("level%d.png", i))}
+		levels = append(levels, level)
+		save(level)
+		b := img.Bounds()
+		if (maxLevels > 0 && i+1 >= maxLevels) || b.Dx() < 2 || b.Dy() < 2 {
+			break
+		}
+		start := time.Now()
+		img = downsample2(gaussianBlur(img, kernel, numWorkers, nil), numWorkers)
+		build = time.Since(start)
+	}
+	takePhases() // per-level blur phases are not reported
+	wg.Wait()
+	return levels
+}
+
+func pyramidCommand(program string, args []string) {
+	var sigma float64
+	var maxLevels int
+	fs := flag.NewFlagSet("pyramid", flag.ExitOnError)
+	fs.Float64Var(&sigma, "sigma", 1, "Gaussian sigma applied before each halving")
+	fs.IntVar(&maxLevels, "levels", 0, "number of levels including the input (0 = down to one pixel)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s pyramid [flags] <input_image> <output_dir> [workers]\n", program)
+		fmt.Fprintf(os.Stderr, "  Writes a Gaussian pyramid as level0.png, level1.png, ... in output_dir\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 || fs.NArg() > 3 || sigma <= 0 || maxLevels < 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	numWorkers := cpuCount()
+	if fs.NArg() == 3 {
+		var err error
+		if numWorkers, err = strconv.Atoi(fs.Arg(2)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+	}
+
+	srcImg, err := loadImage(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if err := os.MkdirAll(fs.Arg(1), 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create output directory: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+
+	start := time.Now()
+	levels := buildPyramid(toRGBA(srcImg), sigma, maxLevels, fs.Arg(1), numWorkers)
+	total := time.Since(start)
+
+	failed := false
+	for i, level := range levels {
+		b := level.img.Bounds()
+		fmt.Printf("Level %d: %dx%d, build %dms, encode %dms\n", i, b.Dx(), b.Dy(), level.build.Milliseconds(), level.encode.Milliseconds())
+		if level.writeErr != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save %s: %v\n", level.path, level.writeErr)
+			failed = true
+		}
+	}
+	fmt.Printf("Pyramid time: %dms\n", total.Milliseconds())
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
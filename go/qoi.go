@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// QOI, the "Quite OK Image" format (qoiformat.org): lossless like PNG, but
+// a single cheap pass over the pixels to encode or decode, which makes it a
+// good intermediate between pipeline stages and for benchmark outputs.
+
+const (
+	qoiOpIndex = 0x00 // 00xxxxxx
+	qoiOpDiff  = 0x40 // 01xxxxxx
+	qoiOpLuma  = 0x80 // 10xxxxxx
+	qoiOpRun   = 0xc0 // 11xxxxxx
+	qoiOpRGB   = 0xfe
+	qoiOpRGBA  = 0xff
+	qoiMask2   = 0xc0
+
+	qoiMagic = "qoif"
+	// qoiMaxPixels guards the allocation for a corrupt header, as the
+	// reference implementation does.
+	qoiMaxPixels = 400_000_000
+)
+
+var qoiPadding = [8]byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+func init() {
+	image.RegisterFormat("qoi", qoiMagic, decodeQOI, decodeQOIConfig)
+}
+
+func qoiHash(p [4]uint8) uint8 {
+	return (p[0]*3 + p[1]*5 + p[2]*7 + p[3]*11) % 64
+}
+
+type qoiHeader struct {
+	Magic      [4]byte
+	Width      uint32
+	Height     uint32
+	Channels   uint8
+	Colorspace uint8
+}
+
+func readQOIHeader(r io.Reader) (qoiHeader, error) {
+	var h qoiHeader
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return h, err
+	}
+	if string(h.Magic[:]) != qoiMagic {
+		return h, errors.New("qoi: invalid magic")
+	}
+	if h.Width == 0 || h.Height == 0 || uint64(h.Width)*uint64(h.Height) > qoiMaxPixels {
+		return h, fmt.Errorf("qoi: invalid size %dx%d", h.Width, h.Height)
+	}
+	if h.Channels != 3 && h.Channels != 4 {
+		return h, fmt.Errorf("qoi: invalid channel count %d", h.Channels)
+	}
+	return h, nil
+}
+
+func decodeQOIConfig(r io.Reader) (image.Config, error) {
+	h, err := readQOIHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(h.Width), Height: int(h.Height)}, nil
+}
+
+// decodeQOI returns an *image.NRGBA, QOI storing straight alpha.
+func decodeQOI(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readQOIHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, int(h.Width), int(h.Height)))
+	var index [64][4]uint8
+	px := [4]uint8{0, 0, 0, 255}
+	run := 0
+	for i := 0; i < len(img.Pix); i += 4 {
+		if run > 0 {
+			run--
+		} else {
+			b1, err := br.ReadByte()
+			if err != nil {
+				return nil, qoiUnexpectedEOF(err)
+			}
+			switch {
+			case b1 == qoiOpRGB:
+				if _, err := io.ReadFull(br, px[:3]); err != nil {
+					return nil, qoiUnexpectedEOF(err)
+				}
+			case b1 == qoiOpRGBA:
+				if _, err := io.ReadFull(br, px[:]); err != nil {
+					return nil, qoiUnexpectedEOF(err)
+				}
+			case b1&qoiMask2 == qoiOpIndex:
+				px = index[b1]
+			case b1&qoiMask2 == qoiOpDiff:
+				px[0] += (b1>>4)&3 - 2
+				px[1] += (b1>>2)&3 - 2
+				px[2] += b1&3 - 2
+			case b1&qoiMask2 == qoiOpLuma:
+				b2, err := br.ReadByte()
+				if err != nil {
+					return nil, qoiUnexpectedEOF(err)
+				}
+				dg := b1&0x3f - 32
+				px[0] += dg - 8 + (b2>>4)&0x0f
+				px[1] += dg
+				px[2] += dg - 8 + b2&0x0f
+			default: // qoiOpRun
+				run = int(b1 & 0x3f)
+			}
+			index[qoiHash(px)] = px
+		}
+		copy(img.Pix[i:i+4], px[:])
+	}
+	return img, nil
+}
+
+func qoiUnexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// encodeQOI writes img as QOI, converting from premultiplied alpha the way
+// the PNG encoder does. Fully opaque images are marked as 3-channel.
+func encodeQOI(w io.Writer, img *image.RGBA) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return fmt.Errorf("qoi: invalid image size %dx%d", width, height)
+	}
+	channels := uint8(3)
+	for y := bounds.Min.Y; y < bounds.Max.Y && channels == 3; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		for x := 3; x < width*4; x += 4 {
+			if row[x] != 0xff {
+				channels = 4
+				break
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	binary.Write(bw, binary.BigEndian, qoiHeader{
+		Magic:    [4]byte{'q', 'o', 'i', 'f'},
+		Width:    uint32(width),
+		Height:   uint32(height),
+		Channels: channels,
+	})
+	var index [64][4]uint8
+	prev := [4]uint8{0, 0, 0, 255}
+	run := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		for x := range width {
+			s := row[x*4 : x*4+4]
+			px := [4]uint8{s[0], s[1], s[2], s[3]}
+			if a := uint32(s[3]); a == 0 {
+				px = [4]uint8{}
+			} else if a != 0xff {
+				const m = 0x101 * 0xffff
+				a *= 0x101
+				px[0] = uint8((uint32(s[0]) * m / a) >> 8)
+				px[1] = uint8((uint32(s[1]) * m / a) >> 8)
+				px[2] = uint8((uint32(s[2]) * m / a) >> 8)
+			}
+
+			if px == prev {
+				run++
+				if run == 62 {
+					bw.WriteByte(qoiOpRun | uint8(run-1))
+					run = 0
+				}
+				continue
+			}
+			if run > 0 {
+				bw.WriteByte(qoiOpRun | uint8(run-1))
+				run = 0
+			}
+			h := qoiHash(px)
+			switch {
+			case index[h] == px:
+				bw.WriteByte(qoiOpIndex | h)
+			case px[3] != prev[3]:
+				index[h] = px
+				bw.Write([]byte{qoiOpRGBA, px[0], px[1], px[2], px[3]})
+			default:
+				index[h] = px
+				dr, dg, db := int8(px[0]-prev[0]), int8(px[1]-prev[1]), int8(px[2]-prev[2])
+				drg, dbg := dr-dg, db-dg
+				switch {
+				case dr >= -2 && dr <= 1 && dg >= -2 && dg <= 1 && db >= -2 && db <= 1:
+					bw.WriteByte(qoiOpDiff | uint8(dr+2)<<4 | uint8(dg+2)<<2 | uint8(db+2))
+				case dg >= -32 && dg <= 31 && drg >= -8 && drg <= 7 && dbg >= -8 && dbg <= 7:
+					bw.Write([]byte{qoiOpLuma | uint8(dg+32), uint8(drg+8)<<4 | uint8(dbg+8)})
+				default:
+					bw.Write([]byte{qoiOpRGB, px[0], px[1], px[2]})
+				}
+			}
+			prev = px
+		}
+	}
+	if run > 0 {
+		bw.WriteByte(qoiOpRun | uint8(run-1))
+	}
+	bw.Write(qoiPadding[:])
+	return bw.Flush()
+}
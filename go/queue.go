@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The consume command turns the binary into a worker of a fleet fed from a
+// Redis list. Producers LPUSH jobs; each consumer moves one at a time to
+// the processing list with BRPOPLPUSH, runs it, RPUSHes the result and
+// removes the job from the processing list. Jobs of a consumer that dies
+// stay in the processing list to be requeued by hand; jobs cut short by
+// SIGINT or SIGTERM go back to the queue.
+
+// QueueJob is a job message: a batch job with an id echoed in its result.
+type QueueJob struct {
+	ID string `json:"id,omitempty"`
+	Job
+}
+
+// QueueResult is published for every job, failed or not.
+type QueueResult struct {
+	ID string `json:"id,omitempty"`
+	JobResult
+	Consumer string `json:"consumer"`
+}
+
+// redisConn is a minimal RESP2 client, enough for the list commands.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// errRedisNil is the nil reply, such as a blocking pop timing out.
+var errRedisNil = errors.New("redis: nil")
+
+// dialRedis connects to a redis://[:password@]host[:port][/db] URL, or a
+// plain host:port.
+func dialRedis(addr string) (*redisConn, error) {
+	var password string
+	db := 0
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "redis" {
+			return nil, fmt.Errorf("unsupported scheme %q, use redis://", u.Scheme)
+		}
+		password, _ = u.User.Password()
+		if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+			if db, err = strconv.Atoi(path); err != nil {
+				return nil, fmt.Errorf("invalid database %q", path)
+			}
+		}
+		addr = u.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "6379")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and reads its reply: a string, an int64, a []any or
+// errRedisNil.
+func (c *redisConn) do(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *redisConn) reply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.reply(); err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// consumer takes jobs from queue one at a time on its own connection, as
+// the blocking pop holds it.
+type consumer struct {
+	name                       string
+	addr                       string
+	queue, processing, results string
+	numWorkers                 int
+}
+
+// run handles jobs until interrupted or the connection fails. A failed job
+// is still a result; only Redis errors end the consumer.
+func (c *consumer) run() error {
+	conn, err := dialRedis(c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for !interrupted() {
+		// Wait a second at most, to notice interrupts.
+		reply, err := conn.do("BRPOPLPUSH", c.queue, c.processing, "1")
+		if errors.Is(err, errRedisNil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msg, _ := reply.(string)
+		result := c.handle(msg)
+		if interrupted() && result.Error != "" {
+			// Cut short: back to the end the consumers pop from.
+			if _, err := conn.do("RPUSH", c.queue, msg); err != nil {
+				return err
+			}
+		} else {
+			data, _ := json.Marshal(result)
+			if _, err := conn.do("RPUSH", c.results, string(data)); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.do("LREM", c.processing, "1", msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle runs one job message.
+func (c *consumer) handle(msg string) QueueResult {
+	var job QueueJob
+	result := QueueResult{Consumer: c.name}
+	err := json.Unmarshal([]byte(msg), &job)
+	if err == nil {
+		err = checkQueueJob(&job.Job)
+	}
+	result.ID = job.ID
+	if err != nil {
+		result.Input, result.Output = job.Input, job.Output
+		result.Error = fmt.Sprintf("invalid job: %v", err)
+		logger.Warn("invalid job", "consumer", c.name, "err", err)
+		return result
+	}
+	load := make(chan decoded, 1)
+	start := time.Now()
+	var img image.Image
+	retries, err := ioRetry.do("read", func() (err error) {
+		img, err = loadImage(job.Input)
+		return err
+	})
+	load <- decoded{img, err, time.Since(start), retries}
+	result.JobResult = runJob(job.Job, load, c.numWorkers)
+	if result.Error != "" {
+		logger.Warn("job failed", "consumer", c.name, "id", job.ID, "err", result.Error)
+	} else {
+		logger.Debug("job done", "consumer", c.name, "id", job.ID, "ms", result.TotalMs)
+	}
+	return result
+}
+
+// checkQueueJob validates a job like loadJobFile, without resolving paths:
+// they are the consumer's.
+func checkQueueJob(job *Job) error {
+	if job.Input == "" || job.Output == "" {
+		return errors.New("input and output are required")
+	}
+	if len(job.Steps) == 0 {
+		return errors.New("no steps")
+	}
+	for _, step := range job.Steps {
+		if _, ok := lookupOperation(step.Operation); !ok {
+			return fmt.Errorf("%w %q", ErrUnknownOperation, step.Operation)
+		}
+	}
+	return nil
+}
+
+func consumeCommand(program string, args []string) {
+	fs := flag.NewFlagSet("consume", flag.ExitOnError)
+	addr := fs.String("redis", "localhost:6379", "Redis server, host:port or redis://[:password@]host:port[/db]")
+	queue := fs.String("queue", "filter:jobs", "list the jobs are LPUSHed to")
+	results := fs.String("results", "filter:results", "list the results are RPUSHed to")
+	concurrency := fs.Int("concurrency", 1, "jobs this consumer runs at once")
+	numWorkers := fs.Int("workers", 0, "workers per job (0 = CPUs divided among the concurrent jobs)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s consume [flags]\n", program)
+		fmt.Fprintf(os.Stderr, "  Runs jobs from a Redis list until interrupted. A job is a batch job with an id:\n")
+		fmt.Fprintf(os.Stderr, "    {\"id\": \"42\", \"input\": \"in.png\", \"output\": \"out.png\", \"steps\": [{\"operation\": \"blur\", \"radius\": 3}]}\n")
+		fmt.Fprintf(os.Stderr, "  Jobs being run wait in <queue>:processing; results are batch results with the id\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *concurrency <= 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *numWorkers <= 0 {
+		*numWorkers = max(cpuCount() / *concurrency, 1)
+	}
+	host, _ := os.Hostname()
+	trapSignals()
+	startDefaultPool()
+	startDefaultIOPool()
+
+	logger.Info("consuming jobs", "redis", *addr, "queue", *queue, "concurrency", *concurrency, "workers", *numWorkers)
+	var wg sync.WaitGroup
+	errs := make(chan error, *concurrency)
+	for i := range *concurrency {
+		c := &consumer{
+			name:       fmt.Sprintf("%s/%d/%d", host, os.Getpid(), i),
+			addr:       *addr,
+			queue:      *queue,
+			processing: *queue + ":processing",
+			results:    *results,
+			numWorkers: *numWorkers,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.run(); err != nil {
+				errs <- fmt.Errorf("%s: %w", c.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		fatal("consumer stopped", "err", err)
+	}
+	exitIfInterrupted()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// maxRadius is the largest useful filter radius for an image: half of the
+// smaller dimension. Beyond that the window only adds copies of the clamped
+// edge pixels, which costs time without changing the result meaningfully.
+func maxRadius(bounds image.Rectangle) int {
+	return max(1, min(bounds.Dx(), bounds.Dy())/2)
+}
+
+// checkRadius validates the radius for an operation and clamps it to the
+// documented maximum. Blur and Kuwahara need a radius of at least 1 (a zero
+// radius gives the Gaussian a zero sigma); saliency accepts 0 to disable
+// smoothing and is limited by its fixed thumbnail size instead of the image.
+// Histogram equalization and the colour operations have no radius and
+// ignore it; hsl takes it as a hue rotation in degrees, any value allowed.
+// Plugin filters check their parameter themselves when built.
+func checkRadius(operation string, radius int, bounds image.Rectangle) (int, error) {
+	if _, ok := filterPlugins[operation]; ok {
+		return radius, nil
+	}
+	minRadius, limit := 1, maxRadius(bounds)
+	if operation == "saliency" {
+		minRadius, limit = 0, saliencySize/2
+	}
+	switch operation {
+	case "histeq", "grayscale", "sepia":
+		minRadius, limit = 0, radius
+	case "hsl":
+		minRadius, limit = radius, radius
+	}
+	if radius < minRadius {
+		return 0, fmt.Errorf("%w %d for %s: must be at least %d", ErrInvalidRadius, radius, operation, minRadius)
+	}
+	return min(radius, limit), nil
+}
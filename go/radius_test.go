@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"testing"
+)
+
+func TestCheckRadius(t *testing.T) {
+	bounds := image.Rect(0, 0, 31, 20) // maxRadius 10
+	tests := []struct {
+		operation string
+		radius    int
+		want      int
+		invalid   bool
+	}{
+		{"blur", 0, 0, true},
+		{"blur", -1, 0, true},
+		{"blur", 1, 1, false},
+		{"blur", 10, 10, false},
+		{"blur", 11, 10, false},
+		{"kuwahara", 0, 0, true},
+		{"kuwahara", 1000, 10, false},
+		{"saliency", 0, 0, false},
+		{"saliency", saliencySize/2 + 1, saliencySize / 2, false},
+		{"histeq", 0, 0, false},
+		{"grayscale", 1000, 1000, false},
+		{"hsl", -90, -90, false},
+	}
+	for _, tt := range tests {
+		got, err := checkRadius(tt.operation, tt.radius, bounds)
+		if tt.invalid {
+			if !errors.Is(err, ErrInvalidRadius) {
+				t.Errorf("%s r%d: error %v, want ErrInvalidRadius", tt.operation, tt.radius, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s r%d: got %d, %v, want %d", tt.operation, tt.radius, got, err, tt.want)
+		}
+	}
+}
+
+func TestBoundaryRadii(t *testing.T) {
+	noise := syntheticImages[len(syntheticImages)-1]
+	for _, shape := range stressShapes {
+		s := noise
+		s.width, s.height = shape.X, shape.Y
+		img := s.generate()
+		limit := maxRadius(img.Bounds())
+		for _, op := range stressOperations {
+			t.Run(fmt.Sprintf("%s_%dx%d", op, shape.X, shape.Y), func(t *testing.T) {
+				if _, err := runCase(op, img, 0, 2); err == nil {
+					t.Error("radius 0 accepted")
+				}
+				atLimit, err := runCase(op, img, limit, 2)
+				if err != nil {
+					t.Fatalf("radius %d: %v", limit, err)
+				}
+				beyond, err := runCase(op, img, limit+100, 2)
+				if err != nil {
+					t.Fatalf("radius %d: %v", limit+100, err)
+				}
+				if pixelChecksum(atLimit) != pixelChecksum(beyond) {
+					t.Errorf("radius %d not clamped to %d", limit+100, limit)
+				}
+			})
+		}
+	}
+}
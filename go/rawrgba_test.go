@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRawRGBAHeader(t *testing.T) {
+	tests := []struct {
+		width, height uint32
+		pixels        int
+	}{
+		{0, 1, 0},
+		{1, 0, 0},
+		{1 << 31, 1 << 31, 0}, // 4 bytes a pixel wraps to 0
+		{1 << 31, 4, 0},
+		{2, 2, 3},
+	}
+	path := filepath.Join(t.TempDir(), "in.raw")
+	for _, tt := range tests {
+		data := make([]byte, rawHeaderSize+tt.pixels*4)
+		binary.LittleEndian.PutUint32(data[0:], tt.width)
+		binary.LittleEndian.PutUint32(data[4:], tt.height)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadRawRGBA(path); !errors.Is(err, ErrDecode) {
+			t.Errorf("%dx%d in %d bytes: error %v, want ErrDecode", tt.width, tt.height, len(data), err)
+		}
+		if _, err := decodeRawRGBA(data); !errors.Is(err, ErrDecode) {
+			t.Errorf("%dx%d in %d bytes, decoded whole: error %v, want ErrDecode", tt.width, tt.height, len(data), err)
+		}
+	}
+
+	data := make([]byte, rawHeaderSize+3*2*4)
+	binary.LittleEndian.PutUint32(data[0:], 3)
+	binary.LittleEndian.PutUint32(data[4:], 2)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := loadRawRGBA(path)
+	if err != nil || img.Bounds().Dx() != 3 || img.Bounds().Dy() != 2 {
+		t.Errorf("3x2: got %v, %v", img, err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+type vec3 struct{ x, y, z float64 }
+
+func (a vec3) add(b vec3) vec3      { return vec3{a.x + b.x, a.y + b.y, a.z + b.z} }
+func (a vec3) sub(b vec3) vec3      { return vec3{a.x - b.x, a.y - b.y, a.z - b.z} }
+func (a vec3) mul(b vec3) vec3      { return vec3{a.x * b.x, a.y * b.y, a.z * b.z} }
+func (a vec3) scale(s float64) vec3 { return vec3{a.x * s, a.y * s, a.z * s} }
+func (a vec3) dot(b vec3) float64   { return a.x*b.x + a.y*b.y + a.z*b.z }
+func (a vec3) length() float64      { return math.Sqrt(a.dot(a)) }
+func (a vec3) normalize() vec3      { return a.scale(1 / a.length()) }
+func (a vec3) reflect(n vec3) vec3  { return a.sub(n.scale(2 * a.dot(n))) }
+func (a vec3) cross(b vec3) vec3 {
+	return vec3{a.y*b.z - a.z*b.y, a.z*b.x - a.x*b.z, a.x*b.y - a.y*b.x}
+}
+
+type material struct {
+	albedo vec3
+	// metal reflects mirror-like, blurred by fuzz; otherwise diffuse.
+	metal bool
+	fuzz  float64
+	// emit is light given off by the surface.
+	emit vec3
+}
+
+type sphere struct {
+	center vec3
+	radius float64
+	mat    material
+}
+
+type hit struct {
+	t      float64
+	point  vec3
+	normal vec3
+	mat    material
+}
+
+// rtScene is a few spheres on a checkered ground plane at y = 0 under a sky
+// gradient.
+var rtScene = []sphere{
+	{vec3{0, 1, 0}, 1, material{albedo: vec3{0.8, 0.3, 0.3}}},
+	{vec3{-2.1, 0.8, 0.6}, 0.8, material{albedo: vec3{0.9, 0.9, 0.9}, metal: true, fuzz: 0.05}},
+	{vec3{2.0, 0.7, 0.8}, 0.7, material{albedo: vec3{0.8, 0.6, 0.2}, metal: true, fuzz: 0.3}},
+	{vec3{0.9, 0.35, 2.0}, 0.35, material{albedo: vec3{0.2, 0.4, 0.9}}},
+	{vec3{-0.6, 3.2, -1.5}, 0.6, material{emit: vec3{6, 5, 4}}},
+}
+
+func intersectScene(origin, dir vec3) (hit, bool) {
+	best := hit{t: math.Inf(1)}
+	found := false
+	for _, s := range rtScene {
+		oc := origin.sub(s.center)
+		b := oc.dot(dir)
+		c := oc.dot(oc) - s.radius*s.radius
+		disc := b*b - c
+		if disc < 0 {
+			continue
+		}
+		sq := math.Sqrt(disc)
+		t := -b - sq
+		if t < 1e-4 {
+			t = -b + sq
+		}
+		if t < 1e-4 || t >= best.t {
+			continue
+		}
+		p := origin.add(dir.scale(t))
+		best = hit{t, p, p.sub(s.center).scale(1 / s.radius), s.mat}
+		found = true
+	}
+	// Ground plane.
+	if dir.y < 0 {
+		if t := -origin.y / dir.y; t > 1e-4 && t < best.t {
+			p := origin.add(dir.scale(t))
+			albedo := vec3{0.75, 0.75, 0.75}
+			if (int(math.Floor(p.x))+int(math.Floor(p.z)))%2 != 0 {
+				albedo = vec3{0.25, 0.3, 0.25}
+			}
+			best = hit{t, p, vec3{0, 1, 0}, material{albedo: albedo}}
+			found = true
+		}
+	}
+	return best, found
+}
+
+// randomUnitVector picks a direction uniformly on the unit sphere.
+func randomUnitVector(rng *xoshiro256) vec3 {
+	z := 2*rng.Float64() - 1
+	a := 2 * math.Pi * rng.Float64()
+	r := math.Sqrt(1 - z*z)
+	return vec3{r * math.Cos(a), r * math.Sin(a), z}
+}
+
+// tracePath follows a path for up to depth bounces and returns the light it
+// carries back.
+func tracePath(origin, dir vec3, depth int, rng *xoshiro256) vec3 {
+	throughput := vec3{1, 1, 1}
+	var light vec3
+	for range depth {
+		h, ok := intersectScene(origin, dir)
+		if !ok {
+			t := 0.5 * (dir.y + 1)
+			sky := vec3{1, 1, 1}.scale(1 - t).add(vec3{0.5, 0.7, 1.0}.scale(t))
+			return light.add(throughput.mul(sky))
+		}
+		light = light.add(throughput.mul(h.mat.emit))
+		var next vec3
+		if h.mat.metal {
+			next = dir.reflect(h.normal).add(randomUnitVector(rng).scale(h.mat.fuzz))
+			if next.dot(h.normal) <= 0 {
+				return light
+			}
+		} else {
+			// Lambertian: cosine-weighted direction around the normal.
+			next = h.normal.add(randomUnitVector(rng))
+			if next.dot(next) < 1e-12 {
+				next = h.normal
+			}
+		}
+		throughput = throughput.mul(h.mat.albedo)
+		origin, dir = h.point, next.normalize()
+	}
+	return light
+}
+
+type raytraceOptions struct {
+	width, height int
+	samples       int
+	depth         int
+	seed          uint64
+}
+
+// renderRaytrace path-traces the scene. Rows are handed out through
+// forEachParallel, so workers that finish cheap sky rows pick up more work.
+// Each pixel seeds its own generator, making the image independent of the
+// worker count.
+func renderRaytrace(opts raytraceOptions, numWorkers int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, opts.width, opts.height))
+	eye := vec3{0, 1.6, 6}
+	forward := vec3{0, 0.9, 0}.sub(eye).normalize()
+	right := forward.cross(vec3{0, 1, 0}).normalize()
+	up := right.cross(forward)
+	fov := math.Tan(35 * math.Pi / 180)
+	aspect := float64(opts.width) / float64(opts.height)
+
+	forEachParallel(opts.height, numWorkers, func(y int) error {
+		row := img.Pix[y*img.Stride:]
+		for x := range opts.width {
+			rng := newXoshiro256(opts.seed ^ uint64(y*opts.width+x)*0x9e3779b97f4a7c15)
+			var sum vec3
+			for range opts.samples {
+				u := (2*(float64(x)+rng.Float64())/float64(opts.width) - 1) * fov * aspect
+				v := (1 - 2*(float64(y)+rng.Float64())/float64(opts.height)) * fov
+				dir := forward.add(right.scale(u)).add(up.scale(v)).normalize()
+				sum = sum.add(tracePath(eye, dir, opts.depth, rng))
+			}
+			c := sum.scale(1 / float64(opts.samples))
+			// Gamma 2 and clamp.
+			for i, v := range [3]float64{c.x, c.y, c.z} {
+				row[x*4+i] = uint8(255 * math.Sqrt(min(max(v, 0), 1)))
+			}
+			row[x*4+3] = 255
+		}
+		return nil
+	})
+	return img
+}
+
+func raytraceCommand(program string, args []string) {
+	var opts raytraceOptions
+	var size string
+	var seed int64
+	fs := flag.NewFlagSet("raytrace", flag.ExitOnError)
+	fs.StringVar(&size, "size", "640x360", "output size WxH")
+	fs.IntVar(&opts.samples, "spp", 16, "samples per pixel")
+	fs.IntVar(&opts.depth, "depth", 5, "maximum bounces per path")
+	fs.Int64Var(&seed, "seed", 1, "random seed")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s raytrace [flags] <output_image> [workers]\n", program)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 || opts.samples <= 0 || opts.depth <= 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	var err error
+	if opts.width, opts.height, err = parseSize(size); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --size: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	opts.seed = uint64(seed)
+	numWorkers := cpuCount()
+	if fs.NArg() == 2 {
+		if numWorkers, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+	}
+
+	fmt.Printf("Ray tracing %dx%d at %d samples per pixel using %d workers\n", opts.width, opts.height, opts.samples, numWorkers)
+	start := time.Now()
+	img := renderRaytrace(opts, numWorkers)
+	renderTime := time.Since(start)
+	paths := float64(opts.width*opts.height*opts.samples) / renderTime.Seconds()
+	fmt.Printf("Render time: %dms (%.2f Mpaths/s)\n", renderTime.Milliseconds(), paths/1e6)
+
+	start = time.Now()
+	if err := saveImage(fs.Arg(0), img); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	fmt.Printf("Save time: %dms\n", time.Since(start).Milliseconds())
+}
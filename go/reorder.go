@@ -0,0 +1,127 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ReorderStats describes how much an ordered stage held back.
+type ReorderStats struct {
+	Window     int     `json:"window"`
+	MaxPending int     `json:"max_pending"` // peak of items done but waiting for an earlier one
+	Stalls     int     `json:"stalls"`      // times the producer waited for the window to move
+	StallMs    float64 `json:"stall_ms"`
+}
+
+// reorderBuffer emits items finished in any order in sequence. Items are
+// numbered from 0; put hands one in and the goroutine completing the run
+// at the head emits it and the pending items after it, one emit call at a
+// time. wait keeps the producer within window items of the head, so at
+// most window items are in flight or pending: a slow item stalls the
+// producer rather than letting later ones pile up behind it.
+type reorderBuffer[T any] struct {
+	mu       sync.Mutex
+	window   int
+	next     int
+	pending  map[int]T
+	emitting bool
+	moved    chan struct{} // closed and replaced whenever next advances
+	emit     func(seq int, v T)
+	stats    ReorderStats
+	stalled  time.Duration
+}
+
+func newReorderBuffer[T any](window int, emit func(seq int, v T)) *reorderBuffer[T] {
+	return &reorderBuffer[T]{
+		window:  max(window, 1),
+		pending: make(map[int]T),
+		moved:   make(chan struct{}),
+		emit:    emit,
+		stats:   ReorderStats{Window: max(window, 1)},
+	}
+}
+
+// wait blocks until item seq may start, returning false if cancel closes
+// first.
+func (b *reorderBuffer[T]) wait(seq int, cancel <-chan struct{}) bool {
+	var start time.Time
+	for {
+		b.mu.Lock()
+		if seq < b.next+b.window {
+			if !start.IsZero() {
+				b.stats.Stalls++
+				b.stalled += time.Since(start)
+			}
+			b.mu.Unlock()
+			return true
+		}
+		moved := b.moved
+		b.mu.Unlock()
+		if start.IsZero() {
+			start = time.Now()
+		}
+		select {
+		case <-moved:
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+// put hands in item seq, emitting it and those after it if it is next.
+func (b *reorderBuffer[T]) put(seq int, v T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[seq] = v
+	if seq != b.next {
+		b.stats.MaxPending = max(b.stats.MaxPending, len(b.pending))
+	}
+	if b.emitting {
+		// The goroutine emitting picks it up.
+		return
+	}
+	b.emitting = true
+	for {
+		v, ok := b.pending[b.next]
+		if !ok {
+			break
+		}
+		seq := b.next
+		delete(b.pending, seq)
+		b.mu.Unlock()
+		b.emit(seq, v)
+		b.mu.Lock()
+		b.next++
+		close(b.moved)
+		b.moved = make(chan struct{})
+	}
+	b.emitting = false
+}
+
+// flush emits the pending items in sequence, skipping over the gaps, for
+// when the missing items will never come. No put may run concurrently.
+func (b *reorderBuffer[T]) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seqs := slices.Sorted(maps.Keys(b.pending))
+	for _, seq := range seqs {
+		b.emit(seq, b.pending[seq])
+		delete(b.pending, seq)
+	}
+	if len(seqs) > 0 {
+		b.next = seqs[len(seqs)-1] + 1
+		close(b.moved)
+		b.moved = make(chan struct{})
+	}
+}
+
+// report returns the stats so far.
+func (b *reorderBuffer[T]) report() ReorderStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.StallMs = ms(b.stalled)
+	return stats
+}
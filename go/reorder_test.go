@@ -0,0 +1,25 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReorderBufferFlush(t *testing.T) {
+	var emitted []int
+	b := newReorderBuffer(8, func(seq int, _ string) { emitted = append(emitted, seq) })
+	// 2 never comes, as with a job that didn't start before an interrupt.
+	for _, seq := range []int{4, 1, 0, 3, 6} {
+		b.put(seq, "")
+	}
+	if want := []int{0, 1}; !slices.Equal(emitted, want) {
+		t.Fatalf("before flush emitted %v, want %v", emitted, want)
+	}
+	b.flush()
+	if want := []int{0, 1, 3, 4, 6}; !slices.Equal(emitted, want) {
+		t.Fatalf("after flush emitted %v, want %v", emitted, want)
+	}
+	if !b.wait(6+8, nil) {
+		t.Error("window didn't move past the flushed items")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phase timings reported by the filters while they run (e.g. the Kuwahara SAT
+// build). The caller drains them after each operation.
+type phaseTime struct {
+	name     string
+	duration time.Duration
+}
+
+// phaseLog is a list of phases in the order they were recorded. Filters
+// take one to record into, so runs side by side (a server's requests, a
+// thumbnail next to its output) each keep their own; nil stands for the
+// process-wide log, which takePhases drains and the trace follows.
+type phaseLog struct {
+	sync.Mutex
+	list []phaseTime
+}
+
+// record adds a phase that just took d to l.
+func (l *phaseLog) record(name string, d time.Duration) {
+	if l == nil {
+		l = &processPhases
+		tracePhase(name, d)
+	}
+	l.Lock()
+	l.list = append(l.list, phaseTime{name, d})
+	l.Unlock()
+}
+
+// take returns the recorded phases, summing repeated names in order of
+// first appearance, and empties the log.
+func (l *phaseLog) take() []phaseTime {
+	l.Lock()
+	defer l.Unlock()
+	var list []phaseTime
+	for _, p := range l.list {
+		i := slices.IndexFunc(list, func(q phaseTime) bool { return q.name == p.name })
+		if i < 0 {
+			list = append(list, p)
+		} else {
+			list[i].duration += p.duration
+		}
+	}
+	l.list = nil
+	return list
+}
+
+var processPhases phaseLog
+
+// recordPhase records a phase in the process-wide log.
+func recordPhase(name string, d time.Duration) {
+	(*phaseLog)(nil).record(name, d)
+}
+
+// takePhases returns the phases in the process-wide log.
+func takePhases() []phaseTime {
+	return processPhases.take()
+}
+
+// Report is the machine-readable summary printed by --json.
+type Report struct {
+	Operation  string             `json:"operation"`
+	Input      string             `json:"input,omitempty"`
+	Output     string             `json:"output,omitempty"`
+	Width      int                `json:"width,omitempty"`
+	Height     int                `json:"height,omitempty"`
+	Workers    int                `json:"workers"`
+	Parameters map[string]any     `json:"parameters"`
+	LoadMs     float64            `json:"load_ms"`
+	FilterMs   float64            `json:"filter_ms"`
+	SaveMs     float64            `json:"save_ms"`
+	TotalMs    float64            `json:"total_ms"`
+	PhasesMs   map[string]float64 `json:"phases_ms,omitempty"`
+	Result     any                `json:"result,omitempty"`
+	Verify     *VerifyResult      `json:"verify,omitempty"`
+	Checksum   string             `json:"checksum,omitempty"`
+	Diff       *DiffStats         `json:"diff,omitempty"`
+	Memory     *MemoryStats       `json:"memory,omitempty"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (r *Report) addPhases(list []phaseTime) {
+	if len(list) == 0 {
+		return
+	}
+	if r.PhasesMs == nil {
+		r.PhasesMs = make(map[string]float64)
+	}
+	for _, p := range list {
+		key := strings.ReplaceAll(strings.ToLower(p.name), " ", "_")
+		r.PhasesMs[key] += ms(p.duration)
+	}
+}
+
+func (r *Report) write(w io.Writer) error {
+	return writeJSON(w, r)
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPhaseLogsPerRun(t *testing.T) {
+	takePhases()
+	var wg sync.WaitGroup
+	logs := make([]phaseLog, 8)
+	for i := range logs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				logs[i].record(fmt.Sprintf("run %d", i), 1)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range logs {
+		phases := logs[i].take()
+		if len(phases) != 1 || phases[0].name != fmt.Sprintf("run %d", i) || phases[0].duration != 100 {
+			t.Errorf("run %d collected %v", i, phases)
+		}
+	}
+	if leaked := takePhases(); len(leaked) > 0 {
+		t.Errorf("process-wide log got %v", leaked)
+	}
+}
+
+func TestNilPhaseLogIsProcessWide(t *testing.T) {
+	takePhases()
+	var l *phaseLog
+	l.record("a", 1)
+	recordPhase("a", 2)
+	if got := takePhases(); len(got) != 1 || got[0].name != "a" || got[0].duration != 3 {
+		t.Errorf("process-wide log got %v", got)
+	}
+}
+
+func TestResizePhasesGoToTheirLog(t *testing.T) {
+	takePhases()
+	var l phaseLog
+	if _, err := resizeImage(syntheticImages[0].generate(), 20, 10, "bilinear", 2, &l); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.take(); len(got) == 0 {
+		t.Error("resize recorded no phases in its log")
+	}
+	if leaked := takePhases(); len(leaked) > 0 {
+		t.Errorf("process-wide log got %v", leaked)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// retryPolicy retries transient I/O failures with exponential backoff:
+// up to attempts tries in all, the first retry after backoff and each
+// later one after twice the last wait, every wait stretched by up to half
+// at random so that jobs failing together don't retry in lockstep.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// ioRetry is how batch and consume retry reading inputs and writing
+// outputs, set from batch -retries and -backoff; by default they don't.
+var ioRetry = retryPolicy{attempts: 1, backoff: 100 * time.Millisecond}
+
+// do runs fn until it succeeds, fails with an error that isTransient
+// doesn't accept, runs out of attempts or the run is interrupted, and
+// returns the number of retries along with the last error.
+func (p retryPolicy) do(what string, fn func() error) (int, error) {
+	delay := p.backoff
+	for retries := 0; ; retries++ {
+		err := fn()
+		if err == nil || retries+1 >= p.attempts || !isTransient(err) {
+			return retries, err
+		}
+		wait := delay + rand.N(delay/2+1)
+		logger.Warn("retrying", "op", what, "err", err, "in", wait)
+		select {
+		case <-time.After(wait):
+		case <-interrupt.Done():
+			return retries, err
+		}
+		delay *= 2
+	}
+}
+
+// httpStatusError is a download answered with a status other than 200
+// or 304.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string { return e.status }
+
+// isTransient reports whether err may go away if the operation is tried
+// again: interrupted or timed out system calls, I/O errors of flaky disks
+// and network file systems, timeouts, failed connections, and HTTP 408,
+// 429 and 5xx. A missing file, a denied permission, a corrupt image or a
+// request that can't be made at all (a bad URL, an unknown host, a
+// certificate that doesn't verify) fail the same way every time.
+func isTransient(err error) bool {
+	var status *httpStatusError
+	if errors.As(err, &status) {
+		return status.code == http.StatusRequestTimeout || status.code == http.StatusTooManyRequests || status.code >= 500
+	}
+	// A *url.Error wraps every failed request, so look at what it wraps.
+	// It passes Timeout on from the error underneath.
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EINTR, syscall.EAGAIN, syscall.EIO, syscall.EBUSY, syscall.ETIMEDOUT, syscall.ECONNRESET, syscall.ESTALE} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	request := func(err error) error { return &url.Error{Op: "Get", URL: "http://example.com/a.png", Err: err} }
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"refused", request(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true},
+		{"reset", request(fmt.Errorf("read body: %w", os.NewSyscallError("read", syscall.ECONNRESET))), true},
+		{"timeout", request(os.ErrDeadlineExceeded), true},
+		{"unknown host", request(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), false},
+		{"bad scheme", request(errors.New(`unsupported protocol scheme "foo"`)), false},
+		{"503", &httpStatusError{http.StatusServiceUnavailable, "503 Service Unavailable"}, true},
+		{"404", &httpStatusError{http.StatusNotFound, "404 Not Found"}, false},
+		{"missing file", &fs.PathError{Op: "open", Path: "a.png", Err: syscall.ENOENT}, false},
+		{"stale handle", &fs.PathError{Op: "read", Path: "a.png", Err: syscall.ESTALE}, true},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("%s: isTransient(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsTransientRealRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + l.Addr().String() + "/a.png"
+	l.Close()
+	if _, err := http.Get(closed); err == nil || !isTransient(err) {
+		t.Errorf("refused connection: %v not transient", err)
+	}
+	if _, err := http.Get("foo://example.com/a.png"); err == nil || isTransient(err) {
+		t.Errorf("bad scheme: %v transient", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// rngNames lists the generators accepted by --rng. lcg is the default since
+// it is the formula shared with the other language implementations.
+var rngNames = []string{"lcg", "pcg32", "xoshiro256", "rand"}
+
+// uniformSource yields uniform floats in [0, 1).
+type uniformSource interface {
+	Float64() float64
+}
+
+// newSource returns the named generator seeded for one worker.
+func newSource(name string, seed uint64) (uniformSource, error) {
+	switch name {
+	case "lcg":
+		return &lcgSource{uint32(seed)}, nil
+	case "pcg32":
+		return newPCG32(seed, 54), nil
+	case "xoshiro256":
+		return newXoshiro256(seed), nil
+	case "rand":
+		// math/rand/v2's ChaCha8, seeded deterministically from the worker seed.
+		var key [32]byte
+		for i := range 4 {
+			v := splitMix64(&seed)
+			for j := range 8 {
+				key[i*8+j] = byte(v >> (8 * j))
+			}
+		}
+		return rand.New(rand.NewChaCha8(key)), nil
+	}
+	return nil, fmt.Errorf("unknown rng %q: use one of %v", name, rngNames)
+}
+
+type lcgSource struct{ seed uint32 }
+
+func (s *lcgSource) Float64() float64 { return lcgRandom(&s.seed) }
+
+// pcg32 is O'Neill's PCG-XSH-RR with 64-bit state and 32-bit output.
+type pcg32 struct{ state, inc uint64 }
+
+func newPCG32(seed, seq uint64) *pcg32 {
+	p := &pcg32{inc: seq<<1 | 1}
+	p.next()
+	p.state += seed
+	p.next()
+	return p
+}
+
+func (p *pcg32) next() uint32 {
+	old := p.state
+	p.state = old*6364136223846793005 + p.inc
+	xorshifted := uint32(((old >> 18) ^ old) >> 27)
+	return bits.RotateLeft32(xorshifted, -int(old>>59))
+}
+
+func (p *pcg32) Float64() float64 {
+	// Two outputs give the 53 bits of a float64 mantissa.
+	v := uint64(p.next())<<21 ^ uint64(p.next())>>11
+	return float64(v&(1<<53-1)) / (1 << 53)
+}
+
+// xoshiro256 is Blackman and Vigna's xoshiro256**.
+type xoshiro256 struct{ s [4]uint64 }
+
+func newXoshiro256(seed uint64) *xoshiro256 {
+	x := &xoshiro256{}
+	for i := range x.s {
+		x.s[i] = splitMix64(&seed)
+	}
+	return x
+}
+
+func (x *xoshiro256) Float64() float64 {
+	s := &x.s
+	result := bits.RotateLeft64(s[1]*5, 7) * 9
+	t := s[1] << 17
+	s[2] ^= s[0]
+	s[3] ^= s[1]
+	s[1] ^= s[2]
+	s[0] ^= s[3]
+	s[2] ^= t
+	s[3] = bits.RotateLeft64(s[3], 45)
+	return float64(result>>11) / (1 << 53)
+}
+
+// splitMix64 expands a single seed into well-mixed state words.
+func splitMix64(seed *uint64) uint64 {
+	*seed += 0x9e3779b97f4a7c15
+	z := *seed
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/cmplx"
+)
+
+// The spectral residual is computed on a small fixed-size thumbnail, which is
+// both what the method was designed for and cheap enough that the FFTs don't
+// dominate.
+const saliencySize = 64
+
+// downsampleChannels box-averages the RGB channels into size x size grids.
+func downsampleChannels(img *image.RGBA, size int) [3][]float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	var channels [3][]float64
+	for ch := range 3 {
+		channels[ch] = make([]float64, size*size)
+	}
+	counts := make([]float64, size*size)
+	for y := range height {
+		gy := y * size / height
+		row := img.Pix[y*img.Stride:]
+		for x := range width {
+			i := gy*size + x*size/width
+			for ch := range 3 {
+				channels[ch][i] += float64(row[x*4+ch])
+			}
+			counts[i]++
+		}
+	}
+	for i, n := range counts {
+		if n == 0 {
+			continue
+		}
+		for ch := range 3 {
+			channels[ch][i] /= n
+		}
+	}
+	return channels
+}
+
+// spectralResidual returns the saliency of one size x size channel: the log
+// amplitude spectrum minus its local average, recombined with the original
+// phase and transformed back.
+func spectralResidual(channel []float64, size int) []float64 {
+	spectrum := make([]complex128, len(channel))
+	for i, v := range channel {
+		spectrum[i] = complex(v, 0)
+	}
+	fft2D(spectrum, size, size, false, 1)
+
+	logAmp := make([]float64, len(spectrum))
+	for i, c := range spectrum {
+		logAmp[i] = math.Log(cmplx.Abs(c) + 1e-9)
+	}
+	for y := range size {
+		for x := range size {
+			avg := 0.0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					sy := min(max(y+dy, 0), size-1)
+					sx := min(max(x+dx, 0), size-1)
+					avg += logAmp[sy*size+sx]
+				}
+			}
+			i := y*size + x
+			spectrum[i] = cmplx.Rect(math.Exp(logAmp[i]-avg/9), cmplx.Phase(spectrum[i]))
+		}
+	}
+	fft2D(spectrum, size, size, true, 1)
+
+	saliency := make([]float64, len(spectrum))
+	for i, c := range spectrum {
+		a := cmplx.Abs(c)
+		saliency[i] = a * a
+	}
+	return saliency
+}
+
+// blurFloat applies a separable Gaussian to a single-channel float grid.
+func blurFloat(values []float64, width, height, radius int) []float64 {
+	kernel := generateGaussianKernel(radius)
+	tmp := make([]float64, len(values))
+	out := make([]float64, len(values))
+	for y := range height {
+		for x := range width {
+			sum := 0.0
+			for k := -radius; k <= radius; k++ {
+				sx := min(max(x+k, 0), width-1)
+				sum += values[y*width+sx] * kernel[k+radius]
+			}
+			tmp[y*width+x] = sum
+		}
+	}
+	for y := range height {
+		for x := range width {
+			sum := 0.0
+			for k := -radius; k <= radius; k++ {
+				sy := min(max(y+k, 0), height-1)
+				sum += tmp[sy*width+x] * kernel[k+radius]
+			}
+			out[y*width+x] = sum
+		}
+	}
+	return out
+}
+
+// saliencyMap returns a per-pixel saliency in [0, 1] at the source
+// resolution. The three channels are analysed in parallel and summed; radius
+// smooths the thumbnail map before it is upsampled.
+func saliencyMap(srcImg image.Image, radius, numWorkers int) []float64 {
+	img := toRGBA(srcImg)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	channels := downsampleChannels(img, saliencySize)
+
+	var maps [3][]float64
+	var wg workerGroup
+	for ch := range 3 {
+		spawnWorker(&wg, func() {
+			maps[ch] = spectralResidual(channels[ch], saliencySize)
+		})
+	}
+	wg.Wait()
+
+	small := make([]float64, saliencySize*saliencySize)
+	for i := range small {
+		small[i] = maps[0][i] + maps[1][i] + maps[2][i]
+	}
+	if radius > 0 {
+		small = blurFloat(small, saliencySize, saliencySize, radius)
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range small {
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	for i := range small {
+		if hi > lo {
+			small[i] = (small[i] - lo) / (hi - lo)
+		} else {
+			small[i] = 0
+		}
+	}
+
+	// Bilinear upsample back to the source size, split by rows.
+	values := make([]float64, width*height)
+	for _, r := range splitRows(height, numWorkers) {
+		spawnWorker(&wg, func() {
+			forRowChunks(r.start, r.end, func(from, to int) {
+				for y := from; y < to; y++ {
+					fy := (float64(y)+0.5)*saliencySize/float64(height) - 0.5
+					y0 := min(max(int(math.Floor(fy)), 0), saliencySize-1)
+					y1 := min(y0+1, saliencySize-1)
+					ty := min(max(fy-float64(y0), 0), 1)
+					for x := range width {
+						fx := (float64(x)+0.5)*saliencySize/float64(width) - 0.5
+						x0 := min(max(int(math.Floor(fx)), 0), saliencySize-1)
+						x1 := min(x0+1, saliencySize-1)
+						tx := min(max(fx-float64(x0), 0), 1)
+						top := small[y0*saliencySize+x0]*(1-tx) + small[y0*saliencySize+x1]*tx
+						bottom := small[y1*saliencySize+x0]*(1-tx) + small[y1*saliencySize+x1]*tx
+						values[y*width+x] = top*(1-ty) + bottom*ty
+					}
+				}
+			})
+		})
+	}
+	wg.Wait()
+
+	return values
+}
+
+// heatColor maps v in [0, 1] to a blue-cyan-green-yellow-red ramp.
+func heatColor(v float64) color.RGBA {
+	v = min(max(v, 0), 1)
+	r := math.Min(math.Max(1.5-math.Abs(4*v-3), 0), 1)
+	g := math.Min(math.Max(1.5-math.Abs(4*v-2), 0), 1)
+	b := math.Min(math.Max(1.5-math.Abs(4*v-1), 0), 1)
+	return color.RGBA{uint8(r * 255), uint8(g * 255), uint8(b * 255), 255}
+}
+
+func applySaliency(srcImg image.Image, radius, numWorkers int) *image.RGBA {
+	bounds := srcImg.Bounds()
+	width := bounds.Dx()
+	values := saliencyMap(srcImg, radius, numWorkers)
+	dstImg := image.NewRGBA(image.Rect(0, 0, width, bounds.Dy()))
+	for i, v := range values {
+		dstImg.SetRGBA(i%width, i/width, heatColor(v))
+	}
+	return dstImg
+}
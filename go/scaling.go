@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// ScalingReport is the bench summary: per worker count results plus an
+// Amdahl's law fit and a per-phase breakdown of where scaling is lost.
+type ScalingReport struct {
+	Schedule       string         `json:"schedule,omitempty"`
+	Results        []BenchResult  `json:"results"`
+	SerialFraction float64        `json:"serial_fraction"`
+	MaxSpeedup     float64        `json:"max_speedup,omitempty"`
+	PhaseScaling   []PhaseScaling `json:"phase_scaling,omitempty"`
+	LimitingPhase  string         `json:"limiting_phase,omitempty"`
+	GPU            *BenchResult   `json:"gpu,omitempty"` // with bench --gpu
+}
+
+// PhaseScaling compares one phase between the single-worker baseline and the
+// largest worker count. LostMs is the time spent above perfect linear
+// scaling; the phase with the most lost time limits overall speedup.
+type PhaseScaling struct {
+	Name       string  `json:"name"`
+	BaselineMs float64 `json:"baseline_ms"`
+	ParallelMs float64 `json:"parallel_ms"`
+	Speedup    float64 `json:"speedup"`
+	LostMs     float64 `json:"lost_ms"`
+}
+
+// karpFlatt is the experimentally determined serial fraction for a single
+// measurement with the given speedup on n workers.
+func karpFlatt(speedup float64, n int) float64 {
+	if n <= 1 || speedup <= 0 {
+		return 0
+	}
+	inv := 1 / float64(n)
+	return (1/speedup - inv) / (1 - inv)
+}
+
+// fitSerialFraction finds s minimizing the squared error of Amdahl's law
+// T(n)/T(1) = s + (1-s)/n over all measurements with more than one worker.
+func fitSerialFraction(results []BenchResult, baselineMs float64) float64 {
+	var sxy, sxx float64
+	for _, r := range results {
+		if r.Workers <= 1 || baselineMs <= 0 {
+			continue
+		}
+		inv := 1 / float64(r.Workers)
+		x := 1 - inv
+		y := r.MedianMs/baselineMs - inv
+		sxy += x * y
+		sxx += x * x
+	}
+	if sxx == 0 {
+		return 0
+	}
+	return min(max(sxy/sxx, 0), 1)
+}
+
+func analyzeScaling(results []BenchResult, baseline BenchResult) ScalingReport {
+	report := ScalingReport{Results: results}
+	for i := range report.Results {
+		r := &report.Results[i]
+		r.Efficiency = r.Speedup / float64(r.Workers)
+		r.KarpFlatt = karpFlatt(r.Speedup, r.Workers)
+	}
+	report.SerialFraction = fitSerialFraction(results, baseline.MedianMs)
+	if report.SerialFraction > 0 {
+		report.MaxSpeedup = 1 / report.SerialFraction
+	}
+
+	widest := results[0]
+	for _, r := range results {
+		if r.Workers > widest.Workers {
+			widest = r
+		}
+	}
+	if widest.Workers <= 1 {
+		return report
+	}
+	var mostLost float64
+	for _, p := range baseline.Phases {
+		var parallel float64
+		for _, q := range widest.Phases {
+			if q.Name == p.Name {
+				parallel = q.MedianMs
+			}
+		}
+		ps := PhaseScaling{
+			Name:       p.Name,
+			BaselineMs: p.MedianMs,
+			ParallelMs: parallel,
+			LostMs:     parallel - p.MedianMs/float64(widest.Workers),
+		}
+		if parallel > 0 {
+			ps.Speedup = p.MedianMs / parallel
+		}
+		if ps.LostMs > mostLost {
+			mostLost = ps.LostMs
+			report.LimitingPhase = p.Name
+		}
+		report.PhaseScaling = append(report.PhaseScaling, ps)
+	}
+	return report
+}
+
+func printScaling(out io.Writer, report ScalingReport) {
+	fmt.Fprintf(out, "\nScaling efficiency:\n")
+	fmt.Fprintf(out, "%8s %10s %12s\n", "workers", "efficiency", "karp-flatt")
+	for _, r := range report.Results {
+		fmt.Fprintf(out, "%8d %9.1f%% %12.3f\n", r.Workers, r.Efficiency*100, r.KarpFlatt)
+	}
+	fmt.Fprintf(out, "Amdahl serial fraction: %.3f", report.SerialFraction)
+	if report.MaxSpeedup > 0 {
+		fmt.Fprintf(out, " (max speedup %.1fx)", report.MaxSpeedup)
+	}
+	fmt.Fprintf(out, "\n")
+
+	if len(report.PhaseScaling) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "\n%-16s %12s %12s %8s %12s\n", "phase", "1 worker", "parallel", "speedup", "lost")
+	for _, p := range report.PhaseScaling {
+		fmt.Fprintf(out, "%-16s %10.2fms %10.2fms %7.2fx %10.2fms\n", p.Name, p.BaselineMs, p.ParallelMs, p.Speedup, p.LostMs)
+	}
+	if report.LimitingPhase != "" {
+		fmt.Fprintf(out, "Scaling is limited by: %s\n", report.LimitingPhase)
+	}
+}
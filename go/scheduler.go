@@ -0,0 +1,283 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheduler hands out the indices [0, n) to numWorkers workers in chunks,
+// calling fn(worker, start, end) for each chunk, and returns when all are
+// done. Every index is covered exactly once whatever the policy, so results
+// don't depend on it; only the balance between workers does.
+type Scheduler interface {
+	Run(n, numWorkers int, fn func(worker, start, end int))
+}
+
+// staticScheduler gives each worker one contiguous band up front, the
+// cheapest policy when every index costs the same.
+type staticScheduler struct{}
+
+func (staticScheduler) Run(n, numWorkers int, fn func(worker, start, end int)) {
+	var wg workerGroup
+	for i, r := range splitRows(n, numWorkers) {
+		spawnWorker(&wg, func() { fn(i, r.start, r.end) })
+	}
+	wg.Wait()
+}
+
+// dynamicScheduler has workers take the next chunk from a shared counter,
+// balancing uneven work at the cost of one atomic add per chunk.
+type dynamicScheduler struct{ chunk int }
+
+func (s dynamicScheduler) Run(n, numWorkers int, fn func(worker, start, end int)) {
+	chunk := max(s.chunk, 1)
+	var next atomic.Int64
+	var wg workerGroup
+	for i := range max(min(numWorkers, n), 1) {
+		spawnWorker(&wg, func() {
+			for {
+				start := int(next.Add(int64(chunk))) - chunk
+				if start >= n {
+					return
+				}
+				fn(i, start, min(start+chunk, n))
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// guidedScheduler is guided self-scheduling: each grab takes the remaining
+// work divided by the worker count, but at least minChunk, so chunks start
+// large (few atomics) and shrink towards the end (good balance).
+type guidedScheduler struct{ minChunk int }
+
+func (s guidedScheduler) Run(n, numWorkers int, fn func(worker, start, end int)) {
+	minChunk := max(s.minChunk, 1)
+	workers := max(min(numWorkers, n), 1)
+	var next atomic.Int64
+	var wg workerGroup
+	for i := range workers {
+		spawnWorker(&wg, func() {
+			for {
+				start := int(next.Load())
+				if start >= n {
+					return
+				}
+				end := min(start+max((n-start)/workers, minChunk), n)
+				if next.CompareAndSwap(int64(start), int64(end)) {
+					fn(i, start, end)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// stealingScheduler starts like the static split, but each worker takes its
+// band a chunk at a time and, once it runs out, steals the back half of the
+// largest band left to another worker. Neighbouring indices stay on one
+// worker until imbalance forces a steal.
+type stealingScheduler struct{ chunk int }
+
+// band is the unprocessed part [lo, hi) of one worker's range.
+type band struct {
+	sync.Mutex
+	lo, hi int
+}
+
+func (s stealingScheduler) Run(n, numWorkers int, fn func(worker, start, end int)) {
+	chunk := max(s.chunk, 1)
+	ranges := splitRows(n, numWorkers)
+	bands := make([]band, len(ranges))
+	for i, r := range ranges {
+		bands[i].lo, bands[i].hi = r.start, r.end
+	}
+
+	// steal moves the back half of the fullest other band to worker i.
+	steal := func(i int) bool {
+		victim, most := -1, 0
+		for j := range bands {
+			if j == i {
+				continue
+			}
+			bands[j].Lock()
+			if left := bands[j].hi - bands[j].lo; left > most {
+				victim, most = j, left
+			}
+			bands[j].Unlock()
+		}
+		if victim < 0 {
+			return false
+		}
+		v := &bands[victim]
+		v.Lock()
+		left := v.hi - v.lo
+		if left == 0 {
+			v.Unlock()
+			return true // someone got there first; look again
+		}
+		mid := v.hi - (left+1)/2
+		lo, hi := mid, v.hi
+		v.hi = mid
+		v.Unlock()
+		bands[i].Lock()
+		bands[i].lo, bands[i].hi = lo, hi
+		bands[i].Unlock()
+		return true
+	}
+
+	var wg workerGroup
+	for i := range bands {
+		spawnWorker(&wg, func() {
+			own := &bands[i]
+			for {
+				own.Lock()
+				start := own.lo
+				end := min(start+chunk, own.hi)
+				own.lo = end
+				own.Unlock()
+				if start < end {
+					fn(i, start, end)
+					continue
+				}
+				if !steal(i) {
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// adaptiveChunkTarget is the time the adaptive scheduler aims each chunk
+// at: long enough that taking a chunk costs nothing in comparison, short
+// enough that the last chunks leave little imbalance. A calibrated profile
+// lowers it where handing out chunks is cheap.
+const adaptiveChunkTarget = 500 * time.Microsecond
+
+// adaptiveScheduler is dynamic scheduling with the chunk size set by
+// feedback. Chunks start at one index; after each, the worker times it and
+// scales the shared chunk size towards target, at most
+// doubling or halving it at once. Near the end no chunk takes more than
+// half a worker's share of what is left, so the workers finish together.
+// It keeps statistics across runs, for the report.
+type adaptiveScheduler struct {
+	target time.Duration    // 0 for adaptiveChunkTarget
+	now    func() time.Time // the clock chunks are timed with; nil for time.Now
+
+	mu    sync.Mutex
+	stats ChunkStats
+}
+
+// ChunkStats describes the chunks the adaptive scheduler chose.
+type ChunkStats struct {
+	Runs      int `json:"runs"`
+	Chunks    int `json:"chunks"`
+	Indices   int `json:"indices"`
+	LastChunk int `json:"last_chunk"` // the size the feedback settled at in the last run
+	MaxChunk  int `json:"max_chunk"`
+}
+
+func (s *adaptiveScheduler) Run(n, numWorkers int, fn func(worker, start, end int)) {
+	workers := max(min(numWorkers, n), 1)
+	target := cmp.Or(s.target, adaptiveChunkTarget)
+	now := s.now
+	if now == nil {
+		now = time.Now
+	}
+	var next, chunk, chunks, largest atomic.Int64
+	chunk.Store(1)
+	var wg workerGroup
+	for i := range workers {
+		spawnWorker(&wg, func() {
+			for {
+				steady := int(chunk.Load())
+				size := max(min(steady, (n-int(next.Load()))/(2*workers)), 1)
+				start := int(next.Add(int64(size))) - size
+				if start >= n {
+					return
+				}
+				end := min(start+size, n)
+				t := now()
+				fn(i, start, end)
+				elapsed := max(now().Sub(t), time.Microsecond)
+				chunks.Add(1)
+
+				rows := end - start
+				if rows < steady {
+					// Cut short by the tail: its time says nothing about
+					// the chunk size, and feeding it back would shrink the
+					// size reported as the one the run settled at.
+					continue
+				}
+				want := int(float64(rows) * float64(target) / float64(elapsed))
+				want = max(min(want, 2*rows), rows/2, 1)
+				chunk.Store(int64(want))
+				for cur := largest.Load(); int64(want) > cur && !largest.CompareAndSwap(cur, int64(want)); cur = largest.Load() {
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	s.stats.Runs++
+	s.stats.Chunks += int(chunks.Load())
+	s.stats.Indices += n
+	s.stats.LastChunk = int(chunk.Load())
+	s.stats.MaxChunk = max(s.stats.MaxChunk, int(largest.Load()))
+	s.mu.Unlock()
+}
+
+// chunkStats returns the statistics of the runs so far.
+func (s *adaptiveScheduler) chunkStats() ChunkStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// schedulerNames lists the policies accepted by newScheduler.
+var schedulerNames = []string{"static", "dynamic", "guided", "stealing", "adaptive"}
+
+func newScheduler(name string) (Scheduler, error) {
+	switch name {
+	case "static":
+		return staticScheduler{}, nil
+	case "dynamic":
+		return dynamicScheduler{chunk: 1}, nil
+	case "guided":
+		return guidedScheduler{minChunk: 1}, nil
+	case "stealing":
+		return stealingScheduler{chunk: 1}, nil
+	case "adaptive":
+		return &adaptiveScheduler{target: loadCostModel().chunkTarget()}, nil
+	}
+	return nil, fmt.Errorf("unknown schedule %q (want %s)", name, strings.Join(schedulerNames, ", "))
+}
+
+type schedulerHolder struct{ Scheduler }
+
+var rowScheduler atomic.Pointer[schedulerHolder]
+
+// SetScheduler selects the policy parallelRows, and so the row-parallel
+// filters, use to split rows among workers; nil restores the default static
+// bands. It applies to filter calls started afterwards.
+func SetScheduler(s Scheduler) {
+	if s == nil {
+		rowScheduler.Store(nil)
+		return
+	}
+	rowScheduler.Store(&schedulerHolder{s})
+}
+
+func currentScheduler() Scheduler {
+	if h := rowScheduler.Load(); h != nil {
+		return h.Scheduler
+	}
+	return staticScheduler{}
+}
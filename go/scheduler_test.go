@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLastChunkIsSteadyState(t *testing.T) {
+	// Every index costs 20µs on a fake clock that fn advances, so the
+	// feedback sees exact timings and the steady size is 1ms/20µs = 50.
+	const perIndex = 20 * time.Microsecond
+	var clock time.Time
+	s := &adaptiveScheduler{
+		target: time.Millisecond,
+		now:    func() time.Time { return clock },
+	}
+	var sizes []int
+	s.Run(4000, 1, func(_, start, end int) {
+		clock = clock.Add(time.Duration(end-start) * perIndex)
+		sizes = append(sizes, end-start)
+	})
+	stats := s.chunkStats()
+	if stats.Indices != 4000 || stats.Runs != 1 || stats.Chunks != len(sizes) {
+		t.Fatalf("stats %+v for %d chunks", stats, len(sizes))
+	}
+	// The size doubles from 1 until the target caps it at 50.
+	want := []int{1, 2, 4, 8, 16, 32, 50, 50}
+	for i, w := range want {
+		if sizes[i] != w {
+			t.Fatalf("chunk sizes start %v, want %v", sizes[:len(want)], want)
+		}
+	}
+	// The tail chunks shrink to 1; the reported size must not follow them.
+	if sizes[len(sizes)-1] != 1 {
+		t.Errorf("last chunk has %d indices, want the tail cut to 1", sizes[len(sizes)-1])
+	}
+	if stats.LastChunk != 50 || stats.MaxChunk != 50 {
+		t.Errorf("LastChunk %d, MaxChunk %d, want both 50", stats.LastChunk, stats.MaxChunk)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// selftestFilter is one parallel filter exercised by selftest.
+type selftestFilter struct {
+	name string
+	run  func(img *image.RGBA, workers int) (*image.RGBA, error)
+}
+
+// previewFilter checks that the refined result of ProgressiveOperation
+// matches the operation run on the whole image.
+func previewFilter(op string, radius int) selftestFilter {
+	return selftestFilter{fmt.Sprintf("preview %s r%d", op, radius), func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		opts := previewOptions{scale: 2, focus: image.Pt(img.Bounds().Dx()/3, 0), numWorkers: workers}
+		dst, err := ProgressiveOperation(op, img, radius, opts, func(*image.RGBA, image.Rectangle, bool) {})
+		if err != nil {
+			return nil, err
+		}
+		want, err := runCase(op, img, radius, workers)
+		if err != nil {
+			return nil, err
+		}
+		if pixelChecksum(dst) != pixelChecksum(want) {
+			return nil, errors.New("refined output differs from the whole-image filter")
+		}
+		return dst, nil
+	}}
+}
+
+func operationFilter(op string, radius int) selftestFilter {
+	return selftestFilter{fmt.Sprintf("%s r%d", op, radius), func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		return runCase(op, img, radius, workers)
+	}}
+}
+
+// blurAccuracyFilter checks a blur algorithm against the direct passes:
+// no channel off by more than maxDiff, and a PSNR of at least minPSNR.
+func blurAccuracyFilter(name string, radius int, blur func(*image.RGBA, []float64, int) *image.RGBA, maxDiff int, minPSNR float64) selftestFilter {
+	return selftestFilter{fmt.Sprintf("blur %s r%d", name, radius), func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		kernel := blurKernel(radius)
+		dst := blur(img, kernel, workers)
+		want := blurImage(img, kernel, "direct", workers, nil)
+		takePhases()
+		diff, _, err := compareImages(dst, want)
+		if err != nil {
+			return nil, err
+		}
+		m, err := computeMetrics(want, dst, workers)
+		if err != nil {
+			return nil, err
+		}
+		if largest := max(diff[0], diff[1], diff[2], diff[3]); largest > maxDiff || m.PSNR < minPSNR {
+			return nil, fmt.Errorf("off the direct blur by up to %d, PSNR %.1fdB", largest, m.PSNR)
+		}
+		return dst, nil
+	}}
+}
+
+var selftestFilters = []selftestFilter{
+	operationFilter("blur", 2),
+	operationFilter("blur_u8", 2),
+	{"blur stream r2", func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		next := 0
+		dst, err := StreamGaussianBlur(img, 2, workers, 4, func(_ *image.RGBA, start, end int) {
+			if start != next {
+				next = -1
+			} else if next >= 0 {
+				next = end
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if next != img.Bounds().Dy() {
+			return nil, errors.New("rows emitted out of order or incomplete")
+		}
+		if pixelChecksum(dst) != pixelChecksum(applyGaussianBlur(img, 2, workers, nil)) {
+			return nil, errors.New("output differs from blur")
+		}
+		return dst, nil
+	}},
+	blurAccuracyFilter("fft", 6, func(img *image.RGBA, kernel []float64, workers int) *image.RGBA {
+		return blurImage(img, kernel, "fft", workers, nil)
+	}, 1, 50),
+	blurAccuracyFilter("iir", 6, func(img *image.RGBA, kernel []float64, workers int) *image.RGBA {
+		return blurImage(img, kernel, "iir", workers, nil)
+	}, 8, 40),
+	blurAccuracyFilter("uint16", 3, func(img *image.RGBA, kernel []float64, workers int) *image.RGBA {
+		src := imageDataFrom[uint16](img, workers)
+		blurData(src, src, kernel, "direct", workers, nil)
+		return src.RGBA(workers)
+	}, 1, 50),
+	{"blur gray r2", func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		// One channel must give the RGBA path's result on a gray image.
+		gray := image.NewGray(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		for i := range gray.Pix {
+			gray.Pix[i] = img.Pix[i*4]
+		}
+		out, err := applyGrayOperation("blur", gray, 2, workers)
+		if err != nil {
+			return nil, err
+		}
+		dst := toRGBA(out)
+		want, err := runCase("blur", gray, 2, workers)
+		if err != nil {
+			return nil, err
+		}
+		if pixelChecksum(dst) != pixelChecksum(want) {
+			return nil, errors.New("output differs from the RGBA blur")
+		}
+		return dst, nil
+	}},
+	operationFilter("kuwahara", 2),
+	operationFilter("kuwahara_adaptive", 4),
+	{"kuwahara tiled SAT r3", func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		// Small tiles, so that most halos are cut by neighbours.
+		dst := kuwaharaTiled[float64](img, 3, nil, false, 16, workers, nil)
+		if pixelChecksum(dst) != pixelChecksum(kuwaharaFilter[float64](img, 3, false, 1, nil)) {
+			return nil, errors.New("output differs from whole-image tables")
+		}
+		return dst, nil
+	}},
+	{"kuwahara luma variance r3", func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		dst := kuwaharaFilter[float64](img, 3, true, workers, nil)
+		takePhases()
+		return dst, nil
+	}},
+	operationFilter("saliency", 1),
+	operationFilter("xdog", 3),
+	operationFilter("histeq", 0),
+	operationFilter("sepia", 0),
+	operationFilter("hsl", 140),
+	previewFilter("blur", 3),
+	previewFilter("kuwahara", 2),
+	{"glitch", func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		opts := glitchOptions{scanlines: true, shift: true, blocks: true, wobble: true, intensity: 0.7, seed: 7, numWorkers: workers}
+		return applyGlitch(img, opts), nil
+	}},
+	{"resize lanczos3", func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		b := img.Bounds()
+		return resizeImage(img, b.Dx()*2/3+1, b.Dy()*3/2, "lanczos3", workers, nil)
+	}},
+	{"guided filter", func(img *image.RGBA, workers int) (*image.RGBA, error) {
+		width, height := img.Bounds().Dx(), img.Bounds().Dy()
+		guide := luminance(img)
+		alpha := guidedFilter(guide, guide, width, height, 2, 1e-3, workers)
+		out := image.NewRGBA(img.Bounds())
+		for i, a := range alpha {
+			out.Pix[i*4], out.Pix[i*4+3] = uint8(a*255+0.5), 255
+		}
+		return out, nil
+	}},
+}
+
+// selftestSizes include a tiny image, one with fewer rows than most worker
+// counts, and sizes that don't divide evenly into rows or tiles.
+var selftestSizes = []image.Point{{7, 5}, {64, 48}, {257, 131}}
+
+type selftestCase struct {
+	filter selftestFilter
+	img    *image.RGBA
+	name   string
+	want   string
+}
+
+// selftestReferences runs every filter on every size with one worker.
+func selftestReferences() ([]selftestCase, []string) {
+	var cases []selftestCase
+	var failures []string
+	noise := syntheticImages[len(syntheticImages)-1]
+	for _, size := range selftestSizes {
+		s := noise
+		s.width, s.height = size.X, size.Y
+		img := s.generate()
+		for _, f := range selftestFilters {
+			name := fmt.Sprintf("%s %dx%d", f.name, size.X, size.Y)
+			ref, err := f.run(img, 1)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s, 1 worker: %v", name, err))
+				continue
+			}
+			cases = append(cases, selftestCase{f, img, name, pixelChecksum(ref)})
+		}
+	}
+	return cases, failures
+}
+
+// selftestWorkerCounts compares each case against its single-worker
+// reference at several worker counts.
+func selftestWorkerCounts(cases []selftestCase) (int, []string) {
+	cpus := cpuCount()
+	var failures []string
+	runs := 0
+	for _, c := range cases {
+		for _, workers := range []int{2, 3, 4, cpus, 2*cpus + 1} {
+			runs++
+			dst, err := c.filter.run(c.img, workers)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s, %d workers: %v", c.name, workers, err))
+			} else if pixelChecksum(dst) != c.want {
+				failures = append(failures, fmt.Sprintf("%s, %d workers: output differs from 1 worker", c.name, workers))
+			}
+		}
+	}
+	return runs, failures
+}
+
+// selftestConcurrent runs all cases at once from several goroutines, each
+// filter itself using several workers, so that shared state between
+// independent calls (phase timers, scratch buffers) is exercised.
+func selftestConcurrent(cases []selftestCase, rounds int) (int, []string) {
+	var mu sync.Mutex
+	var failures []string
+	var wg sync.WaitGroup
+	for g := range 4 {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for r := range rounds {
+				for i := range cases {
+					c := cases[(i+g+r)%len(cases)]
+					dst, err := c.filter.run(c.img, 3)
+					if err == nil && pixelChecksum(dst) == c.want {
+						continue
+					}
+					mu.Lock()
+					if err != nil {
+						failures = append(failures, fmt.Sprintf("%s, concurrent: %v", c.name, err))
+					} else {
+						failures = append(failures, fmt.Sprintf("%s, concurrent: output differs from 1 worker", c.name))
+					}
+					mu.Unlock()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	return 4 * rounds * len(cases), failures
+}
+
+// selftestYield checks that yield checkpoints leave the output unchanged
+// and that a failing check cancels a filter call with its error.
+func selftestYield(cases []selftestCase) (int, []string) {
+	defer SetYieldInterval(0, nil)
+	SetYieldInterval(3, nil)
+	runs, failures := selftestWorkerCounts(cases)
+
+	errStop := errors.New("stop")
+	for _, op := range []string{"blur", "kuwahara", "saliency"} {
+		var calls atomic.Int64
+		SetYieldInterval(1, func() error {
+			if calls.Add(1) > 2 {
+				return errStop
+			}
+			return nil
+		})
+		runs++
+		if _, err := runCase(op, cases[len(cases)-1].img, 2, 3); err != errStop {
+			failures = append(failures, fmt.Sprintf("%s: cancelled run returned %v", op, err))
+		}
+	}
+	return runs, failures
+}
+
+func selftestCommand(program string, args []string) {
+	var rounds int
+	var verbose bool
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	fs.IntVar(&rounds, "rounds", 2, "repetitions of the concurrent and stress loops")
+	fs.BoolVar(&verbose, "v", false, "list every failing case")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s selftest [flags]\n", program)
+		fmt.Fprintf(os.Stderr, "  Checks that every filter gives the same result at any worker count on this\n")
+		fmt.Fprintf(os.Stderr, "  machine; build with -race to also catch data races\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if rounds <= 0 || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	fmt.Printf("Self-test on %s/%s with %d CPUs (GOMAXPROCS %d)\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), runtime.GOMAXPROCS(0))
+
+	var cases []selftestCase
+	checks := []struct {
+		name string
+		run  func() (int, []string)
+	}{
+		{"single-worker references", func() (int, []string) {
+			var failures []string
+			cases, failures = selftestReferences()
+			return len(cases), failures
+		}},
+		{"worker counts", func() (int, []string) { return selftestWorkerCounts(cases) }},
+		{"concurrent calls", func() (int, []string) { return selftestConcurrent(cases, rounds) }},
+		{"concurrency cap", func() (int, []string) {
+			// Capped runs must give the same output and must not deadlock in
+			// nested parallel sections.
+			defer SetMaxConcurrency(0)
+			runs := 0
+			var failures []string
+			for _, limit := range []int{1, 3} {
+				SetMaxConcurrency(limit)
+				r, f := selftestWorkerCounts(cases)
+				runs += r
+				for _, msg := range f {
+					failures = append(failures, fmt.Sprintf("cap %d: %s", limit, msg))
+				}
+			}
+			return runs, failures
+		}},
+		{"schedulers", func() (int, []string) {
+			// Every policy must cover each row exactly once.
+			defer SetScheduler(nil)
+			runs := 0
+			var failures []string
+			for _, name := range schedulerNames {
+				sched, _ := newScheduler(name)
+				SetScheduler(sched)
+				r, f := selftestWorkerCounts(cases)
+				runs += r
+				for _, msg := range f {
+					failures = append(failures, fmt.Sprintf("%s: %s", name, msg))
+				}
+			}
+			return runs, failures
+		}},
+		{"yield and cancel", func() (int, []string) { return selftestYield(cases) }},
+		{"stress shapes", func() (int, []string) { return runStress(rounds) }},
+	}
+
+	failed := 0
+	for _, check := range checks {
+		start := time.Now()
+		runs, failures := check.run()
+		status := "PASS"
+		if len(failures) > 0 {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%-26s %s  %5d runs  %4d failures  %6dms\n", check.name, status, runs, len(failures), time.Since(start).Milliseconds())
+		for i, f := range failures {
+			if i == 5 && !verbose {
+				fmt.Printf("    ... %d more (use -v)\n", len(failures)-i)
+				break
+			}
+			fmt.Printf("    %s\n", f)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("Self-test FAILED: %d of %d checks\n", failed, len(checks))
+		os.Exit(exitFailure)
+	}
+	fmt.Printf("Self-test passed\n")
+}
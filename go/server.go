@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The serve command filters images over HTTP:
+//
+//	curl --data-binary @in.png 'localhost:8080/filter/blur?radius=5' > out.png
+//
+// Requests share the machine under two limits. A budget of pixels being
+// filtered at once, across all requests, makes a huge upload wait its turn
+// for a large share instead of running beside everything else, and a
+// token bucket per client address answers 429 to bursts above --rate, so
+// one client can't fill the budget for everyone. Requests waiting for the
+// budget line up by priority: an X-Priority header (or ?priority=) of
+// interactive, normal or batch, by default interactive for images up to
+// --interactive-pixels and normal above. Images over --max-image pixels
+// are answered 413 from their header, before any decoding. The filter
+// phases of a request come back in a Server-Timing header.
+
+// Request priorities, highest first in line.
+const (
+	priorityBatch = iota
+	priorityNormal
+	priorityInteractive
+)
+
+var priorityNames = [...]string{"batch", "normal", "interactive"}
+
+// pixelBudget is a semaphore counting pixels. Waiters are served by
+// priority, first come first served within one, and only from the head of
+// the line, so a large request isn't overtaken forever by small ones of
+// its priority that fit in what is left.
+type pixelBudget struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	waiters  []*budgetWaiter
+}
+
+type budgetWaiter struct {
+	n        int64
+	priority int
+	ready    chan struct{}
+}
+
+// acquire takes n pixels, at most the whole budget, waiting for them
+// behind the requests of the same or a higher priority until ctx is done.
+// It returns the pixels taken, to release later.
+func (b *pixelBudget) acquire(ctx context.Context, n int64, priority int) (int64, error) {
+	n = min(n, b.capacity)
+	b.mu.Lock()
+	if len(b.waiters) == 0 && b.used+n <= b.capacity {
+		b.used += n
+		b.mu.Unlock()
+		return n, nil
+	}
+	w := &budgetWaiter{n: n, priority: priority, ready: make(chan struct{})}
+	i := len(b.waiters)
+	for i > 0 && b.waiters[i-1].priority < priority {
+		i--
+	}
+	b.waiters = slices.Insert(b.waiters, i, w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return n, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.ready:
+			// Granted meanwhile: hand it back.
+			b.used -= n
+		default:
+			if i := slices.Index(b.waiters, w); i >= 0 {
+				b.waiters = slices.Delete(b.waiters, i, i+1)
+			}
+		}
+		b.grant()
+		b.mu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+func (b *pixelBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.grant()
+	b.mu.Unlock()
+}
+
+// grant wakes the waiters at the head of the line that now fit.
+func (b *pixelBudget) grant() {
+	for len(b.waiters) > 0 && b.used+b.waiters[0].n <= b.capacity {
+		w := b.waiters[0]
+		b.waiters = b.waiters[1:]
+		b.used += w.n
+		close(w.ready)
+	}
+}
+
+func (b *pixelBudget) usage() (used int64, waiting int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used, len(b.waiters)
+}
+
+// rateLimiter keeps a token bucket per client: burst requests at once,
+// refilled at rate a second.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token of client's bucket, or says how long until there is
+// one.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.buckets) > 4096 {
+		// Forget clients whose buckets have refilled: they start full anyway.
+		full := time.Duration(l.burst / l.rate * float64(time.Second))
+		for c, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, c)
+			}
+		}
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// QueueWaitStats is the time requests of a priority waited for the budget.
+type QueueWaitStats struct {
+	Requests int64   `json:"requests"`
+	MeanMs   float64 `json:"mean_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	totalMs  float64
+}
+
+// ServerStats is served at /stats.
+type ServerStats struct {
+	Requests    int64                     `json:"requests"`
+	Served      int64                     `json:"served"`
+	Failed      int64                     `json:"failed"`
+	RateLimited int64                     `json:"rate_limited"`
+	PixelBudget int64                     `json:"pixel_budget"`
+	PixelsInUse int64                     `json:"pixels_in_use"`
+	Waiting     int                       `json:"waiting"`
+	QueueWait   map[string]QueueWaitStats `json:"queue_wait"`
+	Pool        *PoolStats                `json:"pool,omitempty"`
+}
+
+type server struct {
+	numWorkers        int
+	maxUpload         int64
+	interactivePixels int64
+	maxImage          int64 // pixels of the largest image accepted
+	budget            *pixelBudget
+	limiter           *rateLimiter // nil without --rate
+
+	requests, served, failed, rateLimited atomic.Int64
+
+	waitMu sync.Mutex
+	waits  [len(priorityNames)]QueueWaitStats
+}
+
+// requestPriority reads the priority of r, or picks one by its size.
+func (s *server) requestPriority(r *http.Request, pixels int64) (int, error) {
+	name := r.Header.Get("X-Priority")
+	if name == "" {
+		name = r.URL.Query().Get("priority")
+	}
+	if name == "" {
+		if pixels <= s.interactivePixels {
+			return priorityInteractive, nil
+		}
+		return priorityNormal, nil
+	}
+	if i := slices.Index(priorityNames[:], name); i >= 0 {
+		return i, nil
+	}
+	return 0, fmt.Errorf("%w: priority %q, use interactive, normal or batch", errBadRequest, name)
+}
+
+func (s *server) recordWait(priority int, wait time.Duration) {
+	s.waitMu.Lock()
+	defer s.waitMu.Unlock()
+	stats := &s.waits[priority]
+	stats.Requests++
+	stats.totalMs += ms(wait)
+	stats.MaxMs = max(stats.MaxMs, ms(wait))
+	stats.MeanMs = stats.totalMs / float64(stats.Requests)
+}
+
+// clientAddr identifies the client of r for rate limiting.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// errBadRequest is an invalid request parameter.
+var errBadRequest = errors.New("bad request")
+
+// errImageTooLarge is an image over --max-image, refused before it is
+// decoded so a small compressed file can't make the server allocate a
+// huge one.
+var errImageTooLarge = errors.New("image too large")
+
+// httpStatus maps the errors of a filter request to a status code.
+func httpStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrUnknownOperation):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnsupportedFormat):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrDecode), errors.Is(err, ErrInvalidRadius), errors.Is(err, errBadRequest):
+		return http.StatusBadRequest
+	case errors.As(err, &tooLarge), errors.Is(err, errImageTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *server) handleFilter(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	client := clientAddr(r)
+	if s.limiter != nil {
+		if ok, wait := s.limiter.allow(client); !ok {
+			s.rateLimited.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+	start := time.Now()
+	var queued time.Duration
+	var pixels int64
+	var priority int
+	var phases []phaseTime
+	err := func() error {
+		operation := r.PathValue("operation")
+		info, ok := lookupOperation(operation)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownOperation, operation)
+		}
+		radius := info.defaultArg
+		if arg := r.URL.Query().Get("radius"); arg != "" {
+			var err error
+			if radius, err = strconv.Atoi(arg); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidRadius, err)
+			}
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxUpload))
+		if err != nil {
+			return err
+		}
+		// The header is enough to size the request before decoding it.
+		config, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if errors.Is(err, image.ErrFormat) {
+			return ErrUnsupportedFormat
+		} else if err != nil {
+			return fmt.Errorf("%w: %w", ErrDecode, err)
+		}
+		pixels = int64(config.Width) * int64(config.Height)
+		if pixels > s.maxImage {
+			return fmt.Errorf("%w: %dx%d is over %d pixels", errImageTooLarge, config.Width, config.Height, s.maxImage)
+		}
+		bounds := image.Rect(0, 0, config.Width, config.Height)
+		if radius, err = checkRadius(operation, radius, bounds); err != nil {
+			return err
+		}
+
+		if priority, err = s.requestPriority(r, pixels); err != nil {
+			return err
+		}
+		waitStart := time.Now()
+		taken, err := s.budget.acquire(r.Context(), pixels, priority)
+		if err != nil {
+			return err
+		}
+		defer s.budget.release(taken)
+		queued = time.Since(waitStart)
+		s.recordWait(priority, queued)
+
+		img, _, err := image.Decode(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrDecode, err)
+		}
+		filterStart := time.Now()
+		// The radius is checked already. The request's own log keeps its
+		// phases apart from those of the requests beside it.
+		var log phaseLog
+		dst, err := runFilter(operation, img, radius, s.numWorkers, &log)
+		phases = log.take()
+		if err != nil {
+			return err
+		}
+		if err := cancelled(); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Queue-Ms", strconv.FormatFloat(ms(queued), 'f', 1, 64))
+		w.Header().Set("X-Filter-Ms", strconv.FormatFloat(ms(time.Since(filterStart)), 'f', 1, 64))
+		if len(phases) > 0 {
+			w.Header().Set("Server-Timing", serverTiming(phases))
+		}
+		return encodePNG(w, dst, pngCompression, s.numWorkers)
+	}()
+	if err != nil {
+		s.failed.Add(1)
+		logger.Warn("request failed", "client", client, "path", r.URL.Path, "err", err)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	s.served.Add(1)
+	logger.Debug("request served", "client", client, "path", r.URL.Path, "pixels", pixels,
+		"priority", priorityNames[priority], "queue_ms", ms(queued), "total_ms", ms(time.Since(start)), "phases", serverTiming(phases))
+}
+
+// serverTiming formats the phases of a request as a Server-Timing header,
+// which browser developer tools show next to the request.
+func serverTiming(phases []phaseTime) string {
+	var metrics []string
+	for _, p := range phases {
+		name := strings.ReplaceAll(strings.ToLower(p.name), " ", "_")
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.1f", name, ms(p.duration)))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+func (s *server) stats() ServerStats {
+	used, waiting := s.budget.usage()
+	waits := make(map[string]QueueWaitStats)
+	s.waitMu.Lock()
+	for i, name := range priorityNames {
+		waits[name] = s.waits[i]
+	}
+	s.waitMu.Unlock()
+	return ServerStats{
+		Requests:    s.requests.Load(),
+		Served:      s.served.Load(),
+		Failed:      s.failed.Load(),
+		RateLimited: s.rateLimited.Load(),
+		PixelBudget: s.budget.capacity,
+		PixelsInUse: used,
+		Waiting:     waiting,
+		QueueWait:   waits,
+		Pool:        poolStats(),
+	}
+}
+
+func serveCommand(program string, args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "address to serve HTTP on")
+	numWorkers := fs.Int("workers", 0, "workers per request (0 = one per CPU)")
+	maxPixels := fs.String("max-pixels", "32M", "pixels filtered at once across all requests; a larger image takes the whole budget")
+	maxImage := fs.String("max-image", "256M", "largest image accepted, in pixels; larger ones are refused before decoding")
+	maxUpload := fs.String("max-upload", "64M", "largest request body")
+	rate := fs.Float64("rate", 0, "requests a second allowed per client address (0 = unlimited)")
+	burst := fs.Int("burst", 10, "requests a client may send at once before --rate applies")
+	interactive := fs.String("interactive-pixels", "1M", "images up to this many pixels are interactive unless X-Priority says otherwise")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [flags]\n", program)
+		fmt.Fprintf(os.Stderr, "  Filters images POSTed to /filter/<operation>[?radius=n], answering PNG:\n")
+		fmt.Fprintf(os.Stderr, "    curl --data-binary @in.png 'localhost:8080/filter/blur?radius=5' > out.png\n")
+		fmt.Fprintf(os.Stderr, "  X-Priority: interactive, normal or batch orders the requests waiting for the budget\n")
+		fmt.Fprintf(os.Stderr, "  GET /stats reports the requests, the pixel budget and queue waits as JSON\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	pixels, err := parseBytes(*maxPixels)
+	if err != nil {
+		fatalCode(exitUsage, "invalid --max-pixels", "err", err)
+	}
+	imagePixels, err := parseBytes(*maxImage)
+	if err != nil {
+		fatalCode(exitUsage, "invalid --max-image", "err", err)
+	}
+	upload, err := parseBytes(*maxUpload)
+	if err != nil {
+		fatalCode(exitUsage, "invalid --max-upload", "err", err)
+	}
+	interactivePixels, err := parseBytes(*interactive)
+	if err != nil {
+		fatalCode(exitUsage, "invalid --interactive-pixels", "err", err)
+	}
+	if fs.NArg() != 0 || *rate < 0 || *burst <= 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *numWorkers <= 0 {
+		*numWorkers = cpuCount()
+	}
+
+	startDefaultPool()
+	s := &server{numWorkers: *numWorkers, maxUpload: upload, maxImage: imagePixels, interactivePixels: interactivePixels, budget: &pixelBudget{capacity: pixels}}
+	if *rate > 0 {
+		s.limiter = &rateLimiter{rate: *rate, burst: float64(*burst), buckets: make(map[string]*tokenBucket)}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /filter/{operation}", s.handleFilter)
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, s.stats())
+	})
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal("failed to listen", "err", err)
+	}
+	srv := &http.Server{Handler: mux}
+	trapSignals()
+	stopped := make(chan struct{})
+	go func() {
+		// Stop accepting and wait for the handlers, whose filters the
+		// signal cancels, to answer.
+		<-interrupt.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		close(stopped)
+	}()
+	logger.Info("serving", "addr", listener.Addr().String(), "workers", *numWorkers, "max_pixels", pixels, "rate", *rate)
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("server failed", "err", err)
+	}
+	<-stopped
+	exitIfInterrupted()
+}
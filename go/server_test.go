@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(maxImage int64) *httptest.Server {
+	s := &server{numWorkers: 2, maxUpload: 1 << 20, maxImage: maxImage, budget: &pixelBudget{capacity: 1 << 20}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /filter/{operation}", s.handleFilter)
+	return httptest.NewServer(mux)
+}
+
+func postPNG(t *testing.T, url string, img image.Image) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	if err := png.Encode(&body, img); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "image/png", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestServerMaxImage(t *testing.T) {
+	ts := newTestServer(64 * 64)
+	defer ts.Close()
+	if resp := postPNG(t, ts.URL+"/filter/blur?radius=1", image.NewRGBA(image.Rect(0, 0, 64, 65))); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("64x65 image: status %d, want 413", resp.StatusCode)
+	}
+	if resp := postPNG(t, ts.URL+"/filter/blur?radius=1", image.NewRGBA(image.Rect(0, 0, 64, 64))); resp.StatusCode != http.StatusOK {
+		t.Errorf("64x64 image: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestServerPhasesPerRequest(t *testing.T) {
+	ts := newTestServer(1 << 20)
+	defer ts.Close()
+	takePhases()
+	resp := postPNG(t, ts.URL+"/filter/blur?radius=2", syntheticImages[0].generate())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if timing := resp.Header.Get("Server-Timing"); !strings.Contains(timing, "horizontal_pass;dur=") {
+		t.Errorf("Server-Timing %q has no blur phases", timing)
+	}
+	if leaked := takePhases(); len(leaked) > 0 {
+		t.Errorf("request phases went to the process-wide log: %v", leaked)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitInterrupted is the exit status after SIGINT or SIGTERM, the one a
+// shell reports for a process killed by SIGINT.
+const exitInterrupted = 130
+
+// interruptRows is the yield interval installed once a signal arrives, so
+// running filters notice within a few rows.
+const interruptRows = 8
+
+// interrupt is cancelled by SIGINT or SIGTERM once trapSignals is called.
+var interrupt = context.Background()
+
+// trapSignals makes SIGINT and SIGTERM cancel interrupt instead of killing
+// the process, so commands can stop between images and never leave a file
+// half written. Filters in flight are cancelled through the yield
+// checkpoints, which are only switched on at that point: the workers see
+// them at their next block of rows (see forRowChunks), and filters that
+// don't split their rows with parallelRows run to the end. A second
+// signal kills the process as usual. Commands that never check interrupt
+// must not call this.
+func trapSignals() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	interrupt = ctx
+	go func() {
+		<-ctx.Done()
+		stop()
+		logger.Warn("interrupted, stopping (interrupt again to exit at once)")
+		SetYieldInterval(interruptRows, ctx.Err)
+	}()
+}
+
+func interrupted() bool {
+	return interrupt.Err() != nil
+}
+
+// exitIfInterrupted ends the process with exitInterrupted after a signal;
+// commands call it where an error may just be the cancellation.
+func exitIfInterrupted() {
+	if interrupted() {
+		logger.Error("interrupted")
+		os.Exit(exitInterrupted)
+	}
+}
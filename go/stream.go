@@ -0,0 +1,133 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// RowCallback receives rows [start, end) of dst once they are final. The
+// rows above start have all been delivered before; dst must not be written.
+type RowCallback func(dst *image.RGBA, start, end int)
+
+// StreamGaussianBlur is applyGaussianBlur with output delivered band by band
+// while the rest of the image is still being filtered, so a consumer (an
+// encoder, a network stream) can start before the filter finishes. The
+// image is cut into bands of bandHeight rows (32 if bandHeight <= 0). Workers run the horizontal
+// pass band by band and start the vertical pass of a band as soon as the
+// horizontal bands within radius of it are done, instead of after the whole
+// horizontal pass and a transpose. emit is called from the workers, one call
+// at a time and in top-to-bottom order. The result is identical to
+// applyGaussianBlur.
+//
+// Like the other filters it honours SetYieldInterval's check between bands
+// and returns its error, in which case not every row has been emitted.
+func StreamGaussianBlur(srcImg image.Image, radius, numWorkers, bandHeight int, emit RowCallback) (*image.RGBA, error) {
+	if bandHeight <= 0 {
+		bandHeight = 32
+	}
+	bounds := srcImg.Bounds()
+	height := bounds.Max.Y
+	kernel := blurKernel(radius)
+	horizontal := image.NewRGBA(bounds)
+	dst := image.NewRGBA(bounds)
+	bands := (height + bandHeight - 1) / bandHeight
+
+	var mu sync.Mutex
+	ready := sync.NewCond(&mu)
+	nextHorizontal, nextVertical := 0, 0
+	horizontalDone := make([]bool, bands)
+	doneRows := 0 // horizontal rows [0, doneRows) are complete
+	stopped := false
+	var failure error
+
+	var emitMu sync.Mutex
+	verticalDone := make([]bool, bands)
+	nextEmit := 0
+
+	// needs is the number of leading horizontal rows that vertical band b
+	// reads.
+	needs := func(b int) int { return min((b+1)*bandHeight+radius, height) }
+
+	work := func() {
+		for {
+			mu.Lock()
+			for !stopped && nextVertical < bands && doneRows < needs(nextVertical) && nextHorizontal == bands {
+				// Every horizontal band is taken but some are still running
+				// on other workers; they were started before this worker
+				// took its turn, so they are not waiting on it.
+				ready.Wait()
+			}
+			if stopped || nextVertical == bands {
+				mu.Unlock()
+				return
+			}
+			if err := cancelled(); err != nil {
+				stopped, failure = true, err
+				ready.Broadcast()
+				mu.Unlock()
+				return
+			}
+			if doneRows >= needs(nextVertical) {
+				b := nextVertical
+				nextVertical++
+				mu.Unlock()
+				blurVertical(horizontal, dst, kernel, radius, b*bandHeight, min((b+1)*bandHeight, height))
+
+				emitMu.Lock()
+				verticalDone[b] = true
+				for nextEmit < bands && verticalDone[nextEmit] {
+					emit(dst, nextEmit*bandHeight, min((nextEmit+1)*bandHeight, height))
+					nextEmit++
+				}
+				emitMu.Unlock()
+				continue
+			}
+			b := nextHorizontal
+			nextHorizontal++
+			mu.Unlock()
+			blurHorizontal(srcImg, horizontal, kernel, radius, b*bandHeight, min((b+1)*bandHeight, height))
+
+			mu.Lock()
+			horizontalDone[b] = true
+			for doneRows < height && horizontalDone[doneRows/bandHeight] {
+				doneRows = min(doneRows+bandHeight, height)
+			}
+			ready.Broadcast()
+			mu.Unlock()
+		}
+	}
+
+	var wg workerGroup
+	for range max(numWorkers, 1) {
+		spawnWorker(&wg, work)
+	}
+	wg.Wait()
+	return dst, failure
+}
+
+// blurVertical blurs rows [startY, endY) of src along y into dst. It reads
+// src directly and does the same arithmetic in the same order as
+// convolveColumns, so the results match directBlur.
+func blurVertical(src, dst *image.RGBA, kernel []float64, radius, startY, endY int) {
+	bounds := src.Bounds()
+	for y := startY; y < endY; y++ {
+		out := dst.Pix[dst.PixOffset(bounds.Min.X, y):]
+		for x := range bounds.Dx() {
+			var rSum, gSum, bSum, aSum float64
+			for k := -radius; k <= radius; k++ {
+				sy := min(max(y+k, bounds.Min.Y), bounds.Max.Y-1)
+				p := src.Pix[src.PixOffset(bounds.Min.X+x, sy):]
+				weight := kernel[k+radius]
+				rSum += float64(p[0]) * weight
+				gSum += float64(p[1]) * weight
+				bSum += float64(p[2]) * weight
+				aSum += float64(p[3]) * weight
+			}
+			out[x*4] = uint8(math.Round(rSum))
+			out[x*4+1] = uint8(math.Round(gSum))
+			out[x*4+2] = uint8(math.Round(bSum))
+			out[x*4+3] = uint8(math.Round(aSum))
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"os"
+)
+
+// Shapes that stress the row partitioning: fewer rows than workers, rows
+// not divisible by the worker count, and single-row/single-column images.
+var stressShapes = []image.Point{
+	{1, 1}, {1, 17}, {17, 1}, {64, 1}, {1, 64},
+	{5, 3}, {13, 7}, {31, 29}, {100, 3},
+}
+
+var stressWorkers = []int{1, 2, 3, 7, 16, 64}
+
+// stressOperations are the filters whose radius is clamped to the image,
+// which the boundary checks rely on.
+var stressOperations = []string{"blur", "kuwahara"}
+
+// runCase applies an operation, turning a panic into an error so one broken
+// case doesn't hide the others.
+func runCase(op string, img image.Image, radius, workers int) (dst *image.RGBA, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	dst, err = applyOperation(op, img, radius, workers)
+	takePhases()
+	return dst, err
+}
+
+// checkSplit verifies that splitRows covers every row exactly once with
+// non-empty ranges and never uses more workers than rows.
+func checkSplit(rows, workers int) error {
+	ranges := splitRows(rows, workers)
+	if len(ranges) > min(rows, workers) {
+		return fmt.Errorf("%d ranges", len(ranges))
+	}
+	next := 0
+	for _, r := range ranges {
+		if r.start != next || r.end <= r.start {
+			return fmt.Errorf("bad range [%d, %d)", r.start, r.end)
+		}
+		next = r.end
+	}
+	if next != rows {
+		return fmt.Errorf("covers %d rows", next)
+	}
+	return nil
+}
+
+// checkBoundaryRadii verifies that radius 0 is rejected, that the largest
+// valid radius runs, and that anything beyond it is clamped to the same
+// result.
+func checkBoundaryRadii() []string {
+	var failures []string
+	noise := syntheticImages[len(syntheticImages)-1]
+	for _, shape := range stressShapes {
+		s := noise
+		s.width, s.height = shape.X, shape.Y
+		img := s.generate()
+		limit := maxRadius(img.Bounds())
+		for _, op := range stressOperations {
+			name := fmt.Sprintf("%s %dx%d", op, shape.X, shape.Y)
+			if _, err := runCase(op, img, 0, 2); err == nil {
+				failures = append(failures, fmt.Sprintf("%s: radius 0 accepted", name))
+			}
+			atLimit, err := runCase(op, img, limit, 2)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s, radius %d: %v", name, limit, err))
+				continue
+			}
+			beyond, err := runCase(op, img, limit+100, 2)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s, radius %d: %v", name, limit+100, err))
+				continue
+			}
+			if pixelChecksum(atLimit) != pixelChecksum(beyond) {
+				failures = append(failures, fmt.Sprintf("%s: radius %d not clamped to %d", name, limit+100, limit))
+			}
+		}
+	}
+	return failures
+}
+
+// runStress compares every worker count against the single-worker output on
+// each shape. It is meant to be run with the race detector enabled
+// (go run -race . stress) so overlapping writes between workers are caught.
+func runStress(rounds int) (int, []string) {
+	var failures []string
+	cases := 0
+	for _, shape := range stressShapes {
+		for _, workers := range stressWorkers {
+			if err := checkSplit(shape.Y, workers); err != nil {
+				failures = append(failures, fmt.Sprintf("split %d rows, %d workers: %v", shape.Y, workers, err))
+			}
+		}
+	}
+	failures = append(failures, checkBoundaryRadii()...)
+	noise := syntheticImages[len(syntheticImages)-1]
+	for _, shape := range stressShapes {
+		s := noise
+		s.width, s.height = shape.X, shape.Y
+		img := s.generate()
+		for _, op := range stressOperations {
+			for _, radius := range []int{1, 2} {
+				name := fmt.Sprintf("%s %dx%d r%d", op, shape.X, shape.Y, radius)
+				ref, err := runCase(op, img, radius, 1)
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("%s, 1 worker: %v", name, err))
+					continue
+				}
+				want := pixelChecksum(ref)
+				for _, workers := range stressWorkers[1:] {
+					for range rounds {
+						cases++
+						dst, err := runCase(op, img, radius, workers)
+						if err != nil {
+							failures = append(failures, fmt.Sprintf("%s, %d workers: %v", name, workers, err))
+							break
+						}
+						if dst.Bounds().Size() != shape || pixelChecksum(dst) != want {
+							failures = append(failures, fmt.Sprintf("%s, %d workers: output differs from 1 worker", name, workers))
+							break
+						}
+					}
+				}
+			}
+		}
+	}
+	return cases, failures
+}
+
+func stressCommand(program string, args []string) {
+	var rounds int
+	fs := flag.NewFlagSet("stress", flag.ExitOnError)
+	fs.IntVar(&rounds, "rounds", 3, "repetitions per shape and worker count")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s stress [flags]\n", program)
+		fmt.Fprintf(os.Stderr, "  Runs every filter on odd image shapes and worker counts; build with -race\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if rounds <= 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	cases, failures := runStress(rounds)
+	for _, f := range failures {
+		fmt.Printf("FAIL %s\n", f)
+	}
+	fmt.Printf("%d runs, %d failures\n", cases, len(failures))
+	if len(failures) > 0 {
+		os.Exit(exitFailure)
+	}
+}
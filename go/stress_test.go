@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The tests run the stress shapes; go test -race catches workers writing
+// the same pixels.
+
+func TestSplitRows(t *testing.T) {
+	for _, shape := range stressShapes {
+		for _, workers := range stressWorkers {
+			if err := checkSplit(shape.Y, workers); err != nil {
+				t.Errorf("%d rows, %d workers: %v", shape.Y, workers, err)
+			}
+		}
+	}
+}
+
+func TestWorkerCountsAgree(t *testing.T) {
+	noise := syntheticImages[len(syntheticImages)-1]
+	for _, shape := range stressShapes {
+		s := noise
+		s.width, s.height = shape.X, shape.Y
+		img := s.generate()
+		for _, op := range stressOperations {
+			for _, radius := range []int{1, 2} {
+				t.Run(fmt.Sprintf("%s_%dx%d_r%d", op, shape.X, shape.Y, radius), func(t *testing.T) {
+					ref, err := runCase(op, img, radius, 1)
+					if err != nil {
+						t.Fatalf("1 worker: %v", err)
+					}
+					want := pixelChecksum(ref)
+					for _, workers := range stressWorkers[1:] {
+						dst, err := runCase(op, img, radius, workers)
+						if err != nil {
+							t.Fatalf("%d workers: %v", workers, err)
+						}
+						if dst.Bounds().Size() != shape || pixelChecksum(dst) != want {
+							t.Errorf("%d workers: output differs from 1 worker", workers)
+						}
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// thumbnailBox is the size thumbnails must fit in, set from --thumbnail;
+// zero means no thumbnails.
+var thumbnailBox image.Point
+
+// thumbnailPath puts the thumbnail next to its image: out.png gives
+// out.thumb.png.
+func thumbnailPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".thumb" + ext
+}
+
+// fitSize scales width x height down, keeping the aspect ratio, to fit in
+// box. Images that already fit keep their size.
+func fitSize(width, height int, box image.Point) (int, int) {
+	scale := min(float64(box.X)/float64(width), float64(box.Y)/float64(height), 1)
+	return max(int(float64(width)*scale+0.5), 1), max(int(float64(height)*scale+0.5), 1)
+}
+
+// saveOutput saves img to path with meta and, when --thumbnail is set, a
+// Lanczos-downscaled thumbnail beside it. The thumbnail is resized and
+// encoded on its own goroutine while the full image encodes, so it adds
+// little to the save time of large images.
+func saveOutput(path string, img image.Image, meta *imageMetadata, numWorkers int) error {
+	if thumbnailBox == (image.Point{}) {
+		return saveImageMetadata(path, img, meta)
+	}
+	var thumbErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		width, height := fitSize(img.Bounds().Dx(), img.Bounds().Dy(), thumbnailBox)
+		// The resize phases belong to the thumbnail, not to the filter run
+		// whose phases may still be collected, so they are dropped.
+		thumb, err := resizeImage(img, width, height, "lanczos3", numWorkers, &phaseLog{})
+		if err == nil {
+			err = saveImageMetadata(thumbnailPath(path), thumb, meta)
+		}
+		if err != nil {
+			thumbErr = fmt.Errorf("thumbnail: %w", err)
+		}
+	}()
+	err := saveImageMetadata(path, img, meta)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return thumbErr
+}
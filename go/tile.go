@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// TileIndex describes how an image was cut into tiles so untile can put the
+// processed tiles back together.
+type TileIndex struct {
+	Width    int         `json:"width"`
+	Height   int         `json:"height"`
+	TileSize int         `json:"tile_size"`
+	Overlap  int         `json:"overlap"`
+	Tiles    []TileEntry `json:"tiles"`
+}
+
+type TileEntry struct {
+	File   string `json:"file"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// tileOrigins returns the start offsets along one axis. Tiles advance by
+// size-overlap and the last tile is shifted back so it ends at the edge
+// instead of being cut short.
+func tileOrigins(length, size, overlap int) []int {
+	if size >= length {
+		return []int{0}
+	}
+	stride := size - overlap
+	var origins []int
+	for pos := 0; ; pos += stride {
+		if pos+size >= length {
+			origins = append(origins, length-size)
+			return origins
+		}
+		origins = append(origins, pos)
+	}
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// packedPix is the pixels of src without row padding.
+func packedPix(src *image.RGBA) []byte {
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if src.Stride == width*4 && len(src.Pix) == width*height*4 {
+		return src.Pix
+	}
+	pix := make([]byte, width*height*4)
+	for y := range height {
+		copy(pix[y*width*4:(y+1)*width*4], src.Pix[src.PixOffset(src.Bounds().Min.X, src.Bounds().Min.Y+y):])
+	}
+	return pix
+}
+
+// forEachParallel calls fn for every index in [0, n) using numWorkers
+// goroutines pulling the next index from a shared counter, and returns the
+// first error. Indices start in order, so callers can put the work they
+// want first (the preview its focus tiles) at the front. After an error no
+// new indices are handed out.
+func forEachParallel(n, numWorkers int, fn func(i int) error) error {
+	var next atomic.Int64
+	var mu sync.Mutex
+	var firstErr error
+	var wg workerGroup
+	for range numWorkers {
+		spawnWorker(&wg, func() {
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= n {
+					return
+				}
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					next.Store(int64(n))
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// forEachBanded is forEachParallel for indices whose neighbours share
+// memory, like row-major tiles. Each worker starts on its own contiguous
+// band of indices, so it stays in one region of the image (and of the
+// caches near the CPU it runs on), then helps with the bands of the others
+// once its own is done. Indices don't start in order.
+func forEachBanded(n, numWorkers int, fn func(i int) error) error {
+	bands := splitRows(n, numWorkers)
+	next := make([]atomic.Int64, len(bands))
+	for b, r := range bands {
+		next[b].Store(int64(r.start))
+	}
+	var stopped atomic.Bool
+	var mu sync.Mutex
+	var firstErr error
+	var wg workerGroup
+	for w := range bands {
+		spawnWorker(&wg, func() {
+			for k := range bands {
+				b := (w + k) % len(bands)
+				for !stopped.Load() {
+					i := int(next[b].Add(1) - 1)
+					if i >= bands[b].end {
+						break
+					}
+					if err := fn(i); err != nil {
+						mu.Lock()
+						if firstErr == nil {
+							firstErr = err
+						}
+						mu.Unlock()
+						stopped.Store(true)
+						return
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func tileImage(img image.Image, outDir string, size, overlap, numWorkers int) (*TileIndex, error) {
+	src := toRGBA(img)
+	bounds := src.Bounds()
+	index := &TileIndex{
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		TileSize: size,
+		Overlap:  overlap,
+	}
+	for _, y := range tileOrigins(index.Height, size, overlap) {
+		for _, x := range tileOrigins(index.Width, size, overlap) {
+			index.Tiles = append(index.Tiles, TileEntry{
+				File:   fmt.Sprintf("tile_%05d_%05d.png", y, x),
+				X:      x,
+				Y:      y,
+				Width:  min(size, index.Width),
+				Height: min(size, index.Height),
+			})
+		}
+	}
+
+	err := forEachParallel(len(index.Tiles), numWorkers, func(i int) error {
+		t := index.Tiles[i]
+		rect := image.Rect(t.X, t.Y, t.X+t.Width, t.Y+t.Height).Add(bounds.Min)
+		return saveImage(filepath.Join(outDir, t.File), src.SubImage(rect))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(filepath.Join(outDir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return index, writeJSON(file, index)
+}
+
+// untileMaxPixels bounds the image size an index may give, so a corrupt
+// one can't make untile allocate without limit.
+const untileMaxPixels = 400_000_000
+
+// untileImage reassembles the tiles listed in the index. Pixels covered by
+// several tiles are averaged so seams from overlapping processing blend out.
+func untileImage(indexPath string, numWorkers int) (*image.RGBA, error) {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	var index TileIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid tile index: %w", err)
+	}
+	if index.Width <= 0 || index.Height <= 0 || uint64(index.Width)*uint64(index.Height) > untileMaxPixels {
+		return nil, fmt.Errorf("invalid tile index: image size %dx%d", index.Width, index.Height)
+	}
+	// tileImage never puts two tiles at one origin; a repeated one would
+	// only weigh its pixels more in the average.
+	origins := make(map[image.Point]bool, len(index.Tiles))
+	for _, t := range index.Tiles {
+		if origins[image.Pt(t.X, t.Y)] {
+			return nil, fmt.Errorf("invalid tile index: two tiles at %d,%d", t.X, t.Y)
+		}
+		origins[image.Pt(t.X, t.Y)] = true
+		if t.X < 0 || t.Y < 0 || t.Width < 0 || t.Height < 0 || t.Width > index.Width-t.X || t.Height > index.Height-t.Y {
+			return nil, fmt.Errorf("invalid tile index: %s at %d,%d size %dx%d is outside the %dx%d image",
+				t.File, t.X, t.Y, t.Width, t.Height, index.Width, index.Height)
+		}
+	}
+	dir := filepath.Dir(indexPath)
+
+	tiles := make([]image.Image, len(index.Tiles))
+	err = forEachParallel(len(tiles), numWorkers, func(i int) error {
+		img, err := loadImage(filepath.Join(dir, index.Tiles[i].File))
+		tiles[i] = img
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make([]uint32, index.Width*index.Height*4)
+	counts := make([]uint32, index.Width*index.Height)
+	for i, t := range index.Tiles {
+		tb := tiles[i].Bounds()
+		for y := 0; y < min(t.Height, tb.Dy()); y++ {
+			for x := 0; x < min(t.Width, tb.Dx()); x++ {
+				r, g, b, a := tiles[i].At(tb.Min.X+x, tb.Min.Y+y).RGBA()
+				p := (t.Y+y)*index.Width + t.X + x
+				sums[p*4] += r >> 8
+				sums[p*4+1] += g >> 8
+				sums[p*4+2] += b >> 8
+				sums[p*4+3] += a >> 8
+				counts[p]++
+			}
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, index.Width, index.Height))
+	for p, n := range counts {
+		if n == 0 {
+			continue
+		}
+		c := n
+		dst.Set(p%index.Width, p/index.Width, color.RGBA{
+			R: uint8((sums[p*4] + c/2) / c),
+			G: uint8((sums[p*4+1] + c/2) / c),
+			B: uint8((sums[p*4+2] + c/2) / c),
+			A: uint8((sums[p*4+3] + c/2) / c),
+		})
+	}
+	return dst, nil
+}
+
+func tileCommand(program string, args []string) {
+	var size, overlap, numWorkers int
+	fs := flag.NewFlagSet("tile", flag.ExitOnError)
+	fs.IntVar(&size, "size", 512, "tile width and height in pixels")
+	fs.IntVar(&overlap, "overlap", 32, "pixels shared between neighbouring tiles")
+	fs.IntVar(&numWorkers, "workers", cpuCount(), "number of concurrent tile writers")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s tile [flags] <input_image> <output_dir>\n", program)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 || size <= 0 || overlap < 0 || overlap >= size {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if numWorkers <= 0 {
+		numWorkers = cpuCount()
+	}
+
+	img, err := loadImage(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if err := os.MkdirAll(fs.Arg(1), 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create output directory: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	index, err := tileImage(img, fs.Arg(1), size, overlap, numWorkers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write tiles: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	fmt.Printf("Wrote %d tiles of %dx%d (overlap %d) to %s\n", len(index.Tiles), size, size, overlap, fs.Arg(1))
+}
+
+func untileCommand(program string, args []string) {
+	var numWorkers int
+	fs := flag.NewFlagSet("untile", flag.ExitOnError)
+	fs.IntVar(&numWorkers, "workers", cpuCount(), "number of concurrent tile readers")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s untile [flags] <index.json> <output_image>\n", program)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if numWorkers <= 0 {
+		numWorkers = cpuCount()
+	}
+
+	img, err := untileImage(fs.Arg(0), numWorkers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to reassemble tiles: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if err := saveImage(fs.Arg(1), img); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save image: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	fmt.Printf("Reassembled %dx%d image to %s\n", img.Bounds().Dx(), img.Bounds().Dy(), fs.Arg(1))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForEachVisitsEveryIndexOnce(t *testing.T) {
+	helpers := map[string]func(int, int, func(int) error) error{
+		"parallel": forEachParallel,
+		"banded":   forEachBanded,
+	}
+	for name, forEach := range helpers {
+		for _, n := range []int{0, 1, 7, 100} {
+			for _, workers := range []int{1, 3, 16} {
+				seen := make([]atomic.Int32, n)
+				if err := forEach(n, workers, func(i int) error {
+					seen[i].Add(1)
+					return nil
+				}); err != nil {
+					t.Fatalf("%s n=%d workers=%d: %v", name, n, workers, err)
+				}
+				for i := range seen {
+					if c := seen[i].Load(); c != 1 {
+						t.Errorf("%s n=%d workers=%d: index %d visited %d times", name, n, workers, i, c)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestForEachParallelStartsInOrder(t *testing.T) {
+	// With one worker the shared counter is the order the preview relies on.
+	var order []int
+	forEachParallel(10, 1, func(i int) error {
+		order = append(order, i)
+		return nil
+	})
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("order %v", order)
+		}
+	}
+	boom := errors.New("boom")
+	var after atomic.Int32
+	err := forEachParallel(100, 1, func(i int) error {
+		if i >= 5 {
+			after.Add(1)
+			return boom
+		}
+		return nil
+	})
+	if !errors.Is(err, boom) || after.Load() != 1 {
+		t.Errorf("got %v after %d failing calls, want boom after 1", err, after.Load())
+	}
+}
+
+func TestUntileRejectsBadIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		tiles []TileEntry
+		want  string
+	}{
+		{"outside", []TileEntry{{File: "a.png", X: 8, Y: 0, Width: 16, Height: 16}}, "outside"},
+		{"negative", []TileEntry{{File: "a.png", X: -1, Y: 0, Width: 4, Height: 4}}, "outside"},
+		{"repeated", []TileEntry{{File: "a.png", Width: 4, Height: 4}, {File: "a.png", Width: 4, Height: 4}}, "two tiles"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		data, err := json.Marshal(TileIndex{Width: 16, Height: 16, TileSize: 16, Tiles: tt.tiles})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "index.json")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := untileImage(path, 2); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error about %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"time"
+)
+
+type tileTiming struct {
+	rect     image.Rectangle
+	duration time.Duration
+}
+
+// TileHeatmapStats summarizes per-tile cost; MaxOverMean well above 1 means
+// a row split would leave some workers idle.
+type TileHeatmapStats struct {
+	Tiles       int     `json:"tiles"`
+	TileSize    int     `json:"tile_size"`
+	MinMs       float64 `json:"min_ms"`
+	MaxMs       float64 `json:"max_ms"`
+	MeanMs      float64 `json:"mean_ms"`
+	MaxOverMean float64 `json:"max_over_mean"`
+}
+
+// timeTiles runs the operation separately on every tileSize tile (plus a
+// halo of radius pixels so border handling matches) on a single worker and
+// records how long each took. Tiles are spread over numWorkers goroutines.
+func timeTiles(operation string, srcImg image.Image, radius, numWorkers int) ([]tileTiming, error) {
+	src := toRGBA(srcImg)
+	bounds := src.Bounds()
+	var timings []tileTiming
+	for _, r := range gridTiles(bounds.Dx(), bounds.Dy(), tileSize) {
+		timings = append(timings, tileTiming{rect: r})
+	}
+	err := forEachParallel(len(timings), numWorkers, func(i int) error {
+		halo := timings[i].rect.Inset(-radius).Intersect(bounds)
+		tile := image.NewRGBA(image.Rect(0, 0, halo.Dx(), halo.Dy()))
+		draw.Draw(tile, tile.Bounds(), src, halo.Min, draw.Src)
+		start := time.Now()
+		_, err := applyOperation(operation, tile, radius, 1)
+		timings[i].duration = time.Since(start)
+		return err
+	})
+	// The per-tile runs record phases of their own; they are not part of the
+	// main run's breakdown.
+	takePhases()
+	return timings, err
+}
+
+// renderTileHeatmap colors each tile by its time relative to the slowest
+// tile and outlines the tiles.
+func renderTileHeatmap(timings []tileTiming, width, height int) (*image.RGBA, TileHeatmapStats) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	stats := TileHeatmapStats{Tiles: len(timings), TileSize: tileSize}
+	if len(timings) == 0 {
+		return img, stats
+	}
+	lo, hi, total := timings[0].duration, timings[0].duration, time.Duration(0)
+	for _, t := range timings {
+		lo, hi = min(lo, t.duration), max(hi, t.duration)
+		total += t.duration
+	}
+	mean := total / time.Duration(len(timings))
+	stats.MinMs, stats.MaxMs, stats.MeanMs = ms(lo), ms(hi), ms(mean)
+	if mean > 0 {
+		stats.MaxOverMean = float64(hi) / float64(mean)
+	}
+
+	edge := color.RGBA{0, 0, 0, 255}
+	for _, t := range timings {
+		v := 0.0
+		if hi > 0 {
+			v = float64(t.duration) / float64(hi)
+		}
+		draw.Draw(img, t.rect, image.NewUniform(heatColor(v)), image.Point{}, draw.Src)
+		for x := t.rect.Min.X; x < t.rect.Max.X; x++ {
+			img.SetRGBA(x, t.rect.Min.Y, edge)
+		}
+		for y := t.rect.Min.Y; y < t.rect.Max.Y; y++ {
+			img.SetRGBA(t.rect.Min.X, y, edge)
+		}
+	}
+	return img, stats
+}
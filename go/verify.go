@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"time"
+)
+
+// VerifyResult compares a parallel run against the single-threaded
+// reference, channel by channel.
+type VerifyResult struct {
+	Workers         int     `json:"workers"`
+	MaxDiff         [4]int  `json:"max_diff"` // R, G, B, A
+	DifferingPixels int     `json:"differing_pixels"`
+	ReferenceMs     float64 `json:"reference_ms"`
+	Match           bool    `json:"match"`
+}
+
+// compareImages returns the largest per-channel difference between two
+// images of the same size and how many pixels differ at all.
+func compareImages(a, b *image.RGBA) (maxDiff [4]int, differing int, err error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return maxDiff, 0, fmt.Errorf("size %v differs from the reference %v", a.Bounds().Size(), b.Bounds().Size())
+	}
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	for y := range height {
+		rowA := a.Pix[a.PixOffset(a.Bounds().Min.X, a.Bounds().Min.Y+y):]
+		rowB := b.Pix[b.PixOffset(b.Bounds().Min.X, b.Bounds().Min.Y+y):]
+		for x := range width {
+			same := true
+			for c := range 4 {
+				d := int(rowA[x*4+c]) - int(rowB[x*4+c])
+				if d < 0 {
+					d = -d
+				}
+				if d != 0 {
+					same = false
+					maxDiff[c] = max(maxDiff[c], d)
+				}
+			}
+			if !same {
+				differing++
+			}
+		}
+	}
+	return maxDiff, differing, nil
+}
+
+// verifyOperation reruns the operation with a single worker and compares
+// the result, which it also returns, with dst, the output of the numWorkers
+// run. Any difference means the parallel split changed the result, which
+// for these filters always points at a race or a partitioning bug.
+func verifyOperation(operation string, srcImg image.Image, radius, numWorkers int, dst *image.RGBA) (*VerifyResult, *image.RGBA, error) {
+	start := time.Now()
+	ref, err := applyOperation(operation, srcImg, radius, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	elapsed := time.Since(start)
+	takePhases()
+	maxDiff, differing, err := compareImages(dst, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &VerifyResult{
+		Workers:         numWorkers,
+		MaxDiff:         maxDiff,
+		DifferingPixels: differing,
+		ReferenceMs:     ms(elapsed),
+		Match:           differing == 0,
+	}, ref, nil
+}
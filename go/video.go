@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The video command filters a stream of raw frames, as ffmpeg reads and
+// writes them with -f rawvideo, frame by frame:
+//
+//	ffmpeg -i in.mp4 -f rawvideo -pix_fmt rgb24 - |
+//	  filter video --size 1280x720 blur 5 |
+//	  ffmpeg -f rawvideo -pix_fmt rgb24 -s 1280x720 -r 30 -i - out.mp4
+//
+// A reader cuts the stream into frames, --parallel frame workers filter
+// them with --workers goroutines each, and a writer emits them in input
+// order through a reorder buffer. At most --in-flight frames are read but
+// not yet written, which bounds memory however far a slow frame holds the
+// ones after it back: the reader stalls until it is written.
+
+// videoPixelSizes are the bytes per pixel of the raw formats.
+var videoPixelSizes = map[string]int{"rgb24": 3, "rgba": 4}
+
+// VideoReport summarizes 'video'.
+type VideoReport struct {
+	Operation string  `json:"operation"`
+	Radius    int     `json:"radius"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Frames    int     `json:"frames"`
+	Parallel  int     `json:"parallel"`
+	Workers   int     `json:"workers"`
+	InFlight  int     `json:"in_flight"`
+	FilterMs  float64 `json:"filter_ms"` // summed over frames
+	TotalMs   float64 `json:"total_ms"`
+	FPS       float64 `json:"fps"`
+
+	Reorder ReorderStats `json:"reorder"`
+}
+
+// videoFrame is a raw frame, filtered in place.
+type videoFrame struct {
+	seq      int
+	pix      []byte
+	filterMs float64
+	err      error
+}
+
+type videoStream struct {
+	width, height, pixelSize int
+	operation                string
+	radius                   int
+	parallel, numWorkers     int
+	inFlight                 int
+}
+
+func (v *videoStream) frameSize() int {
+	return v.width * v.height * v.pixelSize
+}
+
+// unpack expands a raw frame into img.
+func (v *videoStream) unpack(pix []byte, img *image.RGBA) {
+	if v.pixelSize == 4 {
+		copy(img.Pix, pix)
+		return
+	}
+	for i, j := 0, 0; i < len(pix); i, j = i+3, j+4 {
+		img.Pix[j], img.Pix[j+1], img.Pix[j+2], img.Pix[j+3] = pix[i], pix[i+1], pix[i+2], 255
+	}
+}
+
+// pack writes img back into a raw frame.
+func (v *videoStream) pack(img *image.RGBA, pix []byte) {
+	src := packedPix(img)
+	if v.pixelSize == 4 {
+		copy(pix, src)
+		return
+	}
+	for i, j := 0, 0; i < len(pix); i, j = i+3, j+4 {
+		pix[i], pix[i+1], pix[i+2] = src[j], src[j+1], src[j+2]
+	}
+}
+
+// filter runs the operation on frames until the channel closes, handing
+// them to the ordered output.
+func (v *videoStream) filter(frames <-chan *videoFrame, out *reorderBuffer[*videoFrame]) {
+	img := image.NewRGBA(image.Rect(0, 0, v.width, v.height))
+	for f := range frames {
+		v.unpack(f.pix, img)
+		start := time.Now()
+		dst, err := applyOperation(v.operation, img, v.radius, v.numWorkers)
+		f.filterMs = ms(time.Since(start))
+		if err != nil {
+			f.err = err
+		} else {
+			v.pack(dst, f.pix)
+		}
+		out.put(f.seq, f)
+	}
+}
+
+// run filters the frames of r into w, counting them in report.
+func (v *videoStream) run(r io.Reader, w io.Writer, report *VideoReport) error {
+	ctx, stop := context.WithCancel(interrupt)
+	defer stop()
+	// Buffers of written frames, for the reader to reuse.
+	free := make(chan []byte, v.inFlight+1)
+
+	// Frames finish in any order and are written in sequence by the worker
+	// completing the oldest one.
+	var err error
+	out := newReorderBuffer(v.inFlight, func(seq int, f *videoFrame) {
+		if err != nil {
+			return
+		}
+		if f.err != nil {
+			err = fmt.Errorf("frame %d: %w", seq, f.err)
+		} else if _, err = w.Write(f.pix); err != nil {
+			err = fmt.Errorf("writing frame %d: %w", seq, err)
+		}
+		if err != nil {
+			// Let the frames in flight drain, read no more.
+			stop()
+			return
+		}
+		report.Frames++
+		report.FilterMs += f.filterMs
+		select {
+		case free <- f.pix:
+		default:
+		}
+	})
+
+	frames := make(chan *videoFrame)
+	var wg sync.WaitGroup
+	for range v.parallel {
+		// Plain goroutines: each frame waits on its own filter workers.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.filter(frames, out)
+		}()
+	}
+
+	var readErr error
+	for seq := 0; ; seq++ {
+		// Wait for the window first, so a stalled stream holds no extra
+		// frame.
+		if !out.wait(seq, ctx.Done()) {
+			break
+		}
+		var pix []byte
+		select {
+		case pix = <-free:
+		default:
+			pix = make([]byte, v.frameSize())
+		}
+		if _, err := io.ReadFull(r, pix); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				readErr = fmt.Errorf("the stream ends within a frame: not %dx%d %d bytes per pixel?", v.width, v.height, v.pixelSize)
+			} else if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		frames <- &videoFrame{seq: seq, pix: pix}
+	}
+	close(frames)
+	wg.Wait()
+	takePhases()
+	report.Reorder = out.report()
+	if err == nil {
+		err = readErr
+	}
+	return err
+}
+
+func videoCommand(program string, args []string, jsonOutput bool) {
+	fs := flag.NewFlagSet("video", flag.ExitOnError)
+	size := fs.String("size", "", "frame size WxH (required)")
+	pixFmt := fs.String("pix-fmt", "rgb24", "raw pixel format of both streams: rgb24 or rgba")
+	inPath := fs.String("in", "-", "file of raw frames, - for stdin")
+	outPath := fs.String("out", "-", "file for the filtered frames, - for stdout")
+	parallel := fs.Int("parallel", 0, "frames filtered at once (0 = one per CPU)")
+	numWorkers := fs.Int("workers", 0, "goroutines per frame (0 = CPUs divided among the frames)")
+	inFlight := fs.Int("in-flight", 0, "frames read but not yet written, at most (0 = twice --parallel)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s video --size WxH [flags] <operation> [radius]\n", program)
+		fmt.Fprintf(os.Stderr, "  Filters raw video frames, as from ffmpeg -f rawvideo -pix_fmt rgb24, keeping their order:\n")
+		fmt.Fprintf(os.Stderr, "    ffmpeg -i in.mp4 -f rawvideo -pix_fmt rgb24 - | %s video --size 1280x720 blur 5 |\n", program)
+		fmt.Fprintf(os.Stderr, "      ffmpeg -f rawvideo -pix_fmt rgb24 -s 1280x720 -r 30 -i - out.mp4\n")
+		fmt.Fprintf(os.Stderr, "  Progress and the report go to stderr when the frames go to stdout\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	pixelSize := videoPixelSizes[*pixFmt]
+	if fs.NArg() < 1 || fs.NArg() > 2 || *size == "" || pixelSize == 0 || *inFlight < 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	width, height, err := parseSize(*size)
+	if err != nil {
+		fatalCode(exitUsage, "invalid --size", "err", err)
+	}
+	operation := fs.Arg(0)
+	info, ok := lookupOperation(operation)
+	if !ok {
+		fatal("cannot filter video", "err", fmt.Errorf("%w: %s", ErrUnknownOperation, operation))
+	}
+	radius := info.defaultArg
+	if fs.NArg() == 2 {
+		if radius, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			fatalCode(exitInvalidRadius, "invalid radius", "err", err)
+		}
+	}
+	if radius, err = checkRadius(operation, radius, image.Rect(0, 0, width, height)); err != nil {
+		fatal("invalid radius", "err", err)
+	}
+
+	v := &videoStream{width: width, height: height, pixelSize: pixelSize, operation: operation, radius: radius}
+	v.parallel, v.numWorkers = batchWorkers(*parallel, *numWorkers, math.MaxInt)
+	v.inFlight = *inFlight
+	if v.inFlight == 0 {
+		v.inFlight = 2 * v.parallel
+	}
+
+	var r io.Reader = os.Stdin
+	if *inPath != "-" {
+		file, err := os.Open(*inPath)
+		if err != nil {
+			fatal("failed to open input", "err", err)
+		}
+		defer file.Close()
+		r = file
+	}
+	var w io.Writer = os.Stdout
+	var outFile *os.File
+	if *outPath != "-" {
+		if outFile, err = os.Create(*outPath); err != nil {
+			fatal("failed to create output", "err", err)
+		}
+		w = outFile
+	}
+	out, reportOut := progressOut(jsonOutput), io.Writer(os.Stdout)
+	if *outPath == "-" {
+		reportOut = os.Stderr
+		if out == os.Stdout {
+			out = os.Stderr
+		}
+	}
+	trapSignals()
+	startDefaultPool()
+
+	fmt.Fprintf(out, "Filtering %dx%d %s frames with %s, %d at once with %d workers each\n",
+		width, height, *pixFmt, operation, v.parallel, v.numWorkers)
+	report := VideoReport{Operation: operation, Radius: radius, Width: width, Height: height,
+		Parallel: v.parallel, Workers: v.numWorkers, InFlight: v.inFlight}
+	start := time.Now()
+	err = v.run(r, w, &report)
+	if outFile != nil {
+		if cerr := outFile.Close(); err == nil {
+			err = cerr
+		}
+	}
+	report.TotalMs = ms(time.Since(start))
+	if report.TotalMs > 0 {
+		report.FPS = float64(report.Frames) / (report.TotalMs / 1000)
+	}
+	if err != nil {
+		exitIfInterrupted()
+		fatal("video failed", "frames", report.Frames, "err", err)
+	}
+	exitIfInterrupted()
+
+	if jsonOutput {
+		writeJSON(reportOut, report)
+		return
+	}
+	fmt.Fprintf(out, "%d frames in %.1fms, %.1f fps, %.1fms filtering per frame\n",
+		report.Frames, report.TotalMs, report.FPS, report.FilterMs/float64(max(report.Frames, 1)))
+	fmt.Fprintf(out, "Reordering: at most %d of %d frames held back, reader stalled %d times for %.1fms\n",
+		report.Reorder.MaxPending, report.Reorder.Window, report.Reorder.Stalls, report.Reorder.StallMs)
+}
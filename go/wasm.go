@@ -0,0 +1,113 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"syscall/js"
+	"time"
+)
+
+// In the browser the filters are called from JavaScript instead of the
+// command line: web/worker.js loads the module in each Web Worker and calls
+// goFilter.apply on a band of rows. Goroutines of one module share a single
+// thread, so the parallelism comes from the Web Workers, one band each.
+
+func init() {
+	platformMain = serveJS
+}
+
+// serveJS sets globalThis.goFilter and keeps the module running to serve
+// its calls:
+//
+//	goFilter.apply(operation, data, width, height, radius, workers[, top, bottom])
+//
+// filters the RGBA pixels of data (an ImageData's Uint8ClampedArray) and
+// returns {data, ms} with the filtered rows top to bottom, all rows by
+// default, or {error}. goFilter.operations lists the operations and
+// goFilter.local those whose bands only need a halo of radius rows;
+// the others read the whole image for any band.
+func serveJS() {
+	var names, local []any
+	for _, op := range operations {
+		names = append(names, op.name)
+		if localOperation(op.name) {
+			local = append(local, op.name)
+		}
+	}
+	js.Global().Set("goFilter", js.ValueOf(map[string]any{
+		"apply":      js.FuncOf(jsApply),
+		"operations": names,
+		"local":      local,
+	}))
+	select {}
+}
+
+func jsError(format string, args ...any) any {
+	return map[string]any{"error": fmt.Sprintf(format, args...)}
+}
+
+func jsApply(_ js.Value, args []js.Value) any {
+	if len(args) != 6 && len(args) != 8 {
+		return jsError("usage: apply(operation, data, width, height, radius, workers[, top, bottom])")
+	}
+	operation := args[0].String()
+	width, height := args[2].Int(), args[3].Int()
+	radius, numWorkers := args[4].Int(), max(args[5].Int(), 1)
+	top, bottom := 0, height
+	if len(args) == 8 {
+		top, bottom = args[6].Int(), args[7].Int()
+	}
+	if width <= 0 || height <= 0 || top < 0 || bottom > height || top >= bottom {
+		return jsError("invalid size %dx%d or rows %d to %d", width, height, top, bottom)
+	}
+
+	// ImageData is not premultiplied, like NRGBA.
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if n := args[1].Get("length").Int(); n != len(src.Pix) {
+		return jsError("data has %d bytes, %dx%d RGBA needs %d", n, width, height, len(src.Pix))
+	}
+	js.CopyBytesToGo(src.Pix, args[1])
+	start := time.Now()
+	dst, err := applyBand(operation, toRGBA(src), radius, numWorkers, top, bottom)
+	if err != nil {
+		return jsError("%v", err)
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, dst.Bounds().Dx(), dst.Bounds().Dy()))
+	draw.Draw(out, out.Bounds(), dst, dst.Bounds().Min, draw.Src)
+	ms := float64(time.Since(start).Microseconds()) / 1000
+
+	data := js.Global().Get("Uint8ClampedArray").New(len(out.Pix))
+	js.CopyBytesToJS(data, out.Pix)
+	return map[string]any{"data": data, "ms": ms}
+}
+
+// applyBand filters rows top to bottom of src. Local operations filter a
+// copy of those rows with radius rows above and below, like applyTiled,
+// after clamping the radius against the whole image; others filter all of
+// src and crop.
+func applyBand(operation string, src *image.RGBA, radius, numWorkers, top, bottom int) (*image.RGBA, error) {
+	bounds := src.Bounds()
+	band := image.Rect(0, top, bounds.Dx(), bottom)
+	if band == bounds || !localOperation(operation) {
+		dst, err := applyOperation(operation, src, radius, numWorkers)
+		if err != nil {
+			return nil, err
+		}
+		return dst.SubImage(band).(*image.RGBA), nil
+	}
+	radius, err := checkRadius(operation, radius, bounds)
+	if err != nil {
+		return nil, err
+	}
+	halo := image.Rect(0, max(top-radius, 0), bounds.Dx(), min(bottom+radius, bounds.Dy()))
+	tile := image.NewRGBA(image.Rect(0, 0, halo.Dx(), halo.Dy()))
+	draw.Draw(tile, tile.Bounds(), src, halo.Min, draw.Src)
+	dst, err := runFilter(operation, tile, radius, numWorkers, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dst.SubImage(band.Sub(halo.Min)).(*image.RGBA), nil
+}
@@ -0,0 +1,24 @@
+// One Web Worker: loads the Go filters and filters the bands of rows the
+// page sends it. Each worker runs its own instance of the module, so N
+// workers filter N bands on N threads.
+importScripts("wasm_exec.js");
+
+const ready = (async () => {
+  const go = new Go();
+  const { instance } = await WebAssembly.instantiateStreaming(fetch("filter.wasm"), go.importObject);
+  // Never settles: the module keeps running to serve goFilter calls.
+  go.run(instance);
+})();
+
+ready.then(() => postMessage({ ready: true, operations: goFilter.operations, local: goFilter.local }));
+
+onmessage = async (event) => {
+  await ready;
+  const { id, operation, data, width, height, radius, top, bottom } = event.data;
+  const result = goFilter.apply(operation, data, width, height, radius, 1, top, bottom);
+  if (result.error) {
+    postMessage({ id, error: result.error });
+    return;
+  }
+  postMessage({ id, top, data: result.data, ms: result.ms }, [result.data.buffer]);
+};
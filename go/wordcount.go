@@ -0,0 +1,217 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// countWords adds the words of text to counts. Words are runs of letters and
+// digits, lower-cased.
+func countWords(text string, counts map[string]int) {
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		counts[strings.ToLower(word)]++
+	}
+}
+
+// mapFiles is the map step: each worker reads and tokenizes files taken from
+// a shared counter into its own partial map, so no locking is needed while
+// counting.
+func mapFiles(paths []string, numWorkers int) ([]map[string]int, int64, error) {
+	partials := make([]map[string]int, numWorkers)
+	var next, bytes atomic.Int64
+	var mu sync.Mutex
+	var firstErr error
+	var wg workerGroup
+	for w := range numWorkers {
+		partials[w] = make(map[string]int)
+		spawnWorker(&wg, func() {
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(paths) {
+					return
+				}
+				data, err := os.ReadFile(paths[i])
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					next.Store(int64(len(paths)))
+					return
+				}
+				bytes.Add(int64(len(data)))
+				countWords(string(data), partials[w])
+			}
+		})
+	}
+	wg.Wait()
+	return partials, bytes.Load(), firstErr
+}
+
+// reduceTree merges the partial maps pairwise, halving their number at each
+// level with the merges of a level running concurrently, and returns the
+// total counts and the number of levels.
+func reduceTree(partials []map[string]int) (map[string]int, int) {
+	levels := 0
+	for len(partials) > 1 {
+		half := (len(partials) + 1) / 2
+		var wg workerGroup
+		for i := range len(partials) / 2 {
+			dst, src := partials[i], partials[half+i]
+			spawnWorker(&wg, func() {
+				for word, n := range src {
+					dst[word] += n
+				}
+			})
+		}
+		wg.Wait()
+		partials = partials[:half]
+		levels++
+	}
+	if len(partials) == 0 {
+		return map[string]int{}, 0
+	}
+	return partials[0], levels
+}
+
+type wordCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+// topWords returns the k most frequent words, ties broken alphabetically.
+func topWords(counts map[string]int, k int) []wordCount {
+	list := make([]wordCount, 0, len(counts))
+	for word, n := range counts {
+		list = append(list, wordCount{word, n})
+	}
+	slices.SortFunc(list, func(a, b wordCount) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Word, b.Word)
+	})
+	return list[:min(k, len(list))]
+}
+
+// listFiles returns the regular files under dir, optionally restricted to the
+// given extensions.
+func listFiles(dir string, exts []string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if len(exts) > 0 && !slices.Contains(exts, strings.ToLower(filepath.Ext(path))) {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	return paths, err
+}
+
+func wordcountCommand(program string, args []string, jsonOutput bool) {
+	var top int
+	var extList string
+	fs := flag.NewFlagSet("wordcount", flag.ExitOnError)
+	fs.IntVar(&top, "top", 20, "number of most frequent words to print")
+	fs.StringVar(&extList, "ext", "", "comma-separated file extensions to include, e.g. .txt,.md (default all files)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s wordcount [flags] <dir> [workers]\n", program)
+		fmt.Fprintf(os.Stderr, "  Counts words in every file under dir with a map-reduce over workers\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 || top <= 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	numWorkers := cpuCount()
+	if fs.NArg() == 2 {
+		var err error
+		if numWorkers, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number of workers: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if numWorkers <= 0 {
+			numWorkers = cpuCount()
+		}
+	}
+	var exts []string
+	for ext := range strings.SplitSeq(extList, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			exts = append(exts, ext)
+		}
+	}
+
+	start := time.Now()
+	paths, err := listFiles(fs.Arg(0), exts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list files: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	listTime := time.Since(start)
+
+	start = time.Now()
+	partials, bytes, err := mapFiles(paths, numWorkers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read file: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	mapTime := time.Since(start)
+
+	start = time.Now()
+	counts, levels := reduceTree(partials)
+	reduceTime := time.Since(start)
+
+	words := 0
+	for _, n := range counts {
+		words += n
+	}
+	best := topWords(counts, top)
+
+	if jsonOutput {
+		writeJSON(os.Stdout, Report{
+			Operation:  "wordcount",
+			Input:      fs.Arg(0),
+			Workers:    numWorkers,
+			Parameters: map[string]any{"top": top, "ext": exts},
+			FilterMs:   ms(mapTime + reduceTime),
+			TotalMs:    ms(listTime + mapTime + reduceTime),
+			PhasesMs:   map[string]float64{"list": ms(listTime), "map": ms(mapTime), "reduce": ms(reduceTime)},
+			Result:     map[string]any{"files": len(paths), "bytes": bytes, "words": words, "distinct": len(counts), "top": best},
+		})
+		return
+	}
+
+	fmt.Printf("Counted %d words (%d distinct) in %d files, %.1f MB, using %d workers\n",
+		words, len(counts), len(paths), float64(bytes)/1e6, numWorkers)
+	for i, wc := range best {
+		fmt.Printf("%4d. %-24s %d\n", i+1, wc.Word, wc.Count)
+	}
+	fmt.Printf("List time: %dms\n", listTime.Milliseconds())
+	fmt.Printf("Map time: %dms (%.1f MB/s)\n", mapTime.Milliseconds(), float64(bytes)/mapTime.Seconds()/1e6)
+	fmt.Printf("Reduce time: %dms (%d levels)\n", reduceTime.Milliseconds(), levels)
+}
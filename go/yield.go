@@ -0,0 +1,67 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+type yieldConfig struct {
+	rows  int
+	check func() error
+}
+
+var yieldSettings atomic.Pointer[yieldConfig]
+
+// SetYieldInterval makes every filter worker pause after each block of rows
+// rows: it calls runtime.Gosched so other goroutines (a GUI event loop, say)
+// get scheduled, then calls check if it is non-nil. When check returns an
+// error the workers skip their remaining rows and the filter call returns
+// that error. check must keep returning the error once it has (context.Err
+// behaves this way) and is shared by all filter calls in flight. rows <= 0
+// disables the checkpoints, which is the default.
+//
+// Workers read the setting before every block, so a call also reaches the
+// filters already running, within idleRows rows when none was set before.
+// Smaller intervals make cancellation quicker at some cost in throughput.
+func SetYieldInterval(rows int, check func() error) {
+	if rows <= 0 {
+		yieldSettings.Store(nil)
+		return
+	}
+	yieldSettings.Store(&yieldConfig{rows, check})
+}
+
+// idleRows is the block size without a yield interval: only an atomic load
+// between blocks, to pick up an interval set while the filter runs.
+const idleRows = 64
+
+// forRowChunks calls fn on [start, end) in blocks of the configured yield
+// interval, yielding between blocks, and stops early once cancelled.
+// Without an interval the blocks are idleRows long and nothing else runs
+// between them.
+func forRowChunks(start, end int, fn func(start, end int)) {
+	for y := start; y < end; {
+		rows := idleRows
+		if cfg := yieldSettings.Load(); cfg != nil {
+			if y > start {
+				runtime.Gosched()
+				if cfg.check != nil && cfg.check() != nil {
+					return
+				}
+			}
+			rows = cfg.rows
+		}
+		next := min(y+rows, end)
+		fn(y, next)
+		y = next
+	}
+}
+
+// cancelled reports the error from the yield check, if any, so callers can
+// discard a partially filtered result.
+func cancelled() error {
+	if cfg := yieldSettings.Load(); cfg != nil && cfg.check != nil {
+		return cfg.check()
+	}
+	return nil
+}
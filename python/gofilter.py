@@ -0,0 +1,105 @@
+#!/usr/bin/env python3
+"""ctypes bindings to the Go filters, for calling them on numpy arrays.
+
+`make go-lib` builds libfilter.so next to this file, along with
+libfilter.h, the header cgo generates for it; the signature declared in
+_load() must match ProcessRGBA there. Set GOFILTER_LIB to load the library
+from elsewhere.
+
+    import numpy as np
+    from PIL import Image
+    import gofilter
+
+    img = np.asarray(Image.open("input.png").convert("RGBA"))
+    out = gofilter.kuwahara(img, radius=5, workers=8)
+    Image.fromarray(out).save("output.png")
+"""
+import ctypes
+import os
+
+import numpy as np
+
+# Exit statuses ProcessRGBA shares with the Go CLI.
+_ERRORS = {
+    1: "filter failed",
+    2: "bad arguments or unknown operation",
+    3: "invalid radius",
+}
+
+_lib = None
+
+
+class FilterError(RuntimeError):
+    def __init__(self, code, operation):
+        super().__init__(f"{operation}: {_ERRORS.get(code, 'failed')} (status {code})")
+        self.code = code
+
+
+def _load():
+    global _lib
+    if _lib is None:
+        path = os.environ.get("GOFILTER_LIB") or os.path.join(os.path.dirname(os.path.abspath(__file__)), "libfilter.so")
+        # CDLL, not PyDLL: ctypes releases the GIL for the duration of every
+        # call, so other Python threads keep running while the Go workers
+        # filter, and several threads may filter different arrays at once.
+        lib = ctypes.CDLL(path)
+        lib.ProcessRGBA.argtypes = [
+            ctypes.POINTER(ctypes.c_uint8),  # buffer, width*height*4 bytes
+            ctypes.c_int,  # width
+            ctypes.c_int,  # height
+            ctypes.c_char_p,  # operation
+            ctypes.c_int,  # radius
+            ctypes.c_int,  # workers, 0 for one per CPU
+        ]
+        lib.ProcessRGBA.restype = ctypes.c_int
+        _lib = lib
+    return _lib
+
+
+def process_buffer(buffer, width, height, operation, radius, workers=0):
+    """Filters buffer, width*height*4 bytes of RGBA rows without padding, in place.
+
+    buffer is any writable object exporting the buffer protocol (a
+    bytearray, a C-contiguous uint8 numpy array). It stays owned by the
+    caller: the Go side reads and writes it only during the call and keeps
+    no reference afterwards, so it may be reused or freed as soon as this
+    returns. With the GIL released during the call, no other thread may
+    touch buffer until it returns.
+    """
+    if len(memoryview(buffer).cast("B")) != width * height * 4:
+        raise ValueError(f"buffer holds {len(memoryview(buffer).cast('B'))} bytes, want {width}x{height}x4")
+    pointer = (ctypes.c_uint8 * (width * height * 4)).from_buffer(buffer)
+    code = _load().ProcessRGBA(pointer, width, height, operation.encode(), radius, workers)
+    if code != 0:
+        raise FilterError(code, operation)
+
+
+def process(image, operation, radius, workers=0):
+    """Returns image, an HxWx4 (RGBA) or HxWx3 (RGB) uint8 array, filtered.
+
+    The input is never modified: the filter runs on a C-contiguous RGBA
+    copy owned by this function, which is returned (without the alpha
+    channel for RGB input). The copy is what makes the call safe for
+    arrays that are views, strided or read-only, such as those of
+    np.asarray(PIL image).
+    """
+    image = np.asarray(image)
+    if image.dtype != np.uint8 or image.ndim != 3 or image.shape[2] not in (3, 4):
+        raise ValueError(f"want an HxWx3 or HxWx4 uint8 array, got {image.dtype} {image.shape}")
+    height, width, channels = image.shape
+    rgba = np.empty((height, width, 4), dtype=np.uint8)
+    rgba[..., :channels] = image
+    if channels == 3:
+        rgba[..., 3] = 255
+    process_buffer(rgba, width, height, operation, radius, workers)
+    return rgba if channels == 4 else rgba[..., :3].copy()
+
+
+def blur(image, radius, workers=0):
+    """Gaussian blur with sigma radius/3, as `filter blur`."""
+    return process(image, "blur", radius, workers)
+
+
+def kuwahara(image, radius, workers=0):
+    """Kuwahara filter, as `filter kuwahara`."""
+    return process(image, "kuwahara", radius, workers)